@@ -1,10 +1,24 @@
 #include "include/vmlinux.h"
 #define AF_INET 2 // From <sys/socket.h>
+#define AF_INET6 10 // From <sys/socket.h>
 #include "include/bpf/bpf_helpers.h"
 #include "include/bpf/bpf_core_read.h"
+#include "include/bpf/bpf_tracing.h"
 
 #define TASK_COMM_LEN 16
 
+#if __BYTE_ORDER__ == __ORDER_LITTLE_ENDIAN__
+#define bpf_ntohs(x) __builtin_bswap16(x)
+#else
+#define bpf_ntohs(x) (x)
+#endif
+
+// Kinds of event. Must match the values used in the Go.
+#define EVENT_KIND_STATE_CHANGE 0
+#define EVENT_KIND_RETRANSMIT 1
+#define EVENT_KIND_SEND_RESET 2
+#define EVENT_KIND_RECEIVE_RESET 3
+
 extern int LINUX_KERNEL_VERSION __kconfig;
 
 struct trace_event_raw_inet_sock_set_state___v56 {
@@ -23,74 +37,429 @@ struct trace_event_raw_inet_sock_set_state___v56 {
 	char __data[0];
 };
 
+// Since 5.15, sock_cgroup_data holds a pointer to the cgroup directly, rather than
+// in a union with the cgroup v1 net_prio and net_cls data
+struct sock_cgroup_data___v515 {
+	struct cgroup *cgroup;
+};
+
+struct sock___v515 {
+	struct sock_cgroup_data___v515 sk_cgrp_data;
+};
+
 struct event_data {
 	char comm_on_cpu[TASK_COMM_LEN];
 	__u64 sock_addr;
-	__u32 pid_on_cpu;
+	__u64 timestamp_ns; // CLOCK_MONOTONIC
+	__u64 cgroup_id_on_cpu; // cgroup v2 ID
+	__u64 sock_cgroup_id; // cgroup v2 ID, or 0 if not available
+	__u64 bytes_received; // Counters are only filled on transition to TCP_CLOSE
+	__u64 bytes_acked;
+	__u32 pid_on_cpu; // TGID
+	__u32 tid_on_cpu;
+	__u32 uid_on_cpu; // Real UID of the task, not the owner of the socket
+	__u32 gid_on_cpu; // Real GID of the task, not the group of the socket
+	__u32 ppid_on_cpu; // TGID of the real parent
 	__u32 sock_inode;
 	__u32 sock_uid;
 	__u32 sock_gid;
+	__u32 netns_inode;
+	__u32 segs_in;
+	__u32 segs_out;
+	__u32 total_retrans;
+	__u32 srtt_us; // Smoothed RTT in microseconds, left-shifted by 3
 	__s32 old_state;
 	__s32 new_state;
 	__u16 src_port;
 	__u16 dst_port;
-	__u8 src_addr[4];
-	__u8 dst_addr[4];	
+	__u16 family;
+	__u8 src_addr[16]; // IPv4 addresses occupy the first 4 bytes only
+	__u8 dst_addr[16];
 	__u8 sock_state;
+	__u8 kind;
 };
 
+// Events which cannot be sent to user-space and of which user-space is not
+// otherwise told are counted here: ring buffers do not report lost events to
+// user-space, and a perf buffer cannot report those emitted while none is open,
+// as while it is being resized or between one process closing it and the next
+// opening its own. Entry 0 holds the
+// count; entry 1 is written by user-space with the number of those lost while no
+// perf buffer was open which it has reported, so that a process reusing the
+// pinned map can report those lost before it opened its perf buffer
+struct {
+	__uint(type, BPF_MAP_TYPE_ARRAY);
+	__uint(max_entries, 2);
+	__type(key, __u32);
+	__type(value, __u64);
+} dropped_events SEC(".maps");
+
+#define ENOENT 2 // From <errno.h>
+
+__always_inline void count_dropped_event() {
+	__u32 key = 0;
+	__u64 *dropped = bpf_map_lookup_elem(&dropped_events, &key);
+	if (dropped) {
+		__sync_fetch_and_add(dropped, 1);
+	}
+}
+
+// When compiled with -DUSE_RINGBUF, events are sent to user-space via a ring buffer,
+// which requires kernel >=5.8. Otherwise, a perf buffer is used.
+#ifdef USE_RINGBUF
+#define RINGBUF_SIZE_BYTES (256 * 1024)
+
+struct {
+	__uint(type, BPF_MAP_TYPE_RINGBUF);
+	__uint(max_entries, RINGBUF_SIZE_BYTES);
+} events SEC(".maps");
+#else
 struct {
 	__uint(type, BPF_MAP_TYPE_PERF_EVENT_ARRAY);
 	__uint(key_size, sizeof(__u32));
 	__uint(value_size, sizeof(__u32));
 } events SEC(".maps");
+#endif
+
+__always_inline void output_event(void *ctx, struct event_data *event) {
+#ifdef USE_RINGBUF
+	if (bpf_ringbuf_output(&events, event, sizeof(struct event_data), 0) != 0) {
+		count_dropped_event();
+	}
+#else
+	// Events lost as the perf buffer is full are reported to user-space by the
+	// perf buffer itself, but the map has no entry for this CPU while none is open
+	if (bpf_perf_event_output(ctx, &events, BPF_F_CURRENT_CPU, event, sizeof(struct event_data)) == -ENOENT) {
+		count_dropped_event();
+	}
+#endif
+}
+
+// Filtering of events takes place in the kernel, so that unwanted events do not
+// consume space in the perf/ring buffer. The filter maps are written by user-space
+// and can be updated at any time without reloading the program.
+// Must match the values used in the Go.
+#define FILTER_PORTS_MAX_ENTRIES 1024
+#define FILTER_CIDRS_MAX_ENTRIES 1024
+#define FILTER_IDS_MAX_ENTRIES 1024
+#define FILTER_COMMS_MAX_ENTRIES 256
+#define FILTER_NETNS_MAX_ENTRIES 1024
+
+#define FILTER_FLAG_ALLOW_PORTS (1 << 0)
+#define FILTER_FLAG_SRC_CIDRS (1 << 1)
+#define FILTER_FLAG_DST_CIDRS (1 << 2)
+#define FILTER_FLAG_UIDS (1 << 3)
+#define FILTER_FLAG_GIDS (1 << 4)
+#define FILTER_FLAG_COMMS (1 << 5)
+#define FILTER_FLAG_EXCLUDE_LOOPBACK (1 << 6)
+#define FILTER_FLAG_NETNS (1 << 7)
+
+struct filter_config {
+	__u32 flags;
+};
+
+// IPv4 addresses are stored in the tries as IPv4-mapped IPv6 addresses
+struct filter_addr_key {
+	__u32 prefixlen;
+	__u8 addr[16];
+};
+
+struct filter_comm_key {
+	__u32 prefixlen;
+	char comm[TASK_COMM_LEN];
+};
+
+struct {
+	__uint(type, BPF_MAP_TYPE_ARRAY);
+	__uint(max_entries, 1);
+	__type(key, __u32);
+	__type(value, struct filter_config);
+} filter_config SEC(".maps");
+
+struct {
+	__uint(type, BPF_MAP_TYPE_HASH);
+	__uint(max_entries, FILTER_PORTS_MAX_ENTRIES);
+	__type(key, __u16);
+	__type(value, __u8);
+} filter_allow_ports SEC(".maps");
+
+struct {
+	__uint(type, BPF_MAP_TYPE_HASH);
+	__uint(max_entries, FILTER_PORTS_MAX_ENTRIES);
+	__type(key, __u16);
+	__type(value, __u8);
+} filter_deny_ports SEC(".maps");
+
+struct {
+	__uint(type, BPF_MAP_TYPE_LPM_TRIE);
+	__uint(max_entries, FILTER_CIDRS_MAX_ENTRIES);
+	__uint(map_flags, BPF_F_NO_PREALLOC);
+	__type(key, struct filter_addr_key);
+	__type(value, __u8);
+} filter_src_cidrs SEC(".maps");
+
+struct {
+	__uint(type, BPF_MAP_TYPE_LPM_TRIE);
+	__uint(max_entries, FILTER_CIDRS_MAX_ENTRIES);
+	__uint(map_flags, BPF_F_NO_PREALLOC);
+	__type(key, struct filter_addr_key);
+	__type(value, __u8);
+} filter_dst_cidrs SEC(".maps");
+
+struct {
+	__uint(type, BPF_MAP_TYPE_HASH);
+	__uint(max_entries, FILTER_IDS_MAX_ENTRIES);
+	__type(key, __u32);
+	__type(value, __u8);
+} filter_uids SEC(".maps");
+
+struct {
+	__uint(type, BPF_MAP_TYPE_HASH);
+	__uint(max_entries, FILTER_IDS_MAX_ENTRIES);
+	__type(key, __u32);
+	__type(value, __u8);
+} filter_gids SEC(".maps");
+
+struct {
+	__uint(type, BPF_MAP_TYPE_LPM_TRIE);
+	__uint(max_entries, FILTER_COMMS_MAX_ENTRIES);
+	__uint(map_flags, BPF_F_NO_PREALLOC);
+	__type(key, struct filter_comm_key);
+	__type(value, __u8);
+} filter_comms SEC(".maps");
+
+struct {
+	__uint(type, BPF_MAP_TYPE_HASH);
+	__uint(max_entries, FILTER_NETNS_MAX_ENTRIES);
+	__type(key, __u32);
+	__type(value, __u8);
+} filter_netns SEC(".maps");
+
+__always_inline void fill_filter_addr_key(__u16 family, __u8 *addr, struct filter_addr_key *key) {
+	key->prefixlen = 128;
+	if (family == AF_INET) {
+		__builtin_memset(key->addr, 0, 10);
+		key->addr[10] = 0xff;
+		key->addr[11] = 0xff;
+		__builtin_memcpy(&key->addr[12], addr, 4);
+	} else {
+		__builtin_memcpy(key->addr, addr, 16);
+	}
+}
+
+__always_inline bool is_loopback(struct filter_addr_key *key) {
+	// 127.0.0.0/8 (IPv4-mapped)
+	if (key->addr[10] == 0xff && key->addr[11] == 0xff && key->addr[12] == 127) {
+		bool mapped = true;
+#pragma unroll
+		for (int i = 0; i < 10; i++) {
+			if (key->addr[i] != 0) {
+				mapped = false;
+			}
+		}
+
+		if (mapped) {
+			return true;
+		}
+	}
+
+	// ::1
+#pragma unroll
+	for (int i = 0; i < 15; i++) {
+		if (key->addr[i] != 0) {
+			return false;
+		}
+	}
+
+	return key->addr[15] == 1;
+}
+
+// Returns true if the event should be emitted, false if it should be discarded
+__always_inline bool filter_event(struct event_data *event) {
+	__u32 config_key = 0;
+	struct filter_config *config = bpf_map_lookup_elem(&filter_config, &config_key);
+	if (!config) {
+		return true;
+	}
+
+	if (bpf_map_lookup_elem(&filter_deny_ports, &event->src_port) ||
+	    bpf_map_lookup_elem(&filter_deny_ports, &event->dst_port)) {
+		return false;
+	}
+
+	if (config->flags == 0) {
+		return true;
+	}
+
+	if ((config->flags & FILTER_FLAG_ALLOW_PORTS) &&
+	    !bpf_map_lookup_elem(&filter_allow_ports, &event->src_port) &&
+	    !bpf_map_lookup_elem(&filter_allow_ports, &event->dst_port)) {
+		return false;
+	}
+
+	if ((config->flags & FILTER_FLAG_UIDS) && !bpf_map_lookup_elem(&filter_uids, &event->sock_uid)) {
+		return false;
+	}
+
+	if ((config->flags & FILTER_FLAG_GIDS) && !bpf_map_lookup_elem(&filter_gids, &event->sock_gid)) {
+		return false;
+	}
+
+	if ((config->flags & FILTER_FLAG_NETNS) && !bpf_map_lookup_elem(&filter_netns, &event->netns_inode)) {
+		return false;
+	}
+
+	if (config->flags & FILTER_FLAG_COMMS) {
+		struct filter_comm_key comm_key = {.prefixlen = TASK_COMM_LEN * 8};
+		__builtin_memcpy(comm_key.comm, event->comm_on_cpu, TASK_COMM_LEN);
+		if (!bpf_map_lookup_elem(&filter_comms, &comm_key)) {
+			return false;
+		}
+	}
+
+	struct filter_addr_key src_key, dst_key;
+	fill_filter_addr_key(event->family, event->src_addr, &src_key);
+	fill_filter_addr_key(event->family, event->dst_addr, &dst_key);
+
+	if ((config->flags & FILTER_FLAG_EXCLUDE_LOOPBACK) && (is_loopback(&src_key) || is_loopback(&dst_key))) {
+		return false;
+	}
+
+	if ((config->flags & FILTER_FLAG_SRC_CIDRS) && !bpf_map_lookup_elem(&filter_src_cidrs, &src_key)) {
+		return false;
+	}
+
+	if ((config->flags & FILTER_FLAG_DST_CIDRS) && !bpf_map_lookup_elem(&filter_dst_cidrs, &dst_key)) {
+		return false;
+	}
+
+	return true;
+}
+
+// Returns the ID of the cgroup v2 cgroup to which the socket belongs, or 0 if it
+// is not available.
+__always_inline __u64 read_sock_cgroup_id(struct sock *sk) {
+	struct cgroup *cgrp;
+
+	if (bpf_core_field_exists(((struct sock___v515 *)sk)->sk_cgrp_data.cgroup)) {
+		cgrp = BPF_CORE_READ((struct sock___v515 *)sk, sk_cgrp_data.cgroup);
+	} else {
+		// If is_data is set, the union holds cgroup v1 data and not a pointer
+		if (BPF_CORE_READ_BITFIELD_PROBED(&sk->sk_cgrp_data, is_data)) {
+			return 0;
+		}
+		cgrp = (struct cgroup *)BPF_CORE_READ(sk, sk_cgrp_data.val);
+	}
+
+	if (!cgrp) {
+		return 0;
+	}
+
+	return BPF_CORE_READ(cgrp, kn, id);
+}
+
+// Fills the details of the task on-CPU at the time of the event
+__always_inline void fill_event_task(struct event_data *event) {
+	event->timestamp_ns = bpf_ktime_get_ns();
+	event->cgroup_id_on_cpu = bpf_get_current_cgroup_id();
+	__u64 pid_tgid = bpf_get_current_pid_tgid();
+	event->pid_on_cpu = pid_tgid >> 32;
+	event->tid_on_cpu = (__u32)pid_tgid;
+	__u64 uid_gid = bpf_get_current_uid_gid();
+	event->uid_on_cpu = (__u32)uid_gid;
+	event->gid_on_cpu = uid_gid >> 32;
+	struct task_struct *task = (struct task_struct *)bpf_get_current_task();
+	event->ppid_on_cpu = BPF_CORE_READ(task, real_parent, tgid);
+	bpf_get_current_comm(event->comm_on_cpu, TASK_COMM_LEN);
+}
+
+// Fills the details of the socket which are not available in the tracepoint
+// arguments. Only full sockets have an associated socket file and cgroup, so
+// these are not filled for time-wait and request sockets, which share only
+// struct sock_common with a full socket.
+__always_inline void fill_event_sock(struct sock *sk, struct event_data *event) {
+	event->netns_inode = BPF_CORE_READ(sk, __sk_common.skc_net.net, ns.inum);
+
+	unsigned char state = BPF_CORE_READ(sk, __sk_common.skc_state);
+	if (state == TCP_TIME_WAIT || state == TCP_NEW_SYN_RECV) {
+		return;
+	}
+
+	event->sock_state = BPF_CORE_READ(sk, sk_socket, state);
+	struct inode *inode = BPF_CORE_READ(sk, sk_socket, file, f_inode);
+	event->sock_inode = BPF_CORE_READ(inode, i_ino);
+	event->sock_uid = BPF_CORE_READ(inode, i_uid.val);
+	event->sock_gid = BPF_CORE_READ(inode, i_gid.val);
+	event->sock_cgroup_id = read_sock_cgroup_id(sk);
+}
+
+// Fills the counters of data transferred over the connection, which are final
+// once the socket is closed
+__always_inline void fill_event_counters(struct sock *sk, struct event_data *event) {
+	struct tcp_sock *tp = (struct tcp_sock *)sk;
+
+	event->bytes_received = BPF_CORE_READ(tp, bytes_received);
+	event->bytes_acked = BPF_CORE_READ(tp, bytes_acked);
+	event->segs_in = BPF_CORE_READ(tp, segs_in);
+	event->segs_out = BPF_CORE_READ(tp, segs_out);
+	event->total_retrans = BPF_CORE_READ(tp, total_retrans);
+	event->srtt_us = BPF_CORE_READ(tp, srtt_us);
+}
 
 __always_inline bool fill_event_old(struct trace_event_raw_inet_sock_set_state___v56 *ctx, struct event_data *event) {
-	if (!(ctx->family == AF_INET && ctx->protocol == IPPROTO_TCP)) {
+	if (!((ctx->family == AF_INET || ctx->family == AF_INET6) && ctx->protocol == IPPROTO_TCP)) {
 		return false;
 	}
 
 	__builtin_memset(event, 0, sizeof(struct event_data)); // https://github.com/iovisor/bcc/issues/2623
-	event->pid_on_cpu = bpf_get_current_pid_tgid() >> 32;	
-	bpf_get_current_comm(event->comm_on_cpu, TASK_COMM_LEN);
-	__builtin_memcpy(event->src_addr, ctx->saddr, sizeof(event->src_addr));
-	__builtin_memcpy(event->dst_addr, ctx->daddr, sizeof(event->dst_addr));	
+	event->kind = EVENT_KIND_STATE_CHANGE;
+	fill_event_task(event);
+	event->family = ctx->family;
+	if (ctx->family == AF_INET) {
+		__builtin_memcpy(event->src_addr, ctx->saddr, sizeof(ctx->saddr));
+		__builtin_memcpy(event->dst_addr, ctx->daddr, sizeof(ctx->daddr));
+	} else {
+		__builtin_memcpy(event->src_addr, ctx->saddr_v6, sizeof(ctx->saddr_v6));
+		__builtin_memcpy(event->dst_addr, ctx->daddr_v6, sizeof(ctx->daddr_v6));
+	}
 	event->src_port = ctx->sport;
 	event->dst_port = ctx->dport;
 	event->old_state = ctx->oldstate;
 	event->new_state = ctx->newstate;	
 	event->sock_addr = (__u64)(ctx->skaddr);
-	struct sock *sk = (struct sock *)(ctx->skaddr);
-	event->sock_state = BPF_CORE_READ(sk, sk_socket, state);
-	struct inode *inode = BPF_CORE_READ(sk, sk_socket, file, f_inode);
-	event->sock_inode = BPF_CORE_READ(inode, i_ino);	
-	event->sock_uid = BPF_CORE_READ(inode, i_uid.val);
-	event->sock_gid = BPF_CORE_READ(inode, i_gid.val);
+	fill_event_sock((struct sock *)(ctx->skaddr), event);
+	if (ctx->newstate == TCP_CLOSE) {
+		fill_event_counters((struct sock *)(ctx->skaddr), event);
+	}
 
 	return true;
 }
 
 __always_inline bool fill_event_new(struct trace_event_raw_inet_sock_set_state *ctx, struct event_data *event) {
-	if (!(ctx->family == AF_INET && ctx->protocol == IPPROTO_TCP)) {
+	if (!((ctx->family == AF_INET || ctx->family == AF_INET6) && ctx->protocol == IPPROTO_TCP)) {
 		return false;
 	}
 
 	__builtin_memset(event, 0, sizeof(struct event_data)); // https://github.com/iovisor/bcc/issues/2623
-	event->pid_on_cpu = bpf_get_current_pid_tgid() >> 32;	
-	bpf_get_current_comm(event->comm_on_cpu, TASK_COMM_LEN);
-	__builtin_memcpy(event->src_addr, ctx->saddr, sizeof(event->src_addr));
-	__builtin_memcpy(event->dst_addr, ctx->daddr, sizeof(event->dst_addr));	
+	event->kind = EVENT_KIND_STATE_CHANGE;
+	fill_event_task(event);
+	event->family = ctx->family;
+	if (ctx->family == AF_INET) {
+		__builtin_memcpy(event->src_addr, ctx->saddr, sizeof(ctx->saddr));
+		__builtin_memcpy(event->dst_addr, ctx->daddr, sizeof(ctx->daddr));
+	} else {
+		__builtin_memcpy(event->src_addr, ctx->saddr_v6, sizeof(ctx->saddr_v6));
+		__builtin_memcpy(event->dst_addr, ctx->daddr_v6, sizeof(ctx->daddr_v6));
+	}
 	event->src_port = ctx->sport;
 	event->dst_port = ctx->dport;
 	event->old_state = ctx->oldstate;
 	event->new_state = ctx->newstate;	
 	event->sock_addr = (__u64)(ctx->skaddr);
-	struct sock *sk = (struct sock *)(ctx->skaddr);
-	event->sock_state = BPF_CORE_READ(sk, sk_socket, state);
-	struct inode *inode = BPF_CORE_READ(sk, sk_socket, file, f_inode);
-	event->sock_inode = BPF_CORE_READ(inode, i_ino);	
-	event->sock_uid = BPF_CORE_READ(inode, i_uid.val);
-	event->sock_gid = BPF_CORE_READ(inode, i_gid.val);
+	fill_event_sock((struct sock *)(ctx->skaddr), event);
+	if (ctx->newstate == TCP_CLOSE) {
+		fill_event_counters((struct sock *)(ctx->skaddr), event);
+	}
 	
 	return true;
 }
@@ -113,8 +482,146 @@ int tracepoint__sock_inet_sock_set_state(void *ctx) {
 		}
 	}	
 
-	bpf_perf_event_output(ctx, &events, BPF_F_CURRENT_CPU, &event, sizeof(struct event_data));
+	if (!filter_event(&event)) {
+		return 0;
+	}
+
+	output_event(ctx, &event);
+	return 0;
+}
+
+// Fills an event which does not change the state of the socket, such as a
+// retransmission or reset, entirely from the socket. Both the old and new state
+// of the event are set to the current state of the socket.
+__always_inline bool fill_event_from_sock(struct sock *sk, __u8 kind, struct event_data *event) {
+	// A reset may be sent in response to a segment for which there is no socket
+	if (!sk) {
+		return false;
+	}
+
+	__u16 family = BPF_CORE_READ(sk, __sk_common.skc_family);
+	if (family != AF_INET && family != AF_INET6) {
+		return false;
+	}
+
+	__builtin_memset(event, 0, sizeof(struct event_data)); // https://github.com/iovisor/bcc/issues/2623
+	event->kind = kind;
+	fill_event_task(event);
+	event->family = family;
+	// The addresses are read into the arrays by size, as BPF_CORE_READ_INTO would
+	// read only sizeof(*event->src_addr), the first byte
+	if (family == AF_INET) {
+		bpf_core_read(event->src_addr, 4, &sk->__sk_common.skc_rcv_saddr);
+		bpf_core_read(event->dst_addr, 4, &sk->__sk_common.skc_daddr);
+	} else {
+		bpf_core_read(event->src_addr, sizeof(event->src_addr), &sk->__sk_common.skc_v6_rcv_saddr);
+		bpf_core_read(event->dst_addr, sizeof(event->dst_addr), &sk->__sk_common.skc_v6_daddr);
+	}
+	event->src_port = BPF_CORE_READ(sk, __sk_common.skc_num); // Already in host byte order
+	event->dst_port = bpf_ntohs(BPF_CORE_READ(sk, __sk_common.skc_dport));
+	event->old_state = BPF_CORE_READ(sk, __sk_common.skc_state);
+	event->new_state = event->old_state;
+	event->sock_addr = (__u64)sk;
+	fill_event_sock(sk, event);
+
+	return true;
+}
+
+__always_inline int handle_sock_event(void *ctx, const void *skaddr, __u8 kind) {
+	struct event_data event;
+
+	if (!fill_event_from_sock((struct sock *)skaddr, kind, &event)) {
+		return 0;
+	}
+
+	if (!filter_event(&event)) {
+		return 0;
+	}
+
+	output_event(ctx, &event);
 	return 0;
 }
 
-char LICENSE[] SEC("license") = "Dual BSD/GPL";
\ No newline at end of file
+// The tcp_retransmit_skb and tcp_send_reset tracepoints have always begun with the
+// skbaddr and skaddr fields, even though the later fields and the name of the event
+// class differ between kernel versions.
+SEC("tracepoint/tcp/tcp_retransmit_skb")
+int tracepoint__tcp_tcp_retransmit_skb(struct trace_event_raw_tcp_event_sk_skb *ctx) {
+	return handle_sock_event(ctx, ctx->skaddr, EVENT_KIND_RETRANSMIT);
+}
+
+SEC("tracepoint/tcp/tcp_send_reset")
+int tracepoint__tcp_tcp_send_reset(struct trace_event_raw_tcp_event_sk_skb *ctx) {
+	return handle_sock_event(ctx, ctx->skaddr, EVENT_KIND_SEND_RESET);
+}
+
+SEC("tracepoint/tcp/tcp_receive_reset")
+int tracepoint__tcp_tcp_receive_reset(struct trace_event_raw_tcp_event_sk *ctx) {
+	return handle_sock_event(ctx, ctx->skaddr, EVENT_KIND_RECEIVE_RESET);
+}
+
+char LICENSE[] SEC("license") = "Dual BSD/GPL";
+
+// The tp_btf programs below are attached directly to the raw tracepoints, which
+// are identified using the kernel's BTF rather than through tracefs. They receive
+// the arguments of the tracepoint, rather than its trace event, so do not depend
+// on the layout of the trace event. They are only loaded when used, as they are
+// not supported by kernels <5.5 or kernels which do not expose their own BTF.
+
+// Fills the source address and port of a state-change event from the inet_sock,
+// as the inet_sock_set_state trace event does, so that events are identical in
+// either attach mode. These can differ from the socket's bound address and port
+// read by fill_event_from_sock. The destination is read from the same fields by
+// both.
+__always_inline void fill_event_source_from_inet_sock(struct sock *sk, struct event_data *event) {
+	struct inet_sock *inet = (struct inet_sock *)sk;
+
+	if (event->family == AF_INET) {
+		bpf_core_read(event->src_addr, 4, &inet->inet_saddr);
+	}
+	event->src_port = bpf_ntohs(BPF_CORE_READ(inet, inet_sport));
+}
+
+SEC("tp_btf/inet_sock_set_state")
+int BPF_PROG(tp_btf__sock_inet_sock_set_state, const struct sock *sk, const int oldstate, const int newstate) {
+	struct event_data event;
+
+	// sk_protocol is a bitfield in kernels <5.6
+	if (BPF_CORE_READ_BITFIELD_PROBED(sk, sk_protocol) != IPPROTO_TCP) {
+		return 0;
+	}
+
+	if (!fill_event_from_sock((struct sock *)sk, EVENT_KIND_STATE_CHANGE, &event)) {
+		return 0;
+	}
+	fill_event_source_from_inet_sock((struct sock *)sk, &event);
+	event.old_state = oldstate;
+	event.new_state = newstate;
+	if (newstate == TCP_CLOSE) {
+		fill_event_counters((struct sock *)sk, &event);
+	}
+
+	if (!filter_event(&event)) {
+		return 0;
+	}
+
+	output_event(ctx, &event);
+	return 0;
+}
+
+// The socket is the first argument of each of the following tracepoints, even
+// where later arguments have been added.
+SEC("tp_btf/tcp_retransmit_skb")
+int BPF_PROG(tp_btf__tcp_tcp_retransmit_skb, const struct sock *sk) {
+	return handle_sock_event(ctx, sk, EVENT_KIND_RETRANSMIT);
+}
+
+SEC("tp_btf/tcp_send_reset")
+int BPF_PROG(tp_btf__tcp_tcp_send_reset, const struct sock *sk) {
+	return handle_sock_event(ctx, sk, EVENT_KIND_SEND_RESET);
+}
+
+SEC("tp_btf/tcp_receive_reset")
+int BPF_PROG(tp_btf__tcp_tcp_receive_reset, struct sock *sk) {
+	return handle_sock_event(ctx, sk, EVENT_KIND_RECEIVE_RESET);
+}
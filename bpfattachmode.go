@@ -0,0 +1,96 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// BPFAttachMode identifies the means by which the BPF programs are attached to
+// the kernel tracepoints.
+type bpfAttachMode int
+
+const (
+	// TracepointAttachMode attaches the programs to the tracepoints through
+	// tracefs, which must be mounted and readable by the process, but which is
+	// supported by all kernels on which the BPF program can run.
+	tracepointAttachMode bpfAttachMode = iota
+
+	// BTFAttachMode attaches BTF-enabled (tp_btf) programs directly to the raw
+	// tracepoints, which are identified by the kernel's BTF rather than through
+	// tracefs, but which is only supported by kernels >=5.5 which expose their
+	// own BTF.
+	btfAttachMode
+)
+
+func (m bpfAttachMode) String() string {
+	switch m {
+	case tracepointAttachMode:
+		return "tracepoints"
+	case btfAttachMode:
+		return "BTF raw tracepoints"
+	default:
+		return "unknown"
+	}
+}
+
+// SelectBPFAttachMode returns the BTF attach mode if the supplied probe reports
+// that the kernel supports it, otherwise it falls back to the tracepoint attach
+// mode.
+func selectBPFAttachMode(btfAttachSupported func() bool) bpfAttachMode {
+	if btfAttachSupported() {
+		return btfAttachMode
+	}
+
+	return tracepointAttachMode
+}
+
+// KernelSupportsBTFAttach reports whether the running kernel is recent enough
+// to support BTF-enabled raw tracepoints, and exposes the BTF needed to identify
+// them. External BTF cannot be used, as the kernel verifies the programs against
+// its own.
+func kernelSupportsBTFAttach() bool {
+	if _, err := os.Stat(kernelBTFPath); err != nil {
+		return false
+	}
+
+	release, _, err := uname()
+	if err != nil {
+		return false
+	}
+
+	major, minor, err := parseKernelVersion(release)
+	if err != nil {
+		return false
+	}
+
+	return major > 5 || (major == 5 && minor >= 5)
+}
+
+// ParseKernelVersion parses the major and minor version from a kernel release,
+// such as "5.15.0-46-generic".
+func parseKernelVersion(release string) (major, minor int, err error) {
+	parts := strings.SplitN(release, ".", 3)
+	if len(parts) < 2 {
+		return 0, 0, fmt.Errorf("illegal kernel release %q", release)
+	}
+
+	major, err = strconv.Atoi(parts[0])
+	if err != nil {
+		return 0, 0, fmt.Errorf("illegal kernel release %q", release)
+	}
+
+	// The minor version is terminated by the patch version, if any, or suffix
+	minorDigits := strings.IndexFunc(parts[1], func(r rune) bool { return r < '0' || r > '9' })
+	if minorDigits < 0 {
+		minorDigits = len(parts[1])
+	}
+
+	minor, err = strconv.Atoi(parts[1][:minorDigits])
+	if err != nil {
+		return 0, 0, fmt.Errorf("illegal kernel release %q", release)
+	}
+
+	return major, minor, nil
+}
@@ -0,0 +1,60 @@
+package main
+
+import "testing"
+
+func TestSelectBPFAttachMode(t *testing.T) {
+	tests := [...]struct {
+		btfAttachSupported bool
+		expected           bpfAttachMode
+	}{
+		{true, btfAttachMode},
+		{false, tracepointAttachMode},
+	}
+
+	for _, test := range tests {
+		output := selectBPFAttachMode(func() bool { return test.btfAttachSupported })
+
+		if output != test.expected {
+			t.Errorf("BTF attach supported %t: expected attach mode %q, got %q",
+				test.btfAttachSupported,
+				test.expected,
+				output)
+		}
+	}
+}
+
+func TestParseKernelVersion(t *testing.T) {
+	tests := [...]struct {
+		release       string
+		expectedMajor int
+		expectedMinor int
+	}{
+		{"5.15.0-46-generic", 5, 15},
+		{"5.4.0", 5, 4},
+		{"6.1", 6, 1},
+		{"4.18.0-348.el8.x86_64", 4, 18},
+		{"5.10-rc1", 5, 10},
+	}
+
+	for _, test := range tests {
+		major, minor, err := parseKernelVersion(test.release)
+		if err != nil {
+			t.Errorf("%s: expected nil error, got %v (of type %T)", test.release, err, err)
+		}
+
+		if major != test.expectedMajor || minor != test.expectedMinor {
+			t.Errorf("%s: expected version %d.%d, got %d.%d",
+				test.release,
+				test.expectedMajor,
+				test.expectedMinor,
+				major,
+				minor)
+		}
+	}
+
+	for _, release := range []string{"", "5", "five.four", "5.x"} {
+		if _, _, err := parseKernelVersion(release); err == nil {
+			t.Errorf("%q: expected error, got nil", release)
+		}
+	}
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"os"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// BPFEventTransport identifies the type of BPF map used to transfer events
+// from the BPF program in the kernel to user-space.
+type bpfEventTransport int
+
+const (
+	// PerfBufTransport uses a BPF_MAP_TYPE_PERF_EVENT_ARRAY, which is
+	// supported by all kernels on which the BPF program can run, but
+	// which has a buffer per-CPU and hence does not preserve the global
+	// ordering of events.
+	perfBufTransport bpfEventTransport = iota
+
+	// RingBufTransport uses a BPF_MAP_TYPE_RINGBUF, which is shared by all
+	// CPUs and preserves the global ordering of events, but which is only
+	// supported by kernels >=5.8.
+	ringBufTransport
+)
+
+func (t bpfEventTransport) String() string {
+	switch t {
+	case perfBufTransport:
+		return "perf buffer"
+	case ringBufTransport:
+		return "ring buffer"
+	default:
+		return "unknown"
+	}
+}
+
+// SelectBPFEventTransport returns the ring buffer transport if the supplied
+// probe reports that the kernel supports it, otherwise it falls back to the
+// perf buffer transport.
+func selectBPFEventTransport(ringBufSupported func() bool) bpfEventTransport {
+	if ringBufSupported() {
+		return ringBufTransport
+	}
+
+	return perfBufTransport
+}
+
+// BPFMapCreateAttr mirrors the leading fields of the kernel's union bpf_attr
+// (linux/bpf.h) as used by the BPF_MAP_CREATE command.
+type bpfMapCreateAttr struct {
+	mapType    uint32
+	keySize    uint32
+	valueSize  uint32
+	maxEntries uint32
+	mapFlags   uint32
+}
+
+// KernelSupportsRingBuf probes whether the running kernel supports BPF ring
+// buffers by attempting to create (and then immediately closing) a minimal
+// ring buffer map.
+func kernelSupportsRingBuf() bool {
+	attr := bpfMapCreateAttr{
+		mapType:    unix.BPF_MAP_TYPE_RINGBUF,
+		maxEntries: uint32(os.Getpagesize()), // Must be a power-of-2 multiple of the page size
+	}
+
+	fd, _, errno := unix.Syscall(unix.SYS_BPF,
+		unix.BPF_MAP_CREATE,
+		uintptr(unsafe.Pointer(&attr)),
+		unsafe.Sizeof(attr))
+	if errno != 0 {
+		return false
+	}
+	unix.Close(int(fd))
+
+	return true
+}
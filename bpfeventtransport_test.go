@@ -0,0 +1,24 @@
+package main
+
+import "testing"
+
+func TestSelectBPFEventTransport(t *testing.T) {
+	tests := [...]struct {
+		ringBufSupported bool
+		expected         bpfEventTransport
+	}{
+		{true, ringBufTransport},
+		{false, perfBufTransport},
+	}
+
+	for _, test := range tests {
+		output := selectBPFEventTransport(func() bool { return test.ringBufSupported })
+
+		if output != test.expected {
+			t.Errorf("ring buffer supported %t: expected transport %q, got %q",
+				test.ringBufSupported,
+				test.expected,
+				output)
+		}
+	}
+}
@@ -0,0 +1,27 @@
+package main
+
+import bpf "github.com/aquasecurity/libbpfgo"
+
+// BPFLink is an interface which describes objects representing the attachment
+// of a BPF program to a kernel hook.
+type bpfLink interface {
+	pin(path string) error
+}
+
+// LibBPFGoBPFLink is a wrapper around a libbpfgo BPFLink,
+// allowing the API to simplified to simplify mocking.
+type libBPFGoBPFLink struct {
+	link *bpf.BPFLink
+}
+
+func newLibBPFGoBPFLink(link *bpf.BPFLink) *libBPFGoBPFLink {
+	return &libBPFGoBPFLink{link}
+}
+
+// Pin pins this link at the provided path within a mounted bpffs, so that the
+// program remains attached after the link is destroyed, until the pin is removed.
+// Only links which are detached by closing them, such as those of BTF-enabled
+// raw tracepoints, survive the process in this way.
+func (l *libBPFGoBPFLink) pin(path string) error {
+	return bpfObjPin(l.link.GetFd(), path)
+}
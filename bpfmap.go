@@ -0,0 +1,71 @@
+package main
+
+import (
+	"unsafe"
+
+	bpf "github.com/aquasecurity/libbpfgo"
+)
+
+// BPFMap is an interface which describes objects representing BPF maps.
+// Keys and values are the raw bytes of the key and value as laid out in the BPF C.
+type bpfMap interface {
+	getValue(key []byte) ([]byte, error)
+	update(key, value []byte) error
+	deleteKey(key []byte) error
+	keys() ([][]byte, error)
+	setPinPath(path string) error
+}
+
+// LibBPFGoBPFMap is a wrapper around a libbpfgo BPFMap,
+// allowing the API to simplified to simplify mocking.
+// libbpfgo takes pointers to the first byte of keys and values, which must
+// therefore not be empty.
+type libBPFGoBPFMap struct {
+	bpfMap *bpf.BPFMap
+}
+
+func newLibBPFGoBPFMap(bpfMap *bpf.BPFMap) *libBPFGoBPFMap {
+	return &libBPFGoBPFMap{bpfMap}
+}
+
+// GetValue returns the value stored in the map under the provided key.
+func (m *libBPFGoBPFMap) getValue(key []byte) ([]byte, error) {
+	return m.bpfMap.GetValue(unsafe.Pointer(&key[0]))
+}
+
+// Update creates or replaces the value stored in the map under the provided key.
+func (m *libBPFGoBPFMap) update(key, value []byte) error {
+	return m.bpfMap.Update(unsafe.Pointer(&key[0]), unsafe.Pointer(&value[0]))
+}
+
+// DeleteKey removes the provided key and its value from the map.
+func (m *libBPFGoBPFMap) deleteKey(key []byte) error {
+	return m.bpfMap.DeleteKey(unsafe.Pointer(&key[0]))
+}
+
+// Keys returns all the keys currently present in the map.
+func (m *libBPFGoBPFMap) keys() ([][]byte, error) {
+	var keys [][]byte
+
+	iterator := m.bpfMap.Iterator()
+	for iterator.Next() {
+		// The iterator reuses its buffer, so take a copy
+		key := make([]byte, len(iterator.Key()))
+		copy(key, iterator.Key())
+		keys = append(keys, key)
+	}
+
+	if err := iterator.Err(); err != nil {
+		return nil, err
+	}
+
+	return keys, nil
+}
+
+// SetPinPath sets the path within a mounted bpffs at which the map is pinned when
+// the BPF object is loaded. If a compatible map is already pinned there, it is
+// reused instead of a new map being created. It must be called before the object
+// is loaded.
+func (m *libBPFGoBPFMap) setPinPath(path string) error {
+	return m.bpfMap.SetPinPath(path)
+}
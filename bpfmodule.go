@@ -6,15 +6,18 @@ import bpf "github.com/aquasecurity/libbpfgo"
 // containing one or more BPF programs which can be loaded into the kernel.
 // Once loaded into the kernel, individual programs can be retrieved from the module
 // and attached to BPF hooks within the kernel.
-// The BPF object my also contain one or more BPF perf buffer maps, which can be
-// initialised using the module.
+// The BPF object my also contain one or more BPF perf buffer or ring buffer maps,
+// which can be initialised using the module, as well as other maps which can be
+// retrieved from the module.
 type bpfModule interface {
 	loadObject() error
 	getProgram(name string) (bpfProgram, error)
+	getMap(name string) (bpfMap, error)
 	initPerfBuf(name string,
 		eventsChan chan []byte,
 		droppedEventCountChan chan uint64,
 		sizeInPages int) (bpfPerfBuffer, error)
+	initRingBuf(name string, eventsChan chan []byte) (bpfRingBuffer, error)
 	close()
 }
 
@@ -44,6 +47,17 @@ func (m *libBPFGoBPFModule) getProgram(name string) (bpfProgram, error) {
 	return newLibBPFGoBPFProgram(program), nil
 }
 
+// GetMap returns a BPFMap representing an individual BPF map within
+// the module.
+func (m *libBPFGoBPFModule) getMap(name string) (bpfMap, error) {
+	bpfMap, err := m.module.GetMap(name)
+	if err != nil {
+		return nil, err
+	}
+
+	return newLibBPFGoBPFMap(bpfMap), nil
+}
+
 // InitPerfBuf initialises the named perf buffer within the loaded module.
 // Once loaded, events and/or dropped event counts will be delivered on the channels
 // provided in eventsChan and droppedEventCountChan, respectively.
@@ -55,8 +69,15 @@ func (m *libBPFGoBPFModule) initPerfBuf(name string,
 	return m.module.InitPerfBuf(name, eventsChan, droppedEventCountChan, sizeInPages)
 }
 
+// InitRingBuf initialises the named ring buffer within the loaded module.
+// Once loaded, events will be delivered on the channel provided in eventsChan.
+// The size of the map within the kernel is fixed by the BPF C.
+func (m *libBPFGoBPFModule) initRingBuf(name string, eventsChan chan []byte) (bpfRingBuffer, error) {
+	return m.module.InitRingBuf(name, eventsChan)
+}
+
 // Close detaches and unloads all items in the kernel related to this module, including
-// programs and perf buffers.
+// programs and perf/ring buffers.
 func (m *libBPFGoBPFModule) close() {
 	m.module.Close()
 }
@@ -2,6 +2,7 @@ package main
 
 import (
 	"fmt"
+	"log"
 
 	bpf "github.com/aquasecurity/libbpfgo"
 )
@@ -13,14 +14,21 @@ type bpfModuleCreator interface {
 }
 
 // LibBPFGoBPFModuleCreator creates a BPFModule using BPF object data provided by
-// a BPFObjectLoader supplied during construction. It leans on the libbpfgo
-// package to perform the "heavy lifting".
+// a BPFObjectLoader supplied during construction. The BTF used by libbpf to
+// perform CO-RE relocations is that of the kernel, unless a BTFLocator supplied
+// during construction locates an alternative. It leans on the libbpfgo package
+// to perform the "heavy lifting".
 type libBPFGoBPFModuleCreator struct {
 	bpfObjectLoader bpfObjectLoader
+	btfLocator      btfLocator // Nil if the kernel's own BTF is always used
 }
 
-func newLibBPFGoBPFModuleCreator(bpfObjectLoader bpfObjectLoader) *libBPFGoBPFModuleCreator {
-	return &libBPFGoBPFModuleCreator{bpfObjectLoader}
+func newLibBPFGoBPFModuleCreator(bpfObjectLoader bpfObjectLoader,
+	btfLocator btfLocator) *libBPFGoBPFModuleCreator {
+	return &libBPFGoBPFModuleCreator{
+		bpfObjectLoader: bpfObjectLoader,
+		btfLocator:      btfLocator,
+	}
 }
 
 // CreateModule creates a new BPFModule using the BPFObjectLoader supplied during
@@ -32,7 +40,22 @@ func (c *libBPFGoBPFModuleCreator) createModule(name string) (bpfModule, error)
 		return nil, fmt.Errorf("loading BPF object: %w", err)
 	}
 
-	module, err := bpf.NewModuleFromBuffer(bpfObj, name)
+	var btfPath string // libbpfgo uses the kernel's own BTF if empty
+	if c.btfLocator != nil {
+		if btfPath, err = c.btfLocator.locate(); err != nil {
+			return nil, fmt.Errorf("locating BTF: %w", err)
+		}
+
+		if btfPath != "" {
+			log.Printf("Kernel BTF not available, using BTF from %q", btfPath)
+		}
+	}
+
+	module, err := bpf.NewModuleFromBufferArgs(bpf.NewModuleArgs{
+		BPFObjBuff: bpfObj,
+		BPFObjName: name,
+		BTFObjPath: btfPath,
+	})
 	if err != nil {
 		return nil, err
 	}
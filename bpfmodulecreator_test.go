@@ -25,11 +25,49 @@ func (ml *mockBPFObjectLoader) load() ([]byte, error) {
 	return nil, nil
 }
 
+type mockBTFLocator struct {
+	errorToReturn error
+
+	locateCalled bool
+}
+
+func newMockBTFLocator(errorToReturn error) *mockBTFLocator {
+	return &mockBTFLocator{errorToReturn: errorToReturn}
+}
+
+func (ml *mockBTFLocator) locate() (string, error) {
+	ml.locateCalled = true
+
+	if ml.errorToReturn != nil {
+		return "", ml.errorToReturn
+	}
+
+	return "", nil
+}
+
 func TestBPFModuleCreatorObjectLoaderError(t *testing.T) {
 	mockError := errors.New("mock BPF object loader error")
 	mockObjectLoader := newMockBPFObjectLoader(mockError)
 
-	moduleCreator := newLibBPFGoBPFModuleCreator(mockObjectLoader)
+	moduleCreator := newLibBPFGoBPFModuleCreator(mockObjectLoader, nil)
+
+	_, err := moduleCreator.createModule("mock-module")
+	if err == nil {
+		t.Error("expected error, got nil")
+	}
+
+	t.Logf("got error %q (of type %T)", err, err)
+
+	if !errors.Is(err, mockError) {
+		t.Errorf("expected error chain to include %q, but did not", mockError)
+	}
+}
+
+func TestBPFModuleCreatorBTFLocatorError(t *testing.T) {
+	mockError := errors.New("mock BTF locator error")
+	mockBTFLocator := newMockBTFLocator(mockError)
+
+	moduleCreator := newLibBPFGoBPFModuleCreator(newMockBPFObjectLoader(nil), mockBTFLocator)
 
 	_, err := moduleCreator.createModule("mock-module")
 	if err == nil {
@@ -41,4 +79,8 @@ func TestBPFModuleCreatorObjectLoaderError(t *testing.T) {
 	if !errors.Is(err, mockError) {
 		t.Errorf("expected error chain to include %q, but did not", mockError)
 	}
+
+	if !mockBTFLocator.locateCalled {
+		t.Error("expected BTF locator to be called, but was not")
+	}
 }
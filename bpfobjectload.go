@@ -1,8 +1,13 @@
 package main
 
 import (
+	"bytes"
+	"debug/elf"
 	_ "embed"
 	"errors"
+	"fmt"
+	"log"
+	"os"
 )
 
 var errNoBPFObject error = errors.New("no BPF object available")
@@ -16,17 +21,142 @@ type bpfObjectLoader interface {
 //go:embed bpf.o
 var bpfObj []byte
 
+//go:embed bpf_ringbuf.o
+var bpfRingBufObj []byte
+
 // EmbeddedBPFObjectLoader returns a BPF ELF-format object as a
 // byte slice, the object having been embedded in the Go executable
-// at build-time.
-type embeddedBPFObjectLoader struct{}
+// at build-time. Two variants of the object are embedded, one for each
+// BPF event transport, and the variant returned is chosen at construction.
+type embeddedBPFObjectLoader struct {
+	transport bpfEventTransport
+}
+
+func newEmbeddedBPFObjectLoader(transport bpfEventTransport) *embeddedBPFObjectLoader {
+	return &embeddedBPFObjectLoader{transport}
+}
 
 // Load returns a BPF ELF-format object.
-func (*embeddedBPFObjectLoader) load() ([]byte, error) {
+func (l *embeddedBPFObjectLoader) load() ([]byte, error) {
+	obj := bpfObj
+	if l.transport == ringBufTransport {
+		obj = bpfRingBufObj
+	}
+
 	// Guard against some build-time mishap
-	if bpfObj == nil || len(bpfObj) == 0 {
+	if obj == nil || len(obj) == 0 {
 		return nil, errNoBPFObject
 	}
 
-	return bpfObj, nil
+	return obj, nil
+}
+
+// FileBPFObjectLoader returns a BPF ELF-format object read from a file, allowing
+// a BPF object other than that embedded at build-time to be used. The object is
+// validated before being returned, as it must have been built for the transport
+// in use.
+type fileBPFObjectLoader struct {
+	path      string
+	transport bpfEventTransport
+}
+
+func newFileBPFObjectLoader(path string, transport bpfEventTransport) *fileBPFObjectLoader {
+	return &fileBPFObjectLoader{
+		path:      path,
+		transport: transport,
+	}
+}
+
+// Load returns a BPF ELF-format object.
+func (l *fileBPFObjectLoader) load() ([]byte, error) {
+	obj, err := os.ReadFile(l.path)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := validateBPFObject(obj, l.transport); err != nil {
+		return nil, fmt.Errorf("validating BPF object %q: %w", l.path, err)
+	}
+
+	return obj, nil
+}
+
+// ChainBPFObjectLoader returns the BPF ELF-format object returned by the first of
+// a chain of BPFObjectLoaders to succeed, logging the errors of those which fail.
+type chainBPFObjectLoader struct {
+	loaders []bpfObjectLoader
+}
+
+func newChainBPFObjectLoader(loaders ...bpfObjectLoader) *chainBPFObjectLoader {
+	return &chainBPFObjectLoader{loaders}
+}
+
+// Load returns a BPF ELF-format object. If every loader fails, the error of the
+// last is returned.
+func (l *chainBPFObjectLoader) load() ([]byte, error) {
+	err := errNoBPFObject
+	for i, loader := range l.loaders {
+		var obj []byte
+		obj, err = loader.load()
+		if err == nil {
+			return obj, nil
+		}
+
+		if i < len(l.loaders)-1 {
+			log.Printf("Error loading BPF object, falling back: %v", err)
+		}
+	}
+
+	return nil, err
+}
+
+// ValidateBPFObject checks that a BPF ELF-format object contains the program
+// and maps required by the BPF runner using the given transport.
+func validateBPFObject(obj []byte, transport bpfEventTransport) error {
+	file, err := elf.NewFile(bytes.NewReader(obj))
+	if err != nil {
+		return fmt.Errorf("parsing ELF: %w", err)
+	}
+
+	if file.Machine != elf.EM_BPF {
+		return fmt.Errorf("not a BPF object: machine is %v", file.Machine)
+	}
+
+	symbols, err := file.Symbols()
+	if err != nil {
+		return fmt.Errorf("reading symbols: %w", err)
+	}
+
+	programs := make(map[string]bool)
+	maps := make(map[string]bool)
+	for _, symbol := range symbols {
+		if symbol.Section == elf.SHN_UNDEF || int(symbol.Section) >= len(file.Sections) {
+			continue // Not defined in a section of the object
+		}
+
+		section := file.Sections[symbol.Section]
+		switch {
+		case elf.ST_TYPE(symbol.Info) == elf.STT_FUNC && section.Flags&elf.SHF_EXECINSTR != 0:
+			programs[symbol.Name] = true
+		case section.Name == ".maps" || section.Name == "maps": // BTF-defined and legacy maps, respectively
+			maps[symbol.Name] = true
+		}
+	}
+
+	if !programs[tcpStateChangeBPFProgramName] {
+		return fmt.Errorf("no program %q", tcpStateChangeBPFProgramName)
+	}
+
+	requiredMaps := []string{tcpStateChangePerfBufName}
+	if transport == ringBufTransport {
+		requiredMaps = append(requiredMaps, tcpStateChangeDroppedMapName)
+	}
+
+	for _, name := range requiredMaps {
+		if !maps[name] {
+			return fmt.Errorf("no map %q (was the object built for the %s transport?)", name, transport)
+		}
+	}
+
+	return nil
 }
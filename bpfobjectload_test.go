@@ -0,0 +1,246 @@
+package main
+
+import (
+	"bytes"
+	"debug/elf"
+	"encoding/binary"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// MockSymbol describes a symbol to be written to a mock BPF object.
+type mockSymbol struct {
+	name    string
+	section string // Either mockProgramSection or ".maps"
+}
+
+const mockProgramSection = "tracepoint/sock/inet_sock_set_state"
+
+// MakeBPFObject builds a minimal relocatable ELF object for the given machine,
+// containing an executable program section and a .maps section, along with a
+// symbol table holding the given symbols.
+func makeBPFObject(machine elf.Machine, symbols ...mockSymbol) []byte {
+	sectionNames := []string{"", ".shstrtab", ".strtab", ".symtab", mockProgramSection, ".maps"}
+	const (
+		strtabIndex  = 2
+		symtabIndex  = 3
+		programIndex = 4
+		mapsIndex    = 5
+	)
+
+	var shstrtab, strtab bytes.Buffer
+	sectionNameOffsets := make([]uint32, len(sectionNames))
+	for i, name := range sectionNames {
+		sectionNameOffsets[i] = uint32(shstrtab.Len())
+		shstrtab.WriteString(name + "\x00")
+	}
+
+	strtab.WriteByte(0)
+	symtab := make([]elf.Sym64, 1, len(symbols)+1) // Starts with the null symbol
+	for _, symbol := range symbols {
+		sym := elf.Sym64{Name: uint32(strtab.Len())}
+		strtab.WriteString(symbol.name + "\x00")
+
+		if symbol.section == mockProgramSection {
+			sym.Info = elf.ST_INFO(elf.STB_GLOBAL, elf.STT_FUNC)
+			sym.Shndx = programIndex
+		} else {
+			sym.Info = elf.ST_INFO(elf.STB_GLOBAL, elf.STT_OBJECT)
+			sym.Shndx = mapsIndex
+		}
+		symtab = append(symtab, sym)
+	}
+
+	var symtabData bytes.Buffer
+	binary.Write(&symtabData, binary.LittleEndian, symtab)
+
+	// Section contents follow the ELF header, and are followed by the section headers
+	contents := [][]byte{nil, shstrtab.Bytes(), strtab.Bytes(), symtabData.Bytes(), nil, nil}
+	headers := make([]elf.Section64, len(sectionNames))
+	offset := uint64(binary.Size(elf.Header64{}))
+	var data bytes.Buffer
+	for i, content := range contents {
+		headers[i] = elf.Section64{
+			Name:      sectionNameOffsets[i],
+			Off:       offset,
+			Size:      uint64(len(content)),
+			Addralign: 1,
+		}
+		data.Write(content)
+		offset += uint64(len(content))
+	}
+	headers[0] = elf.Section64{}
+	headers[1].Type = uint32(elf.SHT_STRTAB)
+	headers[strtabIndex].Type = uint32(elf.SHT_STRTAB)
+	headers[symtabIndex].Type = uint32(elf.SHT_SYMTAB)
+	headers[symtabIndex].Link = strtabIndex
+	headers[symtabIndex].Info = 1 // Index of the first global symbol
+	headers[symtabIndex].Entsize = uint64(binary.Size(elf.Sym64{}))
+	headers[programIndex].Type = uint32(elf.SHT_PROGBITS)
+	headers[programIndex].Flags = uint64(elf.SHF_ALLOC | elf.SHF_EXECINSTR)
+	headers[mapsIndex].Type = uint32(elf.SHT_PROGBITS)
+	headers[mapsIndex].Flags = uint64(elf.SHF_ALLOC | elf.SHF_WRITE)
+
+	header := elf.Header64{
+		Type:      uint16(elf.ET_REL),
+		Machine:   uint16(machine),
+		Version:   uint32(elf.EV_CURRENT),
+		Shoff:     offset,
+		Ehsize:    uint16(binary.Size(elf.Header64{})),
+		Shentsize: uint16(binary.Size(elf.Section64{})),
+		Shnum:     uint16(len(headers)),
+		Shstrndx:  1,
+	}
+	copy(header.Ident[:], elf.ELFMAG)
+	header.Ident[elf.EI_CLASS] = byte(elf.ELFCLASS64)
+	header.Ident[elf.EI_DATA] = byte(elf.ELFDATA2LSB)
+	header.Ident[elf.EI_VERSION] = byte(elf.EV_CURRENT)
+
+	var obj bytes.Buffer
+	binary.Write(&obj, binary.LittleEndian, header)
+	obj.Write(data.Bytes())
+	binary.Write(&obj, binary.LittleEndian, headers)
+
+	return obj.Bytes()
+}
+
+func writeMockBPFObject(t *testing.T, obj []byte) string {
+	path := filepath.Join(t.TempDir(), "bpf.o")
+	if err := os.WriteFile(path, obj, 0o644); err != nil {
+		t.Fatalf("expected nil error, got %v (of type %T)", err, err)
+	}
+
+	return path
+}
+
+func TestFileBPFObjectLoader(t *testing.T) {
+	obj := makeBPFObject(elf.EM_BPF,
+		mockSymbol{tcpStateChangeBPFProgramName, mockProgramSection},
+		mockSymbol{tcpStateChangePerfBufName, ".maps"},
+		mockSymbol{tcpStateChangeDroppedMapName, ".maps"})
+	loader := newFileBPFObjectLoader(writeMockBPFObject(t, obj), ringBufTransport)
+
+	loadedObj, err := loader.load()
+	if err != nil {
+		t.Errorf("expected nil error, got %v (of type %T)", err, err)
+	}
+
+	if !bytes.Equal(loadedObj, obj) {
+		t.Error("expected BPF object to be loaded from file, but was not")
+	}
+}
+
+func TestFileBPFObjectLoaderValidationError(t *testing.T) {
+	tests := []struct {
+		name          string
+		obj           []byte
+		transport     bpfEventTransport
+		expectedError string
+	}{
+		{
+			"not ELF",
+			[]byte("not an ELF object"),
+			perfBufTransport,
+			"parsing ELF",
+		},
+		{
+			"not BPF",
+			makeBPFObject(elf.EM_X86_64,
+				mockSymbol{tcpStateChangeBPFProgramName, mockProgramSection},
+				mockSymbol{tcpStateChangePerfBufName, ".maps"}),
+			perfBufTransport,
+			"not a BPF object",
+		},
+		{
+			"no program",
+			makeBPFObject(elf.EM_BPF,
+				mockSymbol{"tracepoint__sock_other", mockProgramSection},
+				mockSymbol{tcpStateChangePerfBufName, ".maps"}),
+			perfBufTransport,
+			"no program",
+		},
+		{
+			"program is map",
+			makeBPFObject(elf.EM_BPF,
+				mockSymbol{tcpStateChangeBPFProgramName, ".maps"},
+				mockSymbol{tcpStateChangePerfBufName, ".maps"}),
+			perfBufTransport,
+			"no program",
+		},
+		{
+			"no events map",
+			makeBPFObject(elf.EM_BPF,
+				mockSymbol{tcpStateChangeBPFProgramName, mockProgramSection}),
+			perfBufTransport,
+			"no map",
+		},
+		{
+			"perf buffer object with ring buffer transport",
+			makeBPFObject(elf.EM_BPF,
+				mockSymbol{tcpStateChangeBPFProgramName, mockProgramSection},
+				mockSymbol{tcpStateChangePerfBufName, ".maps"}),
+			ringBufTransport,
+			"no map",
+		},
+	}
+
+	for _, test := range tests {
+		loader := newFileBPFObjectLoader(writeMockBPFObject(t, test.obj), test.transport)
+
+		_, err := loader.load()
+		if err == nil {
+			t.Errorf("%s: expected error, got nil", test.name)
+			continue
+		}
+
+		t.Logf("%s: got error %q (of type %T)", test.name, err, err)
+
+		if !strings.Contains(err.Error(), test.expectedError) {
+			t.Errorf("%s: expected error containing %q, got %q", test.name, test.expectedError, err)
+		}
+	}
+}
+
+func TestFileBPFObjectLoaderFileError(t *testing.T) {
+	loader := newFileBPFObjectLoader(filepath.Join(t.TempDir(), "missing.o"), perfBufTransport)
+
+	_, err := loader.load()
+	if !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("expected error chain to include %q, got %v (of type %T)", os.ErrNotExist, err, err)
+	}
+}
+
+func TestChainBPFObjectLoader(t *testing.T) {
+	mockError := errors.New("mock BPF object loader error")
+	failingLoader := newMockBPFObjectLoader(mockError)
+	succeedingLoader := newMockBPFObjectLoader(nil)
+	unusedLoader := newMockBPFObjectLoader(nil)
+	loader := newChainBPFObjectLoader(failingLoader, succeedingLoader, unusedLoader)
+
+	_, err := loader.load()
+	if err != nil {
+		t.Errorf("expected nil error, got %v (of type %T)", err, err)
+	}
+
+	if !failingLoader.loadCalled || !succeedingLoader.loadCalled {
+		t.Error("expected loaders to be called in turn until one succeeded, but were not")
+	}
+
+	if unusedLoader.loadCalled {
+		t.Error("expected loader after successful loader not to be called, but was")
+	}
+}
+
+func TestChainBPFObjectLoaderError(t *testing.T) {
+	mockError := errors.New("mock BPF object loader error")
+	loader := newChainBPFObjectLoader(newMockBPFObjectLoader(errors.New("mock first error")),
+		newMockBPFObjectLoader(mockError))
+
+	_, err := loader.load()
+	if !errors.Is(err, mockError) {
+		t.Errorf("expected error chain to include %q, got %v (of type %T)", mockError, err, err)
+	}
+}
@@ -3,4 +3,5 @@ package main
 // BPFPerfBuffer is an interface which describes BPF perf buffer maps.
 type bpfPerfBuffer interface {
 	Start()
+	Close() // Also closes the channels on which the perf buffer delivers events and dropped event counts
 }
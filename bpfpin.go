@@ -0,0 +1,198 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"runtime"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// Directories beneath the pin path in which the maps and links are pinned
+const (
+	pinnedMapsDir  = "maps"
+	pinnedLinksDir = "links"
+)
+
+// PinnedMapNames returns the names of the maps pinned for the given transport:
+// the event buffer and the maps shared with user-space, which a program attached
+// by a previous runner must continue to use.
+func pinnedMapNames(transport bpfEventTransport) []string {
+	names := []string{tcpStateChangePerfBufName}
+	if transport == ringBufTransport {
+		names = append(names, tcpStateChangeDroppedMapName)
+	}
+
+	return append(names,
+		filterConfigMapName,
+		filterAllowPortsMapName,
+		filterDenyPortsMapName,
+		filterSrcCIDRsMapName,
+		filterDstCIDRsMapName,
+		filterUIDsMapName,
+		filterGIDsMapName,
+		filterCommsMapName,
+		filterNetNSMapName)
+}
+
+// OptionalPinnedMapNames returns the names of the maps pinned for the given
+// transport only if the BPF object has them. Objects built for the perf buffer
+// transport by older versions have no dropped events map.
+func optionalPinnedMapNames(transport bpfEventTransport) []string {
+	if transport == perfBufTransport {
+		return []string{tcpStateChangeDroppedMapName}
+	}
+
+	return nil
+}
+
+func pinnedMapPath(pinPath, mapName string) string {
+	return filepath.Join(pinPath, pinnedMapsDir, mapName)
+}
+
+func pinnedLinkPath(pinPath, programName string) string {
+	return filepath.Join(pinPath, pinnedLinksDir, programName)
+}
+
+// PinMaps sets the path at which each of the named maps is pinned. When the BPF
+// object is loaded, libbpf reuses a map already pinned at that path, or pins the
+// map it creates there. It must be called before the object is loaded. The
+// optional maps are pinned only if the object has them.
+func pinMaps(module bpfModule, pinPath string, mapNames, optionalMapNames []string) error {
+	if err := os.MkdirAll(filepath.Join(pinPath, pinnedMapsDir), 0o700); err != nil {
+		return fmt.Errorf("creating pinned maps directory: %w", err)
+	}
+
+	for _, name := range mapNames {
+		bpfMap, err := module.getMap(name)
+		if err != nil {
+			return fmt.Errorf("getting BPF map %q: %w", name, err)
+		}
+
+		if err := bpfMap.setPinPath(pinnedMapPath(pinPath, name)); err != nil {
+			return fmt.Errorf("setting pin path of BPF map %q: %w", name, err)
+		}
+	}
+
+	for _, name := range optionalMapNames {
+		bpfMap, err := module.getMap(name)
+		if err != nil {
+			continue
+		}
+
+		if err := bpfMap.setPinPath(pinnedMapPath(pinPath, name)); err != nil {
+			return fmt.Errorf("setting pin path of BPF map %q: %w", name, err)
+		}
+	}
+
+	return nil
+}
+
+// RemovePinned removes every map and link pinned beneath the pin path, along with the
+// directories containing them. Once no process holds them open, the kernel
+// detaches the programs and frees the maps.
+func removePinned(pinPath string) error {
+	var firstErr error
+	for _, dir := range []string{pinnedLinksDir, pinnedMapsDir} {
+		entries, err := os.ReadDir(filepath.Join(pinPath, dir))
+		if err != nil {
+			if !os.IsNotExist(err) && firstErr == nil {
+				firstErr = err
+			}
+			continue
+		}
+
+		for _, entry := range entries {
+			if err := os.Remove(filepath.Join(pinPath, dir, entry.Name())); err != nil && firstErr == nil {
+				firstErr = err
+			}
+		}
+
+		if err := os.Remove(filepath.Join(pinPath, dir)); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+
+	if err := os.Remove(pinPath); err != nil && !os.IsNotExist(err) && firstErr == nil {
+		firstErr = err
+	}
+
+	return firstErr
+}
+
+// RemoveIfExists removes the file at the given path, if any.
+func removeIfExists(path string) error {
+	if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+
+	return nil
+}
+
+// BPFObjPin pins the BPF object referred to by the file descriptor at the given
+// path, which must be within a mounted bpffs. libbpfgo does not expose pinning
+// of links, so the bpf() syscall is made directly.
+func bpfObjPin(fd int, path string) error {
+	pathname, err := unix.BytePtrFromString(path)
+	if err != nil {
+		return err
+	}
+
+	attr := bpfObjAttr{
+		pathname: uint64(uintptr(unsafe.Pointer(pathname))),
+		bpfFD:    uint32(fd),
+	}
+	_, _, errno := unix.Syscall(unix.SYS_BPF,
+		unix.BPF_OBJ_PIN,
+		uintptr(unsafe.Pointer(&attr)),
+		unsafe.Sizeof(attr))
+	runtime.KeepAlive(pathname)
+	if errno != 0 {
+		return errno
+	}
+
+	return nil
+}
+
+// BPFObjGet opens the BPF object pinned at the given path, returning a new file
+// descriptor referring to it.
+func bpfObjGet(path string) (int, error) {
+	pathname, err := unix.BytePtrFromString(path)
+	if err != nil {
+		return -1, err
+	}
+
+	attr := bpfObjAttr{pathname: uint64(uintptr(unsafe.Pointer(pathname)))}
+	fd, _, errno := unix.Syscall(unix.SYS_BPF,
+		unix.BPF_OBJ_GET,
+		uintptr(unsafe.Pointer(&attr)),
+		unsafe.Sizeof(attr))
+	runtime.KeepAlive(pathname)
+	if errno != 0 {
+		return -1, errno
+	}
+
+	return int(fd), nil
+}
+
+// OpenPinnedLink opens the BPF link pinned at the given path. The program remains
+// attached at least until the returned link is closed.
+func openPinnedLink(path string) (io.Closer, error) {
+	fd, err := bpfObjGet(path)
+	if err != nil {
+		return nil, err
+	}
+
+	return os.NewFile(uintptr(fd), path), nil
+}
+
+// BPFObjAttr is the layout of union bpf_attr used by the BPF_OBJ_* commands.
+type bpfObjAttr struct {
+	pathname  uint64
+	bpfFD     uint32
+	fileFlags uint32
+}
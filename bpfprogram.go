@@ -1,10 +1,17 @@
 package main
 
-import bpf "github.com/aquasecurity/libbpfgo"
+import (
+	"fmt"
+	"strings"
+
+	bpf "github.com/aquasecurity/libbpfgo"
+)
 
 // BPFProgram is an interface which describes objects representing BPF programs.
 type bpfProgram interface {
 	attachTracepoint(tracepoint string) error
+	attachBTF() (bpfLink, error)
+	setAutoload(autoload bool) error
 }
 
 // LibBPFGoBPFProgram is a wrapper around a libbpfgo BPFProgram,
@@ -20,6 +27,30 @@ func newLibBPFGoBPFProgram(program *bpf.BPFProg) *libBPFGoBPFProgram {
 // AttachTracepoint attaches this program to the provided kernel tracepoint.
 // The tracepoint should be supplied in format `subsystem:tracepoint`.
 func (p *libBPFGoBPFProgram) attachTracepoint(tracepoint string) error {
-	_, err := p.program.AttachTracepoint(tracepoint)
+	parts := strings.SplitN(tracepoint, ":", 2)
+	if len(parts) != 2 {
+		return fmt.Errorf("illegal tracepoint %q", tracepoint)
+	}
+
+	_, err := p.program.AttachTracepoint(parts[0], parts[1])
 	return err
 }
+
+// AttachBTF attaches this BTF-enabled program to the target identified by BTF
+// when the program was loaded, such as the raw tracepoint named in its tp_btf
+// section. libbpf attaches all such programs in the same way, but libbpfgo only
+// exposes it for LSM programs.
+func (p *libBPFGoBPFProgram) attachBTF() (bpfLink, error) {
+	link, err := p.program.AttachLSM()
+	if err != nil {
+		return nil, err
+	}
+
+	return newLibBPFGoBPFLink(link), nil
+}
+
+// SetAutoload sets whether this program is loaded into the kernel along with
+// the rest of the BPF object. It must be called before the object is loaded.
+func (p *libBPFGoBPFProgram) setAutoload(autoload bool) error {
+	return p.program.SetAutoload(autoload)
+}
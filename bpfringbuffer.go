@@ -0,0 +1,6 @@
+package main
+
+// BPFRingBuffer is an interface which describes BPF ring buffer maps.
+type bpfRingBuffer interface {
+	Start()
+}
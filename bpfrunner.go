@@ -1,17 +1,91 @@
 package main
 
 import (
+	"errors"
 	"fmt"
+	"io"
 	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
 )
 
 // Must match that used in the BPF C
 const (
-	tcpStateChangePerfBufName    = "events"
+	tcpStateChangePerfBufName    = "events" // Used for both the perf buffer and the ring buffer
 	tcpStateChangeTracepointName = "sock:inet_sock_set_state"
 	tcpStateChangeBPFProgramName = "tracepoint__sock_inet_sock_set_state"
+	tcpStateChangeBTFProgramName = "tp_btf__sock_inet_sock_set_state"
+	tcpStateChangeDroppedMapName = "dropped_events" // Absent from objects built for the perf buffer transport by older versions
+
+	tcpRetransmitTracepointName   = "tcp:tcp_retransmit_skb"
+	tcpRetransmitBPFProgramName   = "tracepoint__tcp_tcp_retransmit_skb"
+	tcpRetransmitBTFProgramName   = "tp_btf__tcp_tcp_retransmit_skb"
+	tcpSendResetTracepointName    = "tcp:tcp_send_reset"
+	tcpSendResetBPFProgramName    = "tracepoint__tcp_tcp_send_reset"
+	tcpSendResetBTFProgramName    = "tp_btf__tcp_tcp_send_reset"
+	tcpReceiveResetTracepointName = "tcp:tcp_receive_reset"
+	tcpReceiveResetBPFProgramName = "tracepoint__tcp_tcp_receive_reset"
+	tcpReceiveResetBTFProgramName = "tp_btf__tcp_tcp_receive_reset"
+)
+
+// Keys of the entries of the dropped events map. Must match those used in the BPF C
+const (
+	droppedEventsCountKey    = 0 // Incremented by the BPF program for each event lost
+	droppedEventsReportedKey = 1 // Of those lost while no perf buffer was open, the number reported by user-space
 )
 
+// TracepointAttachment names the BPF programs, one for each attach mode, and the
+// kernel tracepoint to which they are attached.
+type tracepointAttachment struct {
+	programName    string
+	btfProgramName string
+	tracepointName string
+}
+
+// ProgramNameFor returns the name of the program attached in the given mode.
+func (a tracepointAttachment) programNameFor(mode bpfAttachMode) string {
+	if mode == btfAttachMode {
+		return a.btfProgramName
+	}
+
+	return a.programName
+}
+
+var tcpStateChangeAttachment = tracepointAttachment{
+	tcpStateChangeBPFProgramName,
+	tcpStateChangeBTFProgramName,
+	tcpStateChangeTracepointName,
+}
+
+// Attachments of the optional BPF programs which emit events of kinds other
+// than state changes. The programs are always loaded, but emit no events unless
+// attached.
+var (
+	retransmitAttachments = []tracepointAttachment{
+		{tcpRetransmitBPFProgramName, tcpRetransmitBTFProgramName, tcpRetransmitTracepointName},
+	}
+	resetAttachments = []tracepointAttachment{
+		{tcpSendResetBPFProgramName, tcpSendResetBTFProgramName, tcpSendResetTracepointName},
+		{tcpReceiveResetBPFProgramName, tcpReceiveResetBTFProgramName, tcpReceiveResetTracepointName},
+	}
+)
+
+// AllAttachments returns the attachments of every program in the BPF object.
+func allAttachments() []tracepointAttachment {
+	attachments := []tracepointAttachment{tcpStateChangeAttachment}
+	attachments = append(attachments, retransmitAttachments...)
+	return append(attachments, resetAttachments...)
+}
+
+const (
+	ringBufDroppedEventsPollInterval = 1 * time.Second
+	perfBufResizeWindow              = 10 * time.Second // Period over which dropped events are counted to decide whether to resize
+)
+
+var errBPFRunnerNotRunning = errors.New("BPF runner is not running")
+
 // BPFRunner is an interface which describes objects which load a BPF program
 // into the kernel and then sends the resultant TCP-state events on the
 // returned channel. If the kernel buffer is full and the BPF program has to
@@ -21,73 +95,694 @@ type bpfRunner interface {
 	run() error
 	eventChannel() <-chan []byte
 	droppedEventCountChannel() <-chan uint64
+	setFilter(filter *Filter) error
+	unpin() error
 	close() error
 }
 
 // LibBPFGoBPFRunner is a BPFRunner which loads a BPF program into the kernel using
 // the libbbfgo library.
 type libBPFGoBPFRunner struct {
+	moduleName                          string
 	tcpStateChangeEventChannelSize      int
 	droppedEventsChannelSize            int
 	tcpStateChangeEventPerfBufSizePages int
+	perfBufMaxSizePages                 int    // Perf buffer is not resized if zero
+	perfBufResizeThreshold              uint64 // Dropped events within the resize window which cause a resize
+	transport                           bpfEventTransport
+	attachMode                          bpfAttachMode // Set to the mode used once running
+	pinPath                             string        // Maps and links are not pinned if empty
 	bpfModuleCreator                    bpfModuleCreator
+	droppedEventsPollInterval           time.Duration
+	perfBufResizeWindow                 time.Duration
+	extraAttachments                    []tracepointAttachment
+	openPinnedLink                      func(path string) (io.Closer, error)
 
 	module                bpfModule
 	eventChan             <-chan []byte
 	droppedEventCountChan <-chan uint64
+	stopDroppedEventsPoll chan struct{}
+	droppedEventsPollDone chan struct{}
+	stopPerfBufForwarding chan struct{}
+	perfBufForwardingDone chan struct{}
+	filterMutex           sync.Mutex
+	pinnedLinks           []io.Closer // Links pinned by a previous runner, held open until closed
+	perfBufDroppedMap     bpfMap      // Events lost while no perf buffer is open are not reported if nil
 }
 
-func newLibBPFGoBPFRunner(tcpStateChangeEventChannelSize int,
+func newLibBPFGoBPFRunner(moduleName string,
+	tcpStateChangeEventChannelSize int,
 	droppedEventsChannelSize int,
 	tcpStateChangeEventPerfBufSizePages int,
-	bpfModuleCreator bpfModuleCreator) *libBPFGoBPFRunner {
+	perfBufMaxSizePages int,
+	perfBufResizeThreshold uint64,
+	transport bpfEventTransport,
+	attachMode bpfAttachMode,
+	pinPath string,
+	bpfModuleCreator bpfModuleCreator,
+	extraAttachments []tracepointAttachment) *libBPFGoBPFRunner {
 	return &libBPFGoBPFRunner{
+		moduleName:                          moduleName,
 		tcpStateChangeEventChannelSize:      tcpStateChangeEventChannelSize,
 		droppedEventsChannelSize:            droppedEventsChannelSize,
 		tcpStateChangeEventPerfBufSizePages: tcpStateChangeEventPerfBufSizePages,
+		perfBufMaxSizePages:                 perfBufMaxSizePages,
+		perfBufResizeThreshold:              perfBufResizeThreshold,
+		transport:                           transport,
+		attachMode:                          attachMode,
+		pinPath:                             pinPath,
 		bpfModuleCreator:                    bpfModuleCreator,
+		droppedEventsPollInterval:           ringBufDroppedEventsPollInterval,
+		perfBufResizeWindow:                 perfBufResizeWindow,
+		extraAttachments:                    extraAttachments,
+		openPinnedLink:                      openPinnedLink,
 	}
 }
 
 // Run loads a BPF program into the kernel and attaches it to the appropriate kernel
-// tracepoint in order to create TCP state-change events.
+// tracepoint in order to create TCP state-change events. Any extra attachments
+// supplied to the runner are also made, in order to create events of other kinds.
+// If the programs cannot be attached using BTF, the tracepoint attach mode is
+// used instead. If a pin path is set, the maps and links are pinned beneath it,
+// or those pinned by a previous runner are reused.
 func (r *libBPFGoBPFRunner) run() error {
-	module, err := r.bpfModuleCreator.createModule("tcp-audit")
+	err := r.loadAndAttach(r.attachMode)
+	if err != nil && r.attachMode == btfAttachMode {
+		log.Printf("Attaching BPF programs using %s failed, falling back to %s: %v",
+			btfAttachMode,
+			tracepointAttachMode,
+			err)
+
+		if r.module != nil {
+			r.module.close()
+			r.module = nil
+		}
+		r.closePinnedLinks()
+
+		r.attachMode = tracepointAttachMode
+		err = r.loadAndAttach(r.attachMode)
+	}
+	if err != nil {
+		return err
+	}
+	log.Printf("Attached BPF programs using %s", r.attachMode)
+	module := r.module
+
+	eventChan := make(chan []byte, r.tcpStateChangeEventChannelSize)
+	droppedEventCountChan := make(chan uint64, r.droppedEventsChannelSize)
+
+	switch {
+	case r.transport == ringBufTransport:
+		if r.perfBufMaxSizePages > 0 {
+			log.Printf("Ring buffer size is fixed when the BPF object is loaded, so will not be resized")
+		}
+
+		if err := r.startRingBuf(module, eventChan, droppedEventCountChan); err != nil {
+			return fmt.Errorf("initialising ring buffer: %w", err)
+		}
+	case r.perfBufMaxSizePages > r.tcpStateChangeEventPerfBufSizePages:
+		if err := r.startResizablePerfBuf(module, eventChan, droppedEventCountChan); err != nil {
+			return fmt.Errorf("initialising perf buffer: %w", err)
+		}
+	default:
+		if err := r.startPerfBuf(module, eventChan, droppedEventCountChan); err != nil {
+			return fmt.Errorf("initialising perf buffer: %w", err)
+		}
+	}
+	r.eventChan = eventChan
+	r.droppedEventCountChan = droppedEventCountChan
+	log.Printf("Receiving BPF events using %s", r.transport)
+
+	return nil
+}
+
+// LoadAndAttach creates the module, loads the BPF object into the kernel and
+// attaches the programs using the given mode. The programs of the other mode are
+// not loaded, as the kernel may not support them.
+func (r *libBPFGoBPFRunner) loadAndAttach(mode bpfAttachMode) error {
+	module, err := r.bpfModuleCreator.createModule(r.moduleName)
 	if err != nil {
 		return fmt.Errorf("creating BPF module: %w", err)
 	}
 	r.module = module
 
+	otherMode := tracepointAttachMode
+	if mode == tracepointAttachMode {
+		otherMode = btfAttachMode
+	}
+
+	for _, attachment := range allAttachments() {
+		if err := disableProgram(module, attachment.programNameFor(otherMode)); err != nil {
+			return err
+		}
+	}
+
+	if r.pinPath != "" {
+		if err := pinMaps(module, r.pinPath, pinnedMapNames(r.transport), optionalPinnedMapNames(r.transport)); err != nil {
+			return err
+		}
+	}
+
 	if err := module.loadObject(); err != nil {
 		return fmt.Errorf("loading BPF object into kernel: %w", err)
 	}
 
-	program, err := module.getProgram(tcpStateChangeBPFProgramName)
+	attachments := append([]tracepointAttachment{tcpStateChangeAttachment}, r.extraAttachments...)
+	if r.pinPath != "" {
+		return r.attachPinned(module, attachments, mode)
+	}
+
+	for _, attachment := range attachments {
+		if _, err := attach(module, attachment, mode); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// AttachPinned attaches the programs as attach does, unless the link of an
+// attachment has been pinned by a previous runner, in which case it is adopted
+// instead, as its program is already emitting events into the pinned maps. Only
+// links attached using BTF are pinned, as those attached to tracepoints through
+// tracefs are detached when the runner is closed. The pinned links of
+// attachments no longer wanted are removed, detaching their programs.
+func (r *libBPFGoBPFRunner) attachPinned(module bpfModule,
+	attachments []tracepointAttachment,
+	mode bpfAttachMode) error {
+	if err := os.MkdirAll(filepath.Join(r.pinPath, pinnedLinksDir), 0o700); err != nil {
+		return fmt.Errorf("creating pinned links directory: %w", err)
+	}
+
+	wanted := make(map[tracepointAttachment]bool)
+	for _, attachment := range attachments {
+		wanted[attachment] = true
+	}
+
+	for _, attachment := range allAttachments() {
+		if wanted[attachment] {
+			continue
+		}
+
+		if err := removeIfExists(pinnedLinkPath(r.pinPath, attachment.btfProgramName)); err != nil {
+			return fmt.Errorf("removing pinned link of tracepoint %q: %w", attachment.tracepointName, err)
+		}
+	}
+
+	for _, attachment := range attachments {
+		path := pinnedLinkPath(r.pinPath, attachment.btfProgramName)
+		adopted, err := r.adoptPinnedLink(path)
+		if err != nil {
+			return err
+		}
+		if adopted {
+			continue
+		}
+
+		link, err := attach(module, attachment, mode)
+		if err != nil {
+			return err
+		}
+
+		if link == nil {
+			log.Printf("BPF program attached to tracepoint %q using %s cannot be pinned, so will be detached when closed",
+				attachment.tracepointName,
+				mode)
+			continue
+		}
+
+		if err := link.pin(path); err != nil {
+			return fmt.Errorf("pinning link of tracepoint %q: %w", attachment.tracepointName, err)
+		}
+	}
+
+	return nil
+}
+
+// AdoptPinnedLink opens the link pinned at the given path, if any, holding it
+// open until the runner is closed. It reports whether the link was adopted.
+func (r *libBPFGoBPFRunner) adoptPinnedLink(path string) (bool, error) {
+	if _, err := os.Stat(path); err != nil {
+		if os.IsNotExist(err) {
+			return false, nil
+		}
+
+		return false, fmt.Errorf("checking for pinned link: %w", err)
+	}
+
+	link, err := r.openPinnedLink(path)
 	if err != nil {
-		return fmt.Errorf("loading BPF program: %w", err)
+		return false, fmt.Errorf("opening pinned link %q: %w", path, err)
 	}
+	r.pinnedLinks = append(r.pinnedLinks, link)
+	log.Printf("Adopted BPF link pinned at %s", path)
 
-	if err = program.attachTracepoint(tcpStateChangeTracepointName); err != nil {
-		return fmt.Errorf("attaching to tracepoint: %w", err)
+	return true, nil
+}
+
+func (r *libBPFGoBPFRunner) closePinnedLinks() {
+	for _, link := range r.pinnedLinks {
+		if err := link.Close(); err != nil {
+			log.Printf("Error closing pinned BPF link: %v", err)
+		}
 	}
+	r.pinnedLinks = nil
+}
 
-	eventChan := make(chan []byte, r.tcpStateChangeEventChannelSize)
-	droppedEventCountChan := make(chan uint64, r.droppedEventsChannelSize)
+// DisableProgram prevents the named program being loaded with the BPF object.
+// A program which is not present in the BPF object, such as one loaded from a
+// file built before the program was added, is ignored.
+func disableProgram(module bpfModule, programName string) error {
+	program, err := module.getProgram(programName)
+	if err != nil {
+		return nil
+	}
+
+	if err := program.setAutoload(false); err != nil {
+		return fmt.Errorf("disabling BPF program %q: %w", programName, err)
+	}
+
+	return nil
+}
+
+// Attach attaches the program of the attachment using the given mode. The link
+// is returned only if attached using BTF, as only those links can be pinned.
+func attach(module bpfModule, attachment tracepointAttachment, mode bpfAttachMode) (bpfLink, error) {
+	programName := attachment.programNameFor(mode)
+	program, err := module.getProgram(programName)
+	if err != nil {
+		return nil, fmt.Errorf("loading BPF program %q: %w", programName, err)
+	}
+
+	var link bpfLink
+	if mode == btfAttachMode {
+		link, err = program.attachBTF()
+	} else {
+		err = program.attachTracepoint(attachment.tracepointName)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("attaching to tracepoint %q: %w", attachment.tracepointName, err)
+	}
+
+	return link, nil
+}
+
+func (r *libBPFGoBPFRunner) startPerfBuf(module bpfModule,
+	eventChan chan []byte,
+	droppedEventCountChan chan uint64) error {
+	// Only a program attached by a previous runner can have emitted events
+	// while no perf buffer was open
+	if r.pinPath != "" {
+		r.perfBufDroppedMap = getPerfBufDroppedMap(module)
+	}
 
 	buf, err := module.initPerfBuf(tcpStateChangePerfBufName,
 		eventChan,
 		droppedEventCountChan,
 		r.tcpStateChangeEventPerfBufSizePages)
 	if err != nil {
-		return fmt.Errorf("initialising perf buffer: %w", err)
+		return err
+	}
+
+	// The channel is empty and not yet written by the perf buffer, so this does not block
+	if lost := r.takeUnreportedDroppedEvents(); lost > 0 {
+		droppedEventCountChan <- lost
 	}
-	r.eventChan = eventChan
-	r.droppedEventCountChan = droppedEventCountChan
 	buf.Start()
 
 	return nil
 }
 
+// StartResizablePerfBuf starts a perf buffer whose events and dropped event
+// counts are forwarded on to the supplied channels, so that the perf buffer can
+// be replaced by a larger one without the channels being closed.
+func (r *libBPFGoBPFRunner) startResizablePerfBuf(module bpfModule,
+	eventChan chan<- []byte,
+	droppedEventCountChan chan<- uint64) error {
+	// No perf buffer is open while the perf buffer is being replaced
+	r.perfBufDroppedMap = getPerfBufDroppedMap(module)
+
+	buf, err := r.initForwardedPerfBuf(module, r.tcpStateChangeEventPerfBufSizePages)
+	if err != nil {
+		return err
+	}
+
+	// Only a program attached by a previous runner can have emitted events while
+	// no perf buffer was open. The channel is empty and not yet written by the
+	// forwarder, so this does not block.
+	if r.pinPath != "" {
+		if lost := r.takeUnreportedDroppedEvents(); lost > 0 {
+			droppedEventCountChan <- lost
+		}
+	}
+
+	r.stopPerfBufForwarding = make(chan struct{})
+	r.perfBufForwardingDone = make(chan struct{})
+	go r.forwardPerfBuf(module, buf, eventChan, droppedEventCountChan)
+
+	return nil
+}
+
+// ForwardedPerfBuf is a started perf buffer along with the channels on which it
+// delivers events and dropped event counts.
+type forwardedPerfBuf struct {
+	buf                   bpfPerfBuffer
+	sizeInPages           int
+	eventChan             chan []byte
+	droppedEventCountChan chan uint64
+}
+
+func (r *libBPFGoBPFRunner) initForwardedPerfBuf(module bpfModule, sizeInPages int) (*forwardedPerfBuf, error) {
+	eventChan := make(chan []byte, r.tcpStateChangeEventChannelSize)
+	droppedEventCountChan := make(chan uint64, r.droppedEventsChannelSize)
+	buf, err := module.initPerfBuf(tcpStateChangePerfBufName,
+		eventChan,
+		droppedEventCountChan,
+		sizeInPages)
+	if err != nil {
+		return nil, err
+	}
+	buf.Start()
+
+	return &forwardedPerfBuf{
+		buf:                   buf,
+		sizeInPages:           sizeInPages,
+		eventChan:             eventChan,
+		droppedEventCountChan: droppedEventCountChan,
+	}, nil
+}
+
+// ForwardPerfBuf forwards events and dropped event counts from the perf buffer on
+// to the supplied channels. If the number of events dropped within the resize
+// window reaches the resize threshold, the perf buffer is replaced by one of
+// twice the size, up to the maximum size. The BPF program remains attached
+// throughout, but events it emits while the perf buffer is being replaced are
+// lost, and only some of them are forwarded on as dropped (see resizePerfBuf).
+func (r *libBPFGoBPFRunner) forwardPerfBuf(module bpfModule,
+	buf *forwardedPerfBuf,
+	eventChan chan<- []byte,
+	droppedEventCountChan chan<- uint64) {
+	defer close(r.perfBufForwardingDone)
+	defer close(droppedEventCountChan)
+	defer close(eventChan)
+
+	ticker := time.NewTicker(r.perfBufResizeWindow)
+	defer ticker.Stop()
+
+	var droppedInWindow uint64
+	for {
+		select {
+		case <-r.stopPerfBufForwarding:
+			return
+		case <-ticker.C:
+			droppedInWindow = 0
+		case eventData := <-buf.eventChan:
+			select {
+			case <-r.stopPerfBufForwarding:
+				return
+			case eventChan <- eventData:
+			}
+		case count := <-buf.droppedEventCountChan:
+			select {
+			case <-r.stopPerfBufForwarding:
+				return
+			case droppedEventCountChan <- count:
+			}
+
+			droppedInWindow += count
+			if droppedInWindow < r.perfBufResizeThreshold || buf.sizeInPages >= r.perfBufMaxSizePages {
+				continue
+			}
+
+			resizedBuf, err := r.resizePerfBuf(module, buf, eventChan, droppedEventCountChan)
+			if err != nil {
+				log.Printf("Error resizing perf buffer, no further events will be received: %v", err)
+				return
+			}
+			if resizedBuf == nil {
+				return // The runner is closing
+			}
+			buf = resizedBuf
+			droppedInWindow = 0
+		}
+	}
+}
+
+// ResizePerfBuf replaces the perf buffer with one of twice the size, up to the
+// maximum size. Events received from the old perf buffer are forwarded on as it
+// is closed. Events emitted while no perf buffer is open are counted by the BPF
+// program and forwarded on as dropped, but libbpfgo races the forwarding of
+// those received from the old perf buffer as it is closed, and discards those
+// it wins without them being counted.
+// If the larger perf buffer cannot be created, one of the old size is created
+// instead. If the runner is closing, no perf buffer is returned.
+func (r *libBPFGoBPFRunner) resizePerfBuf(module bpfModule,
+	buf *forwardedPerfBuf,
+	eventChan chan<- []byte,
+	droppedEventCountChan chan<- uint64) (*forwardedPerfBuf, error) {
+	sizeInPages := buf.sizeInPages * 2
+	if sizeInPages > r.perfBufMaxSizePages {
+		sizeInPages = r.perfBufMaxSizePages
+	}
+
+	// The old perf buffer must be closed first, as closing it removes the
+	// entries for each CPU from the BPF map, which the new one would have replaced.
+	// Closing it stops it being polled and then closes its channels, while
+	// libbpfgo drains them itself, so not every event it received is forwarded.
+	closed := make(chan struct{})
+	go func() {
+		buf.buf.Close()
+		close(closed)
+	}()
+
+	stopping := false
+	for eventData := range buf.eventChan {
+		if stopping {
+			continue // Drained, so that closing the old perf buffer does not block
+		}
+
+		select {
+		case <-r.stopPerfBufForwarding:
+			stopping = true
+		case eventChan <- eventData:
+		}
+	}
+
+	for count := range buf.droppedEventCountChan {
+		if stopping {
+			continue
+		}
+
+		select {
+		case <-r.stopPerfBufForwarding:
+			stopping = true
+		case droppedEventCountChan <- count:
+		}
+	}
+	<-closed
+
+	if stopping {
+		return nil, nil
+	}
+
+	resizedBuf, err := r.initForwardedPerfBuf(module, sizeInPages)
+	if err != nil {
+		log.Printf("Error creating perf buffer of %d pages, reverting to %d pages: %v",
+			sizeInPages,
+			buf.sizeInPages,
+			err)
+		sizeInPages = buf.sizeInPages
+		resizedBuf, err = r.initForwardedPerfBuf(module, sizeInPages)
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		log.Printf("Resized perf buffer from %d to %d pages due to dropped events", buf.sizeInPages, sizeInPages)
+	}
+
+	if lost := r.takeUnreportedDroppedEvents(); lost > 0 {
+		select {
+		case <-r.stopPerfBufForwarding:
+			return nil, nil
+		case droppedEventCountChan <- lost:
+		}
+	}
+
+	return resizedBuf, nil
+}
+
+// GetPerfBufDroppedMap returns the map in which the BPF program counts the
+// events it emits while no perf buffer is open, or nil if the object has none.
+func getPerfBufDroppedMap(module bpfModule) bpfMap {
+	droppedEventsMap, err := module.getMap(tcpStateChangeDroppedMapName)
+	if err != nil {
+		log.Printf("Events lost while no perf buffer is open will not be reported: getting dropped events map: %v", err)
+		return nil
+	}
+
+	return droppedEventsMap
+}
+
+// TakeUnreportedDroppedEvents returns the number of events the BPF program has
+// emitted while no perf buffer was open which have not yet been reported, and
+// records them as reported. The number reported is held in the map alongside
+// the count, so that a runner reusing the pinned map reports those lost since
+// the previous runner last reported, such as while it was starting.
+func (r *libBPFGoBPFRunner) takeUnreportedDroppedEvents() uint64 {
+	if r.perfBufDroppedMap == nil {
+		return 0
+	}
+
+	count, err := readDroppedEventsMapEntry(r.perfBufDroppedMap, droppedEventsCountKey)
+	if err != nil {
+		log.Printf("Error reading count of events lost while no perf buffer was open: %v", err)
+		return 0
+	}
+
+	reported, err := readDroppedEventsMapEntry(r.perfBufDroppedMap, droppedEventsReportedKey)
+	if err != nil {
+		log.Printf("Error reading count of events reported lost while no perf buffer was open: %v", err)
+		return 0
+	}
+
+	if count <= reported {
+		return 0
+	}
+
+	if err := writeDroppedEventsMapEntry(r.perfBufDroppedMap, droppedEventsReportedKey, count); err != nil {
+		log.Printf("Error recording count of events reported lost while no perf buffer was open: %v", err)
+		return 0 // Not reported, as they would be reported again
+	}
+	log.Printf("%d events lost while no perf buffer was open", count-reported)
+
+	return count - reported
+}
+
+func (r *libBPFGoBPFRunner) startRingBuf(module bpfModule,
+	eventChan chan []byte,
+	droppedEventCountChan chan uint64) error {
+	// Unlike a perf buffer, a ring buffer does not report lost events to
+	// user-space, so the BPF C counts them in a separate map which is polled.
+	droppedEventsMap, err := module.getMap(tcpStateChangeDroppedMapName)
+	if err != nil {
+		return fmt.Errorf("getting dropped events map: %w", err)
+	}
+
+	// A pinned map reused from a previous runner already holds the count of the
+	// events dropped before this runner started, which are not reported again
+	var initialCount uint64
+	if r.pinPath != "" {
+		initialCount, err = readDroppedEventCount(droppedEventsMap)
+		if err != nil {
+			return fmt.Errorf("reading dropped event count: %w", err)
+		}
+	}
+
+	buf, err := module.initRingBuf(tcpStateChangePerfBufName, eventChan)
+	if err != nil {
+		return err
+	}
+	buf.Start()
+
+	r.stopDroppedEventsPoll = make(chan struct{})
+	r.droppedEventsPollDone = make(chan struct{})
+	go r.pollDroppedEvents(droppedEventsMap, droppedEventCountChan, initialCount)
+
+	return nil
+}
+
+// PollDroppedEvents periodically reads the total count of events the BPF
+// program has been unable to write to the ring buffer and sends the number
+// of events dropped since the last count, starting from lastCount, on
+// droppedEventCountChan.
+func (r *libBPFGoBPFRunner) pollDroppedEvents(droppedEventsMap bpfMap,
+	droppedEventCountChan chan<- uint64,
+	lastCount uint64) {
+	defer close(r.droppedEventsPollDone)
+	defer close(droppedEventCountChan)
+
+	ticker := time.NewTicker(r.droppedEventsPollInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-r.stopDroppedEventsPoll:
+			return
+		case <-ticker.C:
+		}
+
+		count, err := readDroppedEventCount(droppedEventsMap)
+		if err != nil {
+			log.Printf("Error reading dropped event count: %v", err)
+			continue
+		}
+
+		if count == lastCount {
+			continue
+		}
+
+		select {
+		case <-r.stopDroppedEventsPoll:
+			return
+		case droppedEventCountChan <- count - lastCount:
+			lastCount = count
+		}
+	}
+}
+
+func readDroppedEventCount(droppedEventsMap bpfMap) (uint64, error) {
+	return readDroppedEventsMapEntry(droppedEventsMap, droppedEventsCountKey)
+}
+
+func readDroppedEventsMapEntry(droppedEventsMap bpfMap, key uint32) (uint64, error) {
+	keyBytes := make([]byte, 4)
+	systemEndianess().PutUint32(keyBytes, key)
+	value, err := droppedEventsMap.getValue(keyBytes)
+	if err != nil {
+		return 0, err
+	}
+
+	return systemEndianess().Uint64(value), nil
+}
+
+func writeDroppedEventsMapEntry(droppedEventsMap bpfMap, key uint32, value uint64) error {
+	keyBytes := make([]byte, 4)
+	systemEndianess().PutUint32(keyBytes, key)
+	valueBytes := make([]byte, 8)
+	systemEndianess().PutUint64(valueBytes, value)
+
+	return droppedEventsMap.update(keyBytes, valueBytes)
+}
+
+// SetFilter replaces the filter applied by the running BPF program to TCP
+// state-change events. The filter takes effect without reloading the program.
+func (r *libBPFGoBPFRunner) setFilter(filter *Filter) error {
+	if r.module == nil {
+		return errBPFRunnerNotRunning
+	}
+
+	r.filterMutex.Lock()
+	defer r.filterMutex.Unlock()
+
+	return newBPFFilterWriter(r.module, systemEndianess()).write(filter)
+}
+
+// Unpin removes the maps and links pinned by this runner or a previous one, so
+// that the programs are detached and the maps freed once the runner is closed.
+// It does nothing if no pin path is set.
+func (r *libBPFGoBPFRunner) unpin() error {
+	if r.pinPath == "" {
+		return nil
+	}
+
+	if err := removePinned(r.pinPath); err != nil {
+		return fmt.Errorf("removing BPF objects pinned at %q: %w", r.pinPath, err)
+	}
+	log.Printf("Unpinned BPF objects from %s", r.pinPath)
+
+	return nil
+}
+
 func (r *libBPFGoBPFRunner) eventChannel() <-chan []byte {
 	return r.eventChan
 }
@@ -99,9 +794,22 @@ func (r *libBPFGoBPFRunner) droppedEventCountChannel() <-chan uint64 {
 // Close unloads the BPF program loaded into the kernel by this runner.
 // After this, no more TCP state-change events will be emitted on to the
 // channels returned by the runner.
+// Programs whose links are pinned remain attached, and pinned maps retain their
+// contents, until unpinned.
 func (r *libBPFGoBPFRunner) close() error {
+	if r.stopDroppedEventsPoll != nil {
+		close(r.stopDroppedEventsPoll)
+		<-r.droppedEventsPollDone
+	}
+
+	if r.stopPerfBufForwarding != nil {
+		close(r.stopPerfBufForwarding)
+		<-r.perfBufForwardingDone
+	}
+
 	log.Printf("Closing BPF module")
 	r.module.close()
+	r.closePinnedLinks()
 
 	return nil
 }
@@ -3,14 +3,20 @@ package main
 import (
 	"bytes"
 	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
 	"testing"
+	"time"
 )
 
 type mockBPFModuleCreator struct {
 	errorToReturn     error
 	bpfModuleToReturn bpfModule
 
-	called bool
+	called       bool
+	receivedName string
 }
 
 func newMockBPFModuleCreator(bpfModuleToReturn bpfModule, errorToReturn error) *mockBPFModuleCreator {
@@ -22,6 +28,7 @@ func newMockBPFModuleCreator(bpfModuleToReturn bpfModule, errorToReturn error) *
 
 func (mc *mockBPFModuleCreator) createModule(name string) (bpfModule, error) {
 	mc.called = true
+	mc.receivedName = name
 
 	if mc.errorToReturn != nil {
 		return nil, mc.errorToReturn
@@ -33,18 +40,31 @@ func (mc *mockBPFModuleCreator) createModule(name string) (bpfModule, error) {
 type mockBPFModule struct {
 	programToReturn bpfProgram
 	perfBufToReturn bpfPerfBuffer
+	ringBufToReturn bpfRingBuffer
+	mapToReturn     bpfMap
+	mapsToReturn    map[string]bpfMap // If set, overrides mapToReturn
+
+	chanToSendOnInitPerfBuf chan<- int // If set, the size of each perf buffer initialised is sent on it
 
 	bpfLoadObjectErrorToReturn error
 	getProgramErrorToReturn    error
 	initPerfBufErrorToReturn   error
+	initRingBufErrorToReturn   error
+	getMapErrorToReturn        error
 
 	bpfLoadObjectCalled bool
 	getProgramCalled    bool
 	initPerfBufCalled   bool
+	initRingBufCalled   bool
+	getMapCalled        bool
 	closeCalled         bool
 
 	receivedProgramName           string
+	receivedProgramNames          []string
 	receivedPerfBufferName        string
+	receivedPerfBufferSizes       []int
+	receivedRingBufferName        string
+	receivedMapName               string
 	receivedEventChan             chan []byte
 	receivedDroppedEventCountChan chan uint64
 }
@@ -76,11 +96,16 @@ func (mm *mockBPFModule) loadObject() error {
 func (mm *mockBPFModule) getProgram(name string) (bpfProgram, error) {
 	mm.getProgramCalled = true
 	mm.receivedProgramName = name
+	mm.receivedProgramNames = append(mm.receivedProgramNames, name)
 
 	if mm.getProgramErrorToReturn != nil {
 		return nil, mm.getProgramErrorToReturn
 	}
 
+	if mm.programToReturn == nil {
+		return nil, fmt.Errorf("mock BPF module has no program %q", name)
+	}
+
 	return mm.programToReturn, nil
 }
 
@@ -92,6 +117,16 @@ func (mm *mockBPFModule) initPerfBuf(name string,
 	mm.receivedPerfBufferName = name
 	mm.receivedEventChan = eventsChan
 	mm.receivedDroppedEventCountChan = lostChan
+	mm.receivedPerfBufferSizes = append(mm.receivedPerfBufferSizes, pageCnt)
+
+	if mockPerfBuffer, ok := mm.perfBufToReturn.(*mockBPFPerfBuffer); ok {
+		mockPerfBuffer.eventsChan = eventsChan
+		mockPerfBuffer.lostChan = lostChan
+	}
+
+	if mm.chanToSendOnInitPerfBuf != nil {
+		mm.chanToSendOnInitPerfBuf <- pageCnt
+	}
 
 	if mm.initPerfBufErrorToReturn != nil {
 		return nil, mm.initPerfBufErrorToReturn
@@ -100,15 +135,52 @@ func (mm *mockBPFModule) initPerfBuf(name string,
 	return mm.perfBufToReturn, nil
 }
 
+func (mm *mockBPFModule) getMap(name string) (bpfMap, error) {
+	mm.getMapCalled = true
+	mm.receivedMapName = name
+
+	if mm.getMapErrorToReturn != nil {
+		return nil, mm.getMapErrorToReturn
+	}
+
+	if mm.mapsToReturn != nil {
+		bpfMap, ok := mm.mapsToReturn[name]
+		if !ok {
+			return nil, fmt.Errorf("mock BPF module has no map %q", name)
+		}
+
+		return bpfMap, nil
+	}
+
+	return mm.mapToReturn, nil
+}
+
+func (mm *mockBPFModule) initRingBuf(name string, eventsChan chan []byte) (bpfRingBuffer, error) {
+	mm.initRingBufCalled = true
+	mm.receivedRingBufferName = name
+	mm.receivedEventChan = eventsChan
+
+	if mm.initRingBufErrorToReturn != nil {
+		return nil, mm.initRingBufErrorToReturn
+	}
+
+	return mm.ringBufToReturn, nil
+}
+
 func (mm *mockBPFModule) close() {
 	mm.closeCalled = true
 }
 
 type mockBPFProgram struct {
-	errorToReturn error
-
-	attachTracepointCalled bool
-	receivedTracepointName string
+	errorToReturn          error
+	attachBTFErrorToReturn error
+
+	attachTracepointCalled  bool
+	attachBTFCalls          int
+	receivedTracepointName  string
+	receivedTracepointNames []string
+	autoloadDisabledCalls   int
+	attachedLinks           []*mockBPFLink
 }
 
 func newMockBPFProgram(errorToReturn error) *mockBPFProgram {
@@ -118,6 +190,7 @@ func newMockBPFProgram(errorToReturn error) *mockBPFProgram {
 func (mp *mockBPFProgram) attachTracepoint(tracepoint string) error {
 	mp.attachTracepointCalled = true
 	mp.receivedTracepointName = tracepoint
+	mp.receivedTracepointNames = append(mp.receivedTracepointNames, tracepoint)
 
 	if mp.errorToReturn != nil {
 		return mp.errorToReturn
@@ -126,8 +199,52 @@ func (mp *mockBPFProgram) attachTracepoint(tracepoint string) error {
 	return nil
 }
 
+func (mp *mockBPFProgram) attachBTF() (bpfLink, error) {
+	mp.attachBTFCalls++
+
+	if mp.attachBTFErrorToReturn != nil {
+		return nil, mp.attachBTFErrorToReturn
+	}
+
+	if mp.errorToReturn != nil {
+		return nil, mp.errorToReturn
+	}
+
+	link := newMockBPFLink(nil)
+	mp.attachedLinks = append(mp.attachedLinks, link)
+	return link, nil
+}
+
+func (mp *mockBPFProgram) setAutoload(autoload bool) error {
+	if !autoload {
+		mp.autoloadDisabledCalls++
+	}
+
+	return nil
+}
+
+type mockBPFLink struct {
+	errorToReturn error
+
+	receivedPinPath string
+}
+
+func newMockBPFLink(errorToReturn error) *mockBPFLink {
+	return &mockBPFLink{errorToReturn: errorToReturn}
+}
+
+func (ml *mockBPFLink) pin(path string) error {
+	ml.receivedPinPath = path
+
+	return ml.errorToReturn
+}
+
 type mockBPFPerfBuffer struct {
-	called bool
+	eventsChan chan []byte // Closed on close, as libbpfgo does
+	lostChan   chan uint64
+
+	called     bool
+	closeCalls int
 }
 
 func newMockBPFPerfBuffer() *mockBPFPerfBuffer {
@@ -138,22 +255,141 @@ func (mb *mockBPFPerfBuffer) Start() {
 	mb.called = true
 }
 
+func (mb *mockBPFPerfBuffer) Close() {
+	mb.closeCalls++
+
+	if mb.eventsChan != nil {
+		close(mb.eventsChan)
+		close(mb.lostChan)
+		mb.eventsChan, mb.lostChan = nil, nil
+	}
+}
+
+type mockBPFRingBuffer struct {
+	called bool
+}
+
+func newMockBPFRingBuffer() *mockBPFRingBuffer {
+	return new(mockBPFRingBuffer)
+}
+
+func (mb *mockBPFRingBuffer) Start() {
+	mb.called = true
+}
+
+type mockBPFMap struct {
+	valuesToReturn <-chan []byte
+	errorToReturn  error
+
+	entries map[string][]byte // Keyed by string(key)
+
+	getValueCalled  bool
+	updateCalled    bool
+	deleteKeyCalled bool
+	receivedPinPath string
+}
+
+func newMockBPFMap(valuesToReturn <-chan []byte, errorToReturn error) *mockBPFMap {
+	return &mockBPFMap{
+		valuesToReturn: valuesToReturn,
+		errorToReturn:  errorToReturn,
+		entries:        make(map[string][]byte),
+	}
+}
+
+func (mm *mockBPFMap) getValue(key []byte) ([]byte, error) {
+	mm.getValueCalled = true
+
+	if mm.errorToReturn != nil {
+		return nil, mm.errorToReturn
+	}
+
+	if value, ok := mm.entries[string(key)]; ok {
+		return value, nil
+	}
+
+	if mm.valuesToReturn == nil {
+		return nil, errors.New("mock BPF map has no values")
+	}
+
+	value, ok := <-mm.valuesToReturn
+	if !ok {
+		return nil, errors.New("mock BPF map has no more values")
+	}
+
+	return value, nil
+}
+
+func (mm *mockBPFMap) update(key, value []byte) error {
+	mm.updateCalled = true
+
+	if mm.errorToReturn != nil {
+		return mm.errorToReturn
+	}
+
+	mm.entries[string(key)] = value
+	return nil
+}
+
+func (mm *mockBPFMap) deleteKey(key []byte) error {
+	mm.deleteKeyCalled = true
+
+	if mm.errorToReturn != nil {
+		return mm.errorToReturn
+	}
+
+	delete(mm.entries, string(key))
+	return nil
+}
+
+func (mm *mockBPFMap) setPinPath(path string) error {
+	mm.receivedPinPath = path
+
+	return mm.errorToReturn
+}
+
+func (mm *mockBPFMap) keys() ([][]byte, error) {
+	if mm.errorToReturn != nil {
+		return nil, mm.errorToReturn
+	}
+
+	keys := make([][]byte, 0, len(mm.entries))
+	for key := range mm.entries {
+		keys = append(keys, []byte(key))
+	}
+
+	return keys, nil
+}
+
 func TestBPFRunner(t *testing.T) {
 	mockProgram := newMockBPFProgram(nil)
 	mockPerfBuffer := newMockBPFPerfBuffer()
 	mockModule := newMockBPFModule(mockProgram, mockPerfBuffer, nil, nil, nil)
 	mockBPFModuleCreator := newMockBPFModuleCreator(mockModule, nil)
 
-	runner := newLibBPFGoBPFRunner(tcpStateChangeEventChannelSize,
+	runner := newLibBPFGoBPFRunner(bpfModuleName,
+		tcpStateChangeEventChannelSize,
 		droppedEventsChannelSize,
 		tcpStateChangeEventPerfBufSizePages,
-		mockBPFModuleCreator)
+		0,
+		0,
+		perfBufTransport,
+		tracepointAttachMode,
+		"",
+		mockBPFModuleCreator,
+		nil)
 
 	err := runner.run()
 	if err != nil {
 		t.Errorf("expected nil error, got %v (of type %T)", err, err)
 	}
 
+	if mockBPFModuleCreator.receivedName != bpfModuleName {
+		t.Errorf("expected BPF module to be created with name %q, but was %q",
+			bpfModuleName,
+			mockBPFModuleCreator.receivedName)
+	}
+
 	if !mockModule.bpfLoadObjectCalled {
 		t.Error("expected BPF module load object to be called, but was not")
 	}
@@ -243,14 +479,298 @@ func TestBPFRunner(t *testing.T) {
 	}
 }
 
+func TestBPFRunnerPerfBufResize(t *testing.T) {
+	mockPerfBuffer := newMockBPFPerfBuffer()
+	mockModule := newMockBPFModule(newMockBPFProgram(nil), mockPerfBuffer, nil, nil, nil)
+	initPerfBufChan := make(chan int, 4)
+	mockModule.chanToSendOnInitPerfBuf = initPerfBufChan
+
+	// The count of events lost while no perf buffer is open and the number
+	// reported, read after the first resize, and the count read after the second,
+	// once the number reported has been written
+	mockDroppedEventCounts := make(chan []byte, 3)
+	for _, count := range []uint64{3, 0, 3} {
+		value := make([]byte, 8)
+		systemEndianess().PutUint64(value, count)
+		mockDroppedEventCounts <- value
+	}
+	mockModule.mapsToReturn = map[string]bpfMap{
+		tcpStateChangeDroppedMapName: newMockBPFMap(mockDroppedEventCounts, nil),
+	}
+
+	runner := newLibBPFGoBPFRunner(bpfModuleName,
+		tcpStateChangeEventChannelSize,
+		droppedEventsChannelSize,
+		16,
+		64,
+		10,
+		perfBufTransport,
+		tracepointAttachMode,
+		"",
+		newMockBPFModuleCreator(mockModule, nil),
+		nil)
+	runner.perfBufResizeWindow = time.Hour // Ensure the window does not end during the test
+
+	err := runner.run()
+	if err != nil {
+		t.Errorf("expected nil error, got %v (of type %T)", err, err)
+	}
+
+	if size := <-initPerfBufChan; size != 16 {
+		t.Errorf("expected perf buffer of %d pages, got %d", 16, size)
+	}
+
+	// Check events are forwarded from the perf buffer
+	mockEventData := []byte{0xCA, 0xFE, 0xF0, 0x0D}
+	mockModule.receivedEventChan <- mockEventData
+	if eventData := <-runner.eventChannel(); !bytes.Equal(eventData, mockEventData) {
+		t.Errorf("expected BPF runner events channel to return %X, but returned %X",
+			mockEventData,
+			eventData)
+	}
+
+	// Check the perf buffer is doubled in size, and then capped at the maximum, as
+	// the threshold is reached, with the dropped event counts still forwarded,
+	// along with any events lost while the perf buffer was replaced
+	for _, test := range []struct {
+		expectedSize int
+		expectedLost uint64
+	}{{32, 3}, {64, 0}} {
+		mockModule.receivedDroppedEventCountChan <- 4
+		mockModule.receivedDroppedEventCountChan <- 6
+		for _, expectedCount := range []uint64{4, 6} {
+			if count := <-runner.droppedEventCountChannel(); count != expectedCount {
+				t.Errorf("expected BPF runner dropped event count channel to return %d, but returned %d",
+					expectedCount,
+					count)
+			}
+		}
+
+		if size := <-initPerfBufChan; size != test.expectedSize {
+			t.Errorf("expected perf buffer of %d pages, got %d", test.expectedSize, size)
+		}
+
+		if test.expectedLost == 0 {
+			continue
+		}
+
+		if count := <-runner.droppedEventCountChannel(); count != test.expectedLost {
+			t.Errorf("expected BPF runner dropped event count channel to return %d lost while resizing, but returned %d",
+				test.expectedLost,
+				count)
+		}
+	}
+
+	// Check the perf buffer is not resized beyond the maximum
+	mockModule.receivedDroppedEventCountChan <- 100
+	<-runner.droppedEventCountChannel()
+
+	// Check events are forwarded from the replacement perf buffer
+	mockModule.receivedEventChan <- mockEventData
+	if eventData := <-runner.eventChannel(); !bytes.Equal(eventData, mockEventData) {
+		t.Errorf("expected BPF runner events channel to return %X, but returned %X",
+			mockEventData,
+			eventData)
+	}
+
+	err = runner.close()
+	if err != nil {
+		t.Errorf("expected nil error, got %v (of type %T)", err, err)
+	}
+
+	if fmt.Sprint(mockModule.receivedPerfBufferSizes) != "[16 32 64]" {
+		t.Errorf("expected perf buffers of [16 32 64] pages, got %v", mockModule.receivedPerfBufferSizes)
+	}
+
+	if mockPerfBuffer.closeCalls != 2 {
+		t.Errorf("expected replaced perf buffers to be closed %d times, but was %d", 2, mockPerfBuffer.closeCalls)
+	}
+
+	// Check the forwarded channels are closed
+	if _, ok := <-runner.eventChannel(); ok {
+		t.Error("expected BPF runner events channel to be closed, but was not")
+	}
+}
+
+func TestBPFRunnerExtraAttachments(t *testing.T) {
+	mockProgram := newMockBPFProgram(nil)
+	mockModule := newMockBPFModule(mockProgram, newMockBPFPerfBuffer(), nil, nil, nil)
+	extraAttachments := append(append([]tracepointAttachment{}, retransmitAttachments...), resetAttachments...)
+
+	runner := newLibBPFGoBPFRunner(bpfModuleName,
+		tcpStateChangeEventChannelSize,
+		droppedEventsChannelSize,
+		tcpStateChangeEventPerfBufSizePages,
+		0,
+		0,
+		perfBufTransport,
+		tracepointAttachMode,
+		"",
+		newMockBPFModuleCreator(mockModule, nil),
+		extraAttachments)
+
+	err := runner.run()
+	if err != nil {
+		t.Errorf("expected nil error, got %v (of type %T)", err, err)
+	}
+
+	// Check program and tracepoint names are what we expect them to be (must match
+	// what is in the C and the kernel). The BTF programs are disabled before any
+	// programs are attached.
+	expectedProgramNames := []string{
+		tcpStateChangeBTFProgramName,
+		tcpRetransmitBTFProgramName,
+		tcpSendResetBTFProgramName,
+		tcpReceiveResetBTFProgramName,
+		tcpStateChangeBPFProgramName,
+		tcpRetransmitBPFProgramName,
+		tcpSendResetBPFProgramName,
+		tcpReceiveResetBPFProgramName,
+	}
+	expectedTracepointNames := []string{
+		tcpStateChangeTracepointName,
+		tcpRetransmitTracepointName,
+		tcpSendResetTracepointName,
+		tcpReceiveResetTracepointName,
+	}
+
+	if fmt.Sprint(mockModule.receivedProgramNames) != fmt.Sprint(expectedProgramNames) {
+		t.Errorf("expected BPF module to be requested to load programs %q, but was %q",
+			expectedProgramNames,
+			mockModule.receivedProgramNames)
+	}
+
+	if fmt.Sprint(mockProgram.receivedTracepointNames) != fmt.Sprint(expectedTracepointNames) {
+		t.Errorf("expected BPF programs to be attached to tracepoints %q, but were %q",
+			expectedTracepointNames,
+			mockProgram.receivedTracepointNames)
+	}
+
+	if err := runner.close(); err != nil {
+		t.Errorf("expected nil error, got %v (of type %T)", err, err)
+	}
+}
+
+func TestBPFRunnerBTFAttach(t *testing.T) {
+	mockProgram := newMockBPFProgram(nil)
+	mockModule := newMockBPFModule(mockProgram, newMockBPFPerfBuffer(), nil, nil, nil)
+
+	runner := newLibBPFGoBPFRunner(bpfModuleName,
+		tcpStateChangeEventChannelSize,
+		droppedEventsChannelSize,
+		tcpStateChangeEventPerfBufSizePages,
+		0,
+		0,
+		perfBufTransport,
+		btfAttachMode,
+		"",
+		newMockBPFModuleCreator(mockModule, nil),
+		retransmitAttachments)
+
+	err := runner.run()
+	if err != nil {
+		t.Errorf("expected nil error, got %v (of type %T)", err, err)
+	}
+
+	// The tracepoint programs are disabled, and the BTF programs attached
+	expectedProgramNames := []string{
+		tcpStateChangeBPFProgramName,
+		tcpRetransmitBPFProgramName,
+		tcpSendResetBPFProgramName,
+		tcpReceiveResetBPFProgramName,
+		tcpStateChangeBTFProgramName,
+		tcpRetransmitBTFProgramName,
+	}
+
+	if fmt.Sprint(mockModule.receivedProgramNames) != fmt.Sprint(expectedProgramNames) {
+		t.Errorf("expected BPF module to be requested to load programs %q, but was %q",
+			expectedProgramNames,
+			mockModule.receivedProgramNames)
+	}
+
+	if mockProgram.autoloadDisabledCalls != 4 {
+		t.Errorf("expected 4 BPF programs to be disabled, but %d were", mockProgram.autoloadDisabledCalls)
+	}
+
+	if mockProgram.attachBTFCalls != 2 {
+		t.Errorf("expected 2 BPF programs to be attached using BTF, but %d were", mockProgram.attachBTFCalls)
+	}
+
+	if mockProgram.attachTracepointCalled {
+		t.Error("expected no tracepoint to be attached to BPF program, but was")
+	}
+
+	if runner.attachMode != btfAttachMode {
+		t.Errorf("expected attach mode %v, got %v", btfAttachMode, runner.attachMode)
+	}
+
+	if err := runner.close(); err != nil {
+		t.Errorf("expected nil error, got %v (of type %T)", err, err)
+	}
+}
+
+func TestBPFRunnerBTFAttachFallback(t *testing.T) {
+	mockProgram := newMockBPFProgram(nil)
+	mockProgram.attachBTFErrorToReturn = errors.New("mock attach BTF error")
+	mockModule := newMockBPFModule(mockProgram, newMockBPFPerfBuffer(), nil, nil, nil)
+	mockBPFModuleCreator := newMockBPFModuleCreator(mockModule, nil)
+
+	runner := newLibBPFGoBPFRunner(bpfModuleName,
+		tcpStateChangeEventChannelSize,
+		droppedEventsChannelSize,
+		tcpStateChangeEventPerfBufSizePages,
+		0,
+		0,
+		perfBufTransport,
+		btfAttachMode,
+		"",
+		mockBPFModuleCreator,
+		nil)
+
+	err := runner.run()
+	if err != nil {
+		t.Errorf("expected nil error, got %v (of type %T)", err, err)
+	}
+
+	// The module in which BTF attachment failed is closed and a new one created
+	if !mockModule.closeCalled {
+		t.Error("expected BPF module to be closed, but was not")
+	}
+
+	if mockProgram.attachBTFCalls != 1 {
+		t.Errorf("expected 1 attempt to attach using BTF, got %d", mockProgram.attachBTFCalls)
+	}
+
+	if mockProgram.receivedTracepointName != tcpStateChangeTracepointName {
+		t.Errorf("expected BPF program to be attached to tracepoint %q, but was %q",
+			tcpStateChangeTracepointName,
+			mockProgram.receivedTracepointName)
+	}
+
+	if runner.attachMode != tracepointAttachMode {
+		t.Errorf("expected attach mode %v, got %v", tracepointAttachMode, runner.attachMode)
+	}
+
+	if !mockModule.initPerfBufCalled {
+		t.Error("expected BPF module perf buffer to be initialised, but was not")
+	}
+}
+
 func TestBPFRunnerModuleCreatorError(t *testing.T) {
 	mockError := errors.New("mock BPF module creator error")
 	mockBPFModuleCreator := newMockBPFModuleCreator(nil, mockError)
 
-	runner := newLibBPFGoBPFRunner(tcpStateChangeEventChannelSize,
+	runner := newLibBPFGoBPFRunner(bpfModuleName,
+		tcpStateChangeEventChannelSize,
 		droppedEventsChannelSize,
 		tcpStateChangeEventPerfBufSizePages,
-		mockBPFModuleCreator)
+		0,
+		0,
+		perfBufTransport,
+		tracepointAttachMode,
+		"",
+		mockBPFModuleCreator,
+		nil)
 
 	err := runner.run()
 	if err == nil {
@@ -273,10 +793,17 @@ func TestBPFRunnerModuleLoadObjectError(t *testing.T) {
 	mockModule := newMockBPFModule(nil, nil, mockError, nil, nil)
 	mockBPFModuleCreator := newMockBPFModuleCreator(mockModule, nil)
 
-	runner := newLibBPFGoBPFRunner(tcpStateChangeEventChannelSize,
+	runner := newLibBPFGoBPFRunner(bpfModuleName,
+		tcpStateChangeEventChannelSize,
 		droppedEventsChannelSize,
 		tcpStateChangeEventPerfBufSizePages,
-		mockBPFModuleCreator)
+		0,
+		0,
+		perfBufTransport,
+		tracepointAttachMode,
+		"",
+		mockBPFModuleCreator,
+		nil)
 
 	err := runner.run()
 	if err == nil {
@@ -299,10 +826,17 @@ func TestBPFRunnerModuleGetProgramError(t *testing.T) {
 	mockModule := newMockBPFModule(nil, nil, nil, mockError, nil)
 	mockBPFModuleCreator := newMockBPFModuleCreator(mockModule, nil)
 
-	runner := newLibBPFGoBPFRunner(tcpStateChangeEventChannelSize,
+	runner := newLibBPFGoBPFRunner(bpfModuleName,
+		tcpStateChangeEventChannelSize,
 		droppedEventsChannelSize,
 		tcpStateChangeEventPerfBufSizePages,
-		mockBPFModuleCreator)
+		0,
+		0,
+		perfBufTransport,
+		tracepointAttachMode,
+		"",
+		mockBPFModuleCreator,
+		nil)
 
 	err := runner.run()
 	if err == nil {
@@ -326,10 +860,17 @@ func TestBPFRunnerProgramAttachTracepointError(t *testing.T) {
 	mockModule := newMockBPFModule(mockProgram, nil, nil, nil, nil)
 	mockBPFModuleCreator := newMockBPFModuleCreator(mockModule, nil)
 
-	runner := newLibBPFGoBPFRunner(tcpStateChangeEventChannelSize,
+	runner := newLibBPFGoBPFRunner(bpfModuleName,
+		tcpStateChangeEventChannelSize,
 		droppedEventsChannelSize,
 		tcpStateChangeEventPerfBufSizePages,
-		mockBPFModuleCreator)
+		0,
+		0,
+		perfBufTransport,
+		tracepointAttachMode,
+		"",
+		mockBPFModuleCreator,
+		nil)
 
 	err := runner.run()
 	if err == nil {
@@ -353,10 +894,17 @@ func TestBPFRunnerModuleInitPerfBufferError(t *testing.T) {
 	mockModule := newMockBPFModule(mockProgram, nil, nil, nil, mockError)
 	mockBPFModuleCreator := newMockBPFModuleCreator(mockModule, nil)
 
-	runner := newLibBPFGoBPFRunner(tcpStateChangeEventChannelSize,
+	runner := newLibBPFGoBPFRunner(bpfModuleName,
+		tcpStateChangeEventChannelSize,
 		droppedEventsChannelSize,
 		tcpStateChangeEventPerfBufSizePages,
-		mockBPFModuleCreator)
+		0,
+		0,
+		perfBufTransport,
+		tracepointAttachMode,
+		"",
+		mockBPFModuleCreator,
+		nil)
 
 	err := runner.run()
 	if err == nil {
@@ -373,3 +921,492 @@ func TestBPFRunnerModuleInitPerfBufferError(t *testing.T) {
 		t.Error("expected BPF module perf buffer to be initialised, but was not")
 	}
 }
+
+func TestBPFRunnerRingBuf(t *testing.T) {
+	mockProgram := newMockBPFProgram(nil)
+	mockRingBuffer := newMockBPFRingBuffer()
+	mockDroppedEventCounts := make(chan []byte, 2)
+	mockMap := newMockBPFMap(mockDroppedEventCounts, nil)
+	mockModule := newMockBPFModule(mockProgram, nil, nil, nil, nil)
+	mockModule.ringBufToReturn = mockRingBuffer
+	mockModule.mapToReturn = mockMap
+	mockBPFModuleCreator := newMockBPFModuleCreator(mockModule, nil)
+
+	runner := newLibBPFGoBPFRunner(bpfModuleName,
+		tcpStateChangeEventChannelSize,
+		droppedEventsChannelSize,
+		tcpStateChangeEventPerfBufSizePages,
+		0,
+		0,
+		ringBufTransport,
+		tracepointAttachMode,
+		"",
+		mockBPFModuleCreator,
+		nil)
+	runner.droppedEventsPollInterval = time.Millisecond
+
+	err := runner.run()
+	if err != nil {
+		t.Errorf("expected nil error, got %v (of type %T)", err, err)
+	}
+
+	if mockModule.initPerfBufCalled {
+		t.Error("expected BPF module perf buffer not to be initialised, but was")
+	}
+
+	if !mockModule.initRingBufCalled {
+		t.Error("expected BPF module ring buffer to be initialised, but was not")
+	}
+
+	// Check ring buf name is what we expect it to be (must match what is in the C)
+	if mockModule.receivedRingBufferName != tcpStateChangePerfBufName {
+		t.Errorf("expected BPF module to be requested to init ring buffer %q, but was %q",
+			tcpStateChangePerfBufName,
+			mockModule.receivedRingBufferName)
+	}
+
+	if !mockRingBuffer.called {
+		t.Error("expected BPF ring buffer to be started, but was not")
+	}
+
+	// Check dropped events map name is what we expect it to be (must match what is in the C)
+	if mockModule.receivedMapName != tcpStateChangeDroppedMapName {
+		t.Errorf("expected BPF module to be requested to get map %q, but was %q",
+			tcpStateChangeDroppedMapName,
+			mockModule.receivedMapName)
+	}
+
+	// Check events channel delivers event data on the channel obtained from the BPF runner
+	mockEventData := []byte{0xCA, 0xFE, 0xF0, 0x0D}
+	go func() {
+		mockModule.receivedEventChan <- mockEventData
+	}()
+	eventData := <-runner.eventChannel()
+
+	if !bytes.Equal(eventData, mockEventData) {
+		t.Errorf("expected BPF runner events channel to return %X, but returned %X",
+			mockEventData,
+			eventData)
+	}
+
+	// Check the dropped events map is polled and only the increase in the cumulative
+	// count is delivered on the channel obtained from the BPF runner
+	mockCount := make([]byte, 8)
+	systemEndianess().PutUint64(mockCount, 3)
+	mockDroppedEventCounts <- mockCount
+	mockCount = make([]byte, 8)
+	systemEndianess().PutUint64(mockCount, 10)
+	mockDroppedEventCounts <- mockCount
+
+	for _, expected := range []uint64{3, 7} {
+		droppedEventCount := <-runner.droppedEventCountChannel()
+		if droppedEventCount != expected {
+			t.Errorf("expected BPF runner dropped event count channel to return %d, but returned %d",
+				expected,
+				droppedEventCount)
+		}
+	}
+
+	close(mockDroppedEventCounts) // Allow the poller to proceed until it is stopped
+
+	err = runner.close()
+	if err != nil {
+		t.Errorf("expected nil error, got %v (of type %T)", err, err)
+	}
+
+	if !mockModule.closeCalled {
+		t.Error("expected BPF module to be closed, but was not")
+	}
+}
+
+func TestBPFRunnerModuleGetDroppedEventsMapError(t *testing.T) {
+	mockError := errors.New("mock BPF get map error")
+	mockProgram := newMockBPFProgram(nil)
+	mockModule := newMockBPFModule(mockProgram, nil, nil, nil, nil)
+	mockModule.getMapErrorToReturn = mockError
+	mockBPFModuleCreator := newMockBPFModuleCreator(mockModule, nil)
+
+	runner := newLibBPFGoBPFRunner(bpfModuleName,
+		tcpStateChangeEventChannelSize,
+		droppedEventsChannelSize,
+		tcpStateChangeEventPerfBufSizePages,
+		0,
+		0,
+		ringBufTransport,
+		tracepointAttachMode,
+		"",
+		mockBPFModuleCreator,
+		nil)
+
+	err := runner.run()
+	if err == nil {
+		t.Error("expected error, got nil")
+	}
+
+	t.Logf("got error %q (of type %T)", err, err)
+
+	if !errors.Is(err, mockError) {
+		t.Errorf("expected error chain to include %q, but did not", mockError)
+	}
+
+	if !mockModule.getMapCalled {
+		t.Error("expected BPF module get map to be called, but was not")
+	}
+}
+
+func TestBPFRunnerModuleInitRingBufferError(t *testing.T) {
+	mockError := errors.New("mock BPF init ring buffer error")
+	mockProgram := newMockBPFProgram(nil)
+	mockModule := newMockBPFModule(mockProgram, nil, nil, nil, nil)
+	mockModule.mapToReturn = newMockBPFMap(nil, nil)
+	mockModule.initRingBufErrorToReturn = mockError
+	mockBPFModuleCreator := newMockBPFModuleCreator(mockModule, nil)
+
+	runner := newLibBPFGoBPFRunner(bpfModuleName,
+		tcpStateChangeEventChannelSize,
+		droppedEventsChannelSize,
+		tcpStateChangeEventPerfBufSizePages,
+		0,
+		0,
+		ringBufTransport,
+		tracepointAttachMode,
+		"",
+		mockBPFModuleCreator,
+		nil)
+
+	err := runner.run()
+	if err == nil {
+		t.Error("expected error, got nil")
+	}
+
+	t.Logf("got error %q (of type %T)", err, err)
+
+	if !errors.Is(err, mockError) {
+		t.Errorf("expected error chain to include %q, but did not", mockError)
+	}
+
+	if !mockModule.initRingBufCalled {
+		t.Error("expected BPF module ring buffer to be initialised, but was not")
+	}
+}
+
+func TestBPFRunnerSetFilterNotRunningError(t *testing.T) {
+	runner := newLibBPFGoBPFRunner(bpfModuleName,
+		tcpStateChangeEventChannelSize,
+		droppedEventsChannelSize,
+		tcpStateChangeEventPerfBufSizePages,
+		0,
+		0,
+		perfBufTransport,
+		tracepointAttachMode,
+		"",
+		newMockBPFModuleCreator(nil, nil),
+		nil)
+
+	err := runner.setFilter(new(Filter))
+	if err == nil {
+		t.Error("expected error, got nil")
+	}
+
+	t.Logf("got error %q (of type %T)", err, err)
+
+	if !errors.Is(err, errBPFRunnerNotRunning) {
+		t.Errorf("expected error chain to include %q, but did not", errBPFRunnerNotRunning)
+	}
+}
+
+type mockPinnedLink struct {
+	closeCalled bool
+}
+
+func (ml *mockPinnedLink) Close() error {
+	ml.closeCalled = true
+	return nil
+}
+
+func TestBPFRunnerPinning(t *testing.T) {
+	pinPath := filepath.Join(t.TempDir(), "tcp-audit")
+	mockProgram := newMockBPFProgram(nil)
+	mockDroppedEventCounts := make(chan []byte, 2)
+	mockModule := newMockBPFModule(mockProgram, nil, nil, nil, nil)
+	mockModule.ringBufToReturn = newMockBPFRingBuffer()
+	mockModule.mapsToReturn = make(map[string]bpfMap)
+	mockMaps := make(map[string]*mockBPFMap)
+	for _, name := range pinnedMapNames(ringBufTransport) {
+		mockMaps[name] = newMockBPFMap(nil, nil)
+		mockModule.mapsToReturn[name] = mockMaps[name]
+	}
+	mockMaps[tcpStateChangeDroppedMapName].valuesToReturn = mockDroppedEventCounts
+
+	runner := newLibBPFGoBPFRunner(bpfModuleName,
+		tcpStateChangeEventChannelSize,
+		droppedEventsChannelSize,
+		tcpStateChangeEventPerfBufSizePages,
+		0,
+		0,
+		ringBufTransport,
+		btfAttachMode,
+		pinPath,
+		newMockBPFModuleCreator(mockModule, nil),
+		nil)
+	runner.droppedEventsPollInterval = time.Millisecond
+
+	// The dropped events map reused from a previous runner already holds a count
+	mockCount := make([]byte, 8)
+	systemEndianess().PutUint64(mockCount, 5)
+	mockDroppedEventCounts <- mockCount
+
+	err := runner.run()
+	if err != nil {
+		t.Errorf("expected nil error, got %v (of type %T)", err, err)
+	}
+
+	for name, mockMap := range mockMaps {
+		if mockMap.receivedPinPath != pinnedMapPath(pinPath, name) {
+			t.Errorf("expected BPF map %q to be pinned at %q, but was %q",
+				name,
+				pinnedMapPath(pinPath, name),
+				mockMap.receivedPinPath)
+		}
+	}
+
+	if len(mockProgram.attachedLinks) != 1 {
+		t.Fatalf("expected 1 BPF link to be attached, got %d", len(mockProgram.attachedLinks))
+	}
+
+	expectedLinkPath := pinnedLinkPath(pinPath, tcpStateChangeBTFProgramName)
+	if mockProgram.attachedLinks[0].receivedPinPath != expectedLinkPath {
+		t.Errorf("expected BPF link to be pinned at %q, but was %q",
+			expectedLinkPath,
+			mockProgram.attachedLinks[0].receivedPinPath)
+	}
+
+	if info, err := os.Stat(filepath.Join(pinPath, pinnedLinksDir)); err != nil || !info.IsDir() {
+		t.Errorf("expected pinned links directory to be created, got %v", err)
+	}
+
+	// Only events dropped since the runner started are delivered
+	mockCount = make([]byte, 8)
+	systemEndianess().PutUint64(mockCount, 8)
+	mockDroppedEventCounts <- mockCount
+
+	if droppedEventCount := <-runner.droppedEventCountChannel(); droppedEventCount != 3 {
+		t.Errorf("expected BPF runner dropped event count channel to return 3, but returned %d",
+			droppedEventCount)
+	}
+
+	close(mockDroppedEventCounts) // Allow the poller to proceed until it is stopped
+
+	if err := runner.close(); err != nil {
+		t.Errorf("expected nil error, got %v (of type %T)", err, err)
+	}
+}
+
+func TestBPFRunnerPinningPerfBuf(t *testing.T) {
+	pinPath := filepath.Join(t.TempDir(), "tcp-audit")
+	mockModule := newMockBPFModule(newMockBPFProgram(nil), newMockBPFPerfBuffer(), nil, nil, nil)
+	mockModule.mapsToReturn = make(map[string]bpfMap)
+	mockMaps := make(map[string]*mockBPFMap)
+	for _, name := range append(pinnedMapNames(perfBufTransport), optionalPinnedMapNames(perfBufTransport)...) {
+		mockMaps[name] = newMockBPFMap(nil, nil)
+		mockModule.mapsToReturn[name] = mockMaps[name]
+	}
+
+	// The dropped events map reused from a previous runner holds a count of 12
+	// events lost while no perf buffer was open, of which the previous runner
+	// reported 5 before it was closed
+	mockDroppedMap := mockMaps[tcpStateChangeDroppedMapName]
+	mockDroppedEventCounts := make(chan []byte, 1)
+	mockCount := make([]byte, 8)
+	systemEndianess().PutUint64(mockCount, 12)
+	mockDroppedEventCounts <- mockCount
+	mockDroppedMap.valuesToReturn = mockDroppedEventCounts
+	if err := writeDroppedEventsMapEntry(mockDroppedMap, droppedEventsReportedKey, 5); err != nil {
+		t.Fatalf("expected nil error, got %v (of type %T)", err, err)
+	}
+
+	runner := newLibBPFGoBPFRunner(bpfModuleName,
+		tcpStateChangeEventChannelSize,
+		droppedEventsChannelSize,
+		tcpStateChangeEventPerfBufSizePages,
+		0,
+		0,
+		perfBufTransport,
+		btfAttachMode,
+		pinPath,
+		newMockBPFModuleCreator(mockModule, nil),
+		nil)
+
+	err := runner.run()
+	if err != nil {
+		t.Errorf("expected nil error, got %v (of type %T)", err, err)
+	}
+
+	for name, mockMap := range mockMaps {
+		if mockMap.receivedPinPath != pinnedMapPath(pinPath, name) {
+			t.Errorf("expected BPF map %q to be pinned at %q, but was %q",
+				name,
+				pinnedMapPath(pinPath, name),
+				mockMap.receivedPinPath)
+		}
+	}
+
+	// The events lost since the previous runner last reported are delivered
+	if droppedEventCount := <-runner.droppedEventCountChannel(); droppedEventCount != 7 {
+		t.Errorf("expected BPF runner dropped event count channel to return 7, but returned %d",
+			droppedEventCount)
+	}
+
+	reported, err := readDroppedEventsMapEntry(mockDroppedMap, droppedEventsReportedKey)
+	if err != nil {
+		t.Errorf("expected nil error, got %v (of type %T)", err, err)
+	}
+
+	if reported != 12 {
+		t.Errorf("expected 12 lost events to be recorded as reported, got %d", reported)
+	}
+
+	if err := runner.close(); err != nil {
+		t.Errorf("expected nil error, got %v (of type %T)", err, err)
+	}
+}
+
+func TestBPFRunnerPinningPerfBufWithoutDroppedMap(t *testing.T) {
+	pinPath := filepath.Join(t.TempDir(), "tcp-audit")
+	mockModule := newMockBPFModule(newMockBPFProgram(nil), newMockBPFPerfBuffer(), nil, nil, nil)
+	mockModule.mapsToReturn = make(map[string]bpfMap)
+	for _, name := range pinnedMapNames(perfBufTransport) { // As for an object built by an older version
+		mockModule.mapsToReturn[name] = newMockBPFMap(nil, nil)
+	}
+
+	runner := newLibBPFGoBPFRunner(bpfModuleName,
+		tcpStateChangeEventChannelSize,
+		droppedEventsChannelSize,
+		tcpStateChangeEventPerfBufSizePages,
+		0,
+		0,
+		perfBufTransport,
+		btfAttachMode,
+		pinPath,
+		newMockBPFModuleCreator(mockModule, nil),
+		nil)
+
+	err := runner.run()
+	if err != nil {
+		t.Errorf("expected nil error, got %v (of type %T)", err, err)
+	}
+
+	if err := runner.close(); err != nil {
+		t.Errorf("expected nil error, got %v (of type %T)", err, err)
+	}
+}
+
+func TestBPFRunnerPinnedLinkAdopted(t *testing.T) {
+	pinPath := t.TempDir()
+	for _, programName := range []string{tcpStateChangeBTFProgramName, tcpSendResetBTFProgramName} {
+		path := pinnedLinkPath(pinPath, programName)
+		if err := os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+			t.Fatalf("expected nil error, got %v (of type %T)", err, err)
+		}
+
+		if err := os.WriteFile(path, nil, 0o600); err != nil {
+			t.Fatalf("expected nil error, got %v (of type %T)", err, err)
+		}
+	}
+
+	mockProgram := newMockBPFProgram(nil)
+	mockModule := newMockBPFModule(mockProgram, newMockBPFPerfBuffer(), nil, nil, nil)
+	mockModule.mapToReturn = newMockBPFMap(nil, nil)
+
+	runner := newLibBPFGoBPFRunner(bpfModuleName,
+		tcpStateChangeEventChannelSize,
+		droppedEventsChannelSize,
+		tcpStateChangeEventPerfBufSizePages,
+		0,
+		0,
+		perfBufTransport,
+		tracepointAttachMode,
+		pinPath,
+		newMockBPFModuleCreator(mockModule, nil),
+		retransmitAttachments)
+
+	mockLink := new(mockPinnedLink)
+	var openedPaths []string
+	runner.openPinnedLink = func(path string) (io.Closer, error) {
+		openedPaths = append(openedPaths, path)
+		return mockLink, nil
+	}
+
+	err := runner.run()
+	if err != nil {
+		t.Errorf("expected nil error, got %v (of type %T)", err, err)
+	}
+
+	// The state-change program attached by the previous runner is adopted, and
+	// only the retransmit program is attached
+	expectedOpenedPaths := []string{pinnedLinkPath(pinPath, tcpStateChangeBTFProgramName)}
+	if fmt.Sprint(openedPaths) != fmt.Sprint(expectedOpenedPaths) {
+		t.Errorf("expected pinned links %q to be opened, but were %q", expectedOpenedPaths, openedPaths)
+	}
+
+	expectedTracepointNames := []string{tcpRetransmitTracepointName}
+	if fmt.Sprint(mockProgram.receivedTracepointNames) != fmt.Sprint(expectedTracepointNames) {
+		t.Errorf("expected BPF programs to be attached to tracepoints %q, but were %q",
+			expectedTracepointNames,
+			mockProgram.receivedTracepointNames)
+	}
+
+	// The link of the reset program, which is no longer wanted, is removed
+	if _, err := os.Stat(pinnedLinkPath(pinPath, tcpSendResetBTFProgramName)); !os.IsNotExist(err) {
+		t.Errorf("expected pinned link of unwanted program to be removed, got %v", err)
+	}
+
+	if err := runner.close(); err != nil {
+		t.Errorf("expected nil error, got %v (of type %T)", err, err)
+	}
+
+	if !mockLink.closeCalled {
+		t.Error("expected adopted BPF link to be closed, but was not")
+	}
+}
+
+func TestBPFRunnerUnpin(t *testing.T) {
+	pinPath := t.TempDir()
+	for _, path := range []string{
+		pinnedMapPath(pinPath, tcpStateChangePerfBufName),
+		pinnedLinkPath(pinPath, tcpStateChangeBTFProgramName),
+	} {
+		if err := os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+			t.Fatalf("expected nil error, got %v (of type %T)", err, err)
+		}
+
+		if err := os.WriteFile(path, nil, 0o600); err != nil {
+			t.Fatalf("expected nil error, got %v (of type %T)", err, err)
+		}
+	}
+
+	runner := newLibBPFGoBPFRunner(bpfModuleName,
+		tcpStateChangeEventChannelSize,
+		droppedEventsChannelSize,
+		tcpStateChangeEventPerfBufSizePages,
+		0,
+		0,
+		perfBufTransport,
+		btfAttachMode,
+		pinPath,
+		newMockBPFModuleCreator(nil, nil),
+		nil)
+
+	if err := runner.unpin(); err != nil {
+		t.Errorf("expected nil error, got %v (of type %T)", err, err)
+	}
+
+	if _, err := os.Stat(pinPath); !os.IsNotExist(err) {
+		t.Errorf("expected pin path to be removed, got %v", err)
+	}
+
+	// Unpinning again finds nothing to remove
+	if err := runner.unpin(); err != nil {
+		t.Errorf("expected nil error, got %v (of type %T)", err, err)
+	}
+}
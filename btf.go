@@ -0,0 +1,143 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"golang.org/x/sys/unix"
+)
+
+const kernelBTFPath = "/sys/kernel/btf/vmlinux"
+
+var errBTFFound = errors.New("BTF found") // Stops the search of a BTF archive once a match is found
+
+// BTFLocator is an interface which describes objects which locate a file
+// containing the BTF describing the running kernel, for kernels which do not
+// expose their own.
+type btfLocator interface {
+	// Locate returns an empty path if the kernel's own BTF should be used.
+	locate() (string, error)
+}
+
+// FSBTFLocator locates the BTF of the running kernel in the filesystem. The path
+// supplied is either that of a BTF file, which is used as-is, or of a directory,
+// which is searched for a file named after the kernel release with the extension
+// .btf. The directory may be a BTFHub-style archive, in which files are arranged
+// by distribution and architecture. The kernel's own BTF is always preferred if
+// it is available.
+type fsBTFLocator struct {
+	path          string
+	kernelBTFPath string
+	uname         func() (release, machine string, err error)
+}
+
+func newFSBTFLocator(path string) *fsBTFLocator {
+	return &fsBTFLocator{
+		path:          path,
+		kernelBTFPath: kernelBTFPath,
+		uname:         uname,
+	}
+}
+
+func (l *fsBTFLocator) locate() (string, error) {
+	if _, err := os.Stat(l.kernelBTFPath); err == nil {
+		return "", nil
+	}
+
+	info, err := os.Stat(l.path)
+	if err != nil {
+		return "", err
+	}
+
+	if !info.IsDir() {
+		return l.path, nil
+	}
+
+	release, machine, err := l.uname()
+	if err != nil {
+		return "", fmt.Errorf("getting kernel release: %w", err)
+	}
+
+	path, err := findBTF(l.path, release, machine)
+	if err != nil {
+		return "", fmt.Errorf("finding BTF for kernel %s (%s) in %q: %w", release, machine, l.path, err)
+	}
+
+	return path, nil
+}
+
+// FindBTF searches the directory for the BTF file of the given kernel release,
+// first at the top level and then throughout the directory. Kernels of different
+// architectures may share a release, so a file within a directory named after
+// the architecture is preferred to one which is not.
+func findBTF(dir, release, machine string) (string, error) {
+	name := release + ".btf"
+	if path := filepath.Join(dir, name); isRegularFile(path) {
+		return path, nil
+	}
+
+	arch := btfHubArch(machine)
+	var matches []string
+	var archMatch string
+	err := filepath.WalkDir(dir, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+
+		if entry.IsDir() || entry.Name() != name {
+			return nil
+		}
+
+		if filepath.Base(filepath.Dir(path)) == arch {
+			archMatch = path
+			return errBTFFound
+		}
+
+		matches = append(matches, path)
+		return nil
+	})
+	if err != nil && !errors.Is(err, errBTFFound) {
+		return "", err
+	}
+
+	switch {
+	case archMatch != "":
+		return archMatch, nil
+	case len(matches) == 1:
+		return matches[0], nil
+	case len(matches) > 1:
+		return "", fmt.Errorf("ambiguous BTF files %q", matches)
+	default:
+		return "", fmt.Errorf("no file %q", name)
+	}
+}
+
+// BTFHubArch returns the name of the architecture as used by BTFHub, given the
+// machine name reported by uname.
+func btfHubArch(machine string) string {
+	if machine == "aarch64" {
+		return "arm64"
+	}
+
+	return machine
+}
+
+func isRegularFile(path string) bool {
+	info, err := os.Stat(path)
+	return err == nil && info.Mode().IsRegular()
+}
+
+func uname() (release, machine string, err error) {
+	var utsname unix.Utsname
+	if err := unix.Uname(&utsname); err != nil {
+		return "", "", err
+	}
+
+	return strings.TrimSpace(unix.ByteSliceToString(utsname.Release[:])),
+		unix.ByteSliceToString(utsname.Machine[:]),
+		nil
+}
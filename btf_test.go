@@ -0,0 +1,168 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+const (
+	mockKernelRelease = "5.4.0-42-generic"
+	mockMachine       = "aarch64"
+)
+
+func newMockUname(release, machine string, errorToReturn error) func() (string, string, error) {
+	return func() (string, string, error) {
+		return release, machine, errorToReturn
+	}
+}
+
+func writeMockBTFFile(t *testing.T, path string) {
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		t.Fatalf("expected nil error, got %v (of type %T)", err, err)
+	}
+
+	if err := os.WriteFile(path, []byte("mock BTF"), 0o644); err != nil {
+		t.Fatalf("expected nil error, got %v (of type %T)", err, err)
+	}
+}
+
+func newTestFSBTFLocator(path string) *fsBTFLocator {
+	locator := newFSBTFLocator(path)
+	locator.kernelBTFPath = filepath.Join(filepath.Dir(path), "no-such-vmlinux")
+	locator.uname = newMockUname(mockKernelRelease, mockMachine, nil)
+
+	return locator
+}
+
+func TestFSBTFLocator(t *testing.T) {
+	tests := []struct {
+		name     string
+		files    []string // Relative to the archive directory
+		expected string
+	}{
+		{
+			"top level",
+			[]string{mockKernelRelease + ".btf", "5.4.0-26-generic.btf"},
+			mockKernelRelease + ".btf",
+		},
+		{
+			"BTFHub archive",
+			[]string{
+				"ubuntu/20.04/x86_64/" + mockKernelRelease + ".btf",
+				"ubuntu/20.04/arm64/" + mockKernelRelease + ".btf",
+				"ubuntu/20.04/arm64/5.4.0-26-generic.btf",
+			},
+			"ubuntu/20.04/arm64/" + mockKernelRelease + ".btf",
+		},
+		{
+			"single match for other architecture",
+			[]string{"ubuntu/20.04/" + mockKernelRelease + ".btf"},
+			"ubuntu/20.04/" + mockKernelRelease + ".btf",
+		},
+	}
+
+	for _, test := range tests {
+		dir := t.TempDir()
+		for _, file := range test.files {
+			writeMockBTFFile(t, filepath.Join(dir, file))
+		}
+
+		path, err := newTestFSBTFLocator(dir).locate()
+		if err != nil {
+			t.Errorf("%s: expected nil error, got %v (of type %T)", test.name, err, err)
+		}
+
+		if expected := filepath.Join(dir, test.expected); path != expected {
+			t.Errorf("%s: expected BTF path %q, got %q", test.name, expected, path)
+		}
+	}
+}
+
+func TestFSBTFLocatorFile(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "custom.btf")
+	writeMockBTFFile(t, file)
+
+	path, err := newTestFSBTFLocator(file).locate()
+	if err != nil {
+		t.Errorf("expected nil error, got %v (of type %T)", err, err)
+	}
+
+	if path != file {
+		t.Errorf("expected BTF path %q, got %q", file, path)
+	}
+}
+
+func TestFSBTFLocatorKernelBTF(t *testing.T) {
+	dir := t.TempDir()
+	writeMockBTFFile(t, filepath.Join(dir, mockKernelRelease+".btf"))
+	locator := newTestFSBTFLocator(dir)
+	locator.kernelBTFPath = filepath.Join(t.TempDir(), "vmlinux")
+	writeMockBTFFile(t, locator.kernelBTFPath)
+
+	path, err := locator.locate()
+	if err != nil {
+		t.Errorf("expected nil error, got %v (of type %T)", err, err)
+	}
+
+	if path != "" {
+		t.Errorf("expected kernel's own BTF to be used, got %q", path)
+	}
+}
+
+func TestFSBTFLocatorError(t *testing.T) {
+	mockError := errors.New("mock uname error")
+
+	tests := []struct {
+		name  string
+		files []string
+		uname func() (string, string, error)
+	}{
+		{"no match", []string{"5.4.0-26-generic.btf"}, nil},
+		{
+			"ambiguous",
+			[]string{"ubuntu/20.04/x86_64/" + mockKernelRelease + ".btf", "ubuntu/21.04/x86_64/" + mockKernelRelease + ".btf"},
+			nil,
+		},
+		{"uname error", nil, newMockUname("", "", mockError)},
+	}
+
+	for _, test := range tests {
+		dir := t.TempDir()
+		for _, file := range test.files {
+			writeMockBTFFile(t, filepath.Join(dir, file))
+		}
+
+		locator := newTestFSBTFLocator(dir)
+		if test.uname != nil {
+			locator.uname = test.uname
+		}
+
+		_, err := locator.locate()
+		if err == nil {
+			t.Errorf("%s: expected error, got nil", test.name)
+			continue
+		}
+
+		t.Logf("%s: got error %q (of type %T)", test.name, err, err)
+	}
+
+	_, err := newTestFSBTFLocator(filepath.Join(t.TempDir(), "missing")).locate()
+	if !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("expected error chain to include %q, got %v (of type %T)", os.ErrNotExist, err, err)
+	}
+}
+
+func TestUname(t *testing.T) {
+	release, machine, err := uname()
+	if err != nil {
+		t.Errorf("expected nil error, got %v (of type %T)", err, err)
+	}
+
+	t.Logf("got release %q, machine %q", release, machine)
+
+	if release == "" || machine == "" {
+		t.Error("expected release and machine, got empty")
+	}
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+
+	"golang.org/x/sys/unix"
+)
+
+// Capability is a Linux capability, numbered as in linux/capability.h.
+type capability int
+
+var capabilityNames = map[capability]string{
+	unix.CAP_DAC_OVERRIDE: "CAP_DAC_OVERRIDE",
+	unix.CAP_SYS_PTRACE:   "CAP_SYS_PTRACE",
+	unix.CAP_SYS_ADMIN:    "CAP_SYS_ADMIN",
+	unix.CAP_SYS_RESOURCE: "CAP_SYS_RESOURCE",
+	unix.CAP_PERFMON:      "CAP_PERFMON",
+	unix.CAP_BPF:          "CAP_BPF",
+}
+
+func (c capability) String() string {
+	if name, ok := capabilityNames[c]; ok {
+		return name
+	}
+
+	return fmt.Sprintf("capability %d", int(c))
+}
+
+// CapabilityRequirement is a requirement of the Eventer after the BPF has been
+// loaded which is met by any one of its capabilities, in order of preference.
+type capabilityRequirement []capability
+
+// RetainedCapabilitiesOf returns the capabilities which meet the given
+// requirements of the process or thread whose status file is given, as
+// retainedCapabilities does for its permitted capabilities.
+func retainedCapabilitiesOf(statusPath string, requirements []capabilityRequirement) ([]capability, error) {
+	permitted, err := readCapabilities(statusPath, "CapPrm")
+	if err != nil {
+		return nil, fmt.Errorf("reading permitted capabilities: %w", err)
+	}
+
+	return retainedCapabilities(requirements, permitted), nil
+}
+
+// RetainedCapabilities returns, for each requirement, the first of its
+// capabilities which is permitted, without duplicates.
+func retainedCapabilities(requirements []capabilityRequirement, permitted uint64) []capability {
+	set := make(map[capability]bool)
+	for _, requirement := range requirements {
+		for _, capability := range requirement {
+			if hasCapability(permitted, int(capability)) {
+				set[capability] = true
+				break
+			}
+		}
+	}
+
+	retained := make([]capability, 0, len(set))
+	for capability := range set {
+		retained = append(retained, capability)
+	}
+	sort.Slice(retained, func(i, j int) bool { return retained[i] < retained[j] })
+
+	return retained
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"golang.org/x/sys/unix"
+)
+
+func TestRetainedCapabilities(t *testing.T) {
+	requirements := []capabilityRequirement{
+		{unix.CAP_PERFMON, unix.CAP_SYS_ADMIN},
+		{unix.CAP_SYS_PTRACE},
+		{unix.CAP_BPF},
+	}
+
+	tests := []struct {
+		name      string
+		permitted uint64
+		expected  string
+	}{
+		{"preferred capability permitted", 1<<unix.CAP_PERFMON | 1<<unix.CAP_SYS_ADMIN | 1<<unix.CAP_SYS_PTRACE, "[CAP_SYS_PTRACE CAP_PERFMON]"},
+		{"fallback capability permitted", 1<<unix.CAP_SYS_ADMIN | 1<<unix.CAP_DAC_OVERRIDE, "[CAP_SYS_ADMIN]"},
+		{"none permitted", 1 << unix.CAP_DAC_OVERRIDE, "[]"},
+	}
+
+	for _, test := range tests {
+		retained := retainedCapabilities(requirements, test.permitted)
+		if fmt.Sprint(retained) != test.expected {
+			t.Errorf("%s: expected retained capabilities %s, got %v", test.name, test.expected, retained)
+		}
+	}
+}
+
+func TestRetainedCapabilitiesOf(t *testing.T) {
+	statusPath := filepath.Join(t.TempDir(), "status")
+	status := "Name:\ttcp-audit\nCapInh:\t0000000000000000\nCapPrm:\t000000c000200000\nCapEff:\t000000c000200000\n" // CAP_SYS_ADMIN, CAP_PERFMON and CAP_BPF
+	if err := os.WriteFile(statusPath, []byte(status), 0o644); err != nil {
+		t.Fatalf("expected nil error, got %v (of type %T)", err, err)
+	}
+
+	retained, err := retainedCapabilitiesOf(statusPath, []capabilityRequirement{
+		{unix.CAP_BPF, unix.CAP_SYS_ADMIN},
+		{unix.CAP_SYS_PTRACE},
+	})
+	if err != nil {
+		t.Errorf("expected nil error, got %v (of type %T)", err, err)
+	}
+
+	if fmt.Sprint(retained) != "[CAP_BPF]" {
+		t.Errorf("expected retained capabilities [CAP_BPF], got %v", retained)
+	}
+}
+
+func TestRetainedCapabilitiesOfError(t *testing.T) {
+	_, err := retainedCapabilitiesOf(filepath.Join(t.TempDir(), "missing"), nil)
+	if err == nil {
+		t.Error("expected error, got nil")
+	}
+
+	t.Logf("got error %q (of type %T)", err, err)
+}
@@ -0,0 +1,257 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"time"
+)
+
+// The capture file format consists of a header followed by a sequence of
+// records. All fields are little endian, except for the event data, which is
+// recorded exactly as received from the kernel, in the byte order recorded in
+// the header.
+// The header consists of the magic "TCPAUDIT", a uint8 version, a uint8 byte
+// order (0 for little endian, 1 for big endian) and the int64 offset in
+// nanoseconds of the wall clock from CLOCK_MONOTONIC at the time of recording.
+// Each record consists of a uint8 kind, the int64 wall-clock time (in Unix
+// nanoseconds) at which the record was received, and then either a uint32 length
+// followed by the event data, or a uint64 dropped event count.
+// As the event data is recorded raw, the version must be incremented whenever
+// the layout of the event data changes.
+const (
+	captureMagic   = "TCPAUDIT"
+	captureVersion = 3
+
+	captureByteOrderLittleEndian = 0
+	captureByteOrderBigEndian    = 1
+
+	captureMaxEventLen = 64 * 1024 // Guards against allocating huge buffers for corrupt files
+)
+
+type captureRecordKind uint8
+
+const (
+	captureRecordEvent captureRecordKind = iota + 1
+	captureRecordDroppedEventCount
+)
+
+type captureHeader struct {
+	Magic            [8]byte
+	Version          uint8
+	ByteOrder        uint8
+	KernelTimeOffset int64
+}
+
+// CaptureRecord is a single event or dropped event count read from a capture.
+type captureRecord struct {
+	kind              captureRecordKind
+	arrivalTime       time.Time
+	eventData         []byte // Only set for event records
+	droppedEventCount uint64 // Only set for dropped event count records
+}
+
+// CreateCaptureWriter creates a capture file at the supplied path, replacing any
+// existing file, to which raw events in the system byte order are written.
+func createCaptureWriter(path string, kernelTimeOffset time.Duration) (*captureWriter, error) {
+	file, err := os.Create(path)
+	if err != nil {
+		return nil, err
+	}
+
+	writer, err := newCaptureWriter(file, systemEndianess(), kernelTimeOffset)
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	return writer, nil
+}
+
+// CaptureWriter writes raw events and dropped event counts to a capture.
+type captureWriter struct {
+	writer *bufio.Writer
+	closer io.Closer
+}
+
+func newCaptureWriter(writeCloser io.WriteCloser,
+	endianess binary.ByteOrder,
+	kernelTimeOffset time.Duration) (*captureWriter, error) {
+	header := &captureHeader{
+		Version:          captureVersion,
+		ByteOrder:        captureByteOrderLittleEndian,
+		KernelTimeOffset: int64(kernelTimeOffset),
+	}
+	copy(header.Magic[:], captureMagic)
+	if endianess == binary.BigEndian {
+		header.ByteOrder = captureByteOrderBigEndian
+	}
+
+	writer := bufio.NewWriter(writeCloser)
+	if err := binary.Write(writer, binary.LittleEndian, header); err != nil {
+		return nil, fmt.Errorf("writing capture header: %w", err)
+	}
+
+	return &captureWriter{
+		writer: writer,
+		closer: writeCloser,
+	}, nil
+}
+
+func (w *captureWriter) writeEvent(arrivalTime time.Time, eventData []byte) error {
+	if err := w.writeRecordHeader(captureRecordEvent, arrivalTime); err != nil {
+		return err
+	}
+
+	if err := binary.Write(w.writer, binary.LittleEndian, uint32(len(eventData))); err != nil {
+		return err
+	}
+
+	_, err := w.writer.Write(eventData)
+	return err
+}
+
+func (w *captureWriter) writeDroppedEventCount(arrivalTime time.Time, count uint64) error {
+	if err := w.writeRecordHeader(captureRecordDroppedEventCount, arrivalTime); err != nil {
+		return err
+	}
+
+	return binary.Write(w.writer, binary.LittleEndian, count)
+}
+
+func (w *captureWriter) writeRecordHeader(kind captureRecordKind, arrivalTime time.Time) error {
+	if err := w.writer.WriteByte(byte(kind)); err != nil {
+		return err
+	}
+
+	return binary.Write(w.writer, binary.LittleEndian, arrivalTime.UnixNano())
+}
+
+// Close flushes any buffered records and closes the underlying writer.
+func (w *captureWriter) close() error {
+	if err := w.writer.Flush(); err != nil {
+		w.closer.Close()
+		return fmt.Errorf("flushing capture: %w", err)
+	}
+
+	return w.closer.Close()
+}
+
+// OpenCaptureReader opens the capture file at the supplied path for reading.
+func openCaptureReader(path string) (*captureReader, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+
+	reader, err := newCaptureReader(file)
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	return reader, nil
+}
+
+// CaptureReader reads raw events and dropped event counts from a capture.
+type captureReader struct {
+	reader           *bufio.Reader
+	closer           io.Closer
+	endianess        binary.ByteOrder // Byte order of the recorded event data
+	kernelTimeOffset time.Duration
+}
+
+func newCaptureReader(readCloser io.ReadCloser) (*captureReader, error) {
+	reader := bufio.NewReader(readCloser)
+
+	header := new(captureHeader)
+	if err := binary.Read(reader, binary.LittleEndian, header); err != nil {
+		return nil, fmt.Errorf("reading capture header: %w", err)
+	}
+
+	if string(header.Magic[:]) != captureMagic {
+		return nil, errors.New("not a capture file")
+	}
+
+	if header.Version != captureVersion {
+		return nil, fmt.Errorf("unsupported capture version: %d", header.Version)
+	}
+
+	var endianess binary.ByteOrder
+	switch header.ByteOrder {
+	case captureByteOrderLittleEndian:
+		endianess = binary.LittleEndian
+	case captureByteOrderBigEndian:
+		endianess = binary.BigEndian
+	default:
+		return nil, fmt.Errorf("illegal capture byte order: %d", header.ByteOrder)
+	}
+
+	return &captureReader{
+		reader:           reader,
+		closer:           readCloser,
+		endianess:        endianess,
+		kernelTimeOffset: time.Duration(header.KernelTimeOffset),
+	}, nil
+}
+
+// Next returns the next record in the capture, or io.EOF if there are no
+// more records.
+func (r *captureReader) next() (*captureRecord, error) {
+	kind, err := r.reader.ReadByte()
+	if err != nil {
+		return nil, err // io.EOF at the end of a well-formed capture
+	}
+
+	var arrivalTimeNs int64
+	if err := binary.Read(r.reader, binary.LittleEndian, &arrivalTimeNs); err != nil {
+		return nil, fmt.Errorf("reading record arrival time: %w", unexpectedEOF(err))
+	}
+
+	record := &captureRecord{
+		kind:        captureRecordKind(kind),
+		arrivalTime: time.Unix(0, arrivalTimeNs).UTC(),
+	}
+
+	switch record.kind {
+	case captureRecordEvent:
+		var length uint32
+		if err := binary.Read(r.reader, binary.LittleEndian, &length); err != nil {
+			return nil, fmt.Errorf("reading event length: %w", unexpectedEOF(err))
+		}
+
+		if length > captureMaxEventLen {
+			return nil, fmt.Errorf("illegal event length: %d", length)
+		}
+
+		record.eventData = make([]byte, length)
+		if _, err := io.ReadFull(r.reader, record.eventData); err != nil {
+			return nil, fmt.Errorf("reading event data: %w", unexpectedEOF(err))
+		}
+	case captureRecordDroppedEventCount:
+		if err := binary.Read(r.reader, binary.LittleEndian, &record.droppedEventCount); err != nil {
+			return nil, fmt.Errorf("reading dropped event count: %w", unexpectedEOF(err))
+		}
+	default:
+		return nil, fmt.Errorf("illegal record kind: %d", kind)
+	}
+
+	return record, nil
+}
+
+func (r *captureReader) close() error {
+	return r.closer.Close()
+}
+
+// UnexpectedEOF converts io.EOF to io.ErrUnexpectedEOF, as the end of the capture
+// is only expected between records.
+func unexpectedEOF(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+
+	return err
+}
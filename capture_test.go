@@ -0,0 +1,127 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"testing"
+	"time"
+)
+
+// BufferWriteCloser is a bytes.Buffer which records whether it has been closed.
+type bufferWriteCloser struct {
+	bytes.Buffer
+
+	closeCalled bool
+}
+
+func (b *bufferWriteCloser) Close() error {
+	b.closeCalled = true
+	return nil
+}
+
+func TestCaptureRoundTrip(t *testing.T) {
+	buf := new(bufferWriteCloser)
+	arrivalTime := time.Unix(1600000000, 0).UTC()
+	kernelTimeOffset := 1234 * time.Second
+
+	writer, err := newCaptureWriter(buf, binary.BigEndian, kernelTimeOffset)
+	if err != nil {
+		t.Fatalf("expected nil constructor error, got %v (of type %T)", err, err)
+	}
+
+	if err := writer.writeEvent(arrivalTime, []byte{0x01, 0x02, 0x03}); err != nil {
+		t.Errorf("expected nil error, got %v (of type %T)", err, err)
+	}
+
+	if err := writer.writeDroppedEventCount(arrivalTime.Add(time.Second), 10); err != nil {
+		t.Errorf("expected nil error, got %v (of type %T)", err, err)
+	}
+
+	if err := writer.close(); err != nil {
+		t.Errorf("expected nil error, got %v (of type %T)", err, err)
+	}
+
+	if !buf.closeCalled {
+		t.Error("expected underlying writer to be closed, but was not")
+	}
+
+	reader, err := newCaptureReader(io.NopCloser(&buf.Buffer))
+	if err != nil {
+		t.Fatalf("expected nil constructor error, got %v (of type %T)", err, err)
+	}
+
+	if reader.endianess != binary.BigEndian {
+		t.Errorf("expected byte order %v, got %v", binary.BigEndian, reader.endianess)
+	}
+
+	if reader.kernelTimeOffset != kernelTimeOffset {
+		t.Errorf("expected kernel time offset %v, got %v", kernelTimeOffset, reader.kernelTimeOffset)
+	}
+
+	record, err := reader.next()
+	if err != nil {
+		t.Fatalf("expected nil error, got %v (of type %T)", err, err)
+	}
+
+	if record.kind != captureRecordEvent ||
+		!record.arrivalTime.Equal(arrivalTime) ||
+		!bytes.Equal(record.eventData, []byte{0x01, 0x02, 0x03}) {
+		t.Errorf("expected event record, got %+v", record)
+	}
+
+	record, err = reader.next()
+	if err != nil {
+		t.Fatalf("expected nil error, got %v (of type %T)", err, err)
+	}
+
+	if record.kind != captureRecordDroppedEventCount ||
+		!record.arrivalTime.Equal(arrivalTime.Add(time.Second)) ||
+		record.droppedEventCount != 10 {
+		t.Errorf("expected dropped event count record, got %+v", record)
+	}
+
+	if _, err := reader.next(); err != io.EOF {
+		t.Errorf("expected %v, got %v (of type %T)", io.EOF, err, err)
+	}
+}
+
+func TestCaptureReaderNotCapture(t *testing.T) {
+	_, err := newCaptureReader(io.NopCloser(bytes.NewBufferString("not a capture file at all")))
+	if err == nil {
+		t.Error("expected constructor error, got nil")
+	}
+
+	t.Logf("got constructor error %q (of type %T)", err, err)
+}
+
+func TestCaptureReaderTruncated(t *testing.T) {
+	buf := new(bufferWriteCloser)
+	writer, err := newCaptureWriter(buf, binary.LittleEndian, 0)
+	if err != nil {
+		t.Fatalf("expected nil constructor error, got %v (of type %T)", err, err)
+	}
+
+	if err := writer.writeEvent(time.Now(), []byte{0x01, 0x02, 0x03}); err != nil {
+		t.Errorf("expected nil error, got %v (of type %T)", err, err)
+	}
+	writer.close()
+
+	truncated := buf.Bytes()[:buf.Len()-1]
+	reader, err := newCaptureReader(io.NopCloser(bytes.NewBuffer(truncated)))
+	if err != nil {
+		t.Fatalf("expected nil constructor error, got %v (of type %T)", err, err)
+	}
+
+	_, err = reader.next()
+	if err == nil {
+		t.Error("expected error, got nil")
+	}
+
+	t.Logf("got error %q (of type %T)", err, err)
+
+	if !errors.Is(err, io.ErrUnexpectedEOF) {
+		t.Errorf("expected error chain to include %q, but did not", io.ErrUnexpectedEOF)
+	}
+}
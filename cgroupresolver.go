@@ -0,0 +1,239 @@
+package main
+
+import (
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/jhwbarlow/tcp-audit-bpf-eventer/pkg/bpfevent"
+)
+
+var (
+	// Matches the cgroup directory of a container created by Docker, containerd
+	// or CRI-O, with either the cgroupfs or systemd cgroup driver, e.g.
+	// "docker-<id>.scope", "cri-containerd-<id>.scope", "crio-<id>.scope" or "<id>"
+	containerCgroupRegexp = regexp.MustCompile(`^(?:[a-z-]+-)?([0-9a-f]{64})(?:\.scope)?$`)
+
+	// Matches the cgroup directory of a Kubernetes pod, with either the cgroupfs
+	// or systemd cgroup driver, e.g. "pod<uid>" or "kubepods-besteffort-pod<uid>.slice".
+	// The systemd driver replaces the dashes in the UID with underscores.
+	podCgroupRegexp = regexp.MustCompile(`pod([0-9a-f]{8}[-_][0-9a-f]{4}[-_][0-9a-f]{4}[-_][0-9a-f]{4}[-_][0-9a-f]{12})(?:\.slice)?$`)
+)
+
+// CgroupResolver is an interface which describes objects which resolve cgroup
+// IDs to the container to which the cgroup belongs.
+type cgroupResolver interface {
+	// Resolve returns nil if the cgroup does not belong to a container.
+	resolve(cgroupID uint64) (*bpfevent.Container, error)
+}
+
+// CgroupFSResolver resolves cgroup IDs to containers by walking the cgroup v2
+// filesystem, in which the ID of a cgroup is the inode number of its directory.
+// Kubernetes pod names and namespaces are resolved from the names of the
+// directories in which the kubelet stores pod logs, which are of the form
+// "<namespace>_<name>_<uid>".
+// Results are cached, including for cgroups which do not belong to a container.
+// On a cache miss, the filesystem is walked again in the background, no more
+// often than the rescan interval, to discover new cgroups, so a cgroup created
+// since the last walk is not resolved until the walk has completed.
+type cgroupFSResolver struct {
+	cgroupRoot     string
+	podLogDir      string // Pod names and namespaces are not resolved if empty
+	rescanInterval time.Duration
+	clock          clock
+
+	mutex      sync.Mutex
+	containers map[uint64]*bpfevent.Container // Nil for cgroups which do not belong to a container
+	scannedAt  time.Time
+	scanning   bool
+	scanErr    error          // Returned by the next call to resolve
+	scans      sync.WaitGroup // Background scans in progress
+}
+
+func newCgroupFSResolver(cgroupRoot, podLogDir string,
+	rescanInterval time.Duration,
+	clock clock) *cgroupFSResolver {
+	return &cgroupFSResolver{
+		cgroupRoot:     cgroupRoot,
+		podLogDir:      podLogDir,
+		rescanInterval: rescanInterval,
+		clock:          clock,
+		containers:     make(map[uint64]*bpfevent.Container),
+	}
+}
+
+func (r *cgroupFSResolver) resolve(cgroupID uint64) (*bpfevent.Container, error) {
+	if cgroupID == 0 {
+		return nil, nil
+	}
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if err := r.scanErr; err != nil {
+		r.scanErr = nil
+		return nil, fmt.Errorf("scanning cgroups: %w", err)
+	}
+
+	if container, ok := r.containers[cgroupID]; ok {
+		return container, nil
+	}
+
+	if r.scanning {
+		return nil, nil
+	}
+
+	now := r.clock.wallNow()
+	if !r.scannedAt.IsZero() && now.Sub(r.scannedAt) < r.rescanInterval {
+		return nil, nil
+	}
+	r.scannedAt = now
+
+	r.scanning = true
+	r.scans.Add(1)
+	go r.rescan()
+
+	return nil, nil
+}
+
+// Rescan walks the cgroup filesystem and replaces the cache with the cgroups
+// found, so that removed cgroups do not accumulate.
+func (r *cgroupFSResolver) rescan() {
+	defer r.scans.Done()
+
+	containers, err := r.scan()
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	r.scanning = false
+	if err != nil {
+		r.scanErr = err
+		return
+	}
+	r.containers = containers
+}
+
+// Scan walks the cgroup filesystem and returns the containers to which each
+// cgroup found belongs, keyed by cgroup ID. Cgroups which do not belong to a
+// container are included with a nil container.
+func (r *cgroupFSResolver) scan() (map[uint64]*bpfevent.Container, error) {
+	pods, err := r.scanPods()
+	if err != nil {
+		return nil, fmt.Errorf("scanning pod metadata: %w", err)
+	}
+
+	containers := make(map[uint64]*bpfevent.Container)
+	err = filepath.WalkDir(r.cgroupRoot, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			if path == r.cgroupRoot {
+				return err
+			}
+
+			return nil // cgroups may be removed while walking, so ignore errors beneath the root
+		}
+
+		if !entry.IsDir() {
+			return nil
+		}
+
+		info, err := entry.Info()
+		if err != nil {
+			return nil
+		}
+
+		stat, ok := info.Sys().(*syscall.Stat_t)
+		if !ok {
+			return nil
+		}
+
+		relPath, err := filepath.Rel(r.cgroupRoot, path)
+		if err != nil {
+			return nil
+		}
+
+		container := containerFromCgroupPath("/" + filepath.ToSlash(relPath))
+		if container != nil {
+			if pod, ok := pods[container.PodUID]; ok {
+				container.PodName = pod.name
+				container.PodNamespace = pod.namespace
+			}
+		}
+		containers[stat.Ino] = container
+
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return containers, nil
+}
+
+type podMetadata struct {
+	name, namespace string
+}
+
+// ScanPods returns the metadata of the pods whose logs are in the pod log
+// directory, keyed by pod UID.
+func (r *cgroupFSResolver) scanPods() (map[string]podMetadata, error) {
+	pods := make(map[string]podMetadata)
+	if r.podLogDir == "" {
+		return pods, nil
+	}
+
+	entries, err := os.ReadDir(r.podLogDir)
+	if err != nil {
+		if os.IsNotExist(err) { // Not a Kubernetes node
+			return pods, nil
+		}
+
+		return nil, err
+	}
+
+	for _, entry := range entries {
+		// Names and namespaces are DNS labels or subdomains, so cannot contain underscores
+		fields := strings.Split(entry.Name(), "_")
+		if !entry.IsDir() || len(fields) != 3 {
+			continue
+		}
+
+		pods[fields[2]] = podMetadata{
+			namespace: fields[0],
+			name:      fields[1],
+		}
+	}
+
+	return pods, nil
+}
+
+// ContainerFromCgroupPath returns the container to which the cgroup with the
+// given path belongs, or nil if it does not belong to a container. Cgroups
+// nested beneath the container's cgroup are considered to belong to it.
+func containerFromCgroupPath(cgroupPath string) *bpfevent.Container {
+	components := strings.Split(cgroupPath, "/")
+
+	podUID := ""
+	for i, component := range components {
+		if match := podCgroupRegexp.FindStringSubmatch(component); match != nil {
+			podUID = strings.ReplaceAll(match[1], "_", "-")
+			continue
+		}
+
+		if match := containerCgroupRegexp.FindStringSubmatch(component); match != nil {
+			return &bpfevent.Container{
+				ID:         match[1],
+				CgroupPath: strings.Join(components[:i+1], "/"),
+				PodUID:     podUID,
+			}
+		}
+	}
+
+	return nil
+}
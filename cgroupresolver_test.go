@@ -0,0 +1,181 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+)
+
+const (
+	mockContainerID = "0123456789abcdef0123456789abcdef0123456789abcdef0123456789abcdef"
+	mockPodUID      = "11111111-2222-3333-4444-555555555555"
+)
+
+func makeCgroupDir(t *testing.T, root, path string) uint64 {
+	dir := filepath.Join(root, path)
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		t.Fatalf("expected nil error, got %v (of type %T)", err, err)
+	}
+
+	info, err := os.Stat(dir)
+	if err != nil {
+		t.Fatalf("expected nil error, got %v (of type %T)", err, err)
+	}
+
+	return info.Sys().(*syscall.Stat_t).Ino
+}
+
+func TestContainerFromCgroupPath(t *testing.T) {
+	tests := []struct {
+		cgroupPath         string
+		expectedID         string
+		expectedCgroupPath string
+		expectedPodUID     string
+	}{
+		{"/system.slice/docker-" + mockContainerID + ".scope", mockContainerID, "/system.slice/docker-" + mockContainerID + ".scope", ""},
+		{"/docker/" + mockContainerID, mockContainerID, "/docker/" + mockContainerID, ""},
+		{"/kubepods/besteffort/pod" + mockPodUID + "/" + mockContainerID, mockContainerID, "/kubepods/besteffort/pod" + mockPodUID + "/" + mockContainerID, mockPodUID},
+		{"/kubepods.slice/kubepods-burstable.slice/kubepods-burstable-pod11111111_2222_3333_4444_555555555555.slice/cri-containerd-" + mockContainerID + ".scope/nested",
+			mockContainerID,
+			"/kubepods.slice/kubepods-burstable.slice/kubepods-burstable-pod11111111_2222_3333_4444_555555555555.slice/cri-containerd-" + mockContainerID + ".scope",
+			mockPodUID},
+	}
+
+	for _, test := range tests {
+		container := containerFromCgroupPath(test.cgroupPath)
+		if container == nil {
+			t.Errorf("expected container for cgroup %q, got nil", test.cgroupPath)
+			continue
+		}
+
+		if container.ID != test.expectedID {
+			t.Errorf("expected container ID %q, got %q", test.expectedID, container.ID)
+		}
+
+		if container.CgroupPath != test.expectedCgroupPath {
+			t.Errorf("expected cgroup path %q, got %q", test.expectedCgroupPath, container.CgroupPath)
+		}
+
+		if container.PodUID != test.expectedPodUID {
+			t.Errorf("expected pod UID %q, got %q", test.expectedPodUID, container.PodUID)
+		}
+	}
+}
+
+func TestContainerFromCgroupPathNotContainer(t *testing.T) {
+	for _, cgroupPath := range []string{"/", "/system.slice/sshd.service", "/kubepods/besteffort/pod" + mockPodUID} {
+		if container := containerFromCgroupPath(cgroupPath); container != nil {
+			t.Errorf("expected nil container for cgroup %q, got %v", cgroupPath, container)
+		}
+	}
+}
+
+func TestCgroupFSResolverResolve(t *testing.T) {
+	cgroupRoot := t.TempDir()
+	podLogDir := t.TempDir()
+	containerCgroupID := makeCgroupDir(t, cgroupRoot, "kubepods/besteffort/pod"+mockPodUID+"/"+mockContainerID)
+	hostCgroupID := makeCgroupDir(t, cgroupRoot, "system.slice/sshd.service")
+	makeCgroupDir(t, podLogDir, "default_mock-pod_"+mockPodUID)
+
+	// Only the first lookup, which misses the cache and starts the scan, reads the clock
+	mockClock := newMockClock([]time.Time{time.Now()}, nil, nil)
+	resolver := newCgroupFSResolver(cgroupRoot, podLogDir, time.Minute, mockClock)
+
+	// The cgroup is not resolved until the background scan has completed
+	container, err := resolver.resolve(containerCgroupID)
+	if err != nil {
+		t.Errorf("expected nil error, got %v (of type %T)", err, err)
+	}
+
+	if container != nil {
+		t.Errorf("expected nil container before scan, got %v", container)
+	}
+	resolver.scans.Wait()
+
+	container, err = resolver.resolve(containerCgroupID)
+	if err != nil {
+		t.Errorf("expected nil error, got %v (of type %T)", err, err)
+	}
+
+	if container == nil {
+		t.Fatal("expected container, got nil")
+	}
+
+	t.Logf("got container %q", container)
+
+	if container.ID != mockContainerID {
+		t.Errorf("expected container ID %q, got %q", mockContainerID, container.ID)
+	}
+
+	if container.PodName != "mock-pod" || container.PodNamespace != "default" {
+		t.Errorf("expected pod default/mock-pod, got %s/%s", container.PodNamespace, container.PodName)
+	}
+
+	// The host cgroup is cached as not belonging to a container, so no rescan is started
+	container, err = resolver.resolve(hostCgroupID)
+	if err != nil {
+		t.Errorf("expected nil error, got %v (of type %T)", err, err)
+	}
+
+	if container != nil {
+		t.Errorf("expected nil container, got %v", container)
+	}
+}
+
+func TestCgroupFSResolverRescan(t *testing.T) {
+	cgroupRoot := t.TempDir()
+	timeNow := time.Now()
+	mockClock := newMockClock([]time.Time{timeNow, timeNow, timeNow.Add(time.Minute)}, nil, nil)
+	resolver := newCgroupFSResolver(cgroupRoot, "", time.Minute, mockClock)
+
+	if _, err := resolver.resolve(1); err != nil { // Perform the initial scan
+		t.Errorf("expected nil error, got %v (of type %T)", err, err)
+	}
+	resolver.scans.Wait()
+
+	containerCgroupID := makeCgroupDir(t, cgroupRoot, "docker/"+mockContainerID)
+
+	// Within the rescan interval, the new cgroup should not be discovered
+	container, err := resolver.resolve(containerCgroupID)
+	if err != nil {
+		t.Errorf("expected nil error, got %v (of type %T)", err, err)
+	}
+
+	if container != nil {
+		t.Errorf("expected nil container before rescan, got %v", container)
+	}
+
+	if _, err := resolver.resolve(containerCgroupID); err != nil { // Perform the rescan
+		t.Errorf("expected nil error, got %v (of type %T)", err, err)
+	}
+	resolver.scans.Wait()
+
+	container, err = resolver.resolve(containerCgroupID)
+	if err != nil {
+		t.Errorf("expected nil error, got %v (of type %T)", err, err)
+	}
+
+	if container == nil || container.ID != mockContainerID {
+		t.Errorf("expected container %q after rescan, got %v", mockContainerID, container)
+	}
+}
+
+func TestCgroupFSResolverResolveError(t *testing.T) {
+	mockClock := newMockClock([]time.Time{time.Now()}, nil, nil)
+	resolver := newCgroupFSResolver(filepath.Join(t.TempDir(), "missing"), "", time.Minute, mockClock)
+
+	if _, err := resolver.resolve(1); err != nil { // Perform the scan
+		t.Errorf("expected nil error, got %v (of type %T)", err, err)
+	}
+	resolver.scans.Wait()
+
+	// The error of the background scan is returned by the next lookup
+	_, err := resolver.resolve(1)
+	if err == nil {
+		t.Error("expected error, got nil")
+	}
+
+	t.Logf("got error %q (of type %T)", err, err)
+}
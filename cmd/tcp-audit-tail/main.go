@@ -0,0 +1,256 @@
+// Command tcp-audit-tail prints the events produced by the BPF Eventer, for
+// troubleshooting on a host without the rest of tcp-audit. The Eventer is loaded
+// from the built plugin, and so is configured in the same way, using the
+// TCP_AUDIT_BPF_* environment variables and optional configuration file.
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"os/signal"
+	"plugin"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"github.com/jhwbarlow/tcp-audit-bpf-eventer/pkg/bpfevent"
+	"github.com/jhwbarlow/tcp-audit-bpf-eventer/pkg/preflight"
+	"github.com/jhwbarlow/tcp-audit-common/pkg/event"
+)
+
+// Must match those used by the Eventer
+const (
+	envConfigFile          = "TCP_AUDIT_BPF_CONFIG_FILE"
+	envDroppedEventHandler = "TCP_AUDIT_BPF_DROPPED_EVENT_HANDLER"
+
+	gapEventDroppedEventHandlerName = "gap-event"
+)
+
+// DetailedEventer is the subset of the methods of the plugin's Eventer used to
+// read events.
+type detailedEventer interface {
+	DetailedEventContext(ctx context.Context) (*bpfevent.Event, error)
+	Close() error
+}
+
+// Unpinner is implemented by Eventers which can remove the BPF objects they have
+// pinned, so that they are not left for a restarted Eventer.
+type unpinner interface {
+	Unpin() error
+}
+
+func main() {
+	pluginPath := flag.String("plugin", "tcp-audit-bpf-eventer.so", "path of the BPF Eventer plugin")
+	configFile := flag.String("config", "", "path of the Eventer configuration file (overrides "+envConfigFile+")")
+	jsonOutput := flag.Bool("json", false, "print events as JSON lines")
+	preflightOnly := flag.Bool("preflight", false, "check the environment meets the requirements of the Eventer, then exit")
+	unpinOnExit := flag.Bool("unpin", false, "remove the BPF objects pinned by the Eventer on exit, detaching its BPF programs")
+	flag.Parse()
+
+	log.SetOutput(os.Stderr)
+
+	if *configFile != "" {
+		os.Setenv(envConfigFile, *configFile)
+	}
+
+	// Dropped events are printed inline, unless another handler is configured
+	if _, ok := os.LookupEnv(envDroppedEventHandler); !ok {
+		os.Setenv(envDroppedEventHandler, gapEventDroppedEventHandlerName)
+	}
+
+	if *preflightOnly {
+		report, err := runPreflight(*pluginPath)
+		if err != nil {
+			log.Fatalf("Error running preflight checks: %v", err)
+		}
+
+		fmt.Println(report)
+		if !report.Passed() {
+			os.Exit(1)
+		}
+		return
+	}
+
+	eventer, err := openEventer(*pluginPath)
+	if err != nil {
+		log.Fatalf("Error creating Eventer: %v", err)
+	}
+
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer cancel()
+
+	writeEvent := writeText
+	if *jsonOutput {
+		writeEvent = writeJSON
+	}
+
+	err = tail(ctx, eventer, os.Stdout, writeEvent)
+	if *unpinOnExit {
+		if unpinErr := unpin(eventer); unpinErr != nil {
+			log.Printf("Error unpinning Eventer: %v", unpinErr)
+		}
+	}
+	if closeErr := eventer.Close(); closeErr != nil {
+		log.Printf("Error closing Eventer: %v", closeErr)
+	}
+
+	if err != nil {
+		log.Fatalf("Error reading events: %v", err)
+	}
+}
+
+// OpenEventer loads the plugin and creates an Eventer using its New function.
+func openEventer(pluginPath string) (detailedEventer, error) {
+	p, err := plugin.Open(pluginPath)
+	if err != nil {
+		return nil, fmt.Errorf("opening plugin: %w", err)
+	}
+
+	symbol, err := p.Lookup("New")
+	if err != nil {
+		return nil, fmt.Errorf("looking up constructor: %w", err)
+	}
+
+	newEventer, ok := symbol.(func() (event.Eventer, error))
+	if !ok {
+		return nil, fmt.Errorf("constructor has unexpected type %T", symbol)
+	}
+
+	eventer, err := newEventer()
+	if err != nil {
+		return nil, err
+	}
+
+	detailedEventer, ok := eventer.(detailedEventer)
+	if !ok {
+		return nil, fmt.Errorf("eventer of type %T does not provide detailed events", eventer)
+	}
+
+	return detailedEventer, nil
+}
+
+// RunPreflight loads the plugin and checks the environment using its Preflight
+// function.
+func runPreflight(pluginPath string) (*preflight.Report, error) {
+	p, err := plugin.Open(pluginPath)
+	if err != nil {
+		return nil, fmt.Errorf("opening plugin: %w", err)
+	}
+
+	symbol, err := p.Lookup("Preflight")
+	if err != nil {
+		return nil, fmt.Errorf("looking up preflight checker: %w", err)
+	}
+
+	check, ok := symbol.(func() (*preflight.Report, error))
+	if !ok {
+		return nil, fmt.Errorf("preflight checker has unexpected type %T", symbol)
+	}
+
+	return check()
+}
+
+// Unpin removes the BPF objects pinned by the Eventer, if it supports pinning.
+func unpin(eventer detailedEventer) error {
+	unpinner, ok := eventer.(unpinner)
+	if !ok {
+		return fmt.Errorf("eventer of type %T does not support unpinning", eventer)
+	}
+
+	return unpinner.Unpin()
+}
+
+// Tail writes events to w until the context is done, which is not treated as
+// an error.
+func tail(ctx context.Context,
+	eventer detailedEventer,
+	w io.Writer,
+	writeEvent func(io.Writer, *bpfevent.Event) error) error {
+	for {
+		event, err := eventer.DetailedEventContext(ctx)
+		if err != nil {
+			if errors.Is(err, context.Canceled) {
+				return nil
+			}
+
+			return err
+		}
+
+		if err := writeEvent(w, event); err != nil {
+			return fmt.Errorf("writing event: %w", err)
+		}
+	}
+}
+
+// WriteText writes the event as a single human-readable line.
+func writeText(w io.Writer, event *bpfevent.Event) error {
+	timestamp := event.Time.Format("2006-01-02T15:04:05.000000Z07:00")
+
+	if event.Kind == bpfevent.KindEventsLost {
+		_, err := fmt.Fprintf(w, "%s %s: %d events lost\n", timestamp, event.Kind, event.LostEvents)
+		return err
+	}
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "%s %s %s -> %s %s -> %s pid=%d comm=%q",
+		timestamp,
+		event.Kind,
+		net.JoinHostPort(event.SourceIP.String(), strconv.Itoa(int(event.SourcePort))),
+		net.JoinHostPort(event.DestIP.String(), strconv.Itoa(int(event.DestPort))),
+		event.OldState,
+		event.NewState,
+		event.PIDOnCPU,
+		event.CommandOnCPU)
+
+	if event.SocketInfo != nil {
+		fmt.Fprintf(&b, " uid=%d", event.SocketInfo.UID)
+	}
+
+	if event.ProcessOnCPU != nil {
+		fmt.Fprintf(&b, " exe=%q", event.ProcessOnCPU.Executable)
+	}
+
+	if container := event.SocketContainer; container != nil {
+		fmt.Fprintf(&b, " container=%s", container.ID)
+		if container.PodName != "" {
+			fmt.Fprintf(&b, " pod=%s/%s", container.PodNamespace, container.PodName)
+		}
+	}
+
+	if event.Counters != nil {
+		fmt.Fprintf(&b, " rx=%dB tx=%dB retrans=%d rtt=%v",
+			event.Counters.BytesReceived,
+			event.Counters.BytesAcked,
+			event.Counters.TotalRetransmits,
+			event.Counters.SmoothedRTT)
+	}
+
+	if event.Snapshot {
+		b.WriteString(" (snapshot)")
+	}
+
+	b.WriteByte('\n')
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+// JSONEvent is an event as written by writeJSON, with the kind given by name.
+type jsonEvent struct {
+	*bpfevent.Event
+	Kind string
+}
+
+// WriteJSON writes the event as a single line of JSON.
+func writeJSON(w io.Writer, event *bpfevent.Event) error {
+	return json.NewEncoder(w).Encode(&jsonEvent{
+		Event: event,
+		Kind:  event.Kind.String(),
+	})
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jhwbarlow/tcp-audit-bpf-eventer/pkg/bpfevent"
+	"github.com/jhwbarlow/tcp-audit-common/pkg/event"
+	"github.com/jhwbarlow/tcp-audit-common/pkg/tcpstate"
+)
+
+type mockDetailedEventer struct {
+	eventsToReturn []*bpfevent.Event
+	errorToReturn  error // Returned once all events have been returned
+
+	unpinCalled bool
+}
+
+func newMockDetailedEventer(eventsToReturn []*bpfevent.Event, errorToReturn error) *mockDetailedEventer {
+	return &mockDetailedEventer{
+		eventsToReturn: eventsToReturn,
+		errorToReturn:  errorToReturn,
+	}
+}
+
+func (me *mockDetailedEventer) DetailedEventContext(ctx context.Context) (*bpfevent.Event, error) {
+	if len(me.eventsToReturn) == 0 {
+		return nil, me.errorToReturn
+	}
+
+	event := me.eventsToReturn[0]
+	me.eventsToReturn = me.eventsToReturn[1:]
+
+	return event, nil
+}
+
+func (me *mockDetailedEventer) Close() error {
+	return nil
+}
+
+func (me *mockDetailedEventer) Unpin() error {
+	me.unpinCalled = true
+	return nil
+}
+
+func newMockEvent() *bpfevent.Event {
+	return &bpfevent.Event{
+		Event: event.Event{
+			Time:         time.Date(2021, 10, 1, 12, 0, 0, 0, time.UTC),
+			PIDOnCPU:     1234,
+			CommandOnCPU: "curl",
+			SourceIP:     net.ParseIP("2001:db8::1"),
+			SourcePort:   54321,
+			DestIP:       net.ParseIP("192.0.2.1"),
+			DestPort:     443,
+			OldState:     tcpstate.StateSynSent,
+			NewState:     tcpstate.StateEstablished,
+		},
+		Kind: bpfevent.KindStateChange,
+		SocketContainer: &bpfevent.Container{
+			ID:           "abc123",
+			PodName:      "web",
+			PodNamespace: "default",
+		},
+	}
+}
+
+func TestWriteText(t *testing.T) {
+	var b strings.Builder
+	if err := writeText(&b, newMockEvent()); err != nil {
+		t.Errorf("expected nil error, got %v (of type %T)", err, err)
+	}
+
+	expected := `2021-10-01T12:00:00.000000Z state-change [2001:db8::1]:54321 -> 192.0.2.1:443 SYN-SENT -> ESTABLISHED pid=1234 comm="curl" container=abc123 pod=default/web` + "\n"
+	if b.String() != expected {
+		t.Errorf("expected line %q, got %q", expected, b.String())
+	}
+}
+
+func TestWriteTextEventsLost(t *testing.T) {
+	var b strings.Builder
+	lostEvent := &bpfevent.Event{
+		Event:      event.Event{Time: time.Date(2021, 10, 1, 12, 0, 0, 0, time.UTC)},
+		Kind:       bpfevent.KindEventsLost,
+		LostEvents: 10,
+	}
+	if err := writeText(&b, lostEvent); err != nil {
+		t.Errorf("expected nil error, got %v (of type %T)", err, err)
+	}
+
+	expected := "2021-10-01T12:00:00.000000Z events-lost: 10 events lost\n"
+	if b.String() != expected {
+		t.Errorf("expected line %q, got %q", expected, b.String())
+	}
+}
+
+func TestWriteJSON(t *testing.T) {
+	var b strings.Builder
+	if err := writeJSON(&b, newMockEvent()); err != nil {
+		t.Errorf("expected nil error, got %v (of type %T)", err, err)
+	}
+
+	t.Logf("got JSON %s", b.String())
+
+	if strings.Count(b.String(), "\n") != 1 || !strings.HasSuffix(b.String(), "\n") {
+		t.Errorf("expected a single line, got %q", b.String())
+	}
+
+	var decoded map[string]interface{}
+	if err := json.Unmarshal([]byte(b.String()), &decoded); err != nil {
+		t.Fatalf("expected nil error, got %v (of type %T)", err, err)
+	}
+
+	if decoded["Kind"] != "state-change" {
+		t.Errorf("expected kind %q, got %v", "state-change", decoded["Kind"])
+	}
+
+	if decoded["DestIP"] != "192.0.2.1" {
+		t.Errorf("expected destination IP %q, got %v", "192.0.2.1", decoded["DestIP"])
+	}
+}
+
+func TestTail(t *testing.T) {
+	eventer := newMockDetailedEventer([]*bpfevent.Event{newMockEvent(), newMockEvent()}, context.Canceled)
+
+	var b strings.Builder
+	if err := tail(context.Background(), eventer, &b, writeText); err != nil {
+		t.Errorf("expected nil error, got %v (of type %T)", err, err)
+	}
+
+	if lines := strings.Count(b.String(), "\n"); lines != 2 {
+		t.Errorf("expected %d lines, got %d", 2, lines)
+	}
+}
+
+func TestTailEventerError(t *testing.T) {
+	mockError := errors.New("mock eventer error")
+	eventer := newMockDetailedEventer(nil, mockError)
+
+	var b strings.Builder
+	err := tail(context.Background(), eventer, &b, writeText)
+	if !errors.Is(err, mockError) {
+		t.Errorf("expected error chain to include %q, got %v (of type %T)", mockError, err, err)
+	}
+}
+
+func TestUnpin(t *testing.T) {
+	mockEventer := newMockDetailedEventer(nil, nil)
+
+	if err := unpin(mockEventer); err != nil {
+		t.Errorf("expected nil error, got %v (of type %T)", err, err)
+	}
+
+	if !mockEventer.unpinCalled {
+		t.Error("expected eventer to be unpinned, but was not")
+	}
+}
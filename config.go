@@ -0,0 +1,479 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"golang.org/x/sys/unix"
+)
+
+// Environment variables from which configuration is read. Values set in the
+// environment take precedence over those in the configuration file.
+const (
+	envConfigFile               = "TCP_AUDIT_BPF_CONFIG_FILE"
+	envEventChannelSize         = "TCP_AUDIT_BPF_EVENT_CHANNEL_SIZE"
+	envDroppedEventsChannelSize = "TCP_AUDIT_BPF_DROPPED_EVENTS_CHANNEL_SIZE"
+	envPerfBufSizePages         = "TCP_AUDIT_BPF_PERF_BUF_SIZE_PAGES"
+	envPerfBufMaxSizePages      = "TCP_AUDIT_BPF_PERF_BUF_MAX_SIZE_PAGES"
+	envPerfBufResizeThreshold   = "TCP_AUDIT_BPF_PERF_BUF_RESIZE_THRESHOLD"
+	envModuleName               = "TCP_AUDIT_BPF_MODULE_NAME"
+	envBPFObjectFile            = "TCP_AUDIT_BPF_OBJECT_FILE"
+	envBPFObjectFallback        = "TCP_AUDIT_BPF_OBJECT_FALLBACK"
+	envBTFPath                  = "TCP_AUDIT_BPF_BTF_PATH"
+	envPreflight                = "TCP_AUDIT_BPF_PREFLIGHT"
+	envPinPath                  = "TCP_AUDIT_BPF_PIN_PATH"
+	envDroppedEventHandler      = "TCP_AUDIT_BPF_DROPPED_EVENT_HANDLER"
+	envDroppedEventThreshold    = "TCP_AUDIT_BPF_DROPPED_EVENT_THRESHOLD"
+	envMetricsAddress           = "TCP_AUDIT_BPF_METRICS_ADDRESS"
+	envCgroupRoot               = "TCP_AUDIT_BPF_CGROUP_ROOT"
+	envPodLogDir                = "TCP_AUDIT_BPF_POD_LOG_DIR"
+	envProcRoot                 = "TCP_AUDIT_BPF_PROC_ROOT"
+	envSnapshot                 = "TCP_AUDIT_BPF_SNAPSHOT"
+	envRetransmitEvents         = "TCP_AUDIT_BPF_RETRANSMIT_EVENTS"
+	envResetEvents              = "TCP_AUDIT_BPF_RESET_EVENTS"
+	envRecordFile               = "TCP_AUDIT_BPF_RECORD_FILE"
+	envReplayFile               = "TCP_AUDIT_BPF_REPLAY_FILE"
+	envReplaySpeed              = "TCP_AUDIT_BPF_REPLAY_SPEED"
+	envFilterAllowPorts         = "TCP_AUDIT_BPF_FILTER_ALLOW_PORTS"
+	envFilterDenyPorts          = "TCP_AUDIT_BPF_FILTER_DENY_PORTS"
+	envFilterSourceCIDRs        = "TCP_AUDIT_BPF_FILTER_SOURCE_CIDRS"
+	envFilterDestCIDRs          = "TCP_AUDIT_BPF_FILTER_DEST_CIDRS"
+	envFilterUIDs               = "TCP_AUDIT_BPF_FILTER_UIDS"
+	envFilterGIDs               = "TCP_AUDIT_BPF_FILTER_GIDS"
+	envFilterCommandPrefixes    = "TCP_AUDIT_BPF_FILTER_COMMAND_PREFIXES"
+	envFilterNetNSINodes        = "TCP_AUDIT_BPF_FILTER_NETNS_INODES"
+	envFilterExcludeLoopback    = "TCP_AUDIT_BPF_FILTER_EXCLUDE_LOOPBACK"
+)
+
+// Config holds the configuration of the Eventer. It is read from an optional
+// JSON configuration file and then overridden by any environment variables set.
+type config struct {
+	EventChannelSize         int          `json:"eventChannelSize"`
+	DroppedEventsChannelSize int          `json:"droppedEventsChannelSize"`
+	PerfBufSizePages         int          `json:"perfBufSizePages"`
+	PerfBufMaxSizePages      int          `json:"perfBufMaxSizePages"` // Perf buffer is not resized if zero
+	PerfBufResizeThreshold   uint64       `json:"perfBufResizeThreshold"`
+	ModuleName               string       `json:"moduleName"`
+	BPFObjectFile            string       `json:"bpfObjectFile"`     // Embedded BPF object is used if empty
+	BPFObjectFallback        bool         `json:"bpfObjectFallback"` // Whether to use the embedded BPF object if the file cannot be used
+	BTFPath                  string       `json:"btfPath"`           // Only the kernel's own BTF is used if empty
+	Preflight                bool         `json:"preflight"`         // Whether New checks the environment before loading the BPF
+	PinPath                  string       `json:"pinPath"`           // Maps and links are not pinned if empty
+	DroppedEventHandler      string       `json:"droppedEventHandler"`
+	DroppedEventThreshold    uint64       `json:"droppedEventThreshold"` // Used only by the fail-closed handler, which by default tolerates no dropped events
+	MetricsAddress           string       `json:"metricsAddress"`        // Metrics are not served if empty
+	CgroupRoot               string       `json:"cgroupRoot"`            // Containers are not resolved if empty
+	PodLogDir                string       `json:"podLogDir"`             // Pods are not resolved if empty
+	ProcRoot                 string       `json:"procRoot"`              // Processes are not resolved if empty
+	Snapshot                 bool         `json:"snapshot"`
+	RetransmitEvents         bool         `json:"retransmitEvents"`
+	ResetEvents              bool         `json:"resetEvents"`
+	RecordFile               string       `json:"recordFile"`  // Events are not recorded if empty
+	ReplayFile               string       `json:"replayFile"`  // Events are read from the kernel if empty
+	ReplaySpeed              float64      `json:"replaySpeed"` // Zero replays as quickly as possible
+	Filter                   filterConfig `json:"filter"`
+
+	filter *Filter // Parsed from Filter during validation
+}
+
+// FilterConfig is the serialised form of a Filter.
+type filterConfig struct {
+	AllowPorts      []uint16 `json:"allowPorts"`
+	DenyPorts       []uint16 `json:"denyPorts"`
+	SourceCIDRs     []string `json:"sourceCIDRs"`
+	DestCIDRs       []string `json:"destCIDRs"`
+	UIDs            []uint32 `json:"uids"`
+	GIDs            []uint32 `json:"gids"`
+	CommandPrefixes []string `json:"commandPrefixes"`
+	NetNSINodes     []uint32 `json:"netnsInodes"`
+	ExcludeLoopback bool     `json:"excludeLoopback"`
+}
+
+func defaultConfig() *config {
+	return &config{
+		EventChannelSize:         tcpStateChangeEventChannelSize,
+		DroppedEventsChannelSize: droppedEventsChannelSize,
+		PerfBufSizePages:         tcpStateChangeEventPerfBufSizePages,
+		PerfBufResizeThreshold:   perfBufResizeThreshold,
+		ModuleName:               bpfModuleName,
+		BPFObjectFallback:        true,
+		Preflight:                true,
+		DroppedEventHandler:      loggingDroppedEventHandlerName,
+		PodLogDir:                podLogDir,
+		ReplaySpeed:              1,
+	}
+}
+
+// LoadConfig builds the configuration from the defaults, the configuration file
+// named by the TCP_AUDIT_BPF_CONFIG_FILE environment variable (if set) and the
+// remaining environment variables, in increasing order of precedence. The
+// resultant configuration is validated before being returned.
+func loadConfig(lookupEnv func(key string) (string, bool)) (*config, error) {
+	config := defaultConfig()
+
+	if path, ok := lookupEnv(envConfigFile); ok && path != "" {
+		if err := config.readFile(path); err != nil {
+			return nil, fmt.Errorf("reading configuration file %q: %w", path, err)
+		}
+	}
+
+	if err := config.readEnv(lookupEnv); err != nil {
+		return nil, fmt.Errorf("reading configuration from environment: %w", err)
+	}
+
+	if err := config.validate(); err != nil {
+		return nil, fmt.Errorf("validating configuration: %w", err)
+	}
+
+	return config, nil
+}
+
+func (c *config) readFile(path string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	decoder := json.NewDecoder(file)
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(c); err != nil {
+		return fmt.Errorf("decoding JSON: %w", err)
+	}
+
+	return nil
+}
+
+func (c *config) readEnv(lookupEnv func(key string) (string, bool)) error {
+	intVars := map[string]*int{
+		envEventChannelSize:         &c.EventChannelSize,
+		envDroppedEventsChannelSize: &c.DroppedEventsChannelSize,
+		envPerfBufSizePages:         &c.PerfBufSizePages,
+		envPerfBufMaxSizePages:      &c.PerfBufMaxSizePages,
+	}
+	for key, field := range intVars {
+		if value, ok := lookupEnv(key); ok {
+			i, err := strconv.Atoi(value)
+			if err != nil {
+				return fmt.Errorf("%s: illegal integer %q", key, value)
+			}
+			*field = i
+		}
+	}
+
+	stringVars := map[string]*string{
+		envModuleName:          &c.ModuleName,
+		envBPFObjectFile:       &c.BPFObjectFile,
+		envBTFPath:             &c.BTFPath,
+		envPinPath:             &c.PinPath,
+		envDroppedEventHandler: &c.DroppedEventHandler,
+		envMetricsAddress:      &c.MetricsAddress,
+		envCgroupRoot:          &c.CgroupRoot,
+		envPodLogDir:           &c.PodLogDir,
+		envProcRoot:            &c.ProcRoot,
+		envRecordFile:          &c.RecordFile,
+		envReplayFile:          &c.ReplayFile,
+	}
+	for key, field := range stringVars {
+		if value, ok := lookupEnv(key); ok {
+			*field = value
+		}
+	}
+
+	uintVars := map[string]*uint64{
+		envPerfBufResizeThreshold: &c.PerfBufResizeThreshold,
+		envDroppedEventThreshold:  &c.DroppedEventThreshold,
+	}
+	for key, field := range uintVars {
+		if value, ok := lookupEnv(key); ok {
+			u, err := strconv.ParseUint(value, 10, 64)
+			if err != nil {
+				return fmt.Errorf("%s: illegal unsigned integer %q", key, value)
+			}
+			*field = u
+		}
+	}
+
+	if value, ok := lookupEnv(envReplaySpeed); ok {
+		f, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			return fmt.Errorf("%s: illegal number %q", envReplaySpeed, value)
+		}
+		c.ReplaySpeed = f
+	}
+
+	listVars := map[string]*[]string{
+		envFilterSourceCIDRs:     &c.Filter.SourceCIDRs,
+		envFilterDestCIDRs:       &c.Filter.DestCIDRs,
+		envFilterCommandPrefixes: &c.Filter.CommandPrefixes,
+	}
+	for key, field := range listVars {
+		if value, ok := lookupEnv(key); ok {
+			*field = splitList(value)
+		}
+	}
+
+	portVars := map[string]*[]uint16{
+		envFilterAllowPorts: &c.Filter.AllowPorts,
+		envFilterDenyPorts:  &c.Filter.DenyPorts,
+	}
+	for key, field := range portVars {
+		if value, ok := lookupEnv(key); ok {
+			ports, err := parseUintList(value, 16)
+			if err != nil {
+				return fmt.Errorf("%s: %w", key, err)
+			}
+
+			*field = make([]uint16, 0, len(ports))
+			for _, port := range ports {
+				*field = append(*field, uint16(port))
+			}
+		}
+	}
+
+	idVars := map[string]*[]uint32{
+		envFilterUIDs:        &c.Filter.UIDs,
+		envFilterGIDs:        &c.Filter.GIDs,
+		envFilterNetNSINodes: &c.Filter.NetNSINodes,
+	}
+	for key, field := range idVars {
+		if value, ok := lookupEnv(key); ok {
+			ids, err := parseUintList(value, 32)
+			if err != nil {
+				return fmt.Errorf("%s: %w", key, err)
+			}
+
+			*field = make([]uint32, 0, len(ids))
+			for _, id := range ids {
+				*field = append(*field, uint32(id))
+			}
+		}
+	}
+
+	boolVars := map[string]*bool{
+		envBPFObjectFallback:     &c.BPFObjectFallback,
+		envPreflight:             &c.Preflight,
+		envSnapshot:              &c.Snapshot,
+		envRetransmitEvents:      &c.RetransmitEvents,
+		envResetEvents:           &c.ResetEvents,
+		envFilterExcludeLoopback: &c.Filter.ExcludeLoopback,
+	}
+	for key, field := range boolVars {
+		if value, ok := lookupEnv(key); ok {
+			b, err := strconv.ParseBool(value)
+			if err != nil {
+				return fmt.Errorf("%s: illegal boolean %q", key, value)
+			}
+			*field = b
+		}
+	}
+
+	return nil
+}
+
+func (c *config) validate() error {
+	if c.EventChannelSize <= 0 {
+		return fmt.Errorf("event channel size must be positive, got %d", c.EventChannelSize)
+	}
+
+	if c.DroppedEventsChannelSize <= 0 {
+		return fmt.Errorf("dropped events channel size must be positive, got %d", c.DroppedEventsChannelSize)
+	}
+
+	// libbpf requires the number of perf buffer pages to be a power of 2
+	if c.PerfBufSizePages <= 0 || c.PerfBufSizePages&(c.PerfBufSizePages-1) != 0 {
+		return fmt.Errorf("perf buffer size must be a positive power of 2 pages, got %d", c.PerfBufSizePages)
+	}
+
+	if c.PerfBufMaxSizePages != 0 {
+		if c.PerfBufMaxSizePages < c.PerfBufSizePages || c.PerfBufMaxSizePages&(c.PerfBufMaxSizePages-1) != 0 {
+			return fmt.Errorf("maximum perf buffer size must be a power of 2 pages no less than the perf buffer size, got %d",
+				c.PerfBufMaxSizePages)
+		}
+
+		if c.PerfBufResizeThreshold == 0 {
+			return errors.New("perf buffer resize threshold must be positive")
+		}
+	}
+
+	if c.ModuleName == "" {
+		return errors.New("BPF module name must not be empty")
+	}
+
+	if !isDroppedEventHandlerName(c.DroppedEventHandler) {
+		return fmt.Errorf("unknown dropped event handler %q", c.DroppedEventHandler)
+	}
+
+	if c.RecordFile != "" && c.ReplayFile != "" {
+		return errors.New("events cannot be both recorded and replayed")
+	}
+
+	if c.ReplayFile != "" && c.Snapshot {
+		return errors.New("a snapshot cannot be taken while replaying events")
+	}
+
+	if c.PinPath != "" && !filepath.IsAbs(c.PinPath) {
+		return fmt.Errorf("pin path must be absolute, got %q", c.PinPath)
+	}
+
+	if c.ReplaySpeed < 0 || math.IsNaN(c.ReplaySpeed) || math.IsInf(c.ReplaySpeed, 0) {
+		return fmt.Errorf("replay speed must be a non-negative number, got %v", c.ReplaySpeed)
+	}
+
+	filter, err := c.Filter.toFilter()
+	if err != nil {
+		return fmt.Errorf("parsing filter: %w", err)
+	}
+
+	if err := filter.validate(); err != nil {
+		return fmt.Errorf("validating filter: %w", err)
+	}
+	c.filter = filter
+
+	return nil
+}
+
+// BPFObjectLoader returns the loader of the configured BPF object, built for the
+// given transport.
+func (c *config) bpfObjectLoader(transport bpfEventTransport) bpfObjectLoader {
+	embeddedLoader := newEmbeddedBPFObjectLoader(transport)
+	if c.BPFObjectFile == "" {
+		return embeddedLoader
+	}
+
+	fileLoader := newFileBPFObjectLoader(c.BPFObjectFile, transport)
+	if !c.BPFObjectFallback {
+		return fileLoader
+	}
+
+	return newChainBPFObjectLoader(fileLoader, embeddedLoader)
+}
+
+// BTFLocator returns the locator of the configured external BTF, or nil if only
+// the kernel's own BTF is to be used.
+func (c *config) btfLocator() btfLocator {
+	if c.BTFPath == "" {
+		return nil
+	}
+
+	return newFSBTFLocator(c.BTFPath)
+}
+
+// PreflightChecker returns a checker of the requirements of loading the BPF
+// programs as configured, and attaching them using the given mode.
+func (c *config) preflightChecker(attachMode bpfAttachMode) *preflightChecker {
+	tracepoints := []string{tcpStateChangeTracepointName}
+	for _, attachment := range c.extraAttachments() {
+		tracepoints = append(tracepoints, attachment.tracepointName)
+	}
+
+	return newPreflightChecker(c.btfLocator(), tracepoints, attachMode == tracepointAttachMode)
+}
+
+// CapabilityRequirements returns the requirements for capabilities of the
+// configured features of the Eventer which remain once the BPF has been loaded
+// using the given transport.
+func (c *config) capabilityRequirements(transport bpfEventTransport) []capabilityRequirement {
+	// The filter maps are rewritten by SetFilter, which may be called at any time.
+	// The dropped events map of the ring buffer is polled, and the perf event array
+	// updated when the perf buffer is resized. Each of these calls bpf(), which
+	// requires a capability when unprivileged BPF is disabled.
+	requirements := []capabilityRequirement{{unix.CAP_BPF, unix.CAP_SYS_ADMIN}}
+
+	// Resizing the perf buffer opens a perf event for each CPU
+	if transport == perfBufTransport && c.PerfBufMaxSizePages > c.PerfBufSizePages {
+		requirements = append(requirements, capabilityRequirement{unix.CAP_PERFMON, unix.CAP_SYS_ADMIN})
+	}
+
+	// Resolving the executable of a process of another user requires ptrace access
+	if c.ProcRoot != "" {
+		requirements = append(requirements, capabilityRequirement{unix.CAP_SYS_PTRACE})
+	}
+
+	return requirements
+}
+
+// ExtraAttachments returns the attachments of the BPF programs required to emit
+// the configured kinds of event other than state changes.
+func (c *config) extraAttachments() []tracepointAttachment {
+	var attachments []tracepointAttachment
+	if c.RetransmitEvents {
+		attachments = append(attachments, retransmitAttachments...)
+	}
+
+	if c.ResetEvents {
+		attachments = append(attachments, resetAttachments...)
+	}
+
+	return attachments
+}
+
+func (fc *filterConfig) toFilter() (*Filter, error) {
+	sourceCIDRs, err := parseCIDRs(fc.SourceCIDRs)
+	if err != nil {
+		return nil, fmt.Errorf("parsing source CIDRs: %w", err)
+	}
+
+	destCIDRs, err := parseCIDRs(fc.DestCIDRs)
+	if err != nil {
+		return nil, fmt.Errorf("parsing destination CIDRs: %w", err)
+	}
+
+	return &Filter{
+		AllowPorts:      fc.AllowPorts,
+		DenyPorts:       fc.DenyPorts,
+		SourceCIDRs:     sourceCIDRs,
+		DestCIDRs:       destCIDRs,
+		UIDs:            fc.UIDs,
+		GIDs:            fc.GIDs,
+		CommandPrefixes: fc.CommandPrefixes,
+		NetNSINodes:     fc.NetNSINodes,
+		ExcludeLoopback: fc.ExcludeLoopback,
+	}, nil
+}
+
+func parseCIDRs(cidrStrings []string) ([]*net.IPNet, error) {
+	cidrs := make([]*net.IPNet, 0, len(cidrStrings))
+	for _, cidrString := range cidrStrings {
+		_, cidr, err := net.ParseCIDR(cidrString)
+		if err != nil {
+			return nil, err
+		}
+		cidrs = append(cidrs, cidr)
+	}
+
+	return cidrs, nil
+}
+
+// SplitList splits a comma-separated list, ignoring whitespace and empty items.
+func splitList(value string) []string {
+	var items []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+
+	return items
+}
+
+func parseUintList(value string, bitSize int) ([]uint64, error) {
+	items := splitList(value)
+	uints := make([]uint64, 0, len(items))
+	for _, item := range items {
+		u, err := strconv.ParseUint(item, 10, bitSize)
+		if err != nil {
+			return nil, fmt.Errorf("illegal %d-bit unsigned integer %q", bitSize, item)
+		}
+		uints = append(uints, u)
+	}
+
+	return uints, nil
+}
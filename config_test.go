@@ -0,0 +1,257 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func newMockLookupEnv(env map[string]string) func(key string) (string, bool) {
+	return func(key string) (string, bool) {
+		value, ok := env[key]
+		return value, ok
+	}
+}
+
+func writeMockConfigFile(t *testing.T, contents string) string {
+	path := filepath.Join(t.TempDir(), "config.json")
+	if err := os.WriteFile(path, []byte(contents), 0600); err != nil {
+		t.Fatalf("writing mock config file: %v", err)
+	}
+
+	return path
+}
+
+func TestLoadConfigDefaults(t *testing.T) {
+	config, err := loadConfig(newMockLookupEnv(nil))
+	if err != nil {
+		t.Errorf("expected nil error, got %v (of type %T)", err, err)
+	}
+
+	if config.EventChannelSize != tcpStateChangeEventChannelSize {
+		t.Errorf("expected event channel size %d, got %d", tcpStateChangeEventChannelSize, config.EventChannelSize)
+	}
+
+	if config.DroppedEventsChannelSize != droppedEventsChannelSize {
+		t.Errorf("expected dropped events channel size %d, got %d", droppedEventsChannelSize, config.DroppedEventsChannelSize)
+	}
+
+	if config.PerfBufSizePages != tcpStateChangeEventPerfBufSizePages {
+		t.Errorf("expected perf buffer size %d, got %d", tcpStateChangeEventPerfBufSizePages, config.PerfBufSizePages)
+	}
+
+	if config.ModuleName != bpfModuleName {
+		t.Errorf("expected module name %q, got %q", bpfModuleName, config.ModuleName)
+	}
+
+	if config.DroppedEventHandler != loggingDroppedEventHandlerName {
+		t.Errorf("expected dropped event handler %q, got %q", loggingDroppedEventHandlerName, config.DroppedEventHandler)
+	}
+
+	if config.CgroupRoot != "" {
+		t.Errorf("expected container attribution to be disabled, got cgroup root %q", config.CgroupRoot)
+	}
+
+	if config.filter == nil || config.filter.flags() != 0 {
+		t.Error("expected empty filter, but was not")
+	}
+}
+
+func TestLoadConfigFileAndEnvironment(t *testing.T) {
+	path := writeMockConfigFile(t, `{
+		"eventChannelSize": 2048,
+		"perfBufSizePages": 32,
+		"perfBufMaxSizePages": 256,
+		"moduleName": "from-file",
+		"resetEvents": true,
+		"droppedEventHandler": "fail-closed",
+		"filter": {
+			"denyPorts": [22],
+			"sourceCIDRs": ["10.0.0.0/8"],
+			"excludeLoopback": true
+		}
+	}`)
+
+	config, err := loadConfig(newMockLookupEnv(map[string]string{
+		envConfigFile:             path,
+		envPerfBufSizePages:       "64",
+		envModuleName:             "from-env",
+		envFilterAllowPorts:       "443, 8443",
+		envFilterUIDs:             "1000",
+		envFilterCommandPrefixes:  "postgres,nginx",
+		envFilterNetNSINodes:      "4026531992",
+		envRetransmitEvents:       "true",
+		envDroppedEventThreshold:  "100",
+		envPerfBufResizeThreshold: "50",
+	}))
+	if err != nil {
+		t.Errorf("expected nil error, got %v (of type %T)", err, err)
+	}
+
+	// Set in file only
+	if config.EventChannelSize != 2048 {
+		t.Errorf("expected event channel size %d, got %d", 2048, config.EventChannelSize)
+	}
+
+	if config.PerfBufMaxSizePages != 256 {
+		t.Errorf("expected maximum perf buffer size %d, got %d", 256, config.PerfBufMaxSizePages)
+	}
+
+	// Set in both file and environment, environment should take precedence
+	if config.PerfBufSizePages != 64 {
+		t.Errorf("expected perf buffer size %d, got %d", 64, config.PerfBufSizePages)
+	}
+
+	if config.ModuleName != "from-env" {
+		t.Errorf("expected module name %q, got %q", "from-env", config.ModuleName)
+	}
+
+	if config.DroppedEventHandler != failClosedDroppedEventHandlerName {
+		t.Errorf("expected dropped event handler %q, got %q", failClosedDroppedEventHandlerName, config.DroppedEventHandler)
+	}
+
+	// Set in environment only
+	if config.PerfBufResizeThreshold != 50 {
+		t.Errorf("expected perf buffer resize threshold %d, got %d", 50, config.PerfBufResizeThreshold)
+	}
+
+	if config.DroppedEventThreshold != 100 {
+		t.Errorf("expected dropped event threshold %d, got %d", 100, config.DroppedEventThreshold)
+	}
+
+	// Set in neither, default should be used
+	if config.DroppedEventsChannelSize != droppedEventsChannelSize {
+		t.Errorf("expected dropped events channel size %d, got %d", droppedEventsChannelSize, config.DroppedEventsChannelSize)
+	}
+
+	if attachments := config.extraAttachments(); len(attachments) != len(retransmitAttachments)+len(resetAttachments) {
+		t.Errorf("expected retransmit and reset tracepoint attachments, got %v", attachments)
+	}
+
+	filter := config.filter
+	if len(filter.AllowPorts) != 2 || filter.AllowPorts[0] != 443 || filter.AllowPorts[1] != 8443 {
+		t.Errorf("expected allowed ports [443 8443], got %v", filter.AllowPorts)
+	}
+
+	if len(filter.DenyPorts) != 1 || filter.DenyPorts[0] != 22 {
+		t.Errorf("expected denied ports [22], got %v", filter.DenyPorts)
+	}
+
+	_, expectedCIDR, _ := net.ParseCIDR("10.0.0.0/8")
+	if len(filter.SourceCIDRs) != 1 || filter.SourceCIDRs[0].String() != expectedCIDR.String() {
+		t.Errorf("expected source CIDRs [%v], got %v", expectedCIDR, filter.SourceCIDRs)
+	}
+
+	if len(filter.UIDs) != 1 || filter.UIDs[0] != 1000 {
+		t.Errorf("expected UIDs [1000], got %v", filter.UIDs)
+	}
+
+	if len(filter.CommandPrefixes) != 2 || filter.CommandPrefixes[0] != "postgres" || filter.CommandPrefixes[1] != "nginx" {
+		t.Errorf("expected command prefixes [postgres nginx], got %v", filter.CommandPrefixes)
+	}
+
+	if len(filter.NetNSINodes) != 1 || filter.NetNSINodes[0] != 4026531992 {
+		t.Errorf("expected network namespaces [4026531992], got %v", filter.NetNSINodes)
+	}
+
+	if !filter.ExcludeLoopback {
+		t.Error("expected loopback to be excluded, but was not")
+	}
+}
+
+func TestLoadConfigError(t *testing.T) {
+	tests := [...]struct {
+		name string
+		env  map[string]string
+	}{
+		{"non-integer channel size", map[string]string{envEventChannelSize: "big"}},
+		{"zero channel size", map[string]string{envEventChannelSize: "0"}},
+		{"negative dropped events channel size", map[string]string{envDroppedEventsChannelSize: "-1"}},
+		{"non-power of 2 perf buffer size", map[string]string{envPerfBufSizePages: "24"}},
+		{"maximum perf buffer size below perf buffer size", map[string]string{envPerfBufMaxSizePages: "8"}},
+		{"non-power of 2 maximum perf buffer size", map[string]string{envPerfBufMaxSizePages: "48"}},
+		{"zero perf buffer resize threshold", map[string]string{envPerfBufMaxSizePages: "64", envPerfBufResizeThreshold: "0"}},
+		{"empty module name", map[string]string{envModuleName: ""}},
+		{"unknown dropped event handler", map[string]string{envDroppedEventHandler: "ignore"}},
+		{"negative dropped event threshold", map[string]string{envDroppedEventThreshold: "-1"}},
+		{"port out of range", map[string]string{envFilterAllowPorts: "65536"}},
+		{"negative UID", map[string]string{envFilterUIDs: "-1"}},
+		{"non-integer network namespace", map[string]string{envFilterNetNSINodes: "host"}},
+		{"illegal CIDR", map[string]string{envFilterDestCIDRs: "10.0.0.0/33"}},
+		{"illegal command prefix", map[string]string{envFilterCommandPrefixes: "a-very-long-command"}},
+		{"record and replay", map[string]string{envRecordFile: "/tmp/a", envReplayFile: "/tmp/b"}},
+		{"replay and snapshot", map[string]string{envReplayFile: "/tmp/b", envSnapshot: "true"}},
+		{"negative replay speed", map[string]string{envReplaySpeed: "-1"}},
+		{"non-numeric replay speed", map[string]string{envReplaySpeed: "fast"}},
+		{"non-boolean snapshot", map[string]string{envSnapshot: "maybe"}},
+		{"non-boolean preflight", map[string]string{envPreflight: "perhaps"}},
+		{"relative pin path", map[string]string{envPinPath: "tcp-audit"}},
+		{"non-boolean reset events", map[string]string{envResetEvents: "often"}},
+		{"non-boolean loopback exclusion", map[string]string{envFilterExcludeLoopback: "sometimes"}},
+		{"missing config file", map[string]string{envConfigFile: "/nonexistent/config.json"}},
+		{"unknown config file field", map[string]string{envConfigFile: writeMockConfigFile(t, `{"eventChanelSize": 1}`)}},
+		{"malformed config file", map[string]string{envConfigFile: writeMockConfigFile(t, `{`)}},
+	}
+
+	for _, test := range tests {
+		_, err := loadConfig(newMockLookupEnv(test.env))
+		if err == nil {
+			t.Errorf("%s: expected error, got nil", test.name)
+		}
+
+		t.Logf("%s: got error %q (of type %T)", test.name, err, err)
+	}
+}
+
+func TestConfigBPFObjectLoader(t *testing.T) {
+	tests := []struct {
+		name         string
+		env          map[string]string
+		expectedType string
+	}{
+		{"embedded", nil, "*main.embeddedBPFObjectLoader"},
+		{"file with fallback", map[string]string{envBPFObjectFile: "/tmp/bpf.o"}, "*main.chainBPFObjectLoader"},
+		{"file only", map[string]string{envBPFObjectFile: "/tmp/bpf.o", envBPFObjectFallback: "false"}, "*main.fileBPFObjectLoader"},
+	}
+
+	for _, test := range tests {
+		config, err := loadConfig(newMockLookupEnv(test.env))
+		if err != nil {
+			t.Errorf("%s: expected nil error, got %v (of type %T)", test.name, err, err)
+			continue
+		}
+
+		if loader := config.bpfObjectLoader(perfBufTransport); fmt.Sprintf("%T", loader) != test.expectedType {
+			t.Errorf("%s: expected BPF object loader of type %s, got %T", test.name, test.expectedType, loader)
+		}
+	}
+}
+
+func TestConfigCapabilityRequirements(t *testing.T) {
+	tests := []struct {
+		name      string
+		env       map[string]string
+		transport bpfEventTransport
+		expected  string
+	}{
+		{"perf buffer", nil, perfBufTransport, "[[CAP_BPF CAP_SYS_ADMIN]]"},
+		{"ring buffer", nil, ringBufTransport, "[[CAP_BPF CAP_SYS_ADMIN]]"},
+		{"resizable perf buffer", map[string]string{envPerfBufMaxSizePages: "64"}, perfBufTransport, "[[CAP_BPF CAP_SYS_ADMIN] [CAP_PERFMON CAP_SYS_ADMIN]]"},
+		{"ring buffer with perf buffer maximum size", map[string]string{envPerfBufMaxSizePages: "64"}, ringBufTransport, "[[CAP_BPF CAP_SYS_ADMIN]]"},
+		{"process enrichment", map[string]string{envProcRoot: "/proc"}, perfBufTransport, "[[CAP_BPF CAP_SYS_ADMIN] [CAP_SYS_PTRACE]]"},
+	}
+
+	for _, test := range tests {
+		config, err := loadConfig(newMockLookupEnv(test.env))
+		if err != nil {
+			t.Errorf("%s: expected nil error, got %v (of type %T)", test.name, err, err)
+			continue
+		}
+
+		if requirements := config.capabilityRequirements(test.transport); fmt.Sprint(requirements) != test.expected {
+			t.Errorf("%s: expected capability requirements %s, got %v", test.name, test.expected, requirements)
+		}
+	}
+}
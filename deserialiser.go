@@ -9,51 +9,108 @@ import (
 	"time"
 	"unsafe"
 
+	"github.com/jhwbarlow/tcp-audit-bpf-eventer/pkg/bpfevent"
 	"github.com/jhwbarlow/tcp-audit-common/pkg/event"
 	"github.com/jhwbarlow/tcp-audit-common/pkg/socketstate"
 
 	"C"
 )
 
+// Causes of deserialisation errors
+const (
+	deserialisationErrorCauseDecode        = "decode"
+	deserialisationErrorCauseTCPState      = "tcp_state"
+	deserialisationErrorCauseSocketState   = "socket_state"
+	deserialisationErrorCauseAddressFamily = "address_family"
+	deserialisationErrorCauseEventKind     = "event_kind"
+)
+
+// DeserialisationError is returned when event data cannot be deserialised.
+// It records the cause of the failure, so that failures can be categorised.
+type deserialisationError struct {
+	cause string
+	err   error
+}
+
+func newDeserialisationError(cause string, err error) *deserialisationError {
+	return &deserialisationError{
+		cause: cause,
+		err:   err,
+	}
+}
+
+func (e *deserialisationError) Error() string {
+	return e.err.Error()
+}
+
+func (e *deserialisationError) Unwrap() error {
+	return e.err
+}
+
 // Deserialiser is an interface which describes objects which convert a byte
 // slice containing a TCP state-change event into an event object.
 type deserialiser interface {
-	toEvent(data []byte) (*event.Event, error)
+	toEvent(data []byte) (*bpfevent.Event, error)
 }
 
 // CStructDeserialiser converts a byte slice containing a C-struct representing
 // a BPF TCP state-change event into a TCP state-change event.
 type cStructDeserialiser struct {
-	endianess binary.ByteOrder
+	endianess     binary.ByteOrder
+	timeConverter kernelTimeConverter
 }
 
-func newCStructDeserialiser(endianess binary.ByteOrder) *cStructDeserialiser {
-	return &cStructDeserialiser{endianess}
+func newCStructDeserialiser(endianess binary.ByteOrder,
+	timeConverter kernelTimeConverter) *cStructDeserialiser {
+	return &cStructDeserialiser{
+		endianess:     endianess,
+		timeConverter: timeConverter,
+	}
 }
 
 // ToEvent creates a TCP state-change event object from the supplied byte
 // slice containing the C-struct data.
-func (d *cStructDeserialiser) toEvent(eventData []byte) (*event.Event, error) {
-	time := time.Now().UTC()
-
+func (d *cStructDeserialiser) toEvent(eventData []byte) (*bpfevent.Event, error) {
 	rawEvent := new(rawEvent)
 	if err := binary.Read(bytes.NewBuffer(eventData), d.endianess, rawEvent); err != nil {
-		return nil, fmt.Errorf("decoding event data: %w", err)
+		return nil, newDeserialisationError(deserialisationErrorCauseDecode,
+			fmt.Errorf("decoding event data: %w", err))
+	}
+
+	kind, err := convertKind(rawEvent.Kind)
+	if err != nil {
+		return nil, newDeserialisationError(deserialisationErrorCauseEventKind,
+			fmt.Errorf("converting event kind: %w", err))
 	}
 
 	oldState, err := convertState(rawEvent.OldState)
 	if err != nil {
-		return nil, fmt.Errorf("converting kernel old TCP state: %w", err)
+		return nil, newDeserialisationError(deserialisationErrorCauseTCPState,
+			fmt.Errorf("converting kernel old TCP state: %w", err))
 	}
 
 	newState, err := convertState(rawEvent.NewState)
 	if err != nil {
-		return nil, fmt.Errorf("converting kernel new TCP state: %w", err)
+		return nil, newDeserialisationError(deserialisationErrorCauseTCPState,
+			fmt.Errorf("converting kernel new TCP state: %w", err))
 	}
 
 	socketState, err := socketstate.FromInt(rawEvent.SockState)
 	if err != nil {
-		return nil, fmt.Errorf("converting socket state: %w", err)
+		return nil, newDeserialisationError(deserialisationErrorCauseSocketState,
+			fmt.Errorf("converting socket state: %w", err))
+	}
+
+	srcIP, err := convertAddr(rawEvent.Family, rawEvent.SrcAddr)
+	if err != nil {
+		return nil, newDeserialisationError(deserialisationErrorCauseAddressFamily,
+			fmt.Errorf("converting source address: %w", err))
+	}
+
+	dstIP, err := convertAddr(rawEvent.Family, rawEvent.DstAddr)
+	if err != nil {
+		return nil, newDeserialisationError(deserialisationErrorCauseAddressFamily,
+			fmt.Errorf("converting destination address: %w", err))
 	}
 
 	socketInfo := &event.SocketInfo{
@@ -64,18 +121,77 @@ func (d *cStructDeserialiser) toEvent(eventData []byte) (*event.Event, error) {
 		SocketState: socketState,
 	}
 
-	event := &event.Event{
-		Time:         time,
-		PIDOnCPU:     int(rawEvent.PIDOnCPU),
-		CommandOnCPU: C.GoString((*C.char)(unsafe.Pointer(&rawEvent.CommOnCPU))),
-		SourceIP:     net.IP(rawEvent.SrcAddr[:]),
-		DestIP:       net.IP(rawEvent.DstAddr[:]),
-		SourcePort:   rawEvent.SrcPort,
-		DestPort:     rawEvent.DstPort,
-		OldState:     oldState,
-		NewState:     newState,
-		SocketInfo:   socketInfo,
+	event := &bpfevent.Event{
+		Event: event.Event{
+			Time:         d.timeConverter.toTime(rawEvent.TimestampNs),
+			PIDOnCPU:     int(rawEvent.PIDOnCPU),
+			CommandOnCPU: C.GoString((*C.char)(unsafe.Pointer(&rawEvent.CommOnCPU))),
+			SourceIP:     srcIP,
+			DestIP:       dstIP,
+			SourcePort:   rawEvent.SrcPort,
+			DestPort:     rawEvent.DstPort,
+			OldState:     oldState,
+			NewState:     newState,
+			SocketInfo:   socketInfo,
+		},
+		Kind:           kind,
+		TIDOnCPU:       int(rawEvent.TIDOnCPU),
+		UIDOnCPU:       rawEvent.UIDOnCPU,
+		GIDOnCPU:       rawEvent.GIDOnCPU,
+		ParentPIDOnCPU: int(rawEvent.ParentPIDOnCPU),
+		CgroupIDOnCPU:  rawEvent.CgroupIDOnCPU,
+		SocketCgroupID: rawEvent.SocketCgroupID,
+		NetNSINode:     rawEvent.NetNSINode,
+	}
+
+	if kind == bpfevent.KindStateChange && rawEvent.NewState == TCPClose {
+		event.Counters = &bpfevent.Counters{
+			BytesReceived:    rawEvent.BytesReceived,
+			BytesAcked:       rawEvent.BytesAcked,
+			SegmentsIn:       rawEvent.SegmentsIn,
+			SegmentsOut:      rawEvent.SegmentsOut,
+			TotalRetransmits: rawEvent.TotalRetransmits,
+			SmoothedRTT:      time.Duration(rawEvent.SmoothedRTTUs>>3) * time.Microsecond,
+		}
 	}
 
 	return event, nil
 }
+
+func convertKind(kind uint8) (bpfevent.Kind, error) {
+	switch kind {
+	case eventKindStateChange:
+		return bpfevent.KindStateChange, nil
+	case eventKindRetransmit:
+		return bpfevent.KindRetransmit, nil
+	case eventKindSendReset:
+		return bpfevent.KindSendReset, nil
+	case eventKindReceiveReset:
+		return bpfevent.KindReceiveReset, nil
+	default:
+		return bpfevent.KindStateChange, fmt.Errorf("illegal event kind: %d", kind)
+	}
+}
+
+// ConvertAddr converts the raw address data from the kernel into an IP address
+// according to the address family. IPv4 addresses are returned in their 4-byte
+// form, and IPv6 addresses in their 16-byte form, unless they are IPv4-mapped
+// IPv6 addresses, which are normalised to the 4-byte IPv4 form.
+func convertAddr(family uint16, addr [16]uint8) (net.IP, error) {
+	switch family {
+	case afINET:
+		ip := make(net.IP, net.IPv4len)
+		copy(ip, addr[:net.IPv4len])
+		return ip, nil
+	case afINET6:
+		ip := make(net.IP, net.IPv6len)
+		copy(ip, addr[:])
+		if ipv4 := ip.To4(); ipv4 != nil {
+			return ipv4, nil
+		}
+
+		return ip, nil
+	default:
+		return nil, fmt.Errorf("illegal address family: %d", family)
+	}
+}
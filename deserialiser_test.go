@@ -6,11 +6,30 @@ import (
 	"testing"
 	"time"
 
+	"github.com/jhwbarlow/tcp-audit-bpf-eventer/pkg/bpfevent"
 	"github.com/jhwbarlow/tcp-audit-common/pkg/event"
 	"github.com/jhwbarlow/tcp-audit-common/pkg/socketstate"
 	"github.com/jhwbarlow/tcp-audit-common/pkg/tcpstate"
 )
 
+type mockKernelTimeConverter struct {
+	timeToReturn time.Time
+
+	toTimeCalled         bool
+	receivedKernelTimeNs uint64
+}
+
+func newMockKernelTimeConverter(timeToReturn time.Time) *mockKernelTimeConverter {
+	return &mockKernelTimeConverter{timeToReturn: timeToReturn}
+}
+
+func (mc *mockKernelTimeConverter) toTime(kernelTimeNs uint64) time.Time {
+	mc.toTimeCalled = true
+	mc.receivedKernelTimeNs = kernelTimeNs
+
+	return mc.timeToReturn
+}
+
 func TestDeserialiseToEvent(t *testing.T) {
 	timeNow := time.Now().UTC()
 	mockEvent := &event.Event{
@@ -35,36 +54,217 @@ func TestDeserialiseToEvent(t *testing.T) {
 	/*
 			char comm_on_cpu[TASK_COMM_LEN];
 		__u64 sock_addr;
+		__u64 timestamp_ns;
+		__u64 cgroup_id_on_cpu;
+		__u64 sock_cgroup_id;
+		__u64 bytes_received;
+		__u64 bytes_acked;
+		__u32 pid_on_cpu;
+		__u32 tid_on_cpu;
+		__u32 uid_on_cpu;
+		__u32 gid_on_cpu;
+		__u32 ppid_on_cpu;
+		__u32 sock_inode;
+		__u32 sock_uid;
+		__u32 sock_gid;
+		__u32 netns_inode;
+		__u32 segs_in;
+		__u32 segs_out;
+		__u32 total_retrans;
+		__u32 srtt_us;
+		__s32 old_state;
+		__s32 new_state;
+		__u16 src_port;
+		__u16 dst_port;
+		__u16 family;
+		__u8 src_addr[16];
+		__u8 dst_addr[16];
+		__u8 sock_state;
+		__u8 kind;
+	*/
+	mockEventData := []byte{
+		0x70, 0x6F, 0x73, 0x74, 0x67, 0x72, 0x65, 0x73, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, // ASCII "postgres"
+		0x00, 0x69, 0x0B, 0x71, 0x45, 0x9E, 0xFF, 0xFF, // 0xffff9e45710b6900 little endian
+		0x00, 0xE4, 0x0B, 0x54, 0x02, 0x00, 0x00, 0x00, // 10000000000 little endian
+		0x39, 0x30, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, // 12345 little endian
+		0x31, 0xD4, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, // 54321 little endian
+		0xE8, 0x03, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, // 1000 little endian
+		0xD0, 0x07, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, // 2000 little endian
+		0xAB, 0xD8, 0x03, 0x00, // 252075 little endian
+		0xAC, 0xD8, 0x03, 0x00, // 252076 little endian
+		0xE7, 0x03, 0x00, 0x00, // 999 little endian
+		0xE6, 0x03, 0x00, 0x00, // 998 little endian
+		0x01, 0x00, 0x00, 0x00, // 1 little endian
+		0x00, 0x00, 0x00, 0x00, // 0 little endian
+		0x00, 0x00, 0x00, 0x00, // 0 little endian
+		0x00, 0x00, 0x00, 0x00, // 0 little endian
+		0x98, 0x00, 0x00, 0xF0, // 4026531992 little endian
+		0x0A, 0x00, 0x00, 0x00, // 10 little endian
+		0x0C, 0x00, 0x00, 0x00, // 12 little endian
+		0x01, 0x00, 0x00, 0x00, // 1 little endian
+		0x40, 0x1F, 0x00, 0x00, // 8000 little endian (1ms left-shifted by 3)
+		0x09, 0x00, 0x00, 0x00, // 9 little endian (LAST-ACK)
+		0x07, 0x00, 0x00, 0x00, // 7 little endian (CLOSED)
+		0x38, 0x15, // 5432 little endian
+		0x7C, 0xD8, // 55420 little endian
+		0x02, 0x00, // 2 little endian (AF_INET)
+		0xAC, 0x11, 0x00, 0x02, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, // 172.17.0.2 big endian
+		0xAC, 0x11, 0x00, 0x03, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, // 172.17.0.3 big endian
+		0x00, // 0 (FREE)
+		0x00, // 0 (state change)
+	}
+
+	mockTimeConverter := newMockKernelTimeConverter(timeNow)
+	deserialiser := newCStructDeserialiser(binary.LittleEndian, mockTimeConverter)
+
+	event, err := deserialiser.toEvent(mockEventData)
+	if err != nil {
+		t.Errorf("expected nil error, got %v (of type %T)", err, err)
+	}
+
+	t.Logf("got event %q", event)
+
+	if !mockTimeConverter.toTimeCalled {
+		t.Error("expected kernel time converter to be called, but was not")
+	}
+
+	if mockTimeConverter.receivedKernelTimeNs != 10000000000 {
+		t.Errorf("expected kernel time converter to receive kernel time %d, but received %d",
+			10000000000,
+			mockTimeConverter.receivedKernelTimeNs)
+	}
+
+	if !event.Equal(mockEvent) {
+		t.Error("expected deserialised event to be equal to mock event, but was not")
+	}
+
+	if event.TIDOnCPU != 252076 {
+		t.Errorf("expected on-CPU TID %d, got %d", 252076, event.TIDOnCPU)
+	}
+
+	if event.UIDOnCPU != 999 || event.GIDOnCPU != 998 {
+		t.Errorf("expected on-CPU UID and GID %d and %d, got %d and %d", 999, 998, event.UIDOnCPU, event.GIDOnCPU)
+	}
+
+	// The task's UID and GID must not be confused with those of the socket owner
+	if event.SocketInfo.UID != 0 || event.SocketInfo.GID != 0 {
+		t.Errorf("expected socket UID and GID %d and %d, got %d and %d", 0, 0, event.SocketInfo.UID, event.SocketInfo.GID)
+	}
+
+	if event.ParentPIDOnCPU != 1 {
+		t.Errorf("expected on-CPU parent PID %d, got %d", 1, event.ParentPIDOnCPU)
+	}
+
+	if event.CgroupIDOnCPU != 12345 {
+		t.Errorf("expected on-CPU cgroup ID %d, got %d", 12345, event.CgroupIDOnCPU)
+	}
+
+	if event.SocketCgroupID != 54321 {
+		t.Errorf("expected socket cgroup ID %d, got %d", 54321, event.SocketCgroupID)
+	}
+
+	if event.NetNSINode != 4026531992 {
+		t.Errorf("expected network namespace inode %d, got %d", uint32(4026531992), event.NetNSINode)
+	}
+
+	expectedCounters := bpfevent.Counters{
+		BytesReceived:    1000,
+		BytesAcked:       2000,
+		SegmentsIn:       10,
+		SegmentsOut:      12,
+		TotalRetransmits: 1,
+		SmoothedRTT:      time.Millisecond,
+	}
+	if event.Counters == nil || *event.Counters != expectedCounters {
+		t.Errorf("expected counters [%s], got [%s]", &expectedCounters, event.Counters)
+	}
+}
+
+func TestDeserialiseToEventIPv6(t *testing.T) {
+	timeNow := time.Now().UTC()
+	mockEvent := &event.Event{
+		Time:         timeNow,
+		PIDOnCPU:     252075,
+		CommandOnCPU: "postgres",
+		SourceIP:     net.ParseIP("2001:db8::2"),
+		DestIP:       net.ParseIP("2001:db8::3"),
+		SourcePort:   5432,
+		DestPort:     55420,
+		OldState:     tcpstate.StateLastAck,
+		NewState:     tcpstate.StateClosed,
+		SocketInfo: &event.SocketInfo{
+			ID:          "ffff9e45710b6900",
+			INode:       0,
+			UID:         0,
+			GID:         0,
+			SocketState: socketstate.StateFree,
+		},
+	}
+
+	/*
+			char comm_on_cpu[TASK_COMM_LEN];
+		__u64 sock_addr;
+		__u64 timestamp_ns;
+		__u64 cgroup_id_on_cpu;
+		__u64 sock_cgroup_id;
+		__u64 bytes_received;
+		__u64 bytes_acked;
 		__u32 pid_on_cpu;
+		__u32 tid_on_cpu;
+		__u32 uid_on_cpu;
+		__u32 gid_on_cpu;
+		__u32 ppid_on_cpu;
 		__u32 sock_inode;
 		__u32 sock_uid;
 		__u32 sock_gid;
+		__u32 netns_inode;
+		__u32 segs_in;
+		__u32 segs_out;
+		__u32 total_retrans;
+		__u32 srtt_us;
 		__s32 old_state;
 		__s32 new_state;
 		__u16 src_port;
 		__u16 dst_port;
-		__u8 src_addr[4];
-		__u8 dst_addr[4];
+		__u16 family;
+		__u8 src_addr[16];
+		__u8 dst_addr[16];
 		__u8 sock_state;
+		__u8 kind;
 	*/
 	mockEventData := []byte{
 		0x70, 0x6F, 0x73, 0x74, 0x67, 0x72, 0x65, 0x73, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, // ASCII "postgres"
 		0x00, 0x69, 0x0B, 0x71, 0x45, 0x9E, 0xFF, 0xFF, // 0xffff9e45710b6900 little endian
+		0x00, 0xE4, 0x0B, 0x54, 0x02, 0x00, 0x00, 0x00, // 10000000000 little endian
+		0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, // 0 little endian
+		0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, // 0 little endian
+		0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, // 0 little endian
+		0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, // 0 little endian
 		0xAB, 0xD8, 0x03, 0x00, // 252075 little endian
 		0x00, 0x00, 0x00, 0x00, // 0 little endian
 		0x00, 0x00, 0x00, 0x00, // 0 little endian
 		0x00, 0x00, 0x00, 0x00, // 0 little endian
+		0x00, 0x00, 0x00, 0x00, // 0 little endian
+		0x00, 0x00, 0x00, 0x00, // 0 little endian
+		0x00, 0x00, 0x00, 0x00, // 0 little endian
+		0x00, 0x00, 0x00, 0x00, // 0 little endian
+		0x00, 0x00, 0x00, 0x00, // 0 little endian
+		0x00, 0x00, 0x00, 0x00, // 0 little endian
+		0x00, 0x00, 0x00, 0x00, // 0 little endian
+		0x00, 0x00, 0x00, 0x00, // 0 little endian
+		0x00, 0x00, 0x00, 0x00, // 0 little endian
 		0x09, 0x00, 0x00, 0x00, // 9 little endian (LAST-ACK)
 		0x07, 0x00, 0x00, 0x00, // 7 little endian (CLOSED)
 		0x38, 0x15, // 5432 little endian
 		0x7C, 0xD8, // 55420 little endian
-		0xAC, 0x11, 0x00, 0x02, // 172.17.0.2 big endian
-		0xAC, 0x11, 0x00, 0x03, // 172.17.0.3 big endian
-		0x00,                                     // 0 (FREE)
-		0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, // Alignment padding
+		0x0A, 0x00, // 10 little endian (AF_INET6)
+		0x20, 0x01, 0x0D, 0xB8, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x02, // 2001:db8::2 big endian
+		0x20, 0x01, 0x0D, 0xB8, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x03, // 2001:db8::3 big endian
+		0x00, // 0 (FREE)
+		0x00, // 0 (state change)
 	}
 
-	deserialiser := newCStructDeserialiser(binary.LittleEndian)
+	deserialiser := newCStructDeserialiser(binary.LittleEndian, newMockKernelTimeConverter(timeNow))
 
 	event, err := deserialiser.toEvent(mockEventData)
 	if err != nil {
@@ -73,14 +273,107 @@ func TestDeserialiseToEvent(t *testing.T) {
 
 	t.Logf("got event %q", event)
 
-	event.Time = timeNow // Reset deserialised event time so comparison is equal
+	if len(event.SourceIP) != net.IPv6len || len(event.DestIP) != net.IPv6len {
+		t.Errorf("expected %d-byte IPv6 addresses, got %d and %d bytes",
+			net.IPv6len,
+			len(event.SourceIP),
+			len(event.DestIP))
+	}
+
 	if !event.Equal(mockEvent) {
 		t.Error("expected deserialised event to be equal to mock event, but was not")
 	}
 }
 
+func TestDeserialiseToEventIPv4MappedIPv6(t *testing.T) {
+	/*
+			char comm_on_cpu[TASK_COMM_LEN];
+		__u64 sock_addr;
+		__u64 timestamp_ns;
+		__u64 cgroup_id_on_cpu;
+		__u64 sock_cgroup_id;
+		__u64 bytes_received;
+		__u64 bytes_acked;
+		__u32 pid_on_cpu;
+		__u32 tid_on_cpu;
+		__u32 uid_on_cpu;
+		__u32 gid_on_cpu;
+		__u32 ppid_on_cpu;
+		__u32 sock_inode;
+		__u32 sock_uid;
+		__u32 sock_gid;
+		__u32 netns_inode;
+		__u32 segs_in;
+		__u32 segs_out;
+		__u32 total_retrans;
+		__u32 srtt_us;
+		__s32 old_state;
+		__s32 new_state;
+		__u16 src_port;
+		__u16 dst_port;
+		__u16 family;
+		__u8 src_addr[16];
+		__u8 dst_addr[16];
+		__u8 sock_state;
+		__u8 kind;
+	*/
+	mockEventData := []byte{
+		0x70, 0x6F, 0x73, 0x74, 0x67, 0x72, 0x65, 0x73, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, // ASCII "postgres"
+		0x00, 0x69, 0x0B, 0x71, 0x45, 0x9E, 0xFF, 0xFF, // 0xffff9e45710b6900 little endian
+		0x00, 0xE4, 0x0B, 0x54, 0x02, 0x00, 0x00, 0x00, // 10000000000 little endian
+		0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, // 0 little endian
+		0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, // 0 little endian
+		0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, // 0 little endian
+		0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, // 0 little endian
+		0xAB, 0xD8, 0x03, 0x00, // 252075 little endian
+		0x00, 0x00, 0x00, 0x00, // 0 little endian
+		0x00, 0x00, 0x00, 0x00, // 0 little endian
+		0x00, 0x00, 0x00, 0x00, // 0 little endian
+		0x00, 0x00, 0x00, 0x00, // 0 little endian
+		0x00, 0x00, 0x00, 0x00, // 0 little endian
+		0x00, 0x00, 0x00, 0x00, // 0 little endian
+		0x00, 0x00, 0x00, 0x00, // 0 little endian
+		0x00, 0x00, 0x00, 0x00, // 0 little endian
+		0x00, 0x00, 0x00, 0x00, // 0 little endian
+		0x00, 0x00, 0x00, 0x00, // 0 little endian
+		0x00, 0x00, 0x00, 0x00, // 0 little endian
+		0x00, 0x00, 0x00, 0x00, // 0 little endian
+		0x09, 0x00, 0x00, 0x00, // 9 little endian (LAST-ACK)
+		0x07, 0x00, 0x00, 0x00, // 7 little endian (CLOSED)
+		0x38, 0x15, // 5432 little endian
+		0x7C, 0xD8, // 55420 little endian
+		0x0A, 0x00, // 10 little endian (AF_INET6)
+		0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0xFF, 0xFF, 0xAC, 0x11, 0x00, 0x02, // ::ffff:172.17.0.2 big endian
+		0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0xFF, 0xFF, 0xAC, 0x11, 0x00, 0x03, // ::ffff:172.17.0.3 big endian
+		0x00, // 0 (FREE)
+		0x00, // 0 (state change)
+	}
+
+	deserialiser := newCStructDeserialiser(binary.LittleEndian, newMockKernelTimeConverter(time.Now().UTC()))
+
+	event, err := deserialiser.toEvent(mockEventData)
+	if err != nil {
+		t.Errorf("expected nil error, got %v (of type %T)", err, err)
+	}
+
+	t.Logf("got event %q", event)
+
+	// IPv4-mapped IPv6 addresses should be normalised to their 4-byte IPv4 form
+	if !event.SourceIP.Equal(net.IPv4(172, 17, 0, 2)) || len(event.SourceIP) != net.IPv4len {
+		t.Errorf("expected source address to be normalised to 4-byte 172.17.0.2, got %v (%d bytes)",
+			event.SourceIP,
+			len(event.SourceIP))
+	}
+
+	if !event.DestIP.Equal(net.IPv4(172, 17, 0, 3)) || len(event.DestIP) != net.IPv4len {
+		t.Errorf("expected destination address to be normalised to 4-byte 172.17.0.3, got %v (%d bytes)",
+			event.DestIP,
+			len(event.DestIP))
+	}
+}
+
 func TestDeserialiseToEventDecodeError(t *testing.T) {
-	deserialiser := newCStructDeserialiser(binary.LittleEndian)
+	deserialiser := newCStructDeserialiser(binary.LittleEndian, newMockKernelTimeConverter(time.Now().UTC()))
 
 	_, err := deserialiser.toEvent([]byte{0x00})
 	if err == nil {
@@ -94,35 +387,66 @@ func TestDeserialiseToEventIllegalTCPOldStateError(t *testing.T) {
 	/*
 			char comm_on_cpu[TASK_COMM_LEN];
 		__u64 sock_addr;
+		__u64 timestamp_ns;
+		__u64 cgroup_id_on_cpu;
+		__u64 sock_cgroup_id;
+		__u64 bytes_received;
+		__u64 bytes_acked;
 		__u32 pid_on_cpu;
+		__u32 tid_on_cpu;
+		__u32 uid_on_cpu;
+		__u32 gid_on_cpu;
+		__u32 ppid_on_cpu;
 		__u32 sock_inode;
 		__u32 sock_uid;
 		__u32 sock_gid;
+		__u32 netns_inode;
+		__u32 segs_in;
+		__u32 segs_out;
+		__u32 total_retrans;
+		__u32 srtt_us;
 		__s32 old_state;
 		__s32 new_state;
 		__u16 src_port;
 		__u16 dst_port;
-		__u8 src_addr[4];
-		__u8 dst_addr[4];
+		__u16 family;
+		__u8 src_addr[16];
+		__u8 dst_addr[16];
 		__u8 sock_state;
+		__u8 kind;
 	*/
 	mockEventData := []byte{
 		0x70, 0x6F, 0x73, 0x74, 0x67, 0x72, 0x65, 0x73, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, // ASCII "postgres"
 		0x00, 0x69, 0x0B, 0x71, 0x45, 0x9E, 0xFF, 0xFF, // 0xffff9e45710b6900 little endian
+		0x00, 0xE4, 0x0B, 0x54, 0x02, 0x00, 0x00, 0x00, // 10000000000 little endian
+		0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, // 0 little endian
+		0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, // 0 little endian
+		0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, // 0 little endian
+		0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, // 0 little endian
 		0xAB, 0xD8, 0x03, 0x00, // 252075 little endian
 		0x00, 0x00, 0x00, 0x00, // 0 little endian
 		0x00, 0x00, 0x00, 0x00, // 0 little endian
 		0x00, 0x00, 0x00, 0x00, // 0 little endian
+		0x00, 0x00, 0x00, 0x00, // 0 little endian
+		0x00, 0x00, 0x00, 0x00, // 0 little endian
+		0x00, 0x00, 0x00, 0x00, // 0 little endian
+		0x00, 0x00, 0x00, 0x00, // 0 little endian
+		0x00, 0x00, 0x00, 0x00, // 0 little endian
+		0x00, 0x00, 0x00, 0x00, // 0 little endian
+		0x00, 0x00, 0x00, 0x00, // 0 little endian
+		0x00, 0x00, 0x00, 0x00, // 0 little endian
+		0x00, 0x00, 0x00, 0x00, // 0 little endian
 		0xBA, 0xD0, 0xBA, 0xD0, // illegal value
 		0x07, 0x00, 0x00, 0x00, // 7 little endian (CLOSED)
 		0x38, 0x15, // 5432 little endian
 		0x7C, 0xD8, // 55420 little endian
-		0xAC, 0x11, 0x00, 0x02, // 172.17.0.2 big endian
-		0xAC, 0x11, 0x00, 0x03, // 172.17.0.3 big endian
-		0x00,                                     // 0 (FREE)
-		0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, // Alignment padding
+		0x02, 0x00, // 2 little endian (AF_INET)
+		0xAC, 0x11, 0x00, 0x02, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, // 172.17.0.2 big endian
+		0xAC, 0x11, 0x00, 0x03, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, // 172.17.0.3 big endian
+		0x00, // 0 (FREE)
+		0x00, // 0 (state change)
 	}
-	deserialiser := newCStructDeserialiser(binary.LittleEndian)
+	deserialiser := newCStructDeserialiser(binary.LittleEndian, newMockKernelTimeConverter(time.Now().UTC()))
 
 	_, err := deserialiser.toEvent(mockEventData)
 	if err == nil {
@@ -136,35 +460,66 @@ func TestDeserialiseToEventIllegalTCPNewStateError(t *testing.T) {
 	/*
 			char comm_on_cpu[TASK_COMM_LEN];
 		__u64 sock_addr;
+		__u64 timestamp_ns;
+		__u64 cgroup_id_on_cpu;
+		__u64 sock_cgroup_id;
+		__u64 bytes_received;
+		__u64 bytes_acked;
 		__u32 pid_on_cpu;
+		__u32 tid_on_cpu;
+		__u32 uid_on_cpu;
+		__u32 gid_on_cpu;
+		__u32 ppid_on_cpu;
 		__u32 sock_inode;
 		__u32 sock_uid;
 		__u32 sock_gid;
+		__u32 netns_inode;
+		__u32 segs_in;
+		__u32 segs_out;
+		__u32 total_retrans;
+		__u32 srtt_us;
 		__s32 old_state;
 		__s32 new_state;
 		__u16 src_port;
 		__u16 dst_port;
-		__u8 src_addr[4];
-		__u8 dst_addr[4];
+		__u16 family;
+		__u8 src_addr[16];
+		__u8 dst_addr[16];
 		__u8 sock_state;
+		__u8 kind;
 	*/
 	mockEventData := []byte{
 		0x70, 0x6F, 0x73, 0x74, 0x67, 0x72, 0x65, 0x73, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, // ASCII "postgres"
 		0x00, 0x69, 0x0B, 0x71, 0x45, 0x9E, 0xFF, 0xFF, // 0xffff9e45710b6900 little endian
+		0x00, 0xE4, 0x0B, 0x54, 0x02, 0x00, 0x00, 0x00, // 10000000000 little endian
+		0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, // 0 little endian
+		0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, // 0 little endian
+		0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, // 0 little endian
+		0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, // 0 little endian
 		0xAB, 0xD8, 0x03, 0x00, // 252075 little endian
 		0x00, 0x00, 0x00, 0x00, // 0 little endian
 		0x00, 0x00, 0x00, 0x00, // 0 little endian
 		0x00, 0x00, 0x00, 0x00, // 0 little endian
+		0x00, 0x00, 0x00, 0x00, // 0 little endian
+		0x00, 0x00, 0x00, 0x00, // 0 little endian
+		0x00, 0x00, 0x00, 0x00, // 0 little endian
+		0x00, 0x00, 0x00, 0x00, // 0 little endian
+		0x00, 0x00, 0x00, 0x00, // 0 little endian
+		0x00, 0x00, 0x00, 0x00, // 0 little endian
+		0x00, 0x00, 0x00, 0x00, // 0 little endian
+		0x00, 0x00, 0x00, 0x00, // 0 little endian
+		0x00, 0x00, 0x00, 0x00, // 0 little endian
 		0x09, 0x00, 0x00, 0x00, // 9 little endian (LAST-ACK)
 		0x0B, 0xAD, 0x0B, 0xAD, // illegal value
 		0x38, 0x15, // 5432 little endian
 		0x7C, 0xD8, // 55420 little endian
-		0xAC, 0x11, 0x00, 0x02, // 172.17.0.2 big endian
-		0xAC, 0x11, 0x00, 0x03, // 172.17.0.3 big endian
-		0x00,                                     // 0 (FREE)
-		0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, // Alignment padding
+		0x02, 0x00, // 2 little endian (AF_INET)
+		0xAC, 0x11, 0x00, 0x02, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, // 172.17.0.2 big endian
+		0xAC, 0x11, 0x00, 0x03, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, // 172.17.0.3 big endian
+		0x00, // 0 (FREE)
+		0x00, // 0 (state change)
 	}
-	deserialiser := newCStructDeserialiser(binary.LittleEndian)
+	deserialiser := newCStructDeserialiser(binary.LittleEndian, newMockKernelTimeConverter(time.Now().UTC()))
 
 	_, err := deserialiser.toEvent(mockEventData)
 	if err == nil {
@@ -178,35 +533,389 @@ func TestDeserialiseToEventIllegalSocketStateError(t *testing.T) {
 	/*
 			char comm_on_cpu[TASK_COMM_LEN];
 		__u64 sock_addr;
+		__u64 timestamp_ns;
+		__u64 cgroup_id_on_cpu;
+		__u64 sock_cgroup_id;
+		__u64 bytes_received;
+		__u64 bytes_acked;
+		__u32 pid_on_cpu;
+		__u32 tid_on_cpu;
+		__u32 uid_on_cpu;
+		__u32 gid_on_cpu;
+		__u32 ppid_on_cpu;
+		__u32 sock_inode;
+		__u32 sock_uid;
+		__u32 sock_gid;
+		__u32 netns_inode;
+		__u32 segs_in;
+		__u32 segs_out;
+		__u32 total_retrans;
+		__u32 srtt_us;
+		__s32 old_state;
+		__s32 new_state;
+		__u16 src_port;
+		__u16 dst_port;
+		__u16 family;
+		__u8 src_addr[16];
+		__u8 dst_addr[16];
+		__u8 sock_state;
+		__u8 kind;
+	*/
+	mockEventData := []byte{
+		0x70, 0x6F, 0x73, 0x74, 0x67, 0x72, 0x65, 0x73, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, // ASCII "postgres"
+		0x00, 0x69, 0x0B, 0x71, 0x45, 0x9E, 0xFF, 0xFF, // 0xffff9e45710b6900 little endian
+		0x00, 0xE4, 0x0B, 0x54, 0x02, 0x00, 0x00, 0x00, // 10000000000 little endian
+		0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, // 0 little endian
+		0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, // 0 little endian
+		0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, // 0 little endian
+		0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, // 0 little endian
+		0xAB, 0xD8, 0x03, 0x00, // 252075 little endian
+		0x00, 0x00, 0x00, 0x00, // 0 little endian
+		0x00, 0x00, 0x00, 0x00, // 0 little endian
+		0x00, 0x00, 0x00, 0x00, // 0 little endian
+		0x00, 0x00, 0x00, 0x00, // 0 little endian
+		0x00, 0x00, 0x00, 0x00, // 0 little endian
+		0x00, 0x00, 0x00, 0x00, // 0 little endian
+		0x00, 0x00, 0x00, 0x00, // 0 little endian
+		0x00, 0x00, 0x00, 0x00, // 0 little endian
+		0x00, 0x00, 0x00, 0x00, // 0 little endian
+		0x00, 0x00, 0x00, 0x00, // 0 little endian
+		0x00, 0x00, 0x00, 0x00, // 0 little endian
+		0x00, 0x00, 0x00, 0x00, // 0 little endian
+		0x09, 0x00, 0x00, 0x00, // 9 little endian (LAST-ACK)
+		0x07, 0x00, 0x00, 0x00, // 7 little endian (CLOSED)
+		0x38, 0x15, // 5432 little endian
+		0x7C, 0xD8, // 55420 little endian
+		0x02, 0x00, // 2 little endian (AF_INET)
+		0xAC, 0x11, 0x00, 0x02, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, // 172.17.0.2 big endian
+		0xAC, 0x11, 0x00, 0x03, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, // 172.17.0.3 big endian
+		0xFF, // illegal value
+		0x00, // 0 (state change)
+	}
+	deserialiser := newCStructDeserialiser(binary.LittleEndian, newMockKernelTimeConverter(time.Now().UTC()))
+
+	_, err := deserialiser.toEvent(mockEventData)
+	if err == nil {
+		t.Error("expected error, got nil")
+	}
+
+	t.Logf("got error %q (of type %T)", err, err)
+}
+
+func TestDeserialiseToEventIllegalAddressFamilyError(t *testing.T) {
+	/*
+			char comm_on_cpu[TASK_COMM_LEN];
+		__u64 sock_addr;
+		__u64 timestamp_ns;
+		__u64 cgroup_id_on_cpu;
+		__u64 sock_cgroup_id;
+		__u64 bytes_received;
+		__u64 bytes_acked;
+		__u32 pid_on_cpu;
+		__u32 tid_on_cpu;
+		__u32 uid_on_cpu;
+		__u32 gid_on_cpu;
+		__u32 ppid_on_cpu;
+		__u32 sock_inode;
+		__u32 sock_uid;
+		__u32 sock_gid;
+		__u32 netns_inode;
+		__u32 segs_in;
+		__u32 segs_out;
+		__u32 total_retrans;
+		__u32 srtt_us;
+		__s32 old_state;
+		__s32 new_state;
+		__u16 src_port;
+		__u16 dst_port;
+		__u16 family;
+		__u8 src_addr[16];
+		__u8 dst_addr[16];
+		__u8 sock_state;
+		__u8 kind;
+	*/
+	mockEventData := []byte{
+		0x70, 0x6F, 0x73, 0x74, 0x67, 0x72, 0x65, 0x73, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, // ASCII "postgres"
+		0x00, 0x69, 0x0B, 0x71, 0x45, 0x9E, 0xFF, 0xFF, // 0xffff9e45710b6900 little endian
+		0x00, 0xE4, 0x0B, 0x54, 0x02, 0x00, 0x00, 0x00, // 10000000000 little endian
+		0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, // 0 little endian
+		0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, // 0 little endian
+		0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, // 0 little endian
+		0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, // 0 little endian
+		0xAB, 0xD8, 0x03, 0x00, // 252075 little endian
+		0x00, 0x00, 0x00, 0x00, // 0 little endian
+		0x00, 0x00, 0x00, 0x00, // 0 little endian
+		0x00, 0x00, 0x00, 0x00, // 0 little endian
+		0x00, 0x00, 0x00, 0x00, // 0 little endian
+		0x00, 0x00, 0x00, 0x00, // 0 little endian
+		0x00, 0x00, 0x00, 0x00, // 0 little endian
+		0x00, 0x00, 0x00, 0x00, // 0 little endian
+		0x00, 0x00, 0x00, 0x00, // 0 little endian
+		0x00, 0x00, 0x00, 0x00, // 0 little endian
+		0x00, 0x00, 0x00, 0x00, // 0 little endian
+		0x00, 0x00, 0x00, 0x00, // 0 little endian
+		0x00, 0x00, 0x00, 0x00, // 0 little endian
+		0x09, 0x00, 0x00, 0x00, // 9 little endian (LAST-ACK)
+		0x07, 0x00, 0x00, 0x00, // 7 little endian (CLOSED)
+		0x38, 0x15, // 5432 little endian
+		0x7C, 0xD8, // 55420 little endian
+		0x01, 0x00, // 1 little endian (AF_UNIX - illegal value)
+		0xAC, 0x11, 0x00, 0x02, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, // 172.17.0.2 big endian
+		0xAC, 0x11, 0x00, 0x03, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, // 172.17.0.3 big endian
+		0x00, // 0 (FREE)
+		0x00, // 0 (state change)
+	}
+	deserialiser := newCStructDeserialiser(binary.LittleEndian, newMockKernelTimeConverter(time.Now().UTC()))
+
+	_, err := deserialiser.toEvent(mockEventData)
+	if err == nil {
+		t.Error("expected error, got nil")
+	}
+
+	t.Logf("got error %q (of type %T)", err, err)
+}
+
+func TestDeserialiseToEventReset(t *testing.T) {
+	/*
+			char comm_on_cpu[TASK_COMM_LEN];
+		__u64 sock_addr;
+		__u64 timestamp_ns;
+		__u64 cgroup_id_on_cpu;
+		__u64 sock_cgroup_id;
+		__u64 bytes_received;
+		__u64 bytes_acked;
+		__u32 pid_on_cpu;
+		__u32 tid_on_cpu;
+		__u32 uid_on_cpu;
+		__u32 gid_on_cpu;
+		__u32 ppid_on_cpu;
+		__u32 sock_inode;
+		__u32 sock_uid;
+		__u32 sock_gid;
+		__u32 netns_inode;
+		__u32 segs_in;
+		__u32 segs_out;
+		__u32 total_retrans;
+		__u32 srtt_us;
+		__s32 old_state;
+		__s32 new_state;
+		__u16 src_port;
+		__u16 dst_port;
+		__u16 family;
+		__u8 src_addr[16];
+		__u8 dst_addr[16];
+		__u8 sock_state;
+		__u8 kind;
+	*/
+	mockEventData := []byte{
+		0x70, 0x6F, 0x73, 0x74, 0x67, 0x72, 0x65, 0x73, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, // ASCII "postgres"
+		0x00, 0x69, 0x0B, 0x71, 0x45, 0x9E, 0xFF, 0xFF, // 0xffff9e45710b6900 little endian
+		0x00, 0xE4, 0x0B, 0x54, 0x02, 0x00, 0x00, 0x00, // 10000000000 little endian
+		0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, // 0 little endian
+		0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, // 0 little endian
+		0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, // 0 little endian
+		0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, // 0 little endian
+		0xAB, 0xD8, 0x03, 0x00, // 252075 little endian
+		0x00, 0x00, 0x00, 0x00, // 0 little endian
+		0x00, 0x00, 0x00, 0x00, // 0 little endian
+		0x00, 0x00, 0x00, 0x00, // 0 little endian
+		0x00, 0x00, 0x00, 0x00, // 0 little endian
+		0x00, 0x00, 0x00, 0x00, // 0 little endian
+		0x00, 0x00, 0x00, 0x00, // 0 little endian
+		0x00, 0x00, 0x00, 0x00, // 0 little endian
+		0x00, 0x00, 0x00, 0x00, // 0 little endian
+		0x00, 0x00, 0x00, 0x00, // 0 little endian
+		0x00, 0x00, 0x00, 0x00, // 0 little endian
+		0x00, 0x00, 0x00, 0x00, // 0 little endian
+		0x00, 0x00, 0x00, 0x00, // 0 little endian
+		0x01, 0x00, 0x00, 0x00, // 1 little endian (ESTABLISHED)
+		0x01, 0x00, 0x00, 0x00, // 1 little endian (ESTABLISHED)
+		0x38, 0x15, // 5432 little endian
+		0x7C, 0xD8, // 55420 little endian
+		0x02, 0x00, // 2 little endian (AF_INET)
+		0xAC, 0x11, 0x00, 0x02, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, // 172.17.0.2 big endian
+		0xAC, 0x11, 0x00, 0x03, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, // 172.17.0.3 big endian
+		0x03, // 3 (CONNECTED)
+		0x03, // 3 (receive reset)
+	}
+	deserialiser := newCStructDeserialiser(binary.LittleEndian, newMockKernelTimeConverter(time.Now().UTC()))
+
+	event, err := deserialiser.toEvent(mockEventData)
+	if err != nil {
+		t.Errorf("expected nil error, got %v (of type %T)", err, err)
+	}
+
+	t.Logf("got event %q", event)
+
+	if event.Kind != bpfevent.KindReceiveReset {
+		t.Errorf("expected event kind %v, got %v", bpfevent.KindReceiveReset, event.Kind)
+	}
+
+	if event.OldState != tcpstate.StateEstablished || event.NewState != tcpstate.StateEstablished {
+		t.Errorf("expected old and new states %q, got %q and %q",
+			tcpstate.StateEstablished,
+			event.OldState,
+			event.NewState)
+	}
+
+	if event.Counters != nil {
+		t.Errorf("expected no counters on event which is not a close, got [%s]", event.Counters)
+	}
+}
+
+// TestDeserialiseToEventRetransmitIPv6 checks that addresses filled from the
+// socket, rather than from the tracepoint, are decoded over their full width.
+func TestDeserialiseToEventRetransmitIPv6(t *testing.T) {
+	/*
+			char comm_on_cpu[TASK_COMM_LEN];
+		__u64 sock_addr;
+		__u64 timestamp_ns;
+		__u64 cgroup_id_on_cpu;
+		__u64 sock_cgroup_id;
+		__u64 bytes_received;
+		__u64 bytes_acked;
+		__u32 pid_on_cpu;
+		__u32 tid_on_cpu;
+		__u32 uid_on_cpu;
+		__u32 gid_on_cpu;
+		__u32 ppid_on_cpu;
+		__u32 sock_inode;
+		__u32 sock_uid;
+		__u32 sock_gid;
+		__u32 netns_inode;
+		__u32 segs_in;
+		__u32 segs_out;
+		__u32 total_retrans;
+		__u32 srtt_us;
+		__s32 old_state;
+		__s32 new_state;
+		__u16 src_port;
+		__u16 dst_port;
+		__u16 family;
+		__u8 src_addr[16];
+		__u8 dst_addr[16];
+		__u8 sock_state;
+		__u8 kind;
+	*/
+	mockEventData := []byte{
+		0x70, 0x6F, 0x73, 0x74, 0x67, 0x72, 0x65, 0x73, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, // ASCII "postgres"
+		0x00, 0x69, 0x0B, 0x71, 0x45, 0x9E, 0xFF, 0xFF, // 0xffff9e45710b6900 little endian
+		0x00, 0xE4, 0x0B, 0x54, 0x02, 0x00, 0x00, 0x00, // 10000000000 little endian
+		0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, // 0 little endian
+		0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, // 0 little endian
+		0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, // 0 little endian
+		0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, // 0 little endian
+		0xAB, 0xD8, 0x03, 0x00, // 252075 little endian
+		0x00, 0x00, 0x00, 0x00, // 0 little endian
+		0x00, 0x00, 0x00, 0x00, // 0 little endian
+		0x00, 0x00, 0x00, 0x00, // 0 little endian
+		0x00, 0x00, 0x00, 0x00, // 0 little endian
+		0x00, 0x00, 0x00, 0x00, // 0 little endian
+		0x00, 0x00, 0x00, 0x00, // 0 little endian
+		0x00, 0x00, 0x00, 0x00, // 0 little endian
+		0x00, 0x00, 0x00, 0x00, // 0 little endian
+		0x00, 0x00, 0x00, 0x00, // 0 little endian
+		0x00, 0x00, 0x00, 0x00, // 0 little endian
+		0x00, 0x00, 0x00, 0x00, // 0 little endian
+		0x00, 0x00, 0x00, 0x00, // 0 little endian
+		0x01, 0x00, 0x00, 0x00, // 1 little endian (ESTABLISHED)
+		0x01, 0x00, 0x00, 0x00, // 1 little endian (ESTABLISHED)
+		0x38, 0x15, // 5432 little endian
+		0x7C, 0xD8, // 55420 little endian
+		0x0A, 0x00, // 10 little endian (AF_INET6)
+		0x20, 0x01, 0x0D, 0xB8, 0x85, 0xA3, 0x08, 0xD3, 0x13, 0x19, 0x8A, 0x2E, 0x03, 0x70, 0x73, 0x48, // 2001:db8:85a3:8d3:1319:8a2e:370:7348 big endian
+		0x20, 0x01, 0x0D, 0xB8, 0x85, 0xA3, 0x08, 0xD3, 0x13, 0x19, 0x8A, 0x2E, 0x03, 0x70, 0x73, 0x49, // 2001:db8:85a3:8d3:1319:8a2e:370:7349 big endian
+		0x03, // 3 (CONNECTED)
+		0x01, // 1 (retransmit)
+	}
+	deserialiser := newCStructDeserialiser(binary.LittleEndian, newMockKernelTimeConverter(time.Now().UTC()))
+
+	event, err := deserialiser.toEvent(mockEventData)
+	if err != nil {
+		t.Errorf("expected nil error, got %v (of type %T)", err, err)
+	}
+
+	t.Logf("got event %q", event)
+
+	if event.Kind != bpfevent.KindRetransmit {
+		t.Errorf("expected event kind %v, got %v", bpfevent.KindRetransmit, event.Kind)
+	}
+
+	expectedSourceIP := net.ParseIP("2001:db8:85a3:8d3:1319:8a2e:370:7348")
+	if !event.SourceIP.Equal(expectedSourceIP) {
+		t.Errorf("expected source IP %v, got %v", expectedSourceIP, event.SourceIP)
+	}
+
+	expectedDestIP := net.ParseIP("2001:db8:85a3:8d3:1319:8a2e:370:7349")
+	if !event.DestIP.Equal(expectedDestIP) {
+		t.Errorf("expected destination IP %v, got %v", expectedDestIP, event.DestIP)
+	}
+}
+
+func TestDeserialiseToEventIllegalEventKindError(t *testing.T) {
+	/*
+			char comm_on_cpu[TASK_COMM_LEN];
+		__u64 sock_addr;
+		__u64 timestamp_ns;
+		__u64 cgroup_id_on_cpu;
+		__u64 sock_cgroup_id;
+		__u64 bytes_received;
+		__u64 bytes_acked;
 		__u32 pid_on_cpu;
+		__u32 tid_on_cpu;
+		__u32 uid_on_cpu;
+		__u32 gid_on_cpu;
+		__u32 ppid_on_cpu;
 		__u32 sock_inode;
 		__u32 sock_uid;
 		__u32 sock_gid;
+		__u32 netns_inode;
+		__u32 segs_in;
+		__u32 segs_out;
+		__u32 total_retrans;
+		__u32 srtt_us;
 		__s32 old_state;
 		__s32 new_state;
 		__u16 src_port;
 		__u16 dst_port;
-		__u8 src_addr[4];
-		__u8 dst_addr[4];
+		__u16 family;
+		__u8 src_addr[16];
+		__u8 dst_addr[16];
 		__u8 sock_state;
+		__u8 kind;
 	*/
 	mockEventData := []byte{
 		0x70, 0x6F, 0x73, 0x74, 0x67, 0x72, 0x65, 0x73, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, // ASCII "postgres"
 		0x00, 0x69, 0x0B, 0x71, 0x45, 0x9E, 0xFF, 0xFF, // 0xffff9e45710b6900 little endian
+		0x00, 0xE4, 0x0B, 0x54, 0x02, 0x00, 0x00, 0x00, // 10000000000 little endian
+		0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, // 0 little endian
+		0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, // 0 little endian
+		0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, // 0 little endian
+		0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, // 0 little endian
 		0xAB, 0xD8, 0x03, 0x00, // 252075 little endian
 		0x00, 0x00, 0x00, 0x00, // 0 little endian
 		0x00, 0x00, 0x00, 0x00, // 0 little endian
 		0x00, 0x00, 0x00, 0x00, // 0 little endian
+		0x00, 0x00, 0x00, 0x00, // 0 little endian
+		0x00, 0x00, 0x00, 0x00, // 0 little endian
+		0x00, 0x00, 0x00, 0x00, // 0 little endian
+		0x00, 0x00, 0x00, 0x00, // 0 little endian
+		0x00, 0x00, 0x00, 0x00, // 0 little endian
+		0x00, 0x00, 0x00, 0x00, // 0 little endian
+		0x00, 0x00, 0x00, 0x00, // 0 little endian
+		0x00, 0x00, 0x00, 0x00, // 0 little endian
+		0x00, 0x00, 0x00, 0x00, // 0 little endian
 		0x09, 0x00, 0x00, 0x00, // 9 little endian (LAST-ACK)
 		0x07, 0x00, 0x00, 0x00, // 7 little endian (CLOSED)
 		0x38, 0x15, // 5432 little endian
 		0x7C, 0xD8, // 55420 little endian
-		0xAC, 0x11, 0x00, 0x02, // 172.17.0.2 big endian
-		0xAC, 0x11, 0x00, 0x03, // 172.17.0.3 big endian
-		0xFF,                                     // illegal value
-		0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, // Alignment padding
+		0x02, 0x00, // 2 little endian (AF_INET)
+		0xAC, 0x11, 0x00, 0x02, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, // 172.17.0.2 big endian
+		0xAC, 0x11, 0x00, 0x03, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, // 172.17.0.3 big endian
+		0x00, // 0 (FREE)
+		0xFF, // illegal value
 	}
-	deserialiser := newCStructDeserialiser(binary.LittleEndian)
+	deserialiser := newCStructDeserialiser(binary.LittleEndian, newMockKernelTimeConverter(time.Now().UTC()))
 
 	_, err := deserialiser.toEvent(mockEventData)
 	if err == nil {
@@ -1,22 +1,136 @@
 package main
 
-import "log"
+import (
+	"errors"
+	"fmt"
+	"log"
+	"sync/atomic"
+
+	"github.com/jhwbarlow/tcp-audit-bpf-eventer/pkg/bpfevent"
+	"github.com/jhwbarlow/tcp-audit-common/pkg/event"
+)
+
+// Names by which dropped event handlers are selected in the configuration
+const (
+	loggingDroppedEventHandlerName    = "log"
+	metricsDroppedEventHandlerName    = "metrics"
+	gapEventDroppedEventHandlerName   = "gap-event"
+	failClosedDroppedEventHandlerName = "fail-closed"
+)
+
+// ErrEventLossThresholdExceeded is returned by the Eventer once more events have
+// been dropped than allowed by the fail-closed dropped event handler. Once returned,
+// it is returned on every subsequent attempt to read an event.
+var ErrEventLossThresholdExceeded = errors.New("event loss threshold exceeded")
 
 // DroppedEventHandler is an interface which describes objects which
 // handle dropped events (events which the kernel could not write to
 // the kernel BPF perf buffer due to it being full).
+// A handler may return an event, which is emitted by the Eventer in place of the
+// dropped events. Errors are logged, unless they wrap ErrEventLossThresholdExceeded,
+// in which case they are returned to the caller.
 type droppedEventHandler interface {
-	handle(droppedEventsCount uint64) error
+	handle(droppedEventsCount uint64) (*bpfevent.Event, error)
+}
+
+func isDroppedEventHandlerName(name string) bool {
+	switch name {
+	case loggingDroppedEventHandlerName,
+		metricsDroppedEventHandlerName,
+		gapEventDroppedEventHandlerName,
+		failClosedDroppedEventHandlerName:
+		return true
+	default:
+		return false
+	}
+}
+
+// NewDroppedEventHandler creates the dropped event handler selected by name.
+// The threshold is used only by the fail-closed handler.
+func newDroppedEventHandler(name string, threshold uint64, clock clock) (droppedEventHandler, error) {
+	switch name {
+	case loggingDroppedEventHandlerName:
+		return new(loggingDroppedEventHandler), nil
+	case metricsDroppedEventHandlerName:
+		return new(metricsDroppedEventHandler), nil
+	case gapEventDroppedEventHandlerName:
+		return newGapEventDroppedEventHandler(clock), nil
+	case failClosedDroppedEventHandlerName:
+		return newFailClosedDroppedEventHandler(threshold), nil
+	default:
+		return nil, fmt.Errorf("unknown dropped event handler %q", name)
+	}
 }
 
 // LoggingDroppedEventHandler logs an dropped event message to stderr.
 type loggingDroppedEventHandler struct{}
 
 // Handle handles a dropped event by logging a message to stderr.
-func (*loggingDroppedEventHandler) handle(droppedEventsCount uint64) error {
+func (*loggingDroppedEventHandler) handle(droppedEventsCount uint64) (*bpfevent.Event, error) {
 	// There is nothing we can do about a dropped event,
 	// except perhaps increase the buffer size or poll the
 	// perf buffer more quickly, so just log it.
 	log.Printf("Dropped events occurred: %d", droppedEventsCount)
-	return nil
+	return nil, nil
+}
+
+// MetricsDroppedEventHandler does nothing beyond the counting of dropped events in
+// the metrics, which the Eventer does regardless of the handler. It avoids filling
+// the log when events are dropped persistently.
+type metricsDroppedEventHandler struct{}
+
+func (*metricsDroppedEventHandler) handle(droppedEventsCount uint64) (*bpfevent.Event, error) {
+	return nil, nil
+}
+
+// GapEventDroppedEventHandler emits a synthetic event marking the gap in the events
+// left by the dropped events, so that consumers know their audit trail is incomplete.
+type gapEventDroppedEventHandler struct {
+	clock clock
+}
+
+func newGapEventDroppedEventHandler(clock clock) *gapEventDroppedEventHandler {
+	return &gapEventDroppedEventHandler{clock: clock}
+}
+
+// Handle handles a dropped event by returning an event of KindEventsLost. As the
+// common event has no field for the number of events lost, it is also given in
+// the command on-CPU, so that it is visible to consumers of Event().
+func (h *gapEventDroppedEventHandler) handle(droppedEventsCount uint64) (*bpfevent.Event, error) {
+	return &bpfevent.Event{
+		Event: event.Event{
+			Time:         h.clock.wallNow(),
+			CommandOnCPU: fmt.Sprintf("events lost: %d", droppedEventsCount),
+		},
+		Kind:       bpfevent.KindEventsLost,
+		LostEvents: droppedEventsCount,
+	}, nil
+}
+
+// FailClosedDroppedEventHandler fails once the total number of dropped events
+// exceeds a threshold, for consumers which would rather stop than continue with
+// an incomplete audit trail. The threshold is zero unless configured, so that by
+// default no dropped event is tolerated.
+type failClosedDroppedEventHandler struct {
+	threshold uint64
+
+	totalDroppedEvents uint64 // Accessed atomically
+}
+
+func newFailClosedDroppedEventHandler(threshold uint64) *failClosedDroppedEventHandler {
+	return &failClosedDroppedEventHandler{threshold: threshold}
+}
+
+func (h *failClosedDroppedEventHandler) handle(droppedEventsCount uint64) (*bpfevent.Event, error) {
+	total := atomic.AddUint64(&h.totalDroppedEvents, droppedEventsCount)
+	log.Printf("Dropped events occurred: %d (%d in total)", droppedEventsCount, total)
+
+	if total > h.threshold {
+		return nil, fmt.Errorf("%w: %d events dropped, threshold is %d",
+			ErrEventLossThresholdExceeded,
+			total,
+			h.threshold)
+	}
+
+	return nil, nil
 }
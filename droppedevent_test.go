@@ -0,0 +1,97 @@
+package main
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/jhwbarlow/tcp-audit-bpf-eventer/pkg/bpfevent"
+)
+
+func TestNewDroppedEventHandler(t *testing.T) {
+	for _, name := range []string{
+		loggingDroppedEventHandlerName,
+		metricsDroppedEventHandlerName,
+		gapEventDroppedEventHandlerName,
+		failClosedDroppedEventHandlerName,
+	} {
+		handler, err := newDroppedEventHandler(name, 0, newMockClock(nil, nil, nil))
+		if err != nil {
+			t.Errorf("%s: expected nil error, got %v (of type %T)", name, err, err)
+		}
+
+		if handler == nil {
+			t.Errorf("%s: expected handler, got nil", name)
+		}
+	}
+
+	if _, err := newDroppedEventHandler("ignore", 0, nil); err == nil {
+		t.Error("expected error, got nil")
+	}
+}
+
+func TestGapEventDroppedEventHandler(t *testing.T) {
+	timeNow := time.Date(2021, 10, 1, 12, 0, 0, 0, time.UTC)
+	handler := newGapEventDroppedEventHandler(newMockClock([]time.Time{timeNow}, nil, nil))
+
+	event, err := handler.handle(10)
+	if err != nil {
+		t.Errorf("expected nil error, got %v (of type %T)", err, err)
+	}
+
+	t.Logf("got event %v", event)
+
+	if event == nil {
+		t.Fatal("expected event, got nil")
+	}
+
+	if event.Kind != bpfevent.KindEventsLost {
+		t.Errorf("expected kind %v, got %v", bpfevent.KindEventsLost, event.Kind)
+	}
+
+	if event.LostEvents != 10 {
+		t.Errorf("expected %d lost events, got %d", 10, event.LostEvents)
+	}
+
+	if !event.Time.Equal(timeNow) {
+		t.Errorf("expected time %v, got %v", timeNow, event.Time)
+	}
+
+	if event.CommandOnCPU != "events lost: 10" {
+		t.Errorf("expected command on-CPU %q, got %q", "events lost: 10", event.CommandOnCPU)
+	}
+}
+
+func TestFailClosedDroppedEventHandler(t *testing.T) {
+	handler := newFailClosedDroppedEventHandler(15)
+
+	// The threshold is not exceeded until the total exceeds it
+	for i := 0; i < 3; i++ {
+		event, err := handler.handle(5)
+		if err != nil {
+			t.Errorf("expected nil error, got %v (of type %T)", err, err)
+		}
+
+		if event != nil {
+			t.Errorf("expected nil event, got %v", event)
+		}
+	}
+
+	_, err := handler.handle(1)
+	if !errors.Is(err, ErrEventLossThresholdExceeded) {
+		t.Errorf("expected error chain to include %q, got %v (of type %T)", ErrEventLossThresholdExceeded, err, err)
+	}
+}
+
+func TestFailClosedDroppedEventHandlerDefaultThreshold(t *testing.T) {
+	handler, err := newDroppedEventHandler(failClosedDroppedEventHandlerName, defaultConfig().DroppedEventThreshold, nil)
+	if err != nil {
+		t.Errorf("expected nil constructor error, got %v (of type %T)", err, err)
+	}
+
+	// By default, no dropped event is tolerated
+	_, err = handler.handle(1)
+	if !errors.Is(err, ErrEventLossThresholdExceeded) {
+		t.Errorf("expected error chain to include %q, got %v (of type %T)", ErrEventLossThresholdExceeded, err, err)
+	}
+}
@@ -0,0 +1,440 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/jhwbarlow/tcp-audit-bpf-eventer/pkg/bpfevent"
+)
+
+// Must match those used in the BPF C
+const (
+	filterConfigMapName     = "filter_config"
+	filterAllowPortsMapName = "filter_allow_ports"
+	filterDenyPortsMapName  = "filter_deny_ports"
+	filterSrcCIDRsMapName   = "filter_src_cidrs"
+	filterDstCIDRsMapName   = "filter_dst_cidrs"
+	filterUIDsMapName       = "filter_uids"
+	filterGIDsMapName       = "filter_gids"
+	filterCommsMapName      = "filter_comms"
+	filterNetNSMapName      = "filter_netns"
+
+	filterPortsMaxEntries = 1024
+	filterCIDRsMaxEntries = 1024
+	filterIDsMaxEntries   = 1024
+	filterCommsMaxEntries = 256
+	filterNetNSMaxEntries = 1024
+)
+
+// Filter flags, which must match those used in the BPF C
+const (
+	filterFlagAllowPorts uint32 = 1 << iota
+	filterFlagSrcCIDRs
+	filterFlagDstCIDRs
+	filterFlagUIDs
+	filterFlagGIDs
+	filterFlagComms
+	filterFlagExcludeLoopback
+	filterFlagNetNS
+)
+
+// Filter describes which TCP state-change events are emitted by the BPF program.
+// Filtering takes place in the kernel, so that unwanted events do not consume
+// space in the kernel buffer. Each non-empty allow-list must be matched for an
+// event to be emitted. The zero value emits all events.
+type Filter struct {
+	// AllowPorts restricts events to those where the source or destination
+	// port is in the list.
+	AllowPorts []uint16
+
+	// DenyPorts discards events where the source or destination port is in the
+	// list, regardless of any other criteria.
+	DenyPorts []uint16
+
+	// SourceCIDRs and DestCIDRs restrict events to those where the source or
+	// destination address, respectively, falls within one of the networks
+	// in the list.
+	SourceCIDRs, DestCIDRs []*net.IPNet
+
+	// UIDs and GIDs restrict events to those where the socket is owned by one
+	// of the user or group IDs in the list.
+	UIDs, GIDs []uint32
+
+	// CommandPrefixes restricts events to those where the command on-CPU at
+	// the time of the event begins with one of the prefixes in the list.
+	CommandPrefixes []string
+
+	// NetNSINodes restricts events to those where the socket is in one of the
+	// network namespaces in the list, identified by inode number (as shown by
+	// "ls -L -i /proc/<pid>/ns/net" or "lsns -t net").
+	NetNSINodes []uint32
+
+	// ExcludeLoopback discards events where the source or destination address
+	// is a loopback address.
+	ExcludeLoopback bool
+}
+
+// Validate checks that the filter can be represented in the BPF filter maps.
+func (f *Filter) validate() error {
+	if len(f.AllowPorts) > filterPortsMaxEntries {
+		return fmt.Errorf("too many allowed ports: %d (maximum %d)", len(f.AllowPorts), filterPortsMaxEntries)
+	}
+
+	if len(f.DenyPorts) > filterPortsMaxEntries {
+		return fmt.Errorf("too many denied ports: %d (maximum %d)", len(f.DenyPorts), filterPortsMaxEntries)
+	}
+
+	if len(f.SourceCIDRs) > filterCIDRsMaxEntries {
+		return fmt.Errorf("too many source CIDRs: %d (maximum %d)", len(f.SourceCIDRs), filterCIDRsMaxEntries)
+	}
+
+	if len(f.DestCIDRs) > filterCIDRsMaxEntries {
+		return fmt.Errorf("too many destination CIDRs: %d (maximum %d)", len(f.DestCIDRs), filterCIDRsMaxEntries)
+	}
+
+	if len(f.UIDs) > filterIDsMaxEntries {
+		return fmt.Errorf("too many UIDs: %d (maximum %d)", len(f.UIDs), filterIDsMaxEntries)
+	}
+
+	if len(f.GIDs) > filterIDsMaxEntries {
+		return fmt.Errorf("too many GIDs: %d (maximum %d)", len(f.GIDs), filterIDsMaxEntries)
+	}
+
+	if len(f.NetNSINodes) > filterNetNSMaxEntries {
+		return fmt.Errorf("too many network namespaces: %d (maximum %d)", len(f.NetNSINodes), filterNetNSMaxEntries)
+	}
+
+	if len(f.CommandPrefixes) > filterCommsMaxEntries {
+		return fmt.Errorf("too many command prefixes: %d (maximum %d)", len(f.CommandPrefixes), filterCommsMaxEntries)
+	}
+
+	for _, cidrs := range [...][]*net.IPNet{f.SourceCIDRs, f.DestCIDRs} {
+		for _, cidr := range cidrs {
+			if err := validateCIDR(cidr); err != nil {
+				return err
+			}
+		}
+	}
+
+	for _, prefix := range f.CommandPrefixes {
+		// The kernel command is NUL-terminated, so at most taskCommLen-1 bytes can match
+		if len(prefix) == 0 || len(prefix) >= taskCommLen {
+			return fmt.Errorf("illegal command prefix %q: length must be between 1 and %d bytes",
+				prefix,
+				taskCommLen-1)
+		}
+	}
+
+	return nil
+}
+
+func validateCIDR(cidr *net.IPNet) error {
+	if cidr == nil || cidr.IP.To16() == nil {
+		return fmt.Errorf("illegal CIDR: %v", cidr)
+	}
+
+	if _, bits := cidr.Mask.Size(); bits == 0 {
+		return fmt.Errorf("illegal CIDR %v: non-canonical mask", cidr)
+	}
+
+	return nil
+}
+
+// Flags returns the BPF filter flags for the filter.
+func (f *Filter) flags() uint32 {
+	var flags uint32
+
+	if len(f.AllowPorts) > 0 {
+		flags |= filterFlagAllowPorts
+	}
+
+	if len(f.SourceCIDRs) > 0 {
+		flags |= filterFlagSrcCIDRs
+	}
+
+	if len(f.DestCIDRs) > 0 {
+		flags |= filterFlagDstCIDRs
+	}
+
+	if len(f.UIDs) > 0 {
+		flags |= filterFlagUIDs
+	}
+
+	if len(f.GIDs) > 0 {
+		flags |= filterFlagGIDs
+	}
+
+	if len(f.CommandPrefixes) > 0 {
+		flags |= filterFlagComms
+	}
+
+	if len(f.NetNSINodes) > 0 {
+		flags |= filterFlagNetNS
+	}
+
+	if f.ExcludeLoopback {
+		flags |= filterFlagExcludeLoopback
+	}
+
+	return flags
+}
+
+// Matches returns true if the event would be emitted by the BPF program with
+// the filter in effect. It is used to filter events which do not originate in
+// the BPF program, such as snapshot events. As the command on-CPU of a
+// snapshot event is not known, the command prefixes are not applied to it.
+func (f *Filter) matches(event *bpfevent.Event) bool {
+	if containsPort(f.DenyPorts, event.SourcePort) || containsPort(f.DenyPorts, event.DestPort) {
+		return false
+	}
+
+	if len(f.AllowPorts) > 0 &&
+		!containsPort(f.AllowPorts, event.SourcePort) &&
+		!containsPort(f.AllowPorts, event.DestPort) {
+		return false
+	}
+
+	var uid, gid uint32
+	if event.SocketInfo != nil {
+		uid, gid = event.SocketInfo.UID, event.SocketInfo.GID
+	}
+
+	if len(f.UIDs) > 0 && !containsID(f.UIDs, uid) {
+		return false
+	}
+
+	if len(f.GIDs) > 0 && !containsID(f.GIDs, gid) {
+		return false
+	}
+
+	if len(f.NetNSINodes) > 0 && !containsID(f.NetNSINodes, event.NetNSINode) {
+		return false
+	}
+
+	if len(f.CommandPrefixes) > 0 && !event.Snapshot {
+		matched := false
+		for _, prefix := range f.CommandPrefixes {
+			if strings.HasPrefix(event.CommandOnCPU, prefix) {
+				matched = true
+				break
+			}
+		}
+
+		if !matched {
+			return false
+		}
+	}
+
+	if f.ExcludeLoopback && (event.SourceIP.IsLoopback() || event.DestIP.IsLoopback()) {
+		return false
+	}
+
+	if len(f.SourceCIDRs) > 0 && !containsIP(f.SourceCIDRs, event.SourceIP) {
+		return false
+	}
+
+	if len(f.DestCIDRs) > 0 && !containsIP(f.DestCIDRs, event.DestIP) {
+		return false
+	}
+
+	return true
+}
+
+func containsPort(ports []uint16, port uint16) bool {
+	for _, p := range ports {
+		if p == port {
+			return true
+		}
+	}
+
+	return false
+}
+
+func containsID(ids []uint32, id uint32) bool {
+	for _, i := range ids {
+		if i == id {
+			return true
+		}
+	}
+
+	return false
+}
+
+func containsIP(cidrs []*net.IPNet, ip net.IP) bool {
+	for _, cidr := range cidrs {
+		if cidr.Contains(ip) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// BPFFilterWriter writes a Filter into the filter maps of a loaded BPF module.
+type bpfFilterWriter struct {
+	module    bpfModule
+	endianess binary.ByteOrder
+}
+
+func newBPFFilterWriter(module bpfModule, endianess binary.ByteOrder) *bpfFilterWriter {
+	return &bpfFilterWriter{
+		module:    module,
+		endianess: endianess,
+	}
+}
+
+// Write replaces the filter currently in effect in the BPF program with the
+// supplied filter. While the filter maps are being rewritten, filtering is
+// disabled (apart from denied ports), so that events are never wrongly
+// discarded during the update. As the new keys of each map are added before the
+// old ones are removed, ports denied by both the old and new filters remain
+// denied throughout.
+func (w *bpfFilterWriter) write(filter *Filter) error {
+	if err := filter.validate(); err != nil {
+		return fmt.Errorf("validating filter: %w", err)
+	}
+
+	configMap, err := w.module.getMap(filterConfigMapName)
+	if err != nil {
+		return fmt.Errorf("getting filter config map: %w", err)
+	}
+
+	if err := w.writeConfig(configMap, 0); err != nil {
+		return fmt.Errorf("disabling filter: %w", err)
+	}
+
+	entries := map[string][][]byte{
+		filterAllowPortsMapName: w.portKeys(filter.AllowPorts),
+		filterDenyPortsMapName:  w.portKeys(filter.DenyPorts),
+		filterSrcCIDRsMapName:   w.cidrKeys(filter.SourceCIDRs),
+		filterDstCIDRsMapName:   w.cidrKeys(filter.DestCIDRs),
+		filterUIDsMapName:       w.idKeys(filter.UIDs),
+		filterGIDsMapName:       w.idKeys(filter.GIDs),
+		filterCommsMapName:      w.commKeys(filter.CommandPrefixes),
+		filterNetNSMapName:      w.idKeys(filter.NetNSINodes),
+	}
+
+	for _, name := range [...]string{
+		filterAllowPortsMapName,
+		filterDenyPortsMapName,
+		filterSrcCIDRsMapName,
+		filterDstCIDRsMapName,
+		filterUIDsMapName,
+		filterGIDsMapName,
+		filterCommsMapName,
+		filterNetNSMapName,
+	} {
+		if err := w.replaceKeys(name, entries[name]); err != nil {
+			return fmt.Errorf("writing filter map %q: %w", name, err)
+		}
+	}
+
+	if err := w.writeConfig(configMap, filter.flags()); err != nil {
+		return fmt.Errorf("enabling filter: %w", err)
+	}
+
+	return nil
+}
+
+func (w *bpfFilterWriter) writeConfig(configMap bpfMap, flags uint32) error {
+	key := make([]byte, 4) // The config is held in the single __u32-keyed entry 0
+	value := make([]byte, 4)
+	w.endianess.PutUint32(value, flags)
+
+	return configMap.update(key, value)
+}
+
+// ReplaceKeys replaces all keys in the named set-like map with the supplied keys.
+// The supplied keys are added before the existing keys not among them are
+// deleted, so a key in both is present throughout.
+func (w *bpfFilterWriter) replaceKeys(name string, keys [][]byte) error {
+	setMap, err := w.module.getMap(name)
+	if err != nil {
+		return fmt.Errorf("getting map: %w", err)
+	}
+
+	existingKeys, err := setMap.keys()
+	if err != nil {
+		return fmt.Errorf("listing existing keys: %w", err)
+	}
+
+	present := []byte{1}
+	wanted := make(map[string]bool, len(keys))
+	for _, key := range keys {
+		if err := setMap.update(key, present); err != nil {
+			return fmt.Errorf("adding key: %w", err)
+		}
+		wanted[string(key)] = true
+	}
+
+	for _, key := range existingKeys {
+		if wanted[string(key)] {
+			continue
+		}
+
+		if err := setMap.deleteKey(key); err != nil {
+			return fmt.Errorf("deleting existing key: %w", err)
+		}
+	}
+
+	return nil
+}
+
+func (w *bpfFilterWriter) portKeys(ports []uint16) [][]byte {
+	keys := make([][]byte, 0, len(ports))
+	for _, port := range ports {
+		key := make([]byte, 2)
+		w.endianess.PutUint16(key, port)
+		keys = append(keys, key)
+	}
+
+	return keys
+}
+
+func (w *bpfFilterWriter) idKeys(ids []uint32) [][]byte {
+	keys := make([][]byte, 0, len(ids))
+	for _, id := range ids {
+		key := make([]byte, 4)
+		w.endianess.PutUint32(key, id)
+		keys = append(keys, key)
+	}
+
+	return keys
+}
+
+// CIDRKeys creates LPM trie keys for the supplied networks. The layout matches
+// struct filter_addr_key in the BPF C: a __u32 prefix length followed by a 16-byte
+// address, with IPv4 networks being represented as IPv4-mapped IPv6 networks.
+func (w *bpfFilterWriter) cidrKeys(cidrs []*net.IPNet) [][]byte {
+	keys := make([][]byte, 0, len(cidrs))
+	for _, cidr := range cidrs {
+		ones, bits := cidr.Mask.Size()
+		if bits == 8*net.IPv4len {
+			ones += 8 * (net.IPv6len - net.IPv4len)
+		}
+
+		key := make([]byte, 4+net.IPv6len)
+		w.endianess.PutUint32(key, uint32(ones))
+		copy(key[4:], cidr.IP.To16())
+		keys = append(keys, key)
+	}
+
+	return keys
+}
+
+// CommKeys creates LPM trie keys for the supplied command prefixes. The layout
+// matches struct filter_comm_key in the BPF C: a __u32 prefix length (in bits)
+// followed by the NUL-padded command.
+func (w *bpfFilterWriter) commKeys(prefixes []string) [][]byte {
+	keys := make([][]byte, 0, len(prefixes))
+	for _, prefix := range prefixes {
+		key := make([]byte, 4+taskCommLen)
+		w.endianess.PutUint32(key, uint32(8*len(prefix)))
+		copy(key[4:], prefix)
+		keys = append(keys, key)
+	}
+
+	return keys
+}
@@ -0,0 +1,266 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/jhwbarlow/tcp-audit-bpf-eventer/pkg/bpfevent"
+	"github.com/jhwbarlow/tcp-audit-common/pkg/event"
+)
+
+func newMockFilterModule() (*mockBPFModule, map[string]*mockBPFMap) {
+	mockMaps := make(map[string]*mockBPFMap)
+	mapsToReturn := make(map[string]bpfMap)
+	for _, name := range [...]string{
+		filterConfigMapName,
+		filterAllowPortsMapName,
+		filterDenyPortsMapName,
+		filterSrcCIDRsMapName,
+		filterDstCIDRsMapName,
+		filterUIDsMapName,
+		filterGIDsMapName,
+		filterCommsMapName,
+		filterNetNSMapName,
+	} {
+		mockMap := newMockBPFMap(nil, nil)
+		mockMaps[name] = mockMap
+		mapsToReturn[name] = mockMap
+	}
+
+	mockModule := newMockBPFModule(nil, nil, nil, nil, nil)
+	mockModule.mapsToReturn = mapsToReturn
+
+	return mockModule, mockMaps
+}
+
+func mustParseCIDR(t *testing.T, s string) *net.IPNet {
+	_, cidr, err := net.ParseCIDR(s)
+	if err != nil {
+		t.Fatalf("parsing CIDR %q: %v", s, err)
+	}
+
+	return cidr
+}
+
+func TestFilterWrite(t *testing.T) {
+	mockModule, mockMaps := newMockFilterModule()
+	mockMaps[filterAllowPortsMapName].entries[string([]byte{0x50, 0x00})] = []byte{1} // Stale port 80 entry from previous filter
+
+	filter := &Filter{
+		AllowPorts:      []uint16{443},
+		DenyPorts:       []uint16{22},
+		SourceCIDRs:     []*net.IPNet{mustParseCIDR(t, "10.0.0.0/8")},
+		DestCIDRs:       []*net.IPNet{mustParseCIDR(t, "2001:db8::/32")},
+		UIDs:            []uint32{1000},
+		GIDs:            []uint32{100},
+		CommandPrefixes: []string{"post"},
+		NetNSINodes:     []uint32{4026531992},
+		ExcludeLoopback: true,
+	}
+
+	writer := newBPFFilterWriter(mockModule, binary.LittleEndian)
+	if err := writer.write(filter); err != nil {
+		t.Errorf("expected nil error, got %v (of type %T)", err, err)
+	}
+
+	tests := [...]struct {
+		mapName     string
+		expectedKey []byte
+	}{
+		{filterAllowPortsMapName, []byte{0xBB, 0x01}}, // 443 little endian
+		{filterDenyPortsMapName, []byte{0x16, 0x00}},  // 22 little endian
+		{filterSrcCIDRsMapName, []byte{
+			0x68, 0x00, 0x00, 0x00, // 104 little endian (96 + 8)
+			0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0xFF, 0xFF, 0x0A, 0x00, 0x00, 0x00, // ::ffff:10.0.0.0
+		}},
+		{filterDstCIDRsMapName, []byte{
+			0x20, 0x00, 0x00, 0x00, // 32 little endian
+			0x20, 0x01, 0x0D, 0xB8, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, // 2001:db8::
+		}},
+		{filterUIDsMapName, []byte{0xE8, 0x03, 0x00, 0x00}},  // 1000 little endian
+		{filterGIDsMapName, []byte{0x64, 0x00, 0x00, 0x00}},  // 100 little endian
+		{filterNetNSMapName, []byte{0x98, 0x00, 0x00, 0xF0}}, // 4026531992 little endian
+		{filterCommsMapName, []byte{
+			0x20, 0x00, 0x00, 0x00, // 32 little endian (4 bytes)
+			0x70, 0x6F, 0x73, 0x74, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, // ASCII "post"
+		}},
+	}
+
+	for _, test := range tests {
+		entries := mockMaps[test.mapName].entries
+		if len(entries) != 1 {
+			t.Errorf("map %q: expected 1 entry, got %d", test.mapName, len(entries))
+		}
+
+		if _, ok := entries[string(test.expectedKey)]; !ok {
+			t.Errorf("map %q: expected key %X to be present, but was not", test.mapName, test.expectedKey)
+		}
+	}
+
+	expectedConfig := []byte{0xFF, 0x00, 0x00, 0x00} // All flags set
+	config := mockMaps[filterConfigMapName].entries[string([]byte{0x00, 0x00, 0x00, 0x00})]
+	if !bytes.Equal(config, expectedConfig) {
+		t.Errorf("expected filter config %X, got %X", expectedConfig, config)
+	}
+}
+
+func TestFilterWriteEmpty(t *testing.T) {
+	mockModule, mockMaps := newMockFilterModule()
+	mockMaps[filterUIDsMapName].entries[string([]byte{0xE8, 0x03, 0x00, 0x00})] = []byte{1} // Stale entry from previous filter
+
+	writer := newBPFFilterWriter(mockModule, binary.LittleEndian)
+	if err := writer.write(new(Filter)); err != nil {
+		t.Errorf("expected nil error, got %v (of type %T)", err, err)
+	}
+
+	if len(mockMaps[filterUIDsMapName].entries) != 0 {
+		t.Error("expected stale filter entries to be removed, but were not")
+	}
+
+	expectedConfig := []byte{0x00, 0x00, 0x00, 0x00} // No flags set
+	config := mockMaps[filterConfigMapName].entries[string([]byte{0x00, 0x00, 0x00, 0x00})]
+	if !bytes.Equal(config, expectedConfig) {
+		t.Errorf("expected filter config %X, got %X", expectedConfig, config)
+	}
+}
+
+func TestFilterWriteRetainsDeniedPorts(t *testing.T) {
+	mockModule, mockMaps := newMockFilterModule()
+	mockMaps[filterDenyPortsMapName].entries[string([]byte{0x16, 0x00})] = []byte{1} // Port 22 denied by previous filter
+
+	writer := newBPFFilterWriter(mockModule, binary.LittleEndian)
+	if err := writer.write(&Filter{DenyPorts: []uint16{22, 23}}); err != nil {
+		t.Errorf("expected nil error, got %v (of type %T)", err, err)
+	}
+
+	// Port 22 is denied by both filters, so must never have been removed
+	if mockMaps[filterDenyPortsMapName].deleteKeyCalled {
+		t.Error("expected no denied port to be deleted, but was")
+	}
+
+	if len(mockMaps[filterDenyPortsMapName].entries) != 2 {
+		t.Errorf("expected 2 denied ports, got %d", len(mockMaps[filterDenyPortsMapName].entries))
+	}
+}
+
+func TestFilterWriteValidationError(t *testing.T) {
+	tests := [...]struct {
+		name   string
+		filter *Filter
+	}{
+		{"too many ports", &Filter{AllowPorts: make([]uint16, filterPortsMaxEntries+1)}},
+		{"nil CIDR", &Filter{SourceCIDRs: []*net.IPNet{nil}}},
+		{"non-canonical mask", &Filter{DestCIDRs: []*net.IPNet{{IP: net.IPv4(10, 0, 0, 0), Mask: net.IPMask{0xFF, 0x00, 0xFF, 0x00}}}}},
+		{"too many network namespaces", &Filter{NetNSINodes: make([]uint32, filterNetNSMaxEntries+1)}},
+		{"empty command prefix", &Filter{CommandPrefixes: []string{""}}},
+		{"long command prefix", &Filter{CommandPrefixes: []string{strings.Repeat("x", taskCommLen)}}},
+	}
+
+	for _, test := range tests {
+		mockModule, mockMaps := newMockFilterModule()
+		writer := newBPFFilterWriter(mockModule, binary.LittleEndian)
+
+		err := writer.write(test.filter)
+		if err == nil {
+			t.Errorf("%s: expected error, got nil", test.name)
+		}
+
+		t.Logf("%s: got error %q (of type %T)", test.name, err, err)
+
+		if mockMaps[filterConfigMapName].updateCalled {
+			t.Errorf("%s: expected filter maps not to be written, but were", test.name)
+		}
+	}
+}
+
+func TestFilterWriteMapError(t *testing.T) {
+	mockError := errors.New("mock BPF map error")
+	mockModule, mockMaps := newMockFilterModule()
+	mockMaps[filterSrcCIDRsMapName].errorToReturn = mockError
+
+	writer := newBPFFilterWriter(mockModule, binary.LittleEndian)
+
+	err := writer.write(&Filter{SourceCIDRs: []*net.IPNet{mustParseCIDR(t, "10.0.0.0/8")}})
+	if err == nil {
+		t.Error("expected error, got nil")
+	}
+
+	t.Logf("got error %q (of type %T)", err, err)
+
+	if !errors.Is(err, mockError) {
+		t.Errorf("expected error chain to include %q, but did not", mockError)
+	}
+
+	// Filtering should be left disabled, rather than partially applied
+	expectedConfig := []byte{0x00, 0x00, 0x00, 0x00}
+	config := mockMaps[filterConfigMapName].entries[string([]byte{0x00, 0x00, 0x00, 0x00})]
+	if !bytes.Equal(config, expectedConfig) {
+		t.Errorf("expected filter config %X, got %X", expectedConfig, config)
+	}
+}
+
+func TestFilterMatches(t *testing.T) {
+	mockEvent := &bpfevent.Event{
+		Event: event.Event{
+			CommandOnCPU: "postgres",
+			SourceIP:     net.IPv4(10, 0, 0, 1),
+			DestIP:       net.IPv4(192, 168, 0, 1),
+			SourcePort:   5432,
+			DestPort:     55420,
+			SocketInfo:   &event.SocketInfo{UID: 1000, GID: 100},
+		},
+		NetNSINode: 4026531992,
+	}
+
+	tests := [...]struct {
+		name     string
+		filter   *Filter
+		expected bool
+	}{
+		{"empty filter", new(Filter), true},
+		{"allowed port", &Filter{AllowPorts: []uint16{5432}}, true},
+		{"not allowed port", &Filter{AllowPorts: []uint16{443}}, false},
+		{"denied port", &Filter{AllowPorts: []uint16{5432}, DenyPorts: []uint16{55420}}, false},
+		{"allowed source CIDR", &Filter{SourceCIDRs: []*net.IPNet{mustParseCIDR(t, "10.0.0.0/8")}}, true},
+		{"not allowed destination CIDR", &Filter{DestCIDRs: []*net.IPNet{mustParseCIDR(t, "10.0.0.0/8")}}, false},
+		{"allowed UID", &Filter{UIDs: []uint32{1000}}, true},
+		{"not allowed GID", &Filter{GIDs: []uint32{0}}, false},
+		{"allowed network namespace", &Filter{NetNSINodes: []uint32{4026531992}}, true},
+		{"not allowed network namespace", &Filter{NetNSINodes: []uint32{1}}, false},
+		{"allowed command prefix", &Filter{CommandPrefixes: []string{"nginx", "post"}}, true},
+		{"not allowed command prefix", &Filter{CommandPrefixes: []string{"nginx"}}, false},
+		{"loopback excluded", &Filter{ExcludeLoopback: true}, true},
+	}
+
+	for _, test := range tests {
+		if matched := test.filter.matches(mockEvent); matched != test.expected {
+			t.Errorf("%s: expected match %t, got %t", test.name, test.expected, matched)
+		}
+	}
+}
+
+func TestFilterMatchesSnapshotIgnoresCommandPrefixes(t *testing.T) {
+	mockEvent := &bpfevent.Event{
+		Event: event.Event{
+			SourceIP:   net.IPv4(10, 0, 0, 1),
+			DestIP:     net.IPv4(192, 168, 0, 1),
+			SourcePort: 5432,
+			DestPort:   55420,
+		},
+		Snapshot: true,
+	}
+
+	filter := &Filter{CommandPrefixes: []string{"nginx"}}
+	if !filter.matches(mockEvent) {
+		t.Error("expected snapshot event to match command prefix filter, but did not")
+	}
+
+	filter.AllowPorts = []uint16{443}
+	if filter.matches(mockEvent) {
+		t.Error("expected snapshot event not to match port filter, but did")
+	}
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// KernelTimeConverter is an interface which describes objects which convert
+// kernel timestamps into wall-clock times.
+type kernelTimeConverter interface {
+	toTime(kernelTimeNs uint64) time.Time
+}
+
+// Clock is an interface which describes objects which read both the wall clock
+// and the kernel's monotonic clock (CLOCK_MONOTONIC).
+type clock interface {
+	wallNow() time.Time
+	monotonicNow() (time.Duration, error)
+}
+
+// SystemClock reads the system's wall and monotonic clocks.
+type systemClock struct{}
+
+func (*systemClock) wallNow() time.Time {
+	return time.Now()
+}
+
+func (*systemClock) monotonicNow() (time.Duration, error) {
+	var ts unix.Timespec
+	if err := unix.ClockGettime(unix.CLOCK_MONOTONIC, &ts); err != nil {
+		return 0, err
+	}
+
+	return time.Duration(ts.Nano()), nil
+}
+
+// MonotonicKernelTimeConverter converts kernel CLOCK_MONOTONIC timestamps, such as
+// those returned by bpf_ktime_get_ns(), into wall-clock times. It does this by
+// adding the offset between the wall clock and the monotonic clock, which is
+// calculated at construction and recalibrated periodically thereafter, as the wall
+// clock may drift from (or be stepped relative to) the monotonic clock.
+type monotonicKernelTimeConverter struct {
+	clock                 clock
+	recalibrationInterval time.Duration
+
+	mutex        sync.Mutex
+	offset       time.Duration
+	calibratedAt time.Duration // Monotonic time of last calibration
+}
+
+func newMonotonicKernelTimeConverter(clock clock,
+	recalibrationInterval time.Duration) (*monotonicKernelTimeConverter, error) {
+	converter := &monotonicKernelTimeConverter{
+		clock:                 clock,
+		recalibrationInterval: recalibrationInterval,
+	}
+
+	if err := converter.calibrate(); err != nil {
+		return nil, fmt.Errorf("calibrating kernel time offset: %w", err)
+	}
+
+	return converter, nil
+}
+
+// Calibrate calculates the offset between the wall clock and the monotonic clock.
+// The wall clock is read either side of the monotonic clock, and the midpoint is
+// used, to minimise the error caused by the time taken to read the clocks.
+func (c *monotonicKernelTimeConverter) calibrate() error {
+	wallBefore := c.clock.wallNow()
+	monotonic, err := c.clock.monotonicNow()
+	if err != nil {
+		return fmt.Errorf("reading monotonic clock: %w", err)
+	}
+	wallAfter := c.clock.wallNow()
+
+	wall := wallBefore.Add(wallAfter.Sub(wallBefore) / 2)
+	c.offset = time.Duration(wall.UnixNano()) - monotonic
+	c.calibratedAt = monotonic
+
+	return nil
+}
+
+// ToTime converts the supplied kernel CLOCK_MONOTONIC timestamp to a UTC
+// wall-clock time, first recalibrating the offset between the clocks if the
+// recalibration interval has passed.
+func (c *monotonicKernelTimeConverter) toTime(kernelTimeNs uint64) time.Time {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	kernelTime := time.Duration(kernelTimeNs)
+	if kernelTime-c.calibratedAt >= c.recalibrationInterval {
+		// Failure is not fatal, the previous offset is still a good approximation
+		if err := c.calibrate(); err != nil {
+			log.Printf("Error recalibrating kernel time offset: %v", err)
+			c.calibratedAt = kernelTime // Do not retry until the next interval
+		}
+	}
+
+	return time.Unix(0, int64(kernelTime+c.offset)).UTC()
+}
+
+// CurrentOffset returns the offset of the wall clock from the monotonic clock
+// as last calibrated.
+func (c *monotonicKernelTimeConverter) currentOffset() time.Duration {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	return c.offset
+}
+
+// FixedOffsetKernelTimeConverter converts kernel CLOCK_MONOTONIC timestamps into
+// wall-clock times using a fixed offset, such as one recorded in a capture.
+type fixedOffsetKernelTimeConverter struct {
+	offset time.Duration
+}
+
+func newFixedOffsetKernelTimeConverter(offset time.Duration) *fixedOffsetKernelTimeConverter {
+	return &fixedOffsetKernelTimeConverter{
+		offset: offset,
+	}
+}
+
+func (c *fixedOffsetKernelTimeConverter) toTime(kernelTimeNs uint64) time.Time {
+	return time.Unix(0, int64(time.Duration(kernelTimeNs)+c.offset)).UTC()
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+type mockClock struct {
+	wallTimesToReturn      []time.Time
+	monotonicTimesToReturn []time.Duration
+	errorToReturn          error
+
+	monotonicNowCalls int
+}
+
+func newMockClock(wallTimesToReturn []time.Time,
+	monotonicTimesToReturn []time.Duration,
+	errorToReturn error) *mockClock {
+	return &mockClock{
+		wallTimesToReturn:      wallTimesToReturn,
+		monotonicTimesToReturn: monotonicTimesToReturn,
+		errorToReturn:          errorToReturn,
+	}
+}
+
+func (mc *mockClock) wallNow() time.Time {
+	wallTime := mc.wallTimesToReturn[0]
+	mc.wallTimesToReturn = mc.wallTimesToReturn[1:]
+
+	return wallTime
+}
+
+func (mc *mockClock) monotonicNow() (time.Duration, error) {
+	mc.monotonicNowCalls++
+
+	if mc.errorToReturn != nil {
+		return 0, mc.errorToReturn
+	}
+
+	monotonicTime := mc.monotonicTimesToReturn[0]
+	mc.monotonicTimesToReturn = mc.monotonicTimesToReturn[1:]
+
+	return monotonicTime, nil
+}
+
+func TestKernelTimeConverter(t *testing.T) {
+	bootTime := time.Date(2021, 10, 1, 12, 0, 0, 0, time.UTC)
+	mockClock := newMockClock([]time.Time{
+		bootTime.Add(100 * time.Second), // Wall clock read either side of monotonic clock...
+		bootTime.Add(102 * time.Second), // ...giving a midpoint of 101s after boot
+	}, []time.Duration{101 * time.Second}, nil)
+
+	converter, err := newMonotonicKernelTimeConverter(mockClock, time.Minute)
+	if err != nil {
+		t.Errorf("expected nil constructor error, got %v (of type %T)", err, err)
+	}
+
+	output := converter.toTime(uint64(110 * time.Second))
+	expected := bootTime.Add(110 * time.Second)
+	if !output.Equal(expected) {
+		t.Errorf("expected time %v, got %v", expected, output)
+	}
+
+	if mockClock.monotonicNowCalls != 1 {
+		t.Errorf("expected monotonic clock to be read once, but was read %d times",
+			mockClock.monotonicNowCalls)
+	}
+}
+
+func TestKernelTimeConverterRecalibration(t *testing.T) {
+	bootTime := time.Date(2021, 10, 1, 12, 0, 0, 0, time.UTC)
+	mockClock := newMockClock([]time.Time{
+		bootTime.Add(100 * time.Second),
+		bootTime.Add(100 * time.Second),
+		bootTime.Add(165 * time.Second), // Wall clock has since been stepped forward by 5s
+		bootTime.Add(165 * time.Second),
+	}, []time.Duration{100 * time.Second, 160 * time.Second}, nil)
+
+	converter, err := newMonotonicKernelTimeConverter(mockClock, time.Minute)
+	if err != nil {
+		t.Errorf("expected nil constructor error, got %v (of type %T)", err, err)
+	}
+
+	// Event timestamped after the recalibration interval should trigger recalibration
+	output := converter.toTime(uint64(170 * time.Second))
+	expected := bootTime.Add(175 * time.Second)
+	if !output.Equal(expected) {
+		t.Errorf("expected time %v, got %v", expected, output)
+	}
+
+	if mockClock.monotonicNowCalls != 2 {
+		t.Errorf("expected monotonic clock to be read twice, but was read %d times",
+			mockClock.monotonicNowCalls)
+	}
+}
+
+func TestKernelTimeConverterConstructorClockError(t *testing.T) {
+	mockError := errors.New("mock monotonic clock error")
+	mockClock := newMockClock([]time.Time{time.Now()}, nil, mockError)
+
+	_, err := newMonotonicKernelTimeConverter(mockClock, time.Minute)
+	if err == nil {
+		t.Error("expected constructor error, got nil")
+	}
+
+	t.Logf("got constructor error %q (of type %T)", err, err)
+
+	if !errors.Is(err, mockError) {
+		t.Errorf("expected error chain to include %q, but did not", mockError)
+	}
+}
+
+func TestFixedOffsetKernelTimeConverter(t *testing.T) {
+	converter := newFixedOffsetKernelTimeConverter(1600000000 * time.Second)
+
+	expectedTime := time.Unix(1600000010, 0).UTC()
+	if converted := converter.toTime(uint64(10 * time.Second)); !converted.Equal(expectedTime) {
+		t.Errorf("expected time %v, got %v", expectedTime, converted)
+	}
+}
@@ -1,18 +1,31 @@
 package main
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"log"
+	"os"
+	"sync"
+	"time"
 
+	"github.com/jhwbarlow/tcp-audit-bpf-eventer/pkg/bpfevent"
+	"github.com/jhwbarlow/tcp-audit-bpf-eventer/pkg/preflight"
 	"github.com/jhwbarlow/tcp-audit-common/pkg/event"
 )
 
-// Magic, potentially tunable, constants
+// Magic constants. Those which are tunable are defaults, which can be
+// overridden by configuration.
 const (
 	tcpStateChangeEventChannelSize      = 1024
 	droppedEventsChannelSize            = 64
 	tcpStateChangeEventPerfBufSizePages = 16 // Number copied from existing libbpf tools
+	perfBufResizeThreshold              = 100
+	bpfModuleName                       = "tcp-audit"
+	kernelTimeRecalibrationInterval     = 1 * time.Minute
+	podLogDir                           = "/var/log/pods"
+	cgroupRescanInterval                = 5 * time.Second
+	processCacheSize                    = 4096
 )
 
 var ErrEventerClosed = errors.New("read from closed eventer")
@@ -21,40 +34,280 @@ type Eventer struct {
 	deserialiser        deserialiser
 	droppedEventHandler droppedEventHandler
 	bpfRunner           bpfRunner
+	cgroupResolver      cgroupResolver  // Nil if container attribution is disabled
+	processResolver     processResolver // Nil if process enrichment is disabled
+	metrics             *metrics
+	metricsServer       *metricsServer // Nil if metrics are not served
+
+	capabilityRequirements []capabilityRequirement // Of the configured features, once the BPF is loaded
+
+	snapshotMutex  sync.Mutex
+	snapshotEvents []*bpfevent.Event // Emitted before any events from the BPF runner
+
+	failureMutex sync.Mutex
+	failure      error // Returned on every read once set by the dropped event handler
 
 	done chan struct{}
 }
 
 func New() (e event.Eventer, err error) {
-	deserialiser := newCStructDeserialiser(systemEndianess())
-	droppedEventHandler := new(loggingDroppedEventHandler)
-	bpfObjectLoader := new(embeddedBPFObjectLoader)
-	bpfModuleCreator := newLibBPFGoBPFModuleCreator(bpfObjectLoader)
-	bpfRunner := newLibBPFGoBPFRunner(tcpStateChangeEventChannelSize,
-		droppedEventsChannelSize,
-		tcpStateChangeEventPerfBufSizePages,
-		bpfModuleCreator)
+	config, err := loadConfig(os.LookupEnv)
+	if err != nil {
+		return nil, fmt.Errorf("loading configuration: %w", err)
+	}
+
+	timeConverter, err := newMonotonicKernelTimeConverter(new(systemClock),
+		kernelTimeRecalibrationInterval)
+	if err != nil {
+		return nil, fmt.Errorf("creating kernel time converter: %w", err)
+	}
+
+	droppedEventHandler, err := newDroppedEventHandler(config.DroppedEventHandler,
+		config.DroppedEventThreshold,
+		new(systemClock))
+	if err != nil {
+		return nil, fmt.Errorf("creating dropped event handler: %w", err)
+	}
+
+	var cgroupResolver cgroupResolver
+	if config.CgroupRoot != "" && config.ReplayFile == "" {
+		cgroupResolver = newCgroupFSResolver(config.CgroupRoot,
+			config.PodLogDir,
+			cgroupRescanInterval,
+			new(systemClock))
+	}
+
+	var processResolver processResolver
+	if config.ProcRoot != "" && config.ReplayFile == "" {
+		processResolver = newProcFSResolver(config.ProcRoot, processCacheSize)
+	}
+
+	var deserialiser deserialiser
+	var bpfRunner bpfRunner
+	var transport bpfEventTransport
+	var captureWriter *captureWriter
+	switch {
+	case config.ReplayFile != "":
+		captureReader, err := openCaptureReader(config.ReplayFile)
+		if err != nil {
+			return nil, fmt.Errorf("opening capture to replay: %w", err)
+		}
+
+		// The events must be deserialised as they would have been when recorded
+		deserialiser = newCStructDeserialiser(captureReader.endianess,
+			newFixedOffsetKernelTimeConverter(captureReader.kernelTimeOffset))
+		bpfRunner = newReplayBPFRunner(captureReader, config.ReplaySpeed)
+	default:
+		deserialiser = newCStructDeserialiser(systemEndianess(), timeConverter)
+		attachMode := selectBPFAttachMode(kernelSupportsBTFAttach)
+		if config.Preflight {
+			report := config.preflightChecker(attachMode).check()
+			if err := report.Err(); err != nil {
+				return nil, err
+			}
+			logPreflightWarnings(report)
+		}
+
+		transport = selectBPFEventTransport(kernelSupportsRingBuf)
+		bpfModuleCreator := newLibBPFGoBPFModuleCreator(config.bpfObjectLoader(transport), config.btfLocator())
+		bpfRunner = newLibBPFGoBPFRunner(config.ModuleName,
+			config.EventChannelSize,
+			config.DroppedEventsChannelSize,
+			config.PerfBufSizePages,
+			config.PerfBufMaxSizePages,
+			config.PerfBufResizeThreshold,
+			transport,
+			attachMode,
+			config.PinPath,
+			bpfModuleCreator,
+			config.extraAttachments())
+
+		if config.RecordFile != "" {
+			captureWriter, err = createCaptureWriter(config.RecordFile, timeConverter.currentOffset())
+			if err != nil {
+				return nil, fmt.Errorf("creating capture to record to: %w", err)
+			}
+
+			bpfRunner = newRecordingBPFRunner(bpfRunner,
+				captureWriter,
+				new(systemClock),
+				config.EventChannelSize,
+				config.DroppedEventsChannelSize)
+		}
+	}
+
+	eventer, err := newEventer(deserialiser,
+		bpfRunner,
+		droppedEventHandler,
+		cgroupResolver,
+		processResolver,
+		newMetrics())
+	if err != nil {
+		if captureWriter != nil {
+			captureWriter.close()
+		}
+		return nil, err
+	}
+
+	if config.MetricsAddress != "" {
+		metricsServer, err := newMetricsServer(config.MetricsAddress, eventer.metrics)
+		if err != nil {
+			eventer.Close()
+			return nil, fmt.Errorf("starting metrics server: %w", err)
+		}
+		eventer.metricsServer = metricsServer
+	}
 
-	return newEventer(deserialiser, bpfRunner, droppedEventHandler)
+	if err := eventer.SetFilter(config.filter); err != nil {
+		eventer.Close()
+		return nil, fmt.Errorf("applying configured filter: %w", err)
+	}
+
+	if config.Snapshot {
+		snapshotter := newSockDiagSnapshotter(new(netlinkSockDiagDumper),
+			new(systemClock),
+			currentNetNSINode)
+		if err := eventer.snapshot(snapshotter, config.filter); err != nil {
+			eventer.Close()
+			return nil, fmt.Errorf("taking snapshot of existing sockets: %w", err)
+		}
+	}
+
+	// Once the BPF is loaded and the perf or ring buffer open, reading events
+	// requires no capabilities, so the host may drop all but those needed by
+	// other features. A replay requires none at all.
+	if config.ReplayFile == "" {
+		eventer.capabilityRequirements = config.capabilityRequirements(transport)
+	}
+
+	return eventer, nil
+}
+
+// Preflight checks that the environment meets the requirements of loading the
+// BPF programs, configured in the same way as by New. New runs the checks itself,
+// unless disabled, but they may be run on their own to diagnose a failure.
+func Preflight() (*preflight.Report, error) {
+	config, err := loadConfig(os.LookupEnv)
+	if err != nil {
+		return nil, fmt.Errorf("loading configuration: %w", err)
+	}
+
+	return config.preflightChecker(selectBPFAttachMode(kernelSupportsBTFAttach)).check(), nil
+}
+
+func logPreflightWarnings(report *preflight.Report) {
+	for _, result := range report.Results {
+		if result.Status == preflight.StatusWarn {
+			log.Printf("Preflight check warning: %v", result)
+		}
+	}
 }
 
 func newEventer(deserialiser deserialiser,
 	bpfRunner bpfRunner,
-	droppedEventHandler droppedEventHandler) (*Eventer, error) {
+	droppedEventHandler droppedEventHandler,
+	cgroupResolver cgroupResolver,
+	processResolver processResolver,
+	metrics *metrics) (*Eventer, error) {
 	if err := bpfRunner.run(); err != nil {
 		return nil, fmt.Errorf("loading BPF: %w", err)
 	}
 
+	metrics.observeEventChannel(bpfRunner.eventChannel())
+
 	return &Eventer{
 		deserialiser:        deserialiser,
 		bpfRunner:           bpfRunner,
 		droppedEventHandler: droppedEventHandler,
+		cgroupResolver:      cgroupResolver,
+		processResolver:     processResolver,
+		metrics:             metrics,
 
 		done: make(chan struct{}), // Closing this channel will cause Event() to no longer attempt to read from the BPF perf buffer
 	}, nil
 }
 
+// Event returns the next TCP state-change event, blocking until one is available.
 func (e *Eventer) Event() (*event.Event, error) {
+	return e.EventContext(context.Background())
+}
+
+// EventContext returns the next TCP state-change event, blocking until one is
+// available or the context is done, in which case the context's error is returned.
+func (e *Eventer) EventContext(ctx context.Context) (*event.Event, error) {
+	event, err := e.DetailedEventContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	return &event.Event, nil
+}
+
+// Events returns up to max TCP state-change events. It blocks until at least one
+// event is available or the context is done, in which case the context's error
+// is returned, and then returns that event along with any others which are
+// ready without blocking. If an error occurs after some events have been read,
+// those events are returned along with the error.
+func (e *Eventer) Events(ctx context.Context, max int) ([]*event.Event, error) {
+	detailedEvents, err := e.DetailedEvents(ctx, max)
+
+	events := make([]*event.Event, 0, len(detailedEvents))
+	for _, detailedEvent := range detailedEvents {
+		events = append(events, &detailedEvent.Event)
+	}
+
+	return events, err
+}
+
+// DetailedEvent returns the next TCP state-change event, including the detail
+// only available from BPF, blocking until one is available.
+func (e *Eventer) DetailedEvent() (*bpfevent.Event, error) {
+	return e.DetailedEventContext(context.Background())
+}
+
+// DetailedEventContext is the equivalent of EventContext for events including
+// the detail only available from BPF.
+func (e *Eventer) DetailedEventContext(ctx context.Context) (*bpfevent.Event, error) {
+	return e.nextEvent(ctx, true)
+}
+
+// DetailedEvents is the equivalent of Events for events including the detail
+// only available from BPF.
+func (e *Eventer) DetailedEvents(ctx context.Context, max int) ([]*bpfevent.Event, error) {
+	if max <= 0 {
+		return nil, fmt.Errorf("maximum number of events must be positive, got %d", max)
+	}
+
+	event, err := e.nextEvent(ctx, true)
+	if err != nil {
+		return nil, err
+	}
+
+	events := []*bpfevent.Event{event}
+	for len(events) < max {
+		event, err := e.nextEvent(ctx, false)
+		if err != nil {
+			if errors.Is(err, ErrEventerClosed) { // The next call will report the closure
+				break
+			}
+
+			return events, err
+		}
+
+		if event == nil { // No more events are ready
+			break
+		}
+
+		events = append(events, event)
+	}
+
+	return events, nil
+}
+
+// NextEvent returns the next TCP state-change event. If wait is true, it blocks
+// until an event is available or the context is done. Otherwise, it returns a
+// nil event and nil error if no event is ready.
+func (e *Eventer) nextEvent(ctx context.Context, wait bool) (*bpfevent.Event, error) {
 	for {
 		select {
 		case <-e.done:
@@ -62,36 +315,225 @@ func (e *Eventer) Event() (*event.Event, error) {
 		default:
 		}
 
-		select {
-		case <-e.done:
-			return nil, ErrEventerClosed
-		case eventData, ok := <-e.bpfRunner.eventChannel():
-			if !ok { // Check if the channel was closed, as the bpfRunner could be closed by Close() while Event() is being called
-				return nil, ErrEventerClosed
-			}
-
-			event, err := e.deserialiser.toEvent(eventData)
-			if err != nil {
-				return nil, fmt.Errorf("deserialising event: %w", err)
-			}
+		if err := e.checkFailure(); err != nil {
+			return nil, err
+		}
 
+		if event := e.nextSnapshotEvent(); event != nil {
 			return event, nil
-		case droppedEventsCount, ok := <-e.bpfRunner.droppedEventCountChannel():
-			if !ok {
+		}
+
+		var eventData []byte
+		var droppedEventsCount uint64
+		var isEvent, ok bool
+		if wait {
+			select {
+			case <-e.done:
 				return nil, ErrEventerClosed
+			case <-ctx.Done():
+				return nil, ctx.Err()
+			case eventData, ok = <-e.bpfRunner.eventChannel():
+				isEvent = true
+			case droppedEventsCount, ok = <-e.bpfRunner.droppedEventCountChannel():
+			}
+		} else {
+			select {
+			case eventData, ok = <-e.bpfRunner.eventChannel():
+				isEvent = true
+			case droppedEventsCount, ok = <-e.bpfRunner.droppedEventCountChannel():
+			default:
+				return nil, nil
 			}
+		}
+
+		if !ok { // Check if the channel was closed, as the bpfRunner could be closed by Close() while Event() is being called
+			return nil, ErrEventerClosed
+		}
+
+		if !isEvent {
+			e.metrics.eventsDropped(droppedEventsCount)
+			event, err := e.droppedEventHandler.handle(droppedEventsCount)
+			if err != nil {
+				if errors.Is(err, ErrEventLossThresholdExceeded) {
+					e.fail(err)
+					return nil, err
+				}
 
-			if err := e.droppedEventHandler.handle(droppedEventsCount); err != nil {
 				// Don't return anything, just go around the loop again to find a non-dropped event.
 				log.Printf("Error handling dropped event: %v", err)
 			}
+
+			if event != nil {
+				return event, nil
+			}
+
+			continue
+		}
+
+		return e.toEvent(eventData)
+	}
+}
+
+// Fail records an error which is returned on every subsequent read.
+func (e *Eventer) fail(err error) {
+	e.failureMutex.Lock()
+	defer e.failureMutex.Unlock()
+
+	if e.failure == nil {
+		e.failure = err
+	}
+}
+
+func (e *Eventer) checkFailure() error {
+	e.failureMutex.Lock()
+	defer e.failureMutex.Unlock()
+
+	return e.failure
+}
+
+func (e *Eventer) toEvent(eventData []byte) (*bpfevent.Event, error) {
+	e.metrics.eventReceived()
+
+	event, err := e.deserialiser.toEvent(eventData)
+	if err != nil {
+		e.metrics.deserialisationFailed(err)
+		return nil, fmt.Errorf("deserialising event: %w", err)
+	}
+	e.metrics.eventDeserialised(event.Kind, event.OldState, event.NewState)
+
+	if e.cgroupResolver != nil {
+		event.ContainerOnCPU = e.resolveContainer(event.CgroupIDOnCPU)
+		event.SocketContainer = e.resolveContainer(event.SocketCgroupID)
+	}
+
+	if e.processResolver != nil {
+		event.ProcessOnCPU = e.resolveProcess(event.PIDOnCPU, event.Time)
+	}
+
+	return event, nil
+}
+
+// Snapshot takes a snapshot of the sockets which already exist and queues
+// those which match the filter to be emitted before any events from the BPF
+// runner. As the BPF runner is already running, sockets which change state while
+// the snapshot is taken will appear both in the snapshot and as events.
+func (e *Eventer) snapshot(snapshotter socketSnapshotter, filter *Filter) error {
+	events, err := snapshotter.snapshot()
+	if err != nil {
+		return err
+	}
+
+	e.snapshotMutex.Lock()
+	defer e.snapshotMutex.Unlock()
+
+	for _, event := range events {
+		if filter == nil || filter.matches(event) {
+			e.snapshotEvents = append(e.snapshotEvents, event)
 		}
 	}
+	e.metrics.snapshotEventsEmitted(uint64(len(e.snapshotEvents)))
+
+	return nil
+}
+
+func (e *Eventer) nextSnapshotEvent() *bpfevent.Event {
+	e.snapshotMutex.Lock()
+	defer e.snapshotMutex.Unlock()
+
+	if len(e.snapshotEvents) == 0 {
+		return nil
+	}
+
+	event := e.snapshotEvents[0]
+	e.snapshotEvents[0] = nil // Allow the event to be garbage collected
+	e.snapshotEvents = e.snapshotEvents[1:]
+
+	return event
+}
+
+// ResolveContainer returns the container to which the cgroup belongs, or nil if
+// it does not belong to a container or cannot be resolved. Failure to resolve
+// is not fatal, as the event is still valid without it.
+func (e *Eventer) resolveContainer(cgroupID uint64) *bpfevent.Container {
+	container, err := e.cgroupResolver.resolve(cgroupID)
+	if err != nil {
+		log.Printf("Error resolving container of cgroup %d: %v", cgroupID, err)
+		return nil
+	}
+
+	return container
+}
+
+// ResolveProcess returns the process with the given PID at the given time, or nil
+// if it cannot be resolved. Failure to resolve is not fatal, as the event is
+// still valid without it.
+func (e *Eventer) resolveProcess(pid int, at time.Time) *bpfevent.Process {
+	process, err := e.processResolver.resolve(pid, at)
+	if err != nil {
+		log.Printf("Error resolving process %d: %v", pid, err)
+		return nil
+	}
+
+	return process
+}
+
+// RetainedCapabilities returns the capabilities, numbered as in linux/capability.h,
+// which the Eventer still requires now that the BPF is loaded, of those the
+// process is permitted. The Eventer does not drop capabilities itself, as
+// capabilities are held by each thread and it cannot change those of the
+// threads of the host process, so the host may drop all other capabilities
+// from every thread, for example using the psx and cap packages of libcap.
+func (e *Eventer) RetainedCapabilities() ([]int, error) {
+	retained, err := retainedCapabilitiesOf("/proc/self/status", e.capabilityRequirements)
+	if err != nil {
+		return nil, err
+	}
+
+	capabilities := make([]int, 0, len(retained))
+	for _, capability := range retained {
+		capabilities = append(capabilities, int(capability))
+	}
+
+	return capabilities, nil
+}
+
+// SetFilter replaces the filter determining which TCP state-change events are
+// emitted. The filter is applied in the kernel and can be changed at any time
+// while the Eventer is running. A nil filter removes all filtering.
+func (e *Eventer) SetFilter(filter *Filter) error {
+	if filter == nil {
+		filter = new(Filter)
+	}
+
+	if err := e.bpfRunner.setFilter(filter); err != nil {
+		return fmt.Errorf("setting BPF filter: %w", err)
+	}
+
+	return nil
+}
+
+// Unpin removes the BPF maps and links pinned beneath the configured pin path,
+// so that the BPF programs are detached and the maps freed once the Eventer is
+// closed, rather than being left for a restarted Eventer to resume from. It
+// should be called before Close on a deliberate shutdown, and does nothing if
+// pinning is not configured.
+func (e *Eventer) Unpin() error {
+	if err := e.bpfRunner.unpin(); err != nil {
+		return fmt.Errorf("unpinning BPF runner: %w", err)
+	}
+
+	return nil
 }
 
 func (e *Eventer) Close() error {
 	close(e.done) // Closing this channel will cause Event() to return ErrEventerClosed
 
+	if e.metricsServer != nil {
+		if err := e.metricsServer.close(); err != nil {
+			log.Printf("Error closing metrics server: %v", err)
+		}
+	}
+
 	if err := e.bpfRunner.close(); err != nil {
 		return fmt.Errorf("closing BPF runner: %w", err)
 	}
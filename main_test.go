@@ -1,9 +1,13 @@
 package main
 
 import (
+	"context"
 	"errors"
+	"fmt"
 	"testing"
+	"time"
 
+	"github.com/jhwbarlow/tcp-audit-bpf-eventer/pkg/bpfevent"
 	"github.com/jhwbarlow/tcp-audit-common/pkg/event"
 )
 
@@ -11,13 +15,19 @@ type mockBPFRunner struct {
 	eventChannelToReturn             <-chan []byte
 	droppedEventCountChannelToReturn <-chan uint64
 
-	runErrorToReturn   error
-	closeErrorToReturn error
+	runErrorToReturn       error
+	setFilterErrorToReturn error
+	unpinErrorToReturn     error
+	closeErrorToReturn     error
 
 	runCalled                      bool
 	eventChannelCalled             bool
 	droppedEventCountChannelCalled bool
+	setFilterCalled                bool
+	unpinCalled                    bool
 	closeCalled                    bool
+
+	receivedFilter *Filter
 }
 
 func newMockBPFRunner(eventChannelToReturn <-chan []byte,
@@ -54,6 +64,23 @@ func (mr *mockBPFRunner) droppedEventCountChannel() <-chan uint64 {
 	return mr.droppedEventCountChannelToReturn
 }
 
+func (mr *mockBPFRunner) setFilter(filter *Filter) error {
+	mr.setFilterCalled = true
+	mr.receivedFilter = filter
+
+	if mr.setFilterErrorToReturn != nil {
+		return mr.setFilterErrorToReturn
+	}
+
+	return nil
+}
+
+func (mr *mockBPFRunner) unpin() error {
+	mr.unpinCalled = true
+
+	return mr.unpinErrorToReturn
+}
+
 func (mr *mockBPFRunner) close() error {
 	mr.closeCalled = true
 
@@ -65,21 +92,24 @@ func (mr *mockBPFRunner) close() error {
 }
 
 type mockDroppedEventHandler struct {
+	eventToReturn       *bpfevent.Event
 	errorToReturn       error
 	chanToCloseOnHandle chan<- struct{}
 
 	handleCalled bool
 }
 
-func newMockDroppedEventHandler(errorToReturn error,
+func newMockDroppedEventHandler(eventToReturn *bpfevent.Event,
+	errorToReturn error,
 	chanToCloseOnHandle chan<- struct{}) *mockDroppedEventHandler {
 	return &mockDroppedEventHandler{
+		eventToReturn:       eventToReturn,
 		errorToReturn:       errorToReturn,
 		chanToCloseOnHandle: chanToCloseOnHandle,
 	}
 }
 
-func (mh *mockDroppedEventHandler) handle(droppedEventsCount uint64) error {
+func (mh *mockDroppedEventHandler) handle(droppedEventsCount uint64) (*bpfevent.Event, error) {
 	mh.handleCalled = true
 
 	if mh.chanToCloseOnHandle != nil {
@@ -87,28 +117,28 @@ func (mh *mockDroppedEventHandler) handle(droppedEventsCount uint64) error {
 	}
 
 	if mh.errorToReturn != nil {
-		return mh.errorToReturn
+		return nil, mh.errorToReturn
 	}
 
-	return nil
+	return mh.eventToReturn, nil
 }
 
 type mockDeserialiser struct {
-	eventToReturn *event.Event
+	eventToReturn *bpfevent.Event
 
 	errorToReturn error
 
 	toEventCalled bool
 }
 
-func newMockDeserialiser(eventToReturn *event.Event, errorToReturn error) *mockDeserialiser {
+func newMockDeserialiser(eventToReturn *bpfevent.Event, errorToReturn error) *mockDeserialiser {
 	return &mockDeserialiser{
 		eventToReturn: eventToReturn,
 		errorToReturn: errorToReturn,
 	}
 }
 
-func (md *mockDeserialiser) toEvent(data []byte) (*event.Event, error) {
+func (md *mockDeserialiser) toEvent(data []byte) (*bpfevent.Event, error) {
 	md.toEventCalled = true
 
 	if md.errorToReturn != nil {
@@ -118,15 +148,86 @@ func (md *mockDeserialiser) toEvent(data []byte) (*event.Event, error) {
 	return md.eventToReturn, nil
 }
 
+type mockCgroupResolver struct {
+	containersToReturn map[uint64]*bpfevent.Container
+	errorToReturn      error
+
+	receivedCgroupIDs []uint64
+}
+
+func newMockCgroupResolver(containersToReturn map[uint64]*bpfevent.Container,
+	errorToReturn error) *mockCgroupResolver {
+	return &mockCgroupResolver{
+		containersToReturn: containersToReturn,
+		errorToReturn:      errorToReturn,
+	}
+}
+
+func (mr *mockCgroupResolver) resolve(cgroupID uint64) (*bpfevent.Container, error) {
+	mr.receivedCgroupIDs = append(mr.receivedCgroupIDs, cgroupID)
+
+	if mr.errorToReturn != nil {
+		return nil, mr.errorToReturn
+	}
+
+	return mr.containersToReturn[cgroupID], nil
+}
+
+type mockProcessResolver struct {
+	processToReturn *bpfevent.Process
+	errorToReturn   error
+
+	receivedPID  int
+	receivedTime time.Time
+}
+
+func newMockProcessResolver(processToReturn *bpfevent.Process, errorToReturn error) *mockProcessResolver {
+	return &mockProcessResolver{
+		processToReturn: processToReturn,
+		errorToReturn:   errorToReturn,
+	}
+}
+
+func (mr *mockProcessResolver) resolve(pid int, at time.Time) (*bpfevent.Process, error) {
+	mr.receivedPID = pid
+	mr.receivedTime = at
+
+	if mr.errorToReturn != nil {
+		return nil, mr.errorToReturn
+	}
+
+	return mr.processToReturn, nil
+}
+
+type mockSocketSnapshotter struct {
+	eventsToReturn []*bpfevent.Event
+	errorToReturn  error
+}
+
+func newMockSocketSnapshotter(eventsToReturn []*bpfevent.Event, errorToReturn error) *mockSocketSnapshotter {
+	return &mockSocketSnapshotter{
+		eventsToReturn: eventsToReturn,
+		errorToReturn:  errorToReturn,
+	}
+}
+
+func (ms *mockSocketSnapshotter) snapshot() ([]*bpfevent.Event, error) {
+	if ms.errorToReturn != nil {
+		return nil, ms.errorToReturn
+	}
+
+	return ms.eventsToReturn, nil
+}
+
 func TestReadEvent(t *testing.T) {
-	mockEvent := &event.Event{}
+	mockEvent := &bpfevent.Event{}
 	mockDeserialiser := newMockDeserialiser(mockEvent, nil)
 	mockEventChannel := make(chan []byte, 1)     // This will be unused as the real deserialiser is mocked and does not consume the []byte read from this channel
 	var mockDroppedEventCountChannel chan uint64 // Nil so it will not be selected
 	mockBPFRunner := newMockBPFRunner(mockEventChannel, mockDroppedEventCountChannel, nil, nil)
-	mockDroppedEventHandler := newMockDroppedEventHandler(nil, nil)
+	mockDroppedEventHandler := newMockDroppedEventHandler(nil, nil, nil)
 
-	eventer, err := newEventer(mockDeserialiser, mockBPFRunner, mockDroppedEventHandler)
+	eventer, err := newEventer(mockDeserialiser, mockBPFRunner, mockDroppedEventHandler, nil, nil, newMetrics())
 	if err != nil {
 		t.Errorf("expected nil constructor error, got %v (of type %T)", err, err)
 	}
@@ -138,7 +239,7 @@ func TestReadEvent(t *testing.T) {
 		t.Errorf("expected nil error, got %v (of type %T)", err, err)
 	}
 
-	if !event.Equal(mockEvent) {
+	if !event.Equal(&mockEvent.Event) {
 		t.Error("expected returned event to be equal to mock event, but was not")
 	}
 
@@ -173,16 +274,16 @@ func TestReadEvent(t *testing.T) {
 }
 
 func TestReadDroppedEventCount(t *testing.T) {
-	mockEvent := &event.Event{}
+	mockEvent := &bpfevent.Event{}
 	mockDeserialiser := newMockDeserialiser(mockEvent, nil)
 	mockEventChannel := make(chan []byte) // This will be unused as the real deserialiser is mocked and does not consume the []byte read from this channel
 	mockDroppedEventCountChannel := make(chan uint64)
 	mockBPFRunner := newMockBPFRunner(mockEventChannel, mockDroppedEventCountChannel, nil, nil)
 	chanToCloseOnDroppedEventHandle := make(chan struct{})
-	mockDroppedEventHandler := newMockDroppedEventHandler(nil, chanToCloseOnDroppedEventHandle)
+	mockDroppedEventHandler := newMockDroppedEventHandler(nil, nil, chanToCloseOnDroppedEventHandle)
 	mockDroppedEventCount := uint64(10)
 
-	eventer, err := newEventer(mockDeserialiser, mockBPFRunner, mockDroppedEventHandler)
+	eventer, err := newEventer(mockDeserialiser, mockBPFRunner, mockDroppedEventHandler, nil, nil, newMetrics())
 	if err != nil {
 		t.Errorf("expected nil constructor error, got %v (of type %T)", err, err)
 	}
@@ -216,9 +317,9 @@ func TestReadEventDeserialiserError(t *testing.T) {
 	mockEventChannel := make(chan []byte, 1)     // This will be unused as the real deserialiser is mocked and does not consume the []byte read from this channel
 	var mockDroppedEventCountChannel chan uint64 // Nil so it will not be selected
 	mockBPFRunner := newMockBPFRunner(mockEventChannel, mockDroppedEventCountChannel, nil, nil)
-	mockDroppedEventHandler := newMockDroppedEventHandler(nil, nil)
+	mockDroppedEventHandler := newMockDroppedEventHandler(nil, nil, nil)
 
-	eventer, err := newEventer(mockDeserialiser, mockBPFRunner, mockDroppedEventHandler)
+	eventer, err := newEventer(mockDeserialiser, mockBPFRunner, mockDroppedEventHandler, nil, nil, newMetrics())
 	if err != nil {
 		t.Errorf("expected nil constructor error, got %v (of type %T)", err, err)
 	}
@@ -238,17 +339,17 @@ func TestReadEventDeserialiserError(t *testing.T) {
 }
 
 func TestReadDroppedEventCountHandlerError(t *testing.T) {
-	mockEvent := &event.Event{}
+	mockEvent := &bpfevent.Event{}
 	mockDeserialiser := newMockDeserialiser(mockEvent, nil)
 	mockEventChannel := make(chan []byte) // This will be unused as the real deserialiser is mocked and does not consume the []byte read from this channel
 	mockDroppedEventCountChannel := make(chan uint64)
 	mockBPFRunner := newMockBPFRunner(mockEventChannel, mockDroppedEventCountChannel, nil, nil)
 	chanToCloseOnDroppedEventHandle := make(chan struct{})
 	mockError := errors.New("mock dropped event count handler error")
-	mockDroppedEventHandler := newMockDroppedEventHandler(mockError, chanToCloseOnDroppedEventHandle)
+	mockDroppedEventHandler := newMockDroppedEventHandler(nil, mockError, chanToCloseOnDroppedEventHandle)
 	mockDroppedEventCount := uint64(10)
 
-	eventer, err := newEventer(mockDeserialiser, mockBPFRunner, mockDroppedEventHandler)
+	eventer, err := newEventer(mockDeserialiser, mockBPFRunner, mockDroppedEventHandler, nil, nil, newMetrics())
 	if err != nil {
 		t.Errorf("expected nil constructor error, got %v (of type %T)", err, err)
 	}
@@ -283,14 +384,105 @@ func TestReadDroppedEventCountHandlerError(t *testing.T) {
 	}
 }
 
+func TestReadDroppedEventCountHandlerEvent(t *testing.T) {
+	mockDeserialiser := newMockDeserialiser(&bpfevent.Event{}, nil)
+	var mockEventChannel chan []byte // Nil so it will not be selected
+	mockDroppedEventCountChannel := make(chan uint64, 1)
+	mockBPFRunner := newMockBPFRunner(mockEventChannel, mockDroppedEventCountChannel, nil, nil)
+	mockGapEvent := &bpfevent.Event{Kind: bpfevent.KindEventsLost, LostEvents: 10}
+	mockDroppedEventHandler := newMockDroppedEventHandler(mockGapEvent, nil, nil)
+
+	eventer, err := newEventer(mockDeserialiser, mockBPFRunner, mockDroppedEventHandler, nil, nil, newMetrics())
+	if err != nil {
+		t.Errorf("expected nil constructor error, got %v (of type %T)", err, err)
+	}
+
+	mockDroppedEventCountChannel <- 10
+
+	event, err := eventer.DetailedEvent()
+	if err != nil {
+		t.Errorf("expected nil error, got %v (of type %T)", err, err)
+	}
+
+	if event != mockGapEvent {
+		t.Errorf("expected event returned by dropped event handler %v, got %v", mockGapEvent, event)
+	}
+
+	if mockDeserialiser.toEventCalled {
+		t.Error("expected deserialiser not to be called, but was")
+	}
+}
+
+func TestReadDroppedEventCountGapEvent(t *testing.T) {
+	mockDeserialiser := newMockDeserialiser(&bpfevent.Event{}, nil)
+	var mockEventChannel chan []byte // Nil so it will not be selected
+	mockDroppedEventCountChannel := make(chan uint64, 1)
+	mockBPFRunner := newMockBPFRunner(mockEventChannel, mockDroppedEventCountChannel, nil, nil)
+	droppedEventHandler := newGapEventDroppedEventHandler(newMockClock([]time.Time{time.Now()}, nil, nil))
+
+	eventer, err := newEventer(mockDeserialiser, mockBPFRunner, droppedEventHandler, nil, nil, newMetrics())
+	if err != nil {
+		t.Errorf("expected nil constructor error, got %v (of type %T)", err, err)
+	}
+
+	mockDroppedEventCountChannel <- 10
+
+	// The gap must be visible to consumers of the common event
+	event, err := eventer.Event()
+	if err != nil {
+		t.Errorf("expected nil error, got %v (of type %T)", err, err)
+	}
+
+	if event == nil {
+		t.Fatal("expected event, got nil")
+	}
+
+	if event.CommandOnCPU != "events lost: 10" {
+		t.Errorf("expected command on-CPU %q, got %q", "events lost: 10", event.CommandOnCPU)
+	}
+}
+
+func TestReadDroppedEventCountThresholdExceeded(t *testing.T) {
+	mockDeserialiser := newMockDeserialiser(&bpfevent.Event{}, nil)
+	mockEventChannel := make(chan []byte, 1)
+	mockDroppedEventCountChannel := make(chan uint64, 1)
+	mockBPFRunner := newMockBPFRunner(mockEventChannel, mockDroppedEventCountChannel, nil, nil)
+	mockError := fmt.Errorf("mock dropped event count handler error: %w", ErrEventLossThresholdExceeded)
+	mockDroppedEventHandler := newMockDroppedEventHandler(nil, mockError, nil)
+
+	eventer, err := newEventer(mockDeserialiser, mockBPFRunner, mockDroppedEventHandler, nil, nil, newMetrics())
+	if err != nil {
+		t.Errorf("expected nil constructor error, got %v (of type %T)", err, err)
+	}
+
+	mockDroppedEventCountChannel <- 10
+
+	_, err = eventer.Event()
+	if !errors.Is(err, ErrEventLossThresholdExceeded) {
+		t.Errorf("expected error chain to include %q, got %v (of type %T)", ErrEventLossThresholdExceeded, err, err)
+	}
+
+	// Once the threshold is exceeded, no further events should be returned
+	mockEventChannel <- []byte{}
+
+	_, err = eventer.Event()
+	if !errors.Is(err, ErrEventLossThresholdExceeded) {
+		t.Errorf("expected error chain to include %q, got %v (of type %T)", ErrEventLossThresholdExceeded, err, err)
+	}
+
+	if mockDeserialiser.toEventCalled {
+		t.Error("expected deserialiser not to be called, but was")
+	}
+}
+
 func TestEventerConstructorBPFRunnerError(t *testing.T) {
-	mockEvent := &event.Event{}
+	mockEvent := &bpfevent.Event{}
 	mockDeserialiser := newMockDeserialiser(mockEvent, nil)
 	mockError := errors.New("mock BPF runner run error")
 	mockBPFRunner := newMockBPFRunner(nil, nil, mockError, nil)
-	mockDroppedEventHandler := newMockDroppedEventHandler(nil, nil)
+	mockDroppedEventHandler := newMockDroppedEventHandler(nil, nil, nil)
 
-	_, err := newEventer(mockDeserialiser, mockBPFRunner, mockDroppedEventHandler)
+	_, err := newEventer(mockDeserialiser, mockBPFRunner, mockDroppedEventHandler, nil, nil, newMetrics())
 	if err == nil {
 		t.Error("expected constructor error, got nil")
 	}
@@ -302,9 +494,9 @@ func TestEventerCloseError(t *testing.T) {
 	mockDeserialiser := newMockDeserialiser(nil, nil)
 	mockError := errors.New("mock BPF runner close error")
 	mockBPFRunner := newMockBPFRunner(nil, nil, nil, mockError)
-	mockDroppedEventHandler := newMockDroppedEventHandler(nil, nil)
+	mockDroppedEventHandler := newMockDroppedEventHandler(nil, nil, nil)
 
-	eventer, err := newEventer(mockDeserialiser, mockBPFRunner, mockDroppedEventHandler)
+	eventer, err := newEventer(mockDeserialiser, mockBPFRunner, mockDroppedEventHandler, nil, nil, newMetrics())
 	if err != nil {
 		t.Errorf("expected nil constructor error, got %v (of type %T)", err, err)
 	}
@@ -320,3 +512,460 @@ func TestEventerCloseError(t *testing.T) {
 		t.Error("expected BPF runner to be closed, but was not")
 	}
 }
+
+func TestEventerSetFilter(t *testing.T) {
+	mockDeserialiser := newMockDeserialiser(nil, nil)
+	mockBPFRunner := newMockBPFRunner(nil, nil, nil, nil)
+	mockDroppedEventHandler := newMockDroppedEventHandler(nil, nil, nil)
+	mockFilter := &Filter{AllowPorts: []uint16{443}}
+
+	eventer, err := newEventer(mockDeserialiser, mockBPFRunner, mockDroppedEventHandler, nil, nil, newMetrics())
+	if err != nil {
+		t.Errorf("expected nil constructor error, got %v (of type %T)", err, err)
+	}
+
+	err = eventer.SetFilter(mockFilter)
+	if err != nil {
+		t.Errorf("expected nil error, got %v (of type %T)", err, err)
+	}
+
+	if !mockBPFRunner.setFilterCalled {
+		t.Error("expected BPF runner set filter to be called, but was not")
+	}
+
+	if mockBPFRunner.receivedFilter != mockFilter {
+		t.Error("expected BPF runner to receive the supplied filter, but did not")
+	}
+}
+
+func TestEventerSetFilterNil(t *testing.T) {
+	mockDeserialiser := newMockDeserialiser(nil, nil)
+	mockBPFRunner := newMockBPFRunner(nil, nil, nil, nil)
+	mockDroppedEventHandler := newMockDroppedEventHandler(nil, nil, nil)
+
+	eventer, err := newEventer(mockDeserialiser, mockBPFRunner, mockDroppedEventHandler, nil, nil, newMetrics())
+	if err != nil {
+		t.Errorf("expected nil constructor error, got %v (of type %T)", err, err)
+	}
+
+	err = eventer.SetFilter(nil)
+	if err != nil {
+		t.Errorf("expected nil error, got %v (of type %T)", err, err)
+	}
+
+	if mockBPFRunner.receivedFilter == nil || mockBPFRunner.receivedFilter.flags() != 0 {
+		t.Errorf("expected BPF runner to receive an empty filter, got %+v", mockBPFRunner.receivedFilter)
+	}
+}
+
+func TestEventerSetFilterError(t *testing.T) {
+	mockDeserialiser := newMockDeserialiser(nil, nil)
+	mockError := errors.New("mock BPF runner set filter error")
+	mockBPFRunner := newMockBPFRunner(nil, nil, nil, nil)
+	mockBPFRunner.setFilterErrorToReturn = mockError
+	mockDroppedEventHandler := newMockDroppedEventHandler(nil, nil, nil)
+
+	eventer, err := newEventer(mockDeserialiser, mockBPFRunner, mockDroppedEventHandler, nil, nil, newMetrics())
+	if err != nil {
+		t.Errorf("expected nil constructor error, got %v (of type %T)", err, err)
+	}
+
+	err = eventer.SetFilter(new(Filter))
+	if err == nil {
+		t.Error("expected error, got nil")
+	}
+
+	t.Logf("got error %q (of type %T)", err, err)
+
+	if !errors.Is(err, mockError) {
+		t.Errorf("expected error chain to include %q, but did not", mockError)
+	}
+}
+
+func TestEventerUnpinError(t *testing.T) {
+	mockDeserialiser := newMockDeserialiser(nil, nil)
+	mockError := errors.New("mock BPF runner unpin error")
+	mockBPFRunner := newMockBPFRunner(nil, nil, nil, nil)
+	mockBPFRunner.unpinErrorToReturn = mockError
+	mockDroppedEventHandler := newMockDroppedEventHandler(nil, nil, nil)
+
+	eventer, err := newEventer(mockDeserialiser, mockBPFRunner, mockDroppedEventHandler, nil, nil, newMetrics())
+	if err != nil {
+		t.Errorf("expected nil constructor error, got %v (of type %T)", err, err)
+	}
+
+	err = eventer.Unpin()
+	if err == nil {
+		t.Error("expected error, got nil")
+	}
+
+	t.Logf("got error %q (of type %T)", err, err)
+
+	if !mockBPFRunner.unpinCalled {
+		t.Error("expected BPF runner to be unpinned, but was not")
+	}
+
+	if !errors.Is(err, mockError) {
+		t.Errorf("expected error chain to include %q, but did not", mockError)
+	}
+}
+
+func TestReadDetailedEventContainers(t *testing.T) {
+	mockEvent := &bpfevent.Event{CgroupIDOnCPU: 1, SocketCgroupID: 2}
+	mockContainer := &bpfevent.Container{ID: "mock-container"}
+	mockDeserialiser := newMockDeserialiser(mockEvent, nil)
+	mockEventChannel := make(chan []byte, 1)
+	mockBPFRunner := newMockBPFRunner(mockEventChannel, nil, nil, nil)
+	mockDroppedEventHandler := newMockDroppedEventHandler(nil, nil, nil)
+	mockCgroupResolver := newMockCgroupResolver(map[uint64]*bpfevent.Container{2: mockContainer}, nil)
+
+	eventer, err := newEventer(mockDeserialiser,
+		mockBPFRunner,
+		mockDroppedEventHandler,
+		mockCgroupResolver,
+		nil,
+		newMetrics())
+	if err != nil {
+		t.Errorf("expected nil constructor error, got %v (of type %T)", err, err)
+	}
+
+	mockEventChannel <- []byte{} // Dummy event data to force selection on the channel
+
+	event, err := eventer.DetailedEvent()
+	if err != nil {
+		t.Errorf("expected nil error, got %v (of type %T)", err, err)
+	}
+
+	if len(mockCgroupResolver.receivedCgroupIDs) != 2 {
+		t.Errorf("expected cgroup resolver to be called twice, but was called %d times",
+			len(mockCgroupResolver.receivedCgroupIDs))
+	}
+
+	if event.ContainerOnCPU != nil {
+		t.Errorf("expected nil on-CPU container, got %v", event.ContainerOnCPU)
+	}
+
+	if event.SocketContainer != mockContainer {
+		t.Errorf("expected socket container %v, got %v", mockContainer, event.SocketContainer)
+	}
+}
+
+func TestReadDetailedEventContainerResolverError(t *testing.T) {
+	mockEvent := &bpfevent.Event{CgroupIDOnCPU: 1, SocketCgroupID: 2}
+	mockDeserialiser := newMockDeserialiser(mockEvent, nil)
+	mockEventChannel := make(chan []byte, 1)
+	mockBPFRunner := newMockBPFRunner(mockEventChannel, nil, nil, nil)
+	mockDroppedEventHandler := newMockDroppedEventHandler(nil, nil, nil)
+	mockCgroupResolver := newMockCgroupResolver(nil, errors.New("mock cgroup resolver error"))
+
+	eventer, err := newEventer(mockDeserialiser,
+		mockBPFRunner,
+		mockDroppedEventHandler,
+		mockCgroupResolver,
+		nil,
+		newMetrics())
+	if err != nil {
+		t.Errorf("expected nil constructor error, got %v (of type %T)", err, err)
+	}
+
+	mockEventChannel <- []byte{} // Dummy event data to force selection on the channel
+
+	// Failure to resolve the containers should not prevent the event being returned
+	event, err := eventer.DetailedEvent()
+	if err != nil {
+		t.Errorf("expected nil error, got %v (of type %T)", err, err)
+	}
+
+	if event.ContainerOnCPU != nil || event.SocketContainer != nil {
+		t.Error("expected nil containers, but were not")
+	}
+}
+
+func TestReadDetailedEventProcess(t *testing.T) {
+	timeNow := time.Now()
+	mockEvent := &bpfevent.Event{Event: event.Event{Time: timeNow, PIDOnCPU: 1234}}
+	mockProcess := &bpfevent.Process{Executable: "/usr/bin/mock"}
+	mockDeserialiser := newMockDeserialiser(mockEvent, nil)
+	mockEventChannel := make(chan []byte, 1)
+	mockBPFRunner := newMockBPFRunner(mockEventChannel, nil, nil, nil)
+	mockDroppedEventHandler := newMockDroppedEventHandler(nil, nil, nil)
+	mockProcessResolver := newMockProcessResolver(mockProcess, nil)
+
+	eventer, err := newEventer(mockDeserialiser,
+		mockBPFRunner,
+		mockDroppedEventHandler,
+		nil,
+		mockProcessResolver,
+		newMetrics())
+	if err != nil {
+		t.Errorf("expected nil constructor error, got %v (of type %T)", err, err)
+	}
+
+	mockEventChannel <- []byte{} // Dummy event data to force selection on the channel
+
+	event, err := eventer.DetailedEvent()
+	if err != nil {
+		t.Errorf("expected nil error, got %v (of type %T)", err, err)
+	}
+
+	if mockProcessResolver.receivedPID != 1234 || !mockProcessResolver.receivedTime.Equal(timeNow) {
+		t.Errorf("expected process resolver to receive PID %d at %v, but received PID %d at %v",
+			1234,
+			timeNow,
+			mockProcessResolver.receivedPID,
+			mockProcessResolver.receivedTime)
+	}
+
+	if event.ProcessOnCPU != mockProcess {
+		t.Errorf("expected on-CPU process %v, got %v", mockProcess, event.ProcessOnCPU)
+	}
+}
+
+func TestReadDetailedEventProcessResolverError(t *testing.T) {
+	mockEvent := &bpfevent.Event{Event: event.Event{PIDOnCPU: 1234}}
+	mockDeserialiser := newMockDeserialiser(mockEvent, nil)
+	mockEventChannel := make(chan []byte, 1)
+	mockBPFRunner := newMockBPFRunner(mockEventChannel, nil, nil, nil)
+	mockDroppedEventHandler := newMockDroppedEventHandler(nil, nil, nil)
+	mockProcessResolver := newMockProcessResolver(nil, errors.New("mock process resolver error"))
+
+	eventer, err := newEventer(mockDeserialiser,
+		mockBPFRunner,
+		mockDroppedEventHandler,
+		nil,
+		mockProcessResolver,
+		newMetrics())
+	if err != nil {
+		t.Errorf("expected nil constructor error, got %v (of type %T)", err, err)
+	}
+
+	mockEventChannel <- []byte{} // Dummy event data to force selection on the channel
+
+	// Failure to resolve the process should not prevent the event being returned
+	event, err := eventer.DetailedEvent()
+	if err != nil {
+		t.Errorf("expected nil error, got %v (of type %T)", err, err)
+	}
+
+	if event.ProcessOnCPU != nil {
+		t.Errorf("expected nil on-CPU process, got %v", event.ProcessOnCPU)
+	}
+}
+
+func TestReadSnapshotEventsFirst(t *testing.T) {
+	mockEvent := &bpfevent.Event{}
+	mockSnapshotEvents := []*bpfevent.Event{
+		{Snapshot: true, Event: event.Event{SourcePort: 22}}, // Discarded by filter
+		{Snapshot: true, Event: event.Event{SourcePort: 443}},
+	}
+	mockDeserialiser := newMockDeserialiser(mockEvent, nil)
+	mockEventChannel := make(chan []byte, 1)
+	mockBPFRunner := newMockBPFRunner(mockEventChannel, nil, nil, nil)
+	mockDroppedEventHandler := newMockDroppedEventHandler(nil, nil, nil)
+	mockSnapshotter := newMockSocketSnapshotter(mockSnapshotEvents, nil)
+
+	eventer, err := newEventer(mockDeserialiser, mockBPFRunner, mockDroppedEventHandler, nil, nil, newMetrics())
+	if err != nil {
+		t.Errorf("expected nil constructor error, got %v (of type %T)", err, err)
+	}
+
+	if err := eventer.snapshot(mockSnapshotter, &Filter{DenyPorts: []uint16{22}}); err != nil {
+		t.Errorf("expected nil error, got %v (of type %T)", err, err)
+	}
+
+	mockEventChannel <- []byte{} // Dummy event data which should only be read after the snapshot events
+
+	event, err := eventer.DetailedEvent()
+	if err != nil {
+		t.Errorf("expected nil error, got %v (of type %T)", err, err)
+	}
+
+	if event != mockSnapshotEvents[1] {
+		t.Errorf("expected snapshot event %v, got %v", mockSnapshotEvents[1], event)
+	}
+
+	if mockDeserialiser.toEventCalled {
+		t.Error("expected deserialiser not to be called before snapshot events are exhausted, but was")
+	}
+
+	event, err = eventer.DetailedEvent()
+	if err != nil {
+		t.Errorf("expected nil error, got %v (of type %T)", err, err)
+	}
+
+	if event != mockEvent {
+		t.Errorf("expected live event %v, got %v", mockEvent, event)
+	}
+}
+
+func TestEventerSnapshotError(t *testing.T) {
+	mockError := errors.New("mock socket snapshotter error")
+	mockBPFRunner := newMockBPFRunner(nil, nil, nil, nil)
+	mockSnapshotter := newMockSocketSnapshotter(nil, mockError)
+
+	eventer, err := newEventer(newMockDeserialiser(nil, nil),
+		mockBPFRunner,
+		newMockDroppedEventHandler(nil, nil, nil),
+		nil,
+		nil,
+		newMetrics())
+	if err != nil {
+		t.Errorf("expected nil constructor error, got %v (of type %T)", err, err)
+	}
+
+	err = eventer.snapshot(mockSnapshotter, nil)
+	if err == nil {
+		t.Error("expected error, got nil")
+	}
+
+	t.Logf("got error %q (of type %T)", err, err)
+
+	if !errors.Is(err, mockError) {
+		t.Errorf("expected error chain to include %q, but did not", mockError)
+	}
+}
+
+func TestReadEventContextCancelled(t *testing.T) {
+	mockBPFRunner := newMockBPFRunner(make(chan []byte), make(chan uint64), nil, nil)
+
+	eventer, err := newEventer(newMockDeserialiser(nil, nil),
+		mockBPFRunner,
+		newMockDroppedEventHandler(nil, nil, nil),
+		nil,
+		nil,
+		newMetrics())
+	if err != nil {
+		t.Errorf("expected nil constructor error, got %v (of type %T)", err, err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+
+	_, err = eventer.EventContext(ctx)
+	if err == nil {
+		t.Error("expected error, got nil")
+	}
+
+	t.Logf("got error %q (of type %T)", err, err)
+
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("expected error chain to include %q, but did not", context.DeadlineExceeded)
+	}
+
+	// The Eventer should still be usable after the context is done
+	if err := eventer.Close(); err != nil {
+		t.Errorf("expected nil error, got %v (of type %T)", err, err)
+	}
+
+	_, err = eventer.EventContext(context.Background())
+	if !errors.Is(err, ErrEventerClosed) {
+		t.Errorf("expected error chain to include %q, but did not", ErrEventerClosed)
+	}
+}
+
+func TestReadEvents(t *testing.T) {
+	mockEvent := &bpfevent.Event{}
+	mockDeserialiser := newMockDeserialiser(mockEvent, nil)
+	mockEventChannel := make(chan []byte, 3)
+	mockDroppedEventCountChannel := make(chan uint64, 1)
+	mockBPFRunner := newMockBPFRunner(mockEventChannel, mockDroppedEventCountChannel, nil, nil)
+	mockDroppedEventHandler := newMockDroppedEventHandler(nil, nil, nil)
+
+	eventer, err := newEventer(mockDeserialiser, mockBPFRunner, mockDroppedEventHandler, nil, nil, newMetrics())
+	if err != nil {
+		t.Errorf("expected nil constructor error, got %v (of type %T)", err, err)
+	}
+
+	mockEventChannel <- []byte{}
+	mockEventChannel <- []byte{}
+	mockEventChannel <- []byte{}
+	mockDroppedEventCountChannel <- 10 // Should be handled without ending the batch
+
+	events, err := eventer.Events(context.Background(), 2)
+	if err != nil {
+		t.Errorf("expected nil error, got %v (of type %T)", err, err)
+	}
+
+	if len(events) != 2 {
+		t.Errorf("expected %d events, got %d", 2, len(events))
+	}
+
+	events, err = eventer.Events(context.Background(), 2)
+	if err != nil {
+		t.Errorf("expected nil error, got %v (of type %T)", err, err)
+	}
+
+	if len(events) != 1 {
+		t.Errorf("expected %d events, got %d", 1, len(events))
+	}
+
+	if !mockDroppedEventHandler.handleCalled {
+		t.Error("expected dropped event handler to be called, but was not")
+	}
+}
+
+func TestReadEventsChannelClosed(t *testing.T) {
+	mockEvent := &bpfevent.Event{}
+	mockEventChannel := make(chan []byte, 1)
+	mockBPFRunner := newMockBPFRunner(mockEventChannel, nil, nil, nil)
+
+	eventer, err := newEventer(newMockDeserialiser(mockEvent, nil),
+		mockBPFRunner,
+		newMockDroppedEventHandler(nil, nil, nil),
+		nil,
+		nil,
+		newMetrics())
+	if err != nil {
+		t.Errorf("expected nil constructor error, got %v (of type %T)", err, err)
+	}
+
+	mockEventChannel <- []byte{}
+	close(mockEventChannel) // As if the BPF runner was closed
+
+	// The event read before the closure should be returned without error
+	events, err := eventer.Events(context.Background(), 10)
+	if err != nil {
+		t.Errorf("expected nil error, got %v (of type %T)", err, err)
+	}
+
+	if len(events) != 1 {
+		t.Errorf("expected %d events, got %d", 1, len(events))
+	}
+
+	_, err = eventer.Events(context.Background(), 10)
+	if !errors.Is(err, ErrEventerClosed) {
+		t.Errorf("expected error chain to include %q, but did not", ErrEventerClosed)
+	}
+}
+
+func TestReadEventsIllegalMax(t *testing.T) {
+	eventer, err := newEventer(newMockDeserialiser(nil, nil),
+		newMockBPFRunner(nil, nil, nil, nil),
+		newMockDroppedEventHandler(nil, nil, nil),
+		nil,
+		nil,
+		newMetrics())
+	if err != nil {
+		t.Errorf("expected nil constructor error, got %v (of type %T)", err, err)
+	}
+
+	_, err = eventer.Events(context.Background(), 0)
+	if err == nil {
+		t.Error("expected error, got nil")
+	}
+
+	t.Logf("got error %q (of type %T)", err, err)
+}
+
+func TestEventerRetainedCapabilitiesNoRequirements(t *testing.T) {
+	eventer := &Eventer{} // As when replaying, the Eventer requires no capabilities
+
+	capabilities, err := eventer.RetainedCapabilities()
+	if err != nil {
+		t.Errorf("expected nil error, got %v (of type %T)", err, err)
+	}
+
+	if len(capabilities) != 0 {
+		t.Errorf("expected no capabilities, got %v", capabilities)
+	}
+}
@@ -0,0 +1,249 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/jhwbarlow/tcp-audit-bpf-eventer/pkg/bpfevent"
+	"github.com/jhwbarlow/tcp-audit-common/pkg/tcpstate"
+)
+
+const (
+	metricsNamespace = "tcp_audit_bpf"
+	metricsPath      = "/metrics"
+)
+
+// StateTransition is a pair of TCP states used to count transitions between them.
+type stateTransition struct {
+	oldState, newState tcpstate.State
+}
+
+// Metrics holds counters and gauges describing the operation of the Eventer.
+// All methods are safe for concurrent use.
+type metrics struct {
+	eventsReceived     uint64 // Accessed atomically
+	eventsDeserialised uint64 // Accessed atomically
+	droppedEvents      uint64 // Accessed atomically
+	snapshotEvents     uint64 // Accessed atomically
+
+	mutex                 sync.Mutex
+	deserialisationErrors map[string]uint64
+	stateTransitions      map[stateTransition]uint64
+	eventKinds            map[bpfevent.Kind]uint64
+
+	eventChannelOccupancy func() int
+	eventChannelCapacity  func() int
+}
+
+func newMetrics() *metrics {
+	return &metrics{
+		deserialisationErrors: make(map[string]uint64),
+		stateTransitions:      make(map[stateTransition]uint64),
+		eventKinds:            make(map[bpfevent.Kind]uint64),
+	}
+}
+
+func (m *metrics) eventReceived() {
+	atomic.AddUint64(&m.eventsReceived, 1)
+}
+
+// EventDeserialised records a deserialised event by kind, and also by state
+// transition if the event is a state change.
+func (m *metrics) eventDeserialised(kind bpfevent.Kind, oldState, newState tcpstate.State) {
+	atomic.AddUint64(&m.eventsDeserialised, 1)
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.eventKinds[kind]++
+	if kind == bpfevent.KindStateChange {
+		m.stateTransitions[stateTransition{oldState, newState}]++
+	}
+}
+
+// DeserialisationFailed records a deserialisation error, categorised by cause
+// if the error is a deserialisationError.
+func (m *metrics) deserialisationFailed(err error) {
+	cause := "unknown"
+	var deserialisationErr *deserialisationError
+	if errors.As(err, &deserialisationErr) {
+		cause = deserialisationErr.cause
+	}
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.deserialisationErrors[cause]++
+}
+
+func (m *metrics) snapshotEventsEmitted(count uint64) {
+	atomic.AddUint64(&m.snapshotEvents, count)
+}
+
+func (m *metrics) eventsDropped(count uint64) {
+	atomic.AddUint64(&m.droppedEvents, count)
+}
+
+// ObserveEventChannel registers the channel on which events are received from the
+// BPF runner, so that its occupancy can be reported.
+func (m *metrics) observeEventChannel(eventChan <-chan []byte) {
+	m.eventChannelOccupancy = func() int { return len(eventChan) }
+	m.eventChannelCapacity = func() int { return cap(eventChan) }
+}
+
+// WriteTo writes all metrics to w in the Prometheus text exposition format.
+func (m *metrics) writeTo(w io.Writer) error {
+	var b strings.Builder
+
+	writeMetricHeader(&b, "events_received_total", "counter",
+		"Number of events received from the kernel.")
+	writeMetricValue(&b, "events_received_total", nil, atomic.LoadUint64(&m.eventsReceived))
+
+	writeMetricHeader(&b, "events_deserialised_total", "counter",
+		"Number of events successfully deserialised.")
+	writeMetricValue(&b, "events_deserialised_total", nil, atomic.LoadUint64(&m.eventsDeserialised))
+
+	writeMetricHeader(&b, "dropped_events_total", "counter",
+		"Number of events dropped by the kernel due to the kernel buffer being full.")
+	writeMetricValue(&b, "dropped_events_total", nil, atomic.LoadUint64(&m.droppedEvents))
+
+	writeMetricHeader(&b, "snapshot_events_total", "counter",
+		"Number of snapshot events describing sockets which existed at startup.")
+	writeMetricValue(&b, "snapshot_events_total", nil, atomic.LoadUint64(&m.snapshotEvents))
+
+	if m.eventChannelOccupancy != nil {
+		writeMetricHeader(&b, "event_channel_occupancy", "gauge",
+			"Number of events waiting in the user-space event channel.")
+		writeMetricValue(&b, "event_channel_occupancy", nil, uint64(m.eventChannelOccupancy()))
+
+		writeMetricHeader(&b, "event_channel_capacity", "gauge",
+			"Capacity of the user-space event channel.")
+		writeMetricValue(&b, "event_channel_capacity", nil, uint64(m.eventChannelCapacity()))
+	}
+
+	m.mutex.Lock()
+	causes := make([]string, 0, len(m.deserialisationErrors))
+	for cause := range m.deserialisationErrors {
+		causes = append(causes, cause)
+	}
+	sort.Strings(causes)
+
+	writeMetricHeader(&b, "deserialisation_errors_total", "counter",
+		"Number of events which could not be deserialised, by cause.")
+	for _, cause := range causes {
+		writeMetricValue(&b, "deserialisation_errors_total",
+			[]string{"cause", cause},
+			m.deserialisationErrors[cause])
+	}
+
+	transitions := make([]stateTransition, 0, len(m.stateTransitions))
+	for transition := range m.stateTransitions {
+		transitions = append(transitions, transition)
+	}
+	sort.Slice(transitions, func(i, j int) bool {
+		if transitions[i].oldState != transitions[j].oldState {
+			return transitions[i].oldState < transitions[j].oldState
+		}
+		return transitions[i].newState < transitions[j].newState
+	})
+
+	writeMetricHeader(&b, "state_transitions_total", "counter",
+		"Number of TCP state transitions, by old and new state.")
+	for _, transition := range transitions {
+		writeMetricValue(&b, "state_transitions_total",
+			[]string{"old_state", string(transition.oldState), "new_state", string(transition.newState)},
+			m.stateTransitions[transition])
+	}
+
+	kinds := make([]bpfevent.Kind, 0, len(m.eventKinds))
+	for kind := range m.eventKinds {
+		kinds = append(kinds, kind)
+	}
+	sort.Slice(kinds, func(i, j int) bool { return kinds[i] < kinds[j] })
+
+	writeMetricHeader(&b, "events_by_kind_total", "counter",
+		"Number of events successfully deserialised, by kind.")
+	for _, kind := range kinds {
+		writeMetricValue(&b, "events_by_kind_total",
+			[]string{"kind", kind.String()},
+			m.eventKinds[kind])
+	}
+	m.mutex.Unlock()
+
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+func writeMetricHeader(b *strings.Builder, name, metricType, help string) {
+	fmt.Fprintf(b, "# HELP %s_%s %s\n", metricsNamespace, name, help)
+	fmt.Fprintf(b, "# TYPE %s_%s %s\n", metricsNamespace, name, metricType)
+}
+
+// WriteMetricValue writes a single sample. Labels are supplied as alternating
+// names and values.
+func writeMetricValue(b *strings.Builder, name string, labels []string, value uint64) {
+	fmt.Fprintf(b, "%s_%s", metricsNamespace, name)
+
+	if len(labels) > 0 {
+		pairs := make([]string, 0, len(labels)/2)
+		for i := 0; i+1 < len(labels); i += 2 {
+			pairs = append(pairs, fmt.Sprintf("%s=\"%s\"", labels[i], escapeLabelValue(labels[i+1])))
+		}
+		fmt.Fprintf(b, "{%s}", strings.Join(pairs, ","))
+	}
+
+	fmt.Fprintf(b, " %d\n", value)
+}
+
+var labelValueEscaper = strings.NewReplacer(`\`, `\\`, "\n", `\n`, `"`, `\"`)
+
+func escapeLabelValue(value string) string {
+	return labelValueEscaper.Replace(value)
+}
+
+// MetricsServer serves metrics over HTTP in the Prometheus text exposition format.
+type metricsServer struct {
+	server   *http.Server
+	listener net.Listener
+}
+
+// NewMetricsServer starts listening on the supplied address and serving the
+// supplied metrics on the /metrics path.
+func newMetricsServer(address string, metrics *metrics) (*metricsServer, error) {
+	listener, err := net.Listen("tcp", address)
+	if err != nil {
+		return nil, fmt.Errorf("listening on %q: %w", address, err)
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc(metricsPath, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		if err := metrics.writeTo(w); err != nil {
+			log.Printf("Error writing metrics: %v", err)
+		}
+	})
+
+	server := &metricsServer{
+		server:   &http.Server{Handler: mux},
+		listener: listener,
+	}
+
+	go func() {
+		if err := server.server.Serve(listener); err != nil && err != http.ErrServerClosed {
+			log.Printf("Error serving metrics: %v", err)
+		}
+	}()
+	log.Printf("Serving metrics on http://%s%s", listener.Addr(), metricsPath)
+
+	return server, nil
+}
+
+func (s *metricsServer) close() error {
+	return s.server.Close()
+}
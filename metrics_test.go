@@ -0,0 +1,109 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/jhwbarlow/tcp-audit-bpf-eventer/pkg/bpfevent"
+	"github.com/jhwbarlow/tcp-audit-common/pkg/tcpstate"
+)
+
+func TestMetricsWriteTo(t *testing.T) {
+	metrics := newMetrics()
+	eventChan := make(chan []byte, 4)
+	eventChan <- []byte{}
+	metrics.observeEventChannel(eventChan)
+
+	metrics.eventReceived()
+	metrics.eventReceived()
+	metrics.eventReceived()
+	metrics.eventDeserialised(bpfevent.KindStateChange, tcpstate.StateSynSent, tcpstate.StateEstablished)
+	metrics.eventDeserialised(bpfevent.KindStateChange, tcpstate.StateSynSent, tcpstate.StateEstablished)
+	metrics.eventDeserialised(bpfevent.KindRetransmit, tcpstate.StateEstablished, tcpstate.StateEstablished)
+	metrics.deserialisationFailed(fmt.Errorf("wrapped: %w",
+		newDeserialisationError(deserialisationErrorCauseTCPState, errors.New("mock error"))))
+	metrics.eventsDropped(10)
+
+	var b strings.Builder
+	if err := metrics.writeTo(&b); err != nil {
+		t.Errorf("expected nil error, got %v (of type %T)", err, err)
+	}
+	output := b.String()
+	t.Logf("got metrics:\n%s", output)
+
+	expectedLines := []string{
+		"tcp_audit_bpf_events_received_total 3",
+		"tcp_audit_bpf_events_deserialised_total 3",
+		"tcp_audit_bpf_dropped_events_total 10",
+		"tcp_audit_bpf_event_channel_occupancy 1",
+		"tcp_audit_bpf_event_channel_capacity 4",
+		`tcp_audit_bpf_deserialisation_errors_total{cause="tcp_state"} 1`,
+		`tcp_audit_bpf_state_transitions_total{old_state="SYN-SENT",new_state="ESTABLISHED"} 2`,
+		`tcp_audit_bpf_events_by_kind_total{kind="state-change"} 2`,
+		`tcp_audit_bpf_events_by_kind_total{kind="retransmit"} 1`,
+	}
+	for _, line := range expectedLines {
+		if !strings.Contains(output, line+"\n") {
+			t.Errorf("expected metrics to contain %q, but did not", line)
+		}
+	}
+}
+
+func TestMetricsDeserialisationFailedUnknownCause(t *testing.T) {
+	metrics := newMetrics()
+	metrics.deserialisationFailed(errors.New("mock error"))
+
+	var b strings.Builder
+	if err := metrics.writeTo(&b); err != nil {
+		t.Errorf("expected nil error, got %v (of type %T)", err, err)
+	}
+
+	expectedLine := `tcp_audit_bpf_deserialisation_errors_total{cause="unknown"} 1`
+	if !strings.Contains(b.String(), expectedLine) {
+		t.Errorf("expected metrics to contain %q, but did not", expectedLine)
+	}
+}
+
+func TestWriteMetricValueEscapesLabelValues(t *testing.T) {
+	var b strings.Builder
+	writeMetricValue(&b, "mock_total", []string{"label", `a "quoted" \ value` + "\n"}, 1)
+
+	expected := `tcp_audit_bpf_mock_total{label="a \"quoted\" \\ value\n"} 1` + "\n"
+	if b.String() != expected {
+		t.Errorf("expected metric %q, got %q", expected, b.String())
+	}
+}
+
+func TestMetricsServer(t *testing.T) {
+	metrics := newMetrics()
+	metrics.eventReceived()
+
+	server, err := newMetricsServer("127.0.0.1:0", metrics)
+	if err != nil {
+		t.Fatalf("expected nil constructor error, got %v (of type %T)", err, err)
+	}
+	defer server.close()
+
+	resp, err := http.Get("http://" + server.listener.Addr().String() + metricsPath)
+	if err != nil {
+		t.Fatalf("expected nil error, got %v (of type %T)", err, err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("expected status %d, got %d", http.StatusOK, resp.StatusCode)
+	}
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Errorf("expected nil error, got %v (of type %T)", err, err)
+	}
+
+	if !strings.Contains(string(body), "tcp_audit_bpf_events_received_total 1\n") {
+		t.Error("expected response to contain received events count, but did not")
+	}
+}
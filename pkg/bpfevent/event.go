@@ -0,0 +1,173 @@
+// Package bpfevent defines the TCP event emitted by the BPF Eventer, which extends
+// the common state change event with information only available from BPF.
+package bpfevent
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/jhwbarlow/tcp-audit-common/pkg/event"
+)
+
+// DetailedEventer is an interface which describes Eventers which are able to emit
+// events carrying BPF-specific detail in addition to the common event.
+type DetailedEventer interface {
+	event.Eventer
+	DetailedEvent() (*Event, error)
+}
+
+// Kind is the kind of occurrence described by an event.
+type Kind uint8
+
+const (
+	KindStateChange  Kind = iota // The TCP state of the socket changed
+	KindRetransmit               // A segment was retransmitted
+	KindSendReset                // A reset was sent
+	KindReceiveReset             // A reset was received
+
+	// KindEventsLost marks a gap in the events, where events were dropped because
+	// the kernel buffer was full. Such events are synthesised by the Eventer, and
+	// have only the time and the number of events lost set.
+	KindEventsLost
+)
+
+func (k Kind) String() string {
+	switch k {
+	case KindStateChange:
+		return "state-change"
+	case KindRetransmit:
+		return "retransmit"
+	case KindSendReset:
+		return "send-reset"
+	case KindReceiveReset:
+		return "receive-reset"
+	case KindEventsLost:
+		return "events-lost"
+	default:
+		return fmt.Sprintf("unknown(%d)", uint8(k))
+	}
+}
+
+// Event is a TCP event with BPF-specific detail
+type Event struct {
+	event.Event
+
+	// Kind is the kind of occurrence the event describes. Events of any kind other
+	// than KindStateChange do not change the state of the socket, and have both the
+	// old and new state set to the state of the socket at the time of the event.
+	Kind Kind
+
+	LostEvents uint64 // Number of events lost, only set on events of KindEventsLost
+
+	// Snapshot is true if the event does not represent a state change, but
+	// describes a socket which already existed when the Eventer started.
+	Snapshot bool
+
+	// Identity of the task on-CPU at the time of the event, in addition to its PID
+	// and command in the common event. The UID and GID are those of the task, and
+	// are distinct from the UID and GID of the owner of the socket's inode in the
+	// common event's socket information. As the task on-CPU may be unrelated to
+	// the connection, these should be interpreted with the same care as the PID.
+	TIDOnCPU       int
+	UIDOnCPU       uint32 // Real UID of the task, in the initial user namespace
+	GIDOnCPU       uint32 // Real GID of the task, in the initial user namespace
+	ParentPIDOnCPU int    // PID of the real parent of the task
+
+	// ProcessOnCPU is nil if the process on-CPU at the time of the event could not
+	// be identified, or process enrichment is disabled.
+	ProcessOnCPU *Process
+
+	NetNSINode      uint32     // Inode number of the socket's network namespace
+	CgroupIDOnCPU   uint64     // cgroup v2 ID of the task on-CPU at the time of the event
+	SocketCgroupID  uint64     // cgroup v2 ID of the socket, 0 if not available
+	ContainerOnCPU  *Container // nil if the task on-CPU is not in a container, or attribution is disabled
+	SocketContainer *Container // nil if the socket is not owned by a container, or attribution is disabled
+
+	// Counters describes the data transferred over the connection. It is only
+	// set on state change events for the transition to the closed state.
+	Counters *Counters
+}
+
+func (e *Event) String() string {
+	return fmt.Sprintf("%s, Kind: %s, Lost Events: %d, Snapshot: %t, TID (on CPU): %d, UID (on CPU): %d, GID (on CPU): %d, Parent PID (on CPU): %d, Process (on CPU): [%s], Network Namespace: %d, cgroup ID (on CPU): %d, Container (on CPU): [%s], Socket cgroup ID: %d, Socket Container: [%s], Counters: [%s]",
+		e.Event.String(),
+		e.Kind,
+		e.LostEvents,
+		e.Snapshot,
+		e.TIDOnCPU,
+		e.UIDOnCPU,
+		e.GIDOnCPU,
+		e.ParentPIDOnCPU,
+		e.ProcessOnCPU,
+		e.NetNSINode,
+		e.CgroupIDOnCPU,
+		e.ContainerOnCPU,
+		e.SocketCgroupID,
+		e.SocketContainer,
+		e.Counters)
+}
+
+// Container identifies the container, and the Kubernetes pod if any, to which a
+// cgroup belongs.
+type Container struct {
+	ID           string
+	CgroupPath   string
+	PodUID       string // Empty if the container is not in a Kubernetes pod
+	PodName      string // Empty if the pod metadata is not available
+	PodNamespace string // Empty if the pod metadata is not available
+}
+
+func (c *Container) String() string {
+	if c == nil {
+		return "<not available>"
+	}
+
+	if c.PodUID == "" {
+		return fmt.Sprintf("ID: %s", c.ID)
+	}
+
+	return fmt.Sprintf("ID: %s, Pod: %s/%s (UID: %s)", c.ID, c.PodNamespace, c.PodName, c.PodUID)
+}
+
+// Process describes a process in more detail than is available from BPF.
+type Process struct {
+	Executable  string   // Empty if not available, e.g. for kernel threads
+	CommandLine []string // Empty if not available
+	StartTime   time.Time
+}
+
+func (p *Process) String() string {
+	if p == nil {
+		return "<not available>"
+	}
+
+	return fmt.Sprintf("Executable: %s, Command Line: %q, Start Time: %v",
+		p.Executable,
+		p.CommandLine,
+		p.StartTime)
+}
+
+// Counters describes the data transferred over a connection during its lifetime,
+// as counted by the kernel.
+type Counters struct {
+	BytesReceived    uint64
+	BytesAcked       uint64 // Bytes sent and acknowledged by the peer
+	SegmentsIn       uint32
+	SegmentsOut      uint32
+	TotalRetransmits uint32
+	SmoothedRTT      time.Duration
+}
+
+func (c *Counters) String() string {
+	if c == nil {
+		return "<not available>"
+	}
+
+	return fmt.Sprintf("Bytes Received: %d, Bytes Acked: %d, Segments In: %d, Segments Out: %d, Retransmits: %d, Smoothed RTT: %v",
+		c.BytesReceived,
+		c.BytesAcked,
+		c.SegmentsIn,
+		c.SegmentsOut,
+		c.TotalRetransmits,
+		c.SmoothedRTT)
+}
@@ -0,0 +1,223 @@
+// Package correlate correlates the TCP state change events of each socket into
+// a summary of the lifecycle of the connection.
+package correlate
+
+import (
+	"container/list"
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/jhwbarlow/tcp-audit-common/pkg/event"
+	"github.com/jhwbarlow/tcp-audit-common/pkg/tcpstate"
+)
+
+// Direction is the direction in which a connection was opened
+type Direction int
+
+const (
+	DirectionActive  Direction = iota + 1 // Opened by connecting (SYN-SENT)
+	DirectionPassive                      // Opened by accepting (SYN-RECEIVED)
+)
+
+func (d Direction) String() string {
+	switch d {
+	case DirectionActive:
+		return "active"
+	case DirectionPassive:
+		return "passive"
+	default:
+		return "unknown"
+	}
+}
+
+// Connection summarises the lifecycle of a connection
+type Connection struct {
+	ID                   string // Socket ID, as in event.SocketInfo.ID
+	SourceIP, DestIP     net.IP
+	SourcePort, DestPort uint16
+	Direction            Direction
+	OpenTime             time.Time
+	CloseTime            time.Time // Time of the last event seen if the connection was evicted
+	Duration             time.Duration
+	States               []tcpstate.State // States in the order they were entered, starting with SYN-SENT or SYN-RECEIVED
+
+	// Evicted is true if the connection was not seen to close, but was discarded
+	// because no event was seen for it within the stale timeout, or to make space
+	// for newer connections.
+	Evicted bool
+}
+
+func (c *Connection) String() string {
+	return fmt.Sprintf("ID: %s, Source: %v:%d, Destination: %v:%d, Direction: %v, Open Time: %v, Close Time: %v, Duration: %v, States: %v, Evicted: %t",
+		c.ID,
+		c.SourceIP,
+		c.SourcePort,
+		c.DestIP,
+		c.DestPort,
+		c.Direction,
+		c.OpenTime,
+		c.CloseTime,
+		c.Duration,
+		c.States,
+		c.Evicted)
+}
+
+// Correlator reads TCP state change events from an Eventer and emits a
+// Connection for each connection seen to open, once it closes or is evicted.
+// Only connections seen to enter the SYN-SENT or SYN-RECEIVED state are
+// tracked; events for other sockets (including listening sockets and
+// connections which were open before the Correlator started) are discarded.
+// Memory is bounded by the maximum number of connections tracked at once, if set.
+// A Correlator is not safe for concurrent use.
+type Correlator struct {
+	eventer        event.Eventer
+	maxConnections int           // Unbounded if not positive
+	staleTimeout   time.Duration // Connections are never stale if not positive
+
+	connections map[string]*list.Element // Elements hold *trackedConnection
+	lru         *list.List               // Front is the most recently seen connection
+	ready       []*Connection            // Connections closed or evicted but not yet returned
+}
+
+type trackedConnection struct {
+	*Connection
+	lastSeen time.Time
+}
+
+// NewCorrelator creates a Correlator which reads events from the supplied
+// Eventer, tracking at most maxConnections at once and evicting connections for
+// which no event has been seen for staleTimeout (measured in event time). If
+// maxConnections is not positive, the number of connections tracked is unbounded,
+// and connections are only evicted once stale. If staleTimeout is not positive,
+// connections are never evicted as stale, only when the maximum is reached.
+func NewCorrelator(eventer event.Eventer,
+	maxConnections int,
+	staleTimeout time.Duration) *Correlator {
+	return &Correlator{
+		eventer:        eventer,
+		maxConnections: maxConnections,
+		staleTimeout:   staleTimeout,
+		connections:    make(map[string]*list.Element),
+		lru:            list.New(),
+	}
+}
+
+// Connection returns the next connection to close or be evicted, blocking
+// until one is available. Errors from the Eventer are returned unchanged.
+func (c *Correlator) Connection() (*Connection, error) {
+	for len(c.ready) == 0 {
+		event, err := c.eventer.Event()
+		if err != nil {
+			return nil, err
+		}
+
+		c.process(event)
+	}
+
+	connection := c.ready[0]
+	c.ready[0] = nil // Allow the connection to be garbage collected
+	c.ready = c.ready[1:]
+
+	return connection, nil
+}
+
+// Len returns the number of connections currently being tracked.
+func (c *Correlator) Len() int {
+	return c.lru.Len()
+}
+
+func (c *Correlator) process(event *event.Event) {
+	c.evictStale(event.Time)
+
+	if event.SocketInfo == nil || event.SocketInfo.ID == "" {
+		return
+	}
+	id := event.SocketInfo.ID
+
+	// Events which do not change the state of the socket, such as retransmissions
+	// and resets, are evidence the connection is alive but are not recorded
+	stateChanged := event.OldState != event.NewState
+
+	if element, ok := c.connections[id]; ok {
+		tracked := element.Value.(*trackedConnection)
+		tracked.lastSeen = event.Time
+		c.lru.MoveToFront(element)
+		if !stateChanged {
+			return
+		}
+		tracked.States = append(tracked.States, event.NewState)
+
+		if event.NewState == tcpstate.StateClosed {
+			tracked.CloseTime = event.Time
+			tracked.Duration = tracked.CloseTime.Sub(tracked.OpenTime)
+			c.remove(element)
+			c.ready = append(c.ready, tracked.Connection)
+		}
+
+		return
+	}
+
+	if !stateChanged {
+		return
+	}
+
+	var direction Direction
+	switch event.NewState {
+	case tcpstate.StateSynSent:
+		direction = DirectionActive
+	case tcpstate.StateSynReceived:
+		direction = DirectionPassive
+	default:
+		return
+	}
+
+	if c.maxConnections > 0 && c.lru.Len() >= c.maxConnections {
+		c.evict(c.lru.Back())
+	}
+
+	tracked := &trackedConnection{
+		Connection: &Connection{
+			ID:         id,
+			SourceIP:   event.SourceIP,
+			DestIP:     event.DestIP,
+			SourcePort: event.SourcePort,
+			DestPort:   event.DestPort,
+			Direction:  direction,
+			OpenTime:   event.Time,
+			States:     []tcpstate.State{event.NewState},
+		},
+		lastSeen: event.Time,
+	}
+	c.connections[id] = c.lru.PushFront(tracked)
+}
+
+// EvictStale evicts the connections for which no event has been seen within the
+// stale timeout of the supplied time.
+func (c *Correlator) evictStale(now time.Time) {
+	if c.staleTimeout <= 0 {
+		return
+	}
+
+	for element := c.lru.Back(); element != nil; element = c.lru.Back() {
+		if now.Sub(element.Value.(*trackedConnection).lastSeen) < c.staleTimeout {
+			return
+		}
+
+		c.evict(element)
+	}
+}
+
+func (c *Correlator) evict(element *list.Element) {
+	tracked := element.Value.(*trackedConnection)
+	tracked.CloseTime = tracked.lastSeen
+	tracked.Duration = tracked.CloseTime.Sub(tracked.OpenTime)
+	tracked.Evicted = true
+	c.remove(element)
+	c.ready = append(c.ready, tracked.Connection)
+}
+
+func (c *Correlator) remove(element *list.Element) {
+	c.lru.Remove(element)
+	delete(c.connections, element.Value.(*trackedConnection).ID)
+}
@@ -0,0 +1,228 @@
+package correlate
+
+import (
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/jhwbarlow/tcp-audit-common/pkg/event"
+	"github.com/jhwbarlow/tcp-audit-common/pkg/tcpstate"
+)
+
+var errMockEventsExhausted = errors.New("mock events exhausted")
+
+type mockEventer struct {
+	eventsToReturn []*event.Event
+}
+
+func newMockEventer(eventsToReturn []*event.Event) *mockEventer {
+	return &mockEventer{
+		eventsToReturn: eventsToReturn,
+	}
+}
+
+func (me *mockEventer) Event() (*event.Event, error) {
+	if len(me.eventsToReturn) == 0 {
+		return nil, errMockEventsExhausted
+	}
+
+	event := me.eventsToReturn[0]
+	me.eventsToReturn = me.eventsToReturn[1:]
+
+	return event, nil
+}
+
+func newMockEvent(id string, eventTime time.Time, oldState, newState tcpstate.State) *event.Event {
+	return &event.Event{
+		Time:       eventTime,
+		SourceIP:   net.IPv4(10, 0, 0, 1),
+		DestIP:     net.IPv4(10, 0, 0, 2),
+		SourcePort: 55420,
+		DestPort:   5432,
+		OldState:   oldState,
+		NewState:   newState,
+		SocketInfo: &event.SocketInfo{ID: id},
+	}
+}
+
+func TestCorrelatorConnection(t *testing.T) {
+	timeNow := time.Now()
+	mockEventer := newMockEventer([]*event.Event{
+		newMockEvent("a", timeNow, tcpstate.StateClosed, tcpstate.StateListen), // Listening socket, not tracked
+		newMockEvent("b", timeNow, tcpstate.StateClosed, tcpstate.StateSynSent),
+		newMockEvent("c", timeNow.Add(1*time.Second), tcpstate.StateListen, tcpstate.StateSynReceived),
+		newMockEvent("d", timeNow.Add(1*time.Second), tcpstate.StateSynSent, tcpstate.StateSynSent), // Retransmission of unseen connection, not tracked
+		newMockEvent("b", timeNow.Add(2*time.Second), tcpstate.StateSynSent, tcpstate.StateEstablished),
+		newMockEvent("b", timeNow.Add(2*time.Second), tcpstate.StateEstablished, tcpstate.StateEstablished), // Retransmission, not a state
+		newMockEvent("b", timeNow.Add(3*time.Second), tcpstate.StateEstablished, tcpstate.StateFinWait1),
+		newMockEvent("b", timeNow.Add(4*time.Second), tcpstate.StateFinWait1, tcpstate.StateClosed),
+	})
+
+	correlator := NewCorrelator(mockEventer, 10, time.Minute)
+	connection, err := correlator.Connection()
+	if err != nil {
+		t.Errorf("expected nil error, got %v (of type %T)", err, err)
+	}
+
+	t.Logf("got connection %q", connection)
+
+	if connection.ID != "b" {
+		t.Errorf("expected connection ID %q, got %q", "b", connection.ID)
+	}
+
+	if connection.Direction != DirectionActive {
+		t.Errorf("expected direction %v, got %v", DirectionActive, connection.Direction)
+	}
+
+	if connection.OpenTime != timeNow || connection.CloseTime != timeNow.Add(4*time.Second) {
+		t.Errorf("expected open and close times %v and %v, got %v and %v",
+			timeNow,
+			timeNow.Add(4*time.Second),
+			connection.OpenTime,
+			connection.CloseTime)
+	}
+
+	if connection.Duration != 4*time.Second {
+		t.Errorf("expected duration %v, got %v", 4*time.Second, connection.Duration)
+	}
+
+	expectedStates := []tcpstate.State{
+		tcpstate.StateSynSent,
+		tcpstate.StateEstablished,
+		tcpstate.StateFinWait1,
+		tcpstate.StateClosed,
+	}
+	if len(connection.States) != len(expectedStates) {
+		t.Fatalf("expected states %v, got %v", expectedStates, connection.States)
+	}
+
+	for i := range expectedStates {
+		if connection.States[i] != expectedStates[i] {
+			t.Errorf("expected states %v, got %v", expectedStates, connection.States)
+			break
+		}
+	}
+
+	if connection.Evicted {
+		t.Error("expected connection not to be evicted, but was")
+	}
+
+	if correlator.Len() != 1 {
+		t.Errorf("expected 1 connection to be tracked, got %d", correlator.Len())
+	}
+}
+
+func TestCorrelatorEvictStale(t *testing.T) {
+	timeNow := time.Now()
+	mockEventer := newMockEventer([]*event.Event{
+		newMockEvent("a", timeNow, tcpstate.StateListen, tcpstate.StateSynReceived),
+		newMockEvent("a", timeNow.Add(1*time.Second), tcpstate.StateSynReceived, tcpstate.StateEstablished),
+		newMockEvent("b", timeNow.Add(2*time.Minute), tcpstate.StateClosed, tcpstate.StateSynSent),
+	})
+
+	correlator := NewCorrelator(mockEventer, 10, time.Minute)
+	connection, err := correlator.Connection()
+	if err != nil {
+		t.Errorf("expected nil error, got %v (of type %T)", err, err)
+	}
+
+	if connection.ID != "a" || !connection.Evicted {
+		t.Errorf("expected connection %q to be evicted, got %v", "a", connection)
+	}
+
+	if connection.Direction != DirectionPassive {
+		t.Errorf("expected direction %v, got %v", DirectionPassive, connection.Direction)
+	}
+
+	if connection.CloseTime != timeNow.Add(1*time.Second) {
+		t.Errorf("expected close time to be time of last event %v, got %v", timeNow.Add(1*time.Second), connection.CloseTime)
+	}
+}
+
+func TestCorrelatorEvictOldestWhenFull(t *testing.T) {
+	timeNow := time.Now()
+	mockEventer := newMockEventer([]*event.Event{
+		newMockEvent("a", timeNow, tcpstate.StateClosed, tcpstate.StateSynSent),
+		newMockEvent("b", timeNow, tcpstate.StateClosed, tcpstate.StateSynSent),
+		newMockEvent("a", timeNow, tcpstate.StateSynSent, tcpstate.StateEstablished), // "b" is now the least recently seen
+		newMockEvent("c", timeNow, tcpstate.StateClosed, tcpstate.StateSynSent),
+	})
+
+	correlator := NewCorrelator(mockEventer, 2, time.Minute)
+	connection, err := correlator.Connection()
+	if err != nil {
+		t.Errorf("expected nil error, got %v (of type %T)", err, err)
+	}
+
+	if connection.ID != "b" || !connection.Evicted {
+		t.Errorf("expected connection %q to be evicted, got %v", "b", connection)
+	}
+
+	if correlator.Len() != 2 {
+		t.Errorf("expected 2 connections to be tracked, got %d", correlator.Len())
+	}
+}
+
+func TestCorrelatorUnboundedConnections(t *testing.T) {
+	timeNow := time.Now()
+	mockEventer := newMockEventer([]*event.Event{
+		newMockEvent("a", timeNow, tcpstate.StateClosed, tcpstate.StateSynSent),
+		newMockEvent("b", timeNow, tcpstate.StateClosed, tcpstate.StateSynSent),
+		newMockEvent("c", timeNow, tcpstate.StateClosed, tcpstate.StateSynSent),
+	})
+
+	correlator := NewCorrelator(mockEventer, 0, time.Minute)
+	_, err := correlator.Connection()
+	if !errors.Is(err, errMockEventsExhausted) {
+		t.Errorf("expected error chain to include %q, got %v (of type %T)", errMockEventsExhausted, err, err)
+	}
+
+	if correlator.Len() != 3 {
+		t.Errorf("expected 3 connections to be tracked, got %d", correlator.Len())
+	}
+}
+
+func TestCorrelatorNoStaleTimeout(t *testing.T) {
+	timeNow := time.Now()
+	mockEventer := newMockEventer([]*event.Event{
+		newMockEvent("a", timeNow, tcpstate.StateClosed, tcpstate.StateSynSent),
+		newMockEvent("b", timeNow.Add(time.Hour), tcpstate.StateClosed, tcpstate.StateSynSent),
+		newMockEvent("a", timeNow.Add(2*time.Hour), tcpstate.StateSynSent, tcpstate.StateEstablished),
+		newMockEvent("a", timeNow.Add(3*time.Hour), tcpstate.StateEstablished, tcpstate.StateClosed),
+	})
+
+	correlator := NewCorrelator(mockEventer, 10, 0)
+	connection, err := correlator.Connection()
+	if err != nil {
+		t.Errorf("expected nil error, got %v (of type %T)", err, err)
+	}
+
+	// Despite the gaps between its events, the connection is not evicted as stale
+	if connection.ID != "a" || connection.Evicted {
+		t.Errorf("expected connection %q to be closed rather than evicted, got %v", "a", connection)
+	}
+
+	if len(connection.States) != 3 {
+		t.Errorf("expected 3 states, got %v", connection.States)
+	}
+
+	if correlator.Len() != 1 {
+		t.Errorf("expected 1 connection to be tracked, got %d", correlator.Len())
+	}
+}
+
+func TestCorrelatorEventerError(t *testing.T) {
+	correlator := NewCorrelator(newMockEventer(nil), 10, time.Minute)
+
+	_, err := correlator.Connection()
+	if err == nil {
+		t.Error("expected error, got nil")
+	}
+
+	t.Logf("got error %q (of type %T)", err, err)
+
+	if !errors.Is(err, errMockEventsExhausted) {
+		t.Errorf("expected error chain to include %q, but did not", errMockEventsExhausted)
+	}
+}
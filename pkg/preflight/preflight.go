@@ -0,0 +1,103 @@
+// Package preflight describes the results of checking, before any BPF is loaded,
+// that the environment meets the requirements of the BPF Eventer.
+package preflight
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Status is the outcome of a single check
+type Status int
+
+const (
+	StatusPass Status = iota
+	StatusWarn        // The requirement could not be checked, or may not be met
+	StatusFail        // The requirement is not met, so loading the BPF will fail
+)
+
+func (s Status) String() string {
+	switch s {
+	case StatusPass:
+		return "pass"
+	case StatusWarn:
+		return "warn"
+	case StatusFail:
+		return "fail"
+	default:
+		return "unknown"
+	}
+}
+
+// Result is the result of checking a single requirement.
+type Result struct {
+	Check       string // The requirement checked
+	Status      Status
+	Detail      string // What was found
+	Remediation string // How to meet the requirement, empty if it is met
+}
+
+func (r *Result) String() string {
+	str := fmt.Sprintf("[%s] %s: %s", r.Status, r.Check, r.Detail)
+	if r.Remediation != "" {
+		str += " (" + r.Remediation + ")"
+	}
+
+	return str
+}
+
+// Report is the result of checking every requirement.
+type Report struct {
+	Results []*Result
+}
+
+// Failures returns the results of the checks which failed.
+func (r *Report) Failures() []*Result {
+	var failures []*Result
+	for _, result := range r.Results {
+		if result.Status == StatusFail {
+			failures = append(failures, result)
+		}
+	}
+
+	return failures
+}
+
+// Passed returns whether no check failed. Warnings do not prevent a pass.
+func (r *Report) Passed() bool {
+	return len(r.Failures()) == 0
+}
+
+// Err returns an error describing the failed checks, or nil if none failed.
+func (r *Report) Err() error {
+	failures := r.Failures()
+	if len(failures) == 0 {
+		return nil
+	}
+
+	return &Error{Failures: failures}
+}
+
+// String returns the result of every check, one per line.
+func (r *Report) String() string {
+	lines := make([]string, 0, len(r.Results))
+	for _, result := range r.Results {
+		lines = append(lines, result.String())
+	}
+
+	return strings.Join(lines, "\n")
+}
+
+// Error is returned when one or more checks fail.
+type Error struct {
+	Failures []*Result
+}
+
+func (e *Error) Error() string {
+	failures := make([]string, 0, len(e.Failures))
+	for _, failure := range e.Failures {
+		failures = append(failures, fmt.Sprintf("%s: %s (%s)", failure.Check, failure.Detail, failure.Remediation))
+	}
+
+	return "preflight checks failed: " + strings.Join(failures, "; ")
+}
@@ -0,0 +1,59 @@
+package preflight
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestReport(t *testing.T) {
+	report := &Report{
+		Results: []*Result{
+			{Check: "BTF", Status: StatusPass, Detail: "found"},
+			{Check: "debugfs", Status: StatusFail, Detail: "not mounted", Remediation: "mount it"},
+			{Check: "lockdown", Status: StatusWarn, Detail: "could not check"},
+		},
+	}
+
+	t.Logf("got report:\n%v", report)
+
+	if report.Passed() {
+		t.Error("expected report not to pass")
+	}
+
+	failures := report.Failures()
+	if len(failures) != 1 || failures[0].Check != "debugfs" {
+		t.Errorf("expected debugfs failure, got %v", failures)
+	}
+
+	err := report.Err()
+	var preflightErr *Error
+	if !errors.As(err, &preflightErr) {
+		t.Fatalf("expected error of type %T, got %v (of type %T)", preflightErr, err, err)
+	}
+
+	if !strings.Contains(err.Error(), "mount it") {
+		t.Errorf("expected error to contain remediation, got %q", err)
+	}
+
+	if lines := strings.Split(report.String(), "\n"); len(lines) != 3 {
+		t.Errorf("expected 3 lines, got %d", len(lines))
+	}
+}
+
+func TestReportPassed(t *testing.T) {
+	report := &Report{
+		Results: []*Result{
+			{Check: "BTF", Status: StatusPass, Detail: "found"},
+			{Check: "lockdown", Status: StatusWarn, Detail: "could not check"},
+		},
+	}
+
+	if !report.Passed() {
+		t.Error("expected report to pass")
+	}
+
+	if err := report.Err(); err != nil {
+		t.Errorf("expected nil error, got %v (of type %T)", err, err)
+	}
+}
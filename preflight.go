@@ -0,0 +1,321 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/jhwbarlow/tcp-audit-bpf-eventer/pkg/preflight"
+	"golang.org/x/sys/unix"
+)
+
+const (
+	tracefsPath        = "/sys/kernel/debug/tracing"
+	procSelfStatus     = "/proc/self/status"
+	lockdownPath       = "/sys/kernel/security/lockdown"
+	libBPFGoMemlock    = 512 << 20 // Limit to which libbpfgo sets RLIMIT_MEMLOCK when creating a module
+	memlockRemediation = "raise the hard RLIMIT_MEMLOCK to at least 512MiB (e.g. docker run --ulimit memlock=-1), or grant CAP_SYS_RESOURCE"
+)
+
+// PreflightChecker checks that the environment meets the requirements of loading
+// and attaching the BPF program, so that the reason for a failure can be
+// reported instead of the opaque error returned by libbpf.
+type preflightChecker struct {
+	btfLocator      btfLocator // Nil if only the kernel's own BTF is used
+	kernelBTFPath   string
+	tracefsPath     string
+	tracepoints     []string // In the form category:name
+	tracefsRequired bool     // False if tracefs is needed only if attaching using BTF fails
+	procStatusPath  string
+	lockdownPath    string
+	geteuid         func() int
+	getrlimit       func(resource int, rlimit *unix.Rlimit) error
+}
+
+func newPreflightChecker(btfLocator btfLocator, tracepoints []string, tracefsRequired bool) *preflightChecker {
+	return &preflightChecker{
+		btfLocator:      btfLocator,
+		kernelBTFPath:   kernelBTFPath,
+		tracefsPath:     tracefsPath,
+		tracepoints:     tracepoints,
+		tracefsRequired: tracefsRequired,
+		procStatusPath:  procSelfStatus,
+		lockdownPath:    lockdownPath,
+		geteuid:         os.Geteuid,
+		getrlimit:       unix.Getrlimit,
+	}
+}
+
+// Check checks every requirement. The checks are independent, so all are made
+// even if one fails.
+func (c *preflightChecker) check() *preflight.Report {
+	capabilities, capabilitiesErr := readCapabilities(c.procStatusPath, "CapEff")
+
+	return &preflight.Report{
+		Results: []*preflight.Result{
+			c.checkBTF(),
+			c.tracefsCheck(c.checkTracefs()),
+			checkAdminCapability(capabilities, capabilitiesErr),
+			c.tracefsCheck(c.checkTracefsAccess(capabilities, capabilitiesErr)),
+			c.checkMemlock(capabilities, capabilitiesErr),
+			c.checkLockdown(),
+		},
+	}
+}
+
+// TracefsCheck downgrades the failure of a check of a requirement of attaching
+// through tracefs to a warning, if tracefs is needed only as a fallback.
+func (c *preflightChecker) tracefsCheck(result *preflight.Result) *preflight.Result {
+	if !c.tracefsRequired && result.Status == preflight.StatusFail {
+		result.Status = preflight.StatusWarn
+		result.Detail += "; required only if attaching using BTF fails"
+	}
+
+	return result
+}
+
+func (c *preflightChecker) checkBTF() *preflight.Result {
+	result := &preflight.Result{Check: "BTF"}
+
+	if _, err := os.Stat(c.kernelBTFPath); err == nil {
+		result.Status = preflight.StatusPass
+		result.Detail = "kernel exposes its own BTF at " + c.kernelBTFPath
+		return result
+	}
+
+	if c.btfLocator == nil {
+		result.Status = preflight.StatusFail
+		result.Detail = "kernel does not expose its own BTF at " + c.kernelBTFPath
+		result.Remediation = "set " + envBTFPath + " to a BTF file or BTFHub archive for this kernel"
+		return result
+	}
+
+	path, err := c.btfLocator.locate()
+	if err != nil {
+		result.Status = preflight.StatusFail
+		result.Detail = fmt.Sprintf("kernel does not expose its own BTF and none was found: %v", err)
+		result.Remediation = "ensure " + envBTFPath + " names a BTF file or BTFHub archive containing this kernel release"
+		return result
+	}
+
+	result.Status = preflight.StatusPass
+	result.Detail = "using external BTF " + path
+	return result
+}
+
+func (c *preflightChecker) checkTracefs() *preflight.Result {
+	result := &preflight.Result{Check: "debugfs"}
+
+	if _, err := os.Stat(c.tracefsPath); err != nil {
+		switch {
+		case os.IsPermission(err):
+			// Reported by the access check
+			result.Status = preflight.StatusWarn
+			result.Detail = "could not check: " + err.Error()
+		case os.IsNotExist(err):
+			result.Status = preflight.StatusFail
+			result.Detail = "tracefs not found at " + c.tracefsPath
+			result.Remediation = "mount debugfs at /sys/kernel/debug (mount -t debugfs debugfs /sys/kernel/debug), " +
+				"or in a container, mount the host's with --volume /sys/kernel/debug:/sys/kernel/debug"
+		default:
+			result.Status = preflight.StatusWarn
+			result.Detail = "could not check: " + err.Error()
+		}
+
+		return result
+	}
+
+	for _, tracepoint := range c.tracepoints {
+		path := filepath.Join(c.tracefsPath, "events", strings.Replace(tracepoint, ":", "/", 1))
+		if _, err := os.Stat(path); err != nil {
+			if os.IsNotExist(err) {
+				result.Status = preflight.StatusFail
+				result.Detail = fmt.Sprintf("tracepoint %q not found", tracepoint)
+				result.Remediation = "run on a kernel which provides the tracepoint (sock:inet_sock_set_state requires 4.16 or later)"
+			} else {
+				result.Status = preflight.StatusWarn
+				result.Detail = fmt.Sprintf("could not check tracepoint %q: %v", tracepoint, err)
+			}
+
+			return result
+		}
+	}
+
+	result.Status = preflight.StatusPass
+	result.Detail = "tracefs mounted at " + c.tracefsPath
+	return result
+}
+
+// CheckAdminCapability checks for CAP_SYS_ADMIN, which is required to load the
+// BPF program. On kernels of 5.8 and later, CAP_BPF and CAP_PERFMON suffice.
+func checkAdminCapability(capabilities uint64, capabilitiesErr error) *preflight.Result {
+	result := &preflight.Result{Check: "CAP_SYS_ADMIN"}
+
+	switch {
+	case capabilitiesErr != nil:
+		result.Status = preflight.StatusWarn
+		result.Detail = "could not read capabilities: " + capabilitiesErr.Error()
+	case hasCapability(capabilities, unix.CAP_SYS_ADMIN):
+		result.Status = preflight.StatusPass
+		result.Detail = "effective"
+	case hasCapability(capabilities, unix.CAP_BPF) && hasCapability(capabilities, unix.CAP_PERFMON):
+		result.Status = preflight.StatusPass
+		result.Detail = "not effective, but CAP_BPF and CAP_PERFMON are"
+	default:
+		result.Status = preflight.StatusFail
+		result.Detail = "not effective"
+		result.Remediation = "grant CAP_SYS_ADMIN (e.g. docker run --cap-add SYS_ADMIN), " +
+			"with the effective bit set if granted as a file capability"
+	}
+
+	return result
+}
+
+// CheckTracefsAccess checks for root or CAP_DAC_OVERRIDE, which is required to
+// read the tracefs files when attaching to the tracepoints, as they are owned
+// by root.
+func (c *preflightChecker) checkTracefsAccess(capabilities uint64, capabilitiesErr error) *preflight.Result {
+	result := &preflight.Result{Check: "root UID or CAP_DAC_OVERRIDE"}
+
+	euid := c.geteuid()
+	switch {
+	case euid == 0:
+		result.Status = preflight.StatusPass
+		result.Detail = "running as root"
+	case capabilitiesErr != nil:
+		result.Status = preflight.StatusWarn
+		result.Detail = fmt.Sprintf("running as UID %d, and could not read capabilities: %v", euid, capabilitiesErr)
+	case hasCapability(capabilities, unix.CAP_DAC_OVERRIDE):
+		result.Status = preflight.StatusPass
+		result.Detail = fmt.Sprintf("running as UID %d with CAP_DAC_OVERRIDE effective", euid)
+	default:
+		result.Status = preflight.StatusFail
+		result.Detail = fmt.Sprintf("running as UID %d without CAP_DAC_OVERRIDE", euid)
+		result.Remediation = "run as root, or grant CAP_DAC_OVERRIDE (e.g. docker run --cap-add DAC_OVERRIDE)"
+	}
+
+	return result
+}
+
+// CheckMemlock checks that libbpfgo will be able to set RLIMIT_MEMLOCK when
+// creating the module, which requires the hard limit to be no lower than that it
+// sets, unless the limit can be raised.
+func (c *preflightChecker) checkMemlock(capabilities uint64, capabilitiesErr error) *preflight.Result {
+	result := &preflight.Result{Check: "memlock rlimit"}
+
+	var rlimit unix.Rlimit
+	if err := c.getrlimit(unix.RLIMIT_MEMLOCK, &rlimit); err != nil {
+		result.Status = preflight.StatusWarn
+		result.Detail = "could not get limit: " + err.Error()
+		return result
+	}
+
+	switch {
+	case rlimit.Max == unix.RLIM_INFINITY:
+		result.Status = preflight.StatusPass
+		result.Detail = "hard limit is unlimited"
+	case rlimit.Max >= libBPFGoMemlock:
+		result.Status = preflight.StatusPass
+		result.Detail = fmt.Sprintf("hard limit is %d bytes", rlimit.Max)
+	case capabilitiesErr != nil:
+		result.Status = preflight.StatusWarn
+		result.Detail = fmt.Sprintf("hard limit is %d bytes, and could not read capabilities: %v", rlimit.Max, capabilitiesErr)
+		result.Remediation = memlockRemediation
+	case hasCapability(capabilities, unix.CAP_SYS_RESOURCE):
+		result.Status = preflight.StatusPass
+		result.Detail = fmt.Sprintf("hard limit is %d bytes, but can be raised with CAP_SYS_RESOURCE", rlimit.Max)
+	default:
+		result.Status = preflight.StatusFail
+		result.Detail = fmt.Sprintf("hard limit is %d bytes and cannot be raised", rlimit.Max)
+		result.Remediation = memlockRemediation
+	}
+
+	return result
+}
+
+// CheckLockdown checks that the kernel is not locked down in confidentiality
+// mode, which prevents BPF programs reading kernel memory.
+func (c *preflightChecker) checkLockdown() *preflight.Result {
+	result := &preflight.Result{Check: "kernel lockdown"}
+
+	contents, err := os.ReadFile(c.lockdownPath)
+	if err != nil {
+		if os.IsNotExist(err) { // Lockdown is not supported, or securityfs is not mounted
+			result.Status = preflight.StatusPass
+			result.Detail = "not available"
+		} else {
+			result.Status = preflight.StatusWarn
+			result.Detail = "could not check: " + err.Error()
+		}
+
+		return result
+	}
+
+	mode, err := parseLockdownMode(string(contents))
+	if err != nil {
+		result.Status = preflight.StatusWarn
+		result.Detail = "could not check: " + err.Error()
+		return result
+	}
+
+	if mode == "confidentiality" {
+		result.Status = preflight.StatusFail
+		result.Detail = "kernel is locked down in confidentiality mode"
+		result.Remediation = "boot with lockdown=integrity or lockdown=none, which may require disabling Secure Boot"
+		return result
+	}
+
+	result.Status = preflight.StatusPass
+	result.Detail = "mode is " + mode
+	return result
+}
+
+// ParseLockdownMode returns the selected mode from the contents of the lockdown
+// file, in which it is enclosed in brackets, e.g. "none [integrity] confidentiality".
+func parseLockdownMode(contents string) (string, error) {
+	for _, mode := range strings.Fields(contents) {
+		if strings.HasPrefix(mode, "[") && strings.HasSuffix(mode, "]") {
+			return strings.Trim(mode, "[]"), nil
+		}
+	}
+
+	return "", fmt.Errorf("no mode selected in %q", strings.TrimSpace(contents))
+}
+
+// ReadCapabilities reads a capability set, such as CapEff or CapPrm, from the
+// status file of a process or thread.
+func readCapabilities(statusPath, set string) (uint64, error) {
+	file, err := os.Open(statusPath)
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) != 2 || fields[0] != set+":" {
+			continue
+		}
+
+		capabilities, err := strconv.ParseUint(fields[1], 16, 64)
+		if err != nil {
+			return 0, fmt.Errorf("illegal %s %q", set, fields[1])
+		}
+
+		return capabilities, nil
+	}
+
+	if err := scanner.Err(); err != nil {
+		return 0, err
+	}
+
+	return 0, fmt.Errorf("no %s found", set)
+}
+
+func hasCapability(capabilities uint64, capability int) bool {
+	return capabilities&(1<<uint(capability)) != 0
+}
@@ -0,0 +1,289 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/jhwbarlow/tcp-audit-bpf-eventer/pkg/preflight"
+	"golang.org/x/sys/unix"
+)
+
+const allCapabilities = 0x000001ffffffffff
+
+type mockEnvironment struct {
+	root         string
+	checker      *preflightChecker
+	memlockLimit uint64
+}
+
+// NewMockEnvironment creates an environment in which every check passes, for
+// tests to break.
+func newMockEnvironment(t *testing.T) *mockEnvironment {
+	root := t.TempDir()
+	env := &mockEnvironment{
+		root:         root,
+		memlockLimit: unix.RLIM_INFINITY,
+	}
+
+	env.checker = &preflightChecker{
+		kernelBTFPath:   filepath.Join(root, "btf", "vmlinux"),
+		tracefsPath:     filepath.Join(root, "tracing"),
+		tracepoints:     []string{tcpStateChangeTracepointName},
+		tracefsRequired: true,
+		procStatusPath:  filepath.Join(root, "status"),
+		lockdownPath:    filepath.Join(root, "lockdown"),
+		geteuid:         func() int { return 0 },
+		getrlimit: func(resource int, rlimit *unix.Rlimit) error {
+			rlimit.Cur = env.memlockLimit
+			rlimit.Max = env.memlockLimit
+			return nil
+		},
+	}
+
+	env.writeFile(t, "btf/vmlinux", "")
+	env.writeFile(t, "tracing/events/sock/inet_sock_set_state/format", "")
+	env.setCapabilities(t, allCapabilities)
+	env.writeFile(t, "lockdown", "[none] integrity confidentiality\n")
+
+	return env
+}
+
+func (e *mockEnvironment) writeFile(t *testing.T, name, contents string) {
+	path := filepath.Join(e.root, name)
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		t.Fatalf("expected nil error, got %v (of type %T)", err, err)
+	}
+
+	if err := os.WriteFile(path, []byte(contents), 0o644); err != nil {
+		t.Fatalf("expected nil error, got %v (of type %T)", err, err)
+	}
+}
+
+func (e *mockEnvironment) remove(t *testing.T, name string) {
+	if err := os.RemoveAll(filepath.Join(e.root, name)); err != nil {
+		t.Fatalf("expected nil error, got %v (of type %T)", err, err)
+	}
+}
+
+func (e *mockEnvironment) setCapabilities(t *testing.T, capabilities uint64) {
+	e.writeFile(t, "status", fmt.Sprintf("Name:\ttcp-audit\nCapInh:\t0000000000000000\nCapEff:\t%016x\n", capabilities))
+}
+
+func findResult(t *testing.T, report *preflight.Report, check string) *preflight.Result {
+	for _, result := range report.Results {
+		if result.Check == check {
+			return result
+		}
+	}
+
+	t.Fatalf("expected result of check %q, got none", check)
+	return nil
+}
+
+func TestPreflightCheckerPass(t *testing.T) {
+	env := newMockEnvironment(t)
+
+	report := env.checker.check()
+
+	t.Logf("got report:\n%v", report)
+
+	if len(report.Results) != 6 {
+		t.Errorf("expected 6 results, got %d", len(report.Results))
+	}
+
+	for _, result := range report.Results {
+		if result.Status != preflight.StatusPass {
+			t.Errorf("expected check %q to pass, got %v", result.Check, result)
+		}
+	}
+
+	if err := report.Err(); err != nil {
+		t.Errorf("expected nil error, got %v (of type %T)", err, err)
+	}
+}
+
+func TestPreflightCheckerFailure(t *testing.T) {
+	tests := []struct {
+		name           string
+		breakEnv       func(t *testing.T, env *mockEnvironment)
+		check          string
+		expectedStatus preflight.Status
+	}{
+		{
+			"no BTF",
+			func(t *testing.T, env *mockEnvironment) { env.remove(t, "btf") },
+			"BTF",
+			preflight.StatusFail,
+		},
+		{
+			"external BTF not found",
+			func(t *testing.T, env *mockEnvironment) {
+				env.remove(t, "btf")
+				env.checker.btfLocator = newMockBTFLocator(errors.New("mock BTF locator error"))
+			},
+			"BTF",
+			preflight.StatusFail,
+		},
+		{
+			"external BTF found",
+			func(t *testing.T, env *mockEnvironment) {
+				env.remove(t, "btf")
+				env.checker.btfLocator = newMockBTFLocator(nil)
+			},
+			"BTF",
+			preflight.StatusPass,
+		},
+		{
+			"debugfs not mounted",
+			func(t *testing.T, env *mockEnvironment) { env.remove(t, "tracing") },
+			"debugfs",
+			preflight.StatusFail,
+		},
+		{
+			"tracepoint missing",
+			func(t *testing.T, env *mockEnvironment) { env.remove(t, "tracing/events/sock") },
+			"debugfs",
+			preflight.StatusFail,
+		},
+		{
+			"debugfs not mounted when attaching using BTF",
+			func(t *testing.T, env *mockEnvironment) {
+				env.remove(t, "tracing")
+				env.checker.tracefsRequired = false
+			},
+			"debugfs",
+			preflight.StatusWarn,
+		},
+		{
+			"no CAP_SYS_ADMIN",
+			func(t *testing.T, env *mockEnvironment) {
+				env.setCapabilities(t, allCapabilities&^(1<<unix.CAP_SYS_ADMIN|1<<unix.CAP_BPF))
+			},
+			"CAP_SYS_ADMIN",
+			preflight.StatusFail,
+		},
+		{
+			"CAP_BPF and CAP_PERFMON",
+			func(t *testing.T, env *mockEnvironment) {
+				env.setCapabilities(t, 1<<unix.CAP_BPF|1<<unix.CAP_PERFMON)
+			},
+			"CAP_SYS_ADMIN",
+			preflight.StatusPass,
+		},
+		{
+			"capabilities unreadable",
+			func(t *testing.T, env *mockEnvironment) { env.remove(t, "status") },
+			"CAP_SYS_ADMIN",
+			preflight.StatusWarn,
+		},
+		{
+			"non-root without CAP_DAC_OVERRIDE",
+			func(t *testing.T, env *mockEnvironment) {
+				env.checker.geteuid = func() int { return 1000 }
+				env.setCapabilities(t, 1<<unix.CAP_SYS_ADMIN)
+			},
+			"root UID or CAP_DAC_OVERRIDE",
+			preflight.StatusFail,
+		},
+		{
+			"non-root with CAP_DAC_OVERRIDE",
+			func(t *testing.T, env *mockEnvironment) {
+				env.checker.geteuid = func() int { return 1000 }
+				env.setCapabilities(t, 1<<unix.CAP_SYS_ADMIN|1<<unix.CAP_DAC_OVERRIDE)
+			},
+			"root UID or CAP_DAC_OVERRIDE",
+			preflight.StatusPass,
+		},
+		{
+			"memlock limit too low",
+			func(t *testing.T, env *mockEnvironment) {
+				env.memlockLimit = 64 << 10
+				env.setCapabilities(t, 1<<unix.CAP_SYS_ADMIN)
+			},
+			"memlock rlimit",
+			preflight.StatusFail,
+		},
+		{
+			"memlock limit raisable",
+			func(t *testing.T, env *mockEnvironment) { env.memlockLimit = 64 << 10 },
+			"memlock rlimit",
+			preflight.StatusPass,
+		},
+		{
+			"confidentiality lockdown",
+			func(t *testing.T, env *mockEnvironment) {
+				env.writeFile(t, "lockdown", "none integrity [confidentiality]\n")
+			},
+			"kernel lockdown",
+			preflight.StatusFail,
+		},
+		{
+			"integrity lockdown",
+			func(t *testing.T, env *mockEnvironment) {
+				env.writeFile(t, "lockdown", "none [integrity] confidentiality\n")
+			},
+			"kernel lockdown",
+			preflight.StatusPass,
+		},
+		{
+			"lockdown unsupported",
+			func(t *testing.T, env *mockEnvironment) { env.remove(t, "lockdown") },
+			"kernel lockdown",
+			preflight.StatusPass,
+		},
+	}
+
+	for _, test := range tests {
+		env := newMockEnvironment(t)
+		test.breakEnv(t, env)
+
+		report := env.checker.check()
+		result := findResult(t, report, test.check)
+
+		t.Logf("%s: got result %v", test.name, result)
+
+		if result.Status != test.expectedStatus {
+			t.Errorf("%s: expected status %v, got %v", test.name, test.expectedStatus, result.Status)
+		}
+
+		if test.expectedStatus == preflight.StatusFail {
+			if result.Remediation == "" {
+				t.Errorf("%s: expected remediation, got none", test.name)
+			}
+
+			var preflightErr *preflight.Error
+			if err := report.Err(); !errors.As(err, &preflightErr) {
+				t.Errorf("%s: expected error of type %T, got %v (of type %T)", test.name, preflightErr, err, err)
+			}
+		}
+	}
+}
+
+func TestParseLockdownMode(t *testing.T) {
+	tests := []struct {
+		contents string
+		expected string
+	}{
+		{"[none] integrity confidentiality\n", "none"},
+		{"none [integrity] confidentiality\n", "integrity"},
+		{"none integrity [confidentiality]\n", "confidentiality"},
+	}
+
+	for _, test := range tests {
+		mode, err := parseLockdownMode(test.contents)
+		if err != nil {
+			t.Errorf("expected nil error, got %v (of type %T)", err, err)
+		}
+
+		if mode != test.expected {
+			t.Errorf("expected mode %q, got %q", test.expected, mode)
+		}
+	}
+
+	if _, err := parseLockdownMode("none integrity confidentiality\n"); err == nil {
+		t.Error("expected error, got nil")
+	}
+}
@@ -0,0 +1,217 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jhwbarlow/tcp-audit-bpf-eventer/pkg/bpfevent"
+)
+
+const (
+	userHZ = 100 // Units of the times in /proc, fixed by the kernel ABI (USER_HZ)
+
+	// The boot time in /proc/stat has a resolution of one second, so process start
+	// times derived from it may be up to a second out
+	processStartTimeTolerance = 1 * time.Second
+)
+
+// ProcessResolver is an interface which describes objects which resolve PIDs to
+// details of the process with that PID at a given time.
+type processResolver interface {
+	// Resolve returns nil if the process cannot be identified, for example
+	// because it has exited.
+	resolve(pid int, at time.Time) (*bpfevent.Process, error)
+}
+
+// ProcFSResolver resolves PIDs to processes by reading the proc filesystem.
+// As events are read some time after they occur, the process with a given PID
+// may have exited and its PID been reused. Reuse is detected by the process
+// start time, and results are cached, so that a process which has since exited
+// or been replaced can still be resolved if it was previously seen. When the
+// cache is full, an arbitrary entry is evicted.
+type procFSResolver struct {
+	procRoot   string
+	maxEntries int
+
+	mutex     sync.Mutex
+	bootTime  time.Time // Read on first use
+	processes map[int]*cachedProcess
+}
+
+type cachedProcess struct {
+	process    *bpfevent.Process
+	startTicks uint64 // Start time in clock ticks since boot, which identifies the process
+}
+
+func newProcFSResolver(procRoot string, maxEntries int) *procFSResolver {
+	return &procFSResolver{
+		procRoot:   procRoot,
+		maxEntries: maxEntries,
+		processes:  make(map[int]*cachedProcess),
+	}
+}
+
+func (r *procFSResolver) resolve(pid int, at time.Time) (*bpfevent.Process, error) {
+	if pid <= 0 { // Event occurred in kernel context, or is a snapshot event
+		return nil, nil
+	}
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	cached := r.processes[pid]
+
+	startTicks, err := r.readStartTicks(pid)
+	if err != nil {
+		if os.IsNotExist(err) { // The process has exited
+			return cached.processStartedBy(at), nil
+		}
+
+		return nil, fmt.Errorf("reading start time of process %d: %w", pid, err)
+	}
+
+	if cached != nil && cached.startTicks == startTicks {
+		return cached.process, nil
+	}
+
+	bootTime, err := r.readBootTime()
+	if err != nil {
+		return nil, fmt.Errorf("reading boot time: %w", err)
+	}
+
+	startTime := bootTime.Add(time.Duration(startTicks) * time.Second / userHZ)
+	if startTime.After(at.Add(processStartTimeTolerance)) {
+		// The PID has been reused since the event, so the current process with
+		// the PID is not the one which was on-CPU at the time
+		return cached.processStartedBy(at), nil
+	}
+
+	process := &bpfevent.Process{StartTime: startTime}
+	dir := r.processDir(pid)
+
+	// Neither is available for kernel threads, and both are unavailable if the
+	// process exits after its start time was read
+	if executable, err := os.Readlink(filepath.Join(dir, "exe")); err == nil {
+		process.Executable = executable
+	}
+
+	if cmdline, err := os.ReadFile(filepath.Join(dir, "cmdline")); err == nil {
+		process.CommandLine = parseCmdline(cmdline)
+	}
+
+	r.store(pid, &cachedProcess{
+		process:    process,
+		startTicks: startTicks,
+	})
+
+	return process, nil
+}
+
+// ProcessStartedBy returns the cached process if it had started by the given
+// time, and nil otherwise. It is safe to call on a nil cachedProcess.
+func (c *cachedProcess) processStartedBy(at time.Time) *bpfevent.Process {
+	if c == nil || c.process.StartTime.After(at.Add(processStartTimeTolerance)) {
+		return nil
+	}
+
+	return c.process
+}
+
+func (r *procFSResolver) store(pid int, process *cachedProcess) {
+	if _, ok := r.processes[pid]; !ok && len(r.processes) >= r.maxEntries {
+		for evictedPID := range r.processes {
+			delete(r.processes, evictedPID)
+			break
+		}
+	}
+
+	r.processes[pid] = process
+}
+
+func (r *procFSResolver) processDir(pid int) string {
+	return filepath.Join(r.procRoot, strconv.Itoa(pid))
+}
+
+// ReadStartTicks reads the start time of the process, in clock ticks since boot,
+// from the 22nd field of /proc/<pid>/stat.
+func (r *procFSResolver) readStartTicks(pid int) (uint64, error) {
+	stat, err := os.ReadFile(filepath.Join(r.processDir(pid), "stat"))
+	if err != nil {
+		return 0, err
+	}
+
+	// The second field is the command in parentheses, which may itself contain
+	// spaces and parentheses, so fields are counted from the last parenthesis
+	commEnd := bytes.LastIndexByte(stat, ')')
+	if commEnd < 0 {
+		return 0, errors.New("malformed stat: no command")
+	}
+
+	fields := strings.Fields(string(stat[commEnd+1:]))
+	const startTimeIndex = 22 - 3 // Fields after the command start at the 3rd
+	if len(fields) <= startTimeIndex {
+		return 0, fmt.Errorf("malformed stat: %d fields after command", len(fields))
+	}
+
+	startTicks, err := strconv.ParseUint(fields[startTimeIndex], 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("malformed stat: illegal start time %q", fields[startTimeIndex])
+	}
+
+	return startTicks, nil
+}
+
+// ReadBootTime reads the time at which the system booted from the btime line of
+// /proc/stat.
+func (r *procFSResolver) readBootTime() (time.Time, error) {
+	if !r.bootTime.IsZero() {
+		return r.bootTime, nil
+	}
+
+	file, err := os.Open(filepath.Join(r.procRoot, "stat"))
+	if err != nil {
+		return time.Time{}, err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) != 2 || fields[0] != "btime" {
+			continue
+		}
+
+		seconds, err := strconv.ParseInt(fields[1], 10, 64)
+		if err != nil {
+			return time.Time{}, fmt.Errorf("illegal boot time %q", fields[1])
+		}
+
+		r.bootTime = time.Unix(seconds, 0)
+		return r.bootTime, nil
+	}
+
+	if err := scanner.Err(); err != nil {
+		return time.Time{}, err
+	}
+
+	return time.Time{}, errors.New("no boot time found")
+}
+
+// ParseCmdline splits the contents of /proc/<pid>/cmdline, in which the
+// arguments are separated and terminated by NUL characters.
+func parseCmdline(cmdline []byte) []string {
+	cmdline = bytes.TrimRight(cmdline, "\x00")
+	if len(cmdline) == 0 {
+		return nil
+	}
+
+	return strings.Split(string(cmdline), "\x00")
+}
@@ -0,0 +1,193 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+)
+
+const (
+	mockPID      = 1234
+	mockBootTime = 1600000000
+)
+
+func makeProcRoot(t *testing.T) string {
+	root := t.TempDir()
+	stat := fmt.Sprintf("cpu  1 2 3 4\nbtime %d\nprocesses 5678\n", mockBootTime)
+	if err := os.WriteFile(filepath.Join(root, "stat"), []byte(stat), 0o644); err != nil {
+		t.Fatalf("expected nil error, got %v (of type %T)", err, err)
+	}
+
+	return root
+}
+
+// MakeProcessDir creates or replaces the proc directory of a process with the
+// given start time in clock ticks since boot.
+func makeProcessDir(t *testing.T, root string, pid int, comm string, startTicks uint64, exe string, args ...string) {
+	dir := filepath.Join(root, strconv.Itoa(pid))
+	if err := os.RemoveAll(dir); err != nil {
+		t.Fatalf("expected nil error, got %v (of type %T)", err, err)
+	}
+
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		t.Fatalf("expected nil error, got %v (of type %T)", err, err)
+	}
+
+	stat := fmt.Sprintf("%d (%s) S 1 %d %d 0 -1 4194560 100 0 0 0 1 2 0 0 20 0 1 0 %d 1000000 100 18446744073709551615\n",
+		pid, comm, pid, pid, startTicks)
+	if err := os.WriteFile(filepath.Join(dir, "stat"), []byte(stat), 0o644); err != nil {
+		t.Fatalf("expected nil error, got %v (of type %T)", err, err)
+	}
+
+	var cmdline []byte
+	for _, arg := range args {
+		cmdline = append(append(cmdline, arg...), 0)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "cmdline"), cmdline, 0o644); err != nil {
+		t.Fatalf("expected nil error, got %v (of type %T)", err, err)
+	}
+
+	if err := os.Symlink(exe, filepath.Join(dir, "exe")); err != nil {
+		t.Fatalf("expected nil error, got %v (of type %T)", err, err)
+	}
+}
+
+func TestProcFSResolver(t *testing.T) {
+	root := makeProcRoot(t)
+	makeProcessDir(t, root, mockPID, "java (main)", 500, "/usr/bin/java", "java", "-jar", "app.jar")
+	resolver := newProcFSResolver(root, 10)
+
+	process, err := resolver.resolve(mockPID, time.Unix(mockBootTime+10, 0))
+	if err != nil {
+		t.Errorf("expected nil error, got %v (of type %T)", err, err)
+	}
+
+	t.Logf("got process %q", process)
+
+	if process == nil {
+		t.Fatal("expected process, got nil")
+	}
+
+	if process.Executable != "/usr/bin/java" {
+		t.Errorf("expected executable %q, got %q", "/usr/bin/java", process.Executable)
+	}
+
+	if fmt.Sprint(process.CommandLine) != "[java -jar app.jar]" {
+		t.Errorf("expected command line %q, got %q", []string{"java", "-jar", "app.jar"}, process.CommandLine)
+	}
+
+	expectedStartTime := time.Unix(mockBootTime+5, 0)
+	if !process.StartTime.Equal(expectedStartTime) {
+		t.Errorf("expected start time %v, got %v", expectedStartTime, process.StartTime)
+	}
+
+	// The same process should be returned from the cache, even after it has exited
+	if err := os.RemoveAll(filepath.Join(root, strconv.Itoa(mockPID))); err != nil {
+		t.Fatalf("expected nil error, got %v (of type %T)", err, err)
+	}
+
+	exitedProcess, err := resolver.resolve(mockPID, time.Unix(mockBootTime+20, 0))
+	if err != nil {
+		t.Errorf("expected nil error, got %v (of type %T)", err, err)
+	}
+
+	if exitedProcess != process {
+		t.Errorf("expected cached process %v, got %v", process, exitedProcess)
+	}
+}
+
+func TestProcFSResolverPIDReuse(t *testing.T) {
+	root := makeProcRoot(t)
+	makeProcessDir(t, root, mockPID, "curl", 500, "/usr/bin/curl", "curl", "https://example.com")
+	resolver := newProcFSResolver(root, 10)
+
+	original, err := resolver.resolve(mockPID, time.Unix(mockBootTime+10, 0))
+	if err != nil {
+		t.Errorf("expected nil error, got %v (of type %T)", err, err)
+	}
+
+	// The PID is reused by a process started 20s after boot
+	makeProcessDir(t, root, mockPID, "wget", 2000, "/usr/bin/wget", "wget", "https://example.com")
+
+	// An event which occurred before the new process started belongs to the original
+	process, err := resolver.resolve(mockPID, time.Unix(mockBootTime+15, 0))
+	if err != nil {
+		t.Errorf("expected nil error, got %v (of type %T)", err, err)
+	}
+
+	if process != original {
+		t.Errorf("expected original process %v, got %v", original, process)
+	}
+
+	// An event which occurred after the new process started belongs to it
+	process, err = resolver.resolve(mockPID, time.Unix(mockBootTime+30, 0))
+	if err != nil {
+		t.Errorf("expected nil error, got %v (of type %T)", err, err)
+	}
+
+	if process == nil || process.Executable != "/usr/bin/wget" {
+		t.Errorf("expected new process, got %v", process)
+	}
+}
+
+func TestProcFSResolverUnknownProcess(t *testing.T) {
+	root := makeProcRoot(t)
+	makeProcessDir(t, root, mockPID, "sshd", 2000, "/usr/sbin/sshd", "sshd")
+	resolver := newProcFSResolver(root, 10)
+
+	tests := []struct {
+		name string
+		pid  int
+	}{
+		{"kernel context", 0},
+		{"exited and not previously seen", mockPID + 1},
+		{"started after event", mockPID},
+	}
+
+	for _, test := range tests {
+		process, err := resolver.resolve(test.pid, time.Unix(mockBootTime+10, 0))
+		if err != nil {
+			t.Errorf("%s: expected nil error, got %v (of type %T)", test.name, err, err)
+		}
+
+		if process != nil {
+			t.Errorf("%s: expected nil process, got %v", test.name, process)
+		}
+	}
+}
+
+func TestProcFSResolverCacheEviction(t *testing.T) {
+	root := makeProcRoot(t)
+	resolver := newProcFSResolver(root, 2)
+
+	for pid := 1; pid <= 3; pid++ {
+		makeProcessDir(t, root, pid, "init", 100, "/sbin/init", "init")
+		if _, err := resolver.resolve(pid, time.Unix(mockBootTime+10, 0)); err != nil {
+			t.Errorf("expected nil error, got %v (of type %T)", err, err)
+		}
+	}
+
+	if len(resolver.processes) != 2 {
+		t.Errorf("expected 2 cached processes, got %d", len(resolver.processes))
+	}
+}
+
+func TestParseCmdline(t *testing.T) {
+	tests := []struct {
+		cmdline  string
+		expected string
+	}{
+		{"python3\x00-m\x00http.server\x00", "[python3 -m http.server]"},
+		{"nginx: worker process\x00\x00\x00", "[nginx: worker process]"}, // Process which has rewritten its arguments
+		{"", "[]"}, // Kernel thread
+	}
+
+	for _, test := range tests {
+		if args := parseCmdline([]byte(test.cmdline)); fmt.Sprint(args) != test.expected {
+			t.Errorf("expected arguments %s, got %q", test.expected, args)
+		}
+	}
+}
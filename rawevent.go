@@ -2,16 +2,45 @@ package main
 
 const taskCommLen = 16 // Defined in kernel (linux/sched.h)
 
+// Address families defined in kernel (linux/socket.h)
+const (
+	afINET  = 2
+	afINET6 = 10
+)
+
+// Kinds of event defined in the BPF C
+const (
+	eventKindStateChange = iota
+	eventKindRetransmit
+	eventKindSendReset
+	eventKindReceiveReset
+)
+
 // RawEvent is the event received from the kernel via a BPF perf buffer.
 // The struct layout must match that of the equivalent struct in the BPF C.
 type rawEvent struct {
 	CommOnCPU            [taskCommLen]byte
 	SocketMemAddr        uint64
-	PIDOnCPU             uint32
+	TimestampNs          uint64 // CLOCK_MONOTONIC
+	CgroupIDOnCPU        uint64
+	SocketCgroupID       uint64
+	BytesReceived        uint64 // Counters are only filled on transition to TCP_CLOSE
+	BytesAcked           uint64
+	PIDOnCPU             uint32 // TGID
+	TIDOnCPU             uint32
+	UIDOnCPU, GIDOnCPU   uint32 // Real UID and GID of the task, not the socket owner
+	ParentPIDOnCPU       uint32
 	SocketINode          uint32
 	SocketUID, SocketGID uint32
+	NetNSINode           uint32
+	SegmentsIn           uint32
+	SegmentsOut          uint32
+	TotalRetransmits     uint32
+	SmoothedRTTUs        uint32 // Left-shifted by 3, as held by the kernel
 	OldState, NewState   int32
 	SrcPort, DstPort     uint16
-	SrcAddr, DstAddr     [4]uint8
+	Family               uint16
+	SrcAddr, DstAddr     [16]uint8 // IPv4 addresses occupy the first 4 bytes only
 	SockState            uint8
+	Kind                 uint8
 }
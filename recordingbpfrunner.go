@@ -0,0 +1,133 @@
+package main
+
+import (
+	"fmt"
+	"log"
+)
+
+// RecordingBPFRunner is a BPFRunner which wraps another BPFRunner, recording the
+// raw events and dropped event counts it emits to a capture before passing them
+// on unchanged. Failure to record is not fatal: it is logged and recording stops,
+// but events continue to be passed on.
+type recordingBPFRunner struct {
+	runner bpfRunner
+	writer *captureWriter
+	clock  clock
+
+	eventChan             chan []byte
+	droppedEventCountChan chan uint64
+	forwardingDone        chan struct{}
+	running               bool
+}
+
+func newRecordingBPFRunner(runner bpfRunner,
+	writer *captureWriter,
+	clock clock,
+	eventChannelSize int,
+	droppedEventsChannelSize int) *recordingBPFRunner {
+	return &recordingBPFRunner{
+		runner:                runner,
+		writer:                writer,
+		clock:                 clock,
+		eventChan:             make(chan []byte, eventChannelSize),
+		droppedEventCountChan: make(chan uint64, droppedEventsChannelSize),
+		forwardingDone:        make(chan struct{}),
+	}
+}
+
+func (r *recordingBPFRunner) run() error {
+	if err := r.runner.run(); err != nil {
+		return err
+	}
+
+	go r.forward()
+	r.running = true
+	log.Printf("Recording BPF events")
+
+	return nil
+}
+
+// Forward records and passes on the events and dropped event counts from the
+// wrapped runner until both of its channels are closed.
+func (r *recordingBPFRunner) forward() {
+	defer close(r.forwardingDone)
+	defer close(r.droppedEventCountChan)
+	defer close(r.eventChan)
+
+	eventChan := r.runner.eventChannel()
+	droppedEventCountChan := r.runner.droppedEventCountChannel()
+	recording := true
+	for eventChan != nil || droppedEventCountChan != nil {
+		var err error
+		select {
+		case eventData, ok := <-eventChan:
+			if !ok {
+				eventChan = nil
+				continue
+			}
+
+			if recording {
+				err = r.writer.writeEvent(r.clock.wallNow(), eventData)
+			}
+			r.eventChan <- eventData
+		case count, ok := <-droppedEventCountChan:
+			if !ok {
+				droppedEventCountChan = nil
+				continue
+			}
+
+			if recording {
+				err = r.writer.writeDroppedEventCount(r.clock.wallNow(), count)
+			}
+			r.droppedEventCountChan <- count
+		}
+
+		if err != nil {
+			log.Printf("Error recording BPF event, recording stopped: %v", err)
+			recording = false
+		}
+	}
+}
+
+func (r *recordingBPFRunner) eventChannel() <-chan []byte {
+	return r.eventChan
+}
+
+func (r *recordingBPFRunner) droppedEventCountChannel() <-chan uint64 {
+	return r.droppedEventCountChan
+}
+
+func (r *recordingBPFRunner) setFilter(filter *Filter) error {
+	return r.runner.setFilter(filter)
+}
+
+func (r *recordingBPFRunner) unpin() error {
+	return r.runner.unpin()
+}
+
+// Close closes the wrapped runner and then, once all of its events have been
+// recorded, the capture.
+func (r *recordingBPFRunner) close() error {
+	runnerErr := r.runner.close()
+	if !r.running {
+		r.writer.close()
+		return runnerErr
+	}
+
+	// Drain any events not yet read, so the forwarding goroutine is not blocked
+	go func() {
+		for range r.eventChan {
+		}
+	}()
+	go func() {
+		for range r.droppedEventCountChan {
+		}
+	}()
+	<-r.forwardingDone
+
+	if err := r.writer.close(); err != nil {
+		return fmt.Errorf("closing capture: %w", err)
+	}
+
+	return runnerErr
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"io"
+	"log"
+	"sync"
+	"time"
+)
+
+// ReplayBPFRunner is a BPFRunner which emits the raw events and dropped event
+// counts read from a capture, rather than from a BPF program, so that events can
+// be processed without privileges or a live kernel. Records are emitted with the
+// same spacing as they were recorded, divided by the speed. A speed of zero
+// emits records as quickly as they are read. The channels are unbuffered, so
+// that records are received in the order they were recorded, and are closed
+// once the capture has been replayed.
+type replayBPFRunner struct {
+	reader *captureReader
+	speed  float64
+
+	eventChan             chan []byte
+	droppedEventCountChan chan uint64
+	stop                  chan struct{}
+	replayDone            chan struct{}
+	stopOnce              sync.Once
+}
+
+func newReplayBPFRunner(reader *captureReader, speed float64) *replayBPFRunner {
+	return &replayBPFRunner{
+		reader: reader,
+		speed:  speed,
+	}
+}
+
+func (r *replayBPFRunner) run() error {
+	r.eventChan = make(chan []byte)
+	r.droppedEventCountChan = make(chan uint64)
+	r.stop = make(chan struct{})
+	r.replayDone = make(chan struct{})
+
+	go r.replay()
+	log.Printf("Replaying BPF events from capture")
+
+	return nil
+}
+
+func (r *replayBPFRunner) replay() {
+	defer close(r.replayDone)
+	defer close(r.droppedEventCountChan)
+	defer close(r.eventChan)
+
+	var firstArrivalTime, startTime time.Time
+	for {
+		record, err := r.reader.next()
+		if err == io.EOF {
+			log.Printf("Finished replaying capture")
+			return
+		}
+
+		if err != nil {
+			log.Printf("Error reading capture, replay stopped: %v", err)
+			return
+		}
+
+		if firstArrivalTime.IsZero() {
+			firstArrivalTime = record.arrivalTime
+			startTime = time.Now()
+		}
+
+		if r.speed > 0 {
+			elapsed := time.Duration(float64(record.arrivalTime.Sub(firstArrivalTime)) / r.speed)
+			if !r.sleep(time.Until(startTime.Add(elapsed))) {
+				return
+			}
+		}
+
+		switch record.kind {
+		case captureRecordEvent:
+			select {
+			case <-r.stop:
+				return
+			case r.eventChan <- record.eventData:
+			}
+		case captureRecordDroppedEventCount:
+			select {
+			case <-r.stop:
+				return
+			case r.droppedEventCountChan <- record.droppedEventCount:
+			}
+		}
+	}
+}
+
+// Sleep waits for the supplied duration, returning false if the runner is closed
+// in the meantime.
+func (r *replayBPFRunner) sleep(duration time.Duration) bool {
+	if duration <= 0 {
+		return true
+	}
+
+	timer := time.NewTimer(duration)
+	defer timer.Stop()
+
+	select {
+	case <-r.stop:
+		return false
+	case <-timer.C:
+		return true
+	}
+}
+
+func (r *replayBPFRunner) eventChannel() <-chan []byte {
+	return r.eventChan
+}
+
+func (r *replayBPFRunner) droppedEventCountChannel() <-chan uint64 {
+	return r.droppedEventCountChan
+}
+
+// SetFilter does nothing, as the events in the capture were filtered by the BPF
+// program when they were recorded.
+func (*replayBPFRunner) setFilter(filter *Filter) error {
+	return nil
+}
+
+// Unpin does nothing, as replaying loads nothing into the kernel.
+func (*replayBPFRunner) unpin() error {
+	return nil
+}
+
+func (r *replayBPFRunner) close() error {
+	if r.stop != nil {
+		r.stopOnce.Do(func() { close(r.stop) })
+		<-r.replayDone
+	}
+
+	return r.reader.close()
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"testing"
+	"time"
+)
+
+func TestRecordAndReplay(t *testing.T) {
+	timeNow := time.Now()
+	mockEventChannel := make(chan []byte, 2)
+	mockDroppedEventCountChannel := make(chan uint64, 1)
+	mockBPFRunner := newMockBPFRunner(mockEventChannel, mockDroppedEventCountChannel, nil, nil)
+	mockClock := newMockClock([]time.Time{timeNow, timeNow.Add(time.Millisecond), timeNow.Add(2 * time.Millisecond)}, nil, nil)
+	buf := new(bufferWriteCloser)
+
+	writer, err := newCaptureWriter(buf, binary.LittleEndian, time.Second)
+	if err != nil {
+		t.Fatalf("expected nil constructor error, got %v (of type %T)", err, err)
+	}
+
+	recordingRunner := newRecordingBPFRunner(mockBPFRunner, writer, mockClock, 2, 1)
+	if err := recordingRunner.run(); err != nil {
+		t.Errorf("expected nil error, got %v (of type %T)", err, err)
+	}
+
+	// Send the records one at a time so that the order in which they are recorded is known
+	mockEventChannel <- []byte{0x01}
+	if eventData := <-recordingRunner.eventChannel(); eventData[0] != 0x01 {
+		t.Errorf("expected event to be passed on unchanged, got %X", eventData)
+	}
+
+	mockDroppedEventCountChannel <- 10
+	if count := <-recordingRunner.droppedEventCountChannel(); count != 10 {
+		t.Errorf("expected dropped event count to be passed on unchanged, got %d", count)
+	}
+
+	mockEventChannel <- []byte{0x02}
+	if eventData := <-recordingRunner.eventChannel(); eventData[0] != 0x02 {
+		t.Errorf("expected event to be passed on unchanged, got %X", eventData)
+	}
+
+	// The wrapped runner closes its channels when closed
+	close(mockEventChannel)
+	close(mockDroppedEventCountChannel)
+	if err := recordingRunner.close(); err != nil {
+		t.Errorf("expected nil error, got %v (of type %T)", err, err)
+	}
+
+	if !mockBPFRunner.closeCalled {
+		t.Error("expected wrapped BPF runner to be closed, but was not")
+	}
+
+	if !buf.closeCalled {
+		t.Error("expected capture to be closed, but was not")
+	}
+
+	reader, err := newCaptureReader(io.NopCloser(&buf.Buffer))
+	if err != nil {
+		t.Fatalf("expected nil constructor error, got %v (of type %T)", err, err)
+	}
+
+	replayRunner := newReplayBPFRunner(reader, 0)
+	if err := replayRunner.run(); err != nil {
+		t.Errorf("expected nil error, got %v (of type %T)", err, err)
+	}
+
+	if eventData := <-replayRunner.eventChannel(); eventData[0] != 0x01 {
+		t.Errorf("expected first recorded event, got %X", eventData)
+	}
+
+	if count := <-replayRunner.droppedEventCountChannel(); count != 10 {
+		t.Errorf("expected recorded dropped event count, got %d", count)
+	}
+
+	if eventData := <-replayRunner.eventChannel(); eventData[0] != 0x02 {
+		t.Errorf("expected second recorded event, got %X", eventData)
+	}
+
+	if _, ok := <-replayRunner.eventChannel(); ok {
+		t.Error("expected event channel to be closed at end of capture, but was not")
+	}
+
+	if err := replayRunner.close(); err != nil {
+		t.Errorf("expected nil error, got %v (of type %T)", err, err)
+	}
+}
+
+func TestReplayAtSpeed(t *testing.T) {
+	timeNow := time.Now()
+	buf := new(bufferWriteCloser)
+	writer, err := newCaptureWriter(buf, binary.LittleEndian, 0)
+	if err != nil {
+		t.Fatalf("expected nil constructor error, got %v (of type %T)", err, err)
+	}
+	writer.writeEvent(timeNow, []byte{0x01})
+	writer.writeEvent(timeNow.Add(100*time.Millisecond), []byte{0x02})
+	writer.close()
+
+	reader, err := newCaptureReader(io.NopCloser(&buf.Buffer))
+	if err != nil {
+		t.Fatalf("expected nil constructor error, got %v (of type %T)", err, err)
+	}
+
+	replayRunner := newReplayBPFRunner(reader, 2) // Twice the original speed
+	replayRunner.run()
+	defer replayRunner.close()
+
+	<-replayRunner.eventChannel()
+	start := time.Now()
+	<-replayRunner.eventChannel()
+	elapsed := time.Since(start)
+
+	if elapsed < 40*time.Millisecond || elapsed > 1*time.Second {
+		t.Errorf("expected second event to be replayed after approximately %v, got %v", 50*time.Millisecond, elapsed)
+	}
+}
+
+func TestReplayClose(t *testing.T) {
+	buf := new(bufferWriteCloser)
+	writer, err := newCaptureWriter(buf, binary.LittleEndian, 0)
+	if err != nil {
+		t.Fatalf("expected nil constructor error, got %v (of type %T)", err, err)
+	}
+	writer.writeEvent(time.Now(), []byte{0x01})
+	writer.close()
+
+	reader, err := newCaptureReader(io.NopCloser(&buf.Buffer))
+	if err != nil {
+		t.Fatalf("expected nil constructor error, got %v (of type %T)", err, err)
+	}
+
+	replayRunner := newReplayBPFRunner(reader, 0)
+	replayRunner.run()
+
+	// Closing while the replay is blocked sending an event should not hang
+	if err := replayRunner.close(); err != nil {
+		t.Errorf("expected nil error, got %v (of type %T)", err, err)
+	}
+}
+
+func TestRecordingBPFRunnerRunError(t *testing.T) {
+	mockError := errors.New("mock BPF runner run error")
+	mockBPFRunner := newMockBPFRunner(nil, nil, mockError, nil)
+	writer, err := newCaptureWriter(new(bufferWriteCloser), binary.LittleEndian, 0)
+	if err != nil {
+		t.Fatalf("expected nil constructor error, got %v (of type %T)", err, err)
+	}
+
+	recordingRunner := newRecordingBPFRunner(mockBPFRunner, writer, newMockClock(nil, nil, nil), 1, 1)
+	err = recordingRunner.run()
+	if err == nil {
+		t.Error("expected error, got nil")
+	}
+
+	t.Logf("got error %q (of type %T)", err, err)
+
+	if !errors.Is(err, mockError) {
+		t.Errorf("expected error chain to include %q, but did not", mockError)
+	}
+}
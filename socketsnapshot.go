@@ -0,0 +1,236 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"os"
+	"syscall"
+
+	"github.com/jhwbarlow/tcp-audit-bpf-eventer/pkg/bpfevent"
+	"github.com/jhwbarlow/tcp-audit-common/pkg/event"
+	"github.com/jhwbarlow/tcp-audit-common/pkg/socketstate"
+	"golang.org/x/sys/unix"
+)
+
+// Defined in kernel (linux/sock_diag.h and linux/inet_diag.h)
+const (
+	sockDiagByFamily   = 20
+	inetDiagReqV2Len   = 56
+	inetDiagMsgLen     = 72
+	sockDiagRecvBufLen = 32 * 1024
+)
+
+// Sockets in these states have no associated socket (i.e. they are time-wait or
+// request sockets), or are not in use, so are not included in the snapshot.
+const snapshotExcludedStates = 1<<TCPTimeWait | 1<<TCPClose | 1<<TCPNewSynRecv
+
+const netNSPath = "/proc/self/ns/net"
+
+// SocketSnapshotter is an interface which describes objects which take a
+// snapshot of the TCP sockets which exist at the time of the call, as
+// synthetic TCP state-change events.
+type socketSnapshotter interface {
+	snapshot() ([]*bpfevent.Event, error)
+}
+
+// SockDiagDumper is an interface which describes objects which dump the
+// TCP sockets of an address family, returning the raw inet_diag_msg structs.
+type sockDiagDumper interface {
+	dump(family uint8, states uint32) ([][]byte, error)
+}
+
+// SockDiagSnapshotter takes a snapshot of the TCP sockets in the current network
+// namespace using the netlink sock_diag interface.
+// The kernel socket address and the information about the task on-CPU are not
+// available for sockets in the snapshot, so the socket ID is empty and the PID
+// and command on-CPU are zero-valued. Each event in the snapshot has both its
+// old and new state set to the state of the socket at the time of the snapshot.
+type sockDiagSnapshotter struct {
+	dumper     sockDiagDumper
+	clock      clock
+	netNSINode func() (uint32, error)
+}
+
+func newSockDiagSnapshotter(dumper sockDiagDumper,
+	clock clock,
+	netNSINode func() (uint32, error)) *sockDiagSnapshotter {
+	return &sockDiagSnapshotter{
+		dumper:     dumper,
+		clock:      clock,
+		netNSINode: netNSINode,
+	}
+}
+
+func (s *sockDiagSnapshotter) snapshot() ([]*bpfevent.Event, error) {
+	netNSINode, err := s.netNSINode()
+	if err != nil {
+		return nil, fmt.Errorf("getting network namespace: %w", err)
+	}
+
+	timeNow := s.clock.wallNow()
+	states := uint32(1<<(TCPNewSynRecv+1)-1) &^ snapshotExcludedStates
+
+	var events []*bpfevent.Event
+	for _, family := range [...]uint8{afINET, afINET6} {
+		msgs, err := s.dumper.dump(family, states)
+		if err != nil {
+			return nil, fmt.Errorf("dumping sockets of address family %d: %w", family, err)
+		}
+
+		for _, msg := range msgs {
+			event, err := inetDiagMsgToEvent(msg)
+			if err != nil {
+				return nil, fmt.Errorf("converting socket: %w", err)
+			}
+
+			event.Time = timeNow
+			event.NetNSINode = netNSINode
+			events = append(events, event)
+		}
+	}
+
+	return events, nil
+}
+
+// InetDiagMsgToEvent creates a snapshot event from an inet_diag_msg struct.
+// Ports and addresses are in network byte order, all other fields are in host
+// byte order.
+func inetDiagMsgToEvent(msg []byte) (*bpfevent.Event, error) {
+	if len(msg) < inetDiagMsgLen {
+		return nil, fmt.Errorf("short inet_diag_msg: %d bytes", len(msg))
+	}
+
+	endianess := systemEndianess()
+	family := uint16(msg[0])
+	kernelState := int32(msg[1])
+	srcPort := binary.BigEndian.Uint16(msg[4:6])
+	dstPort := binary.BigEndian.Uint16(msg[6:8])
+	var rawSrcAddr, rawDstAddr [16]uint8
+	copy(rawSrcAddr[:], msg[8:24])
+	copy(rawDstAddr[:], msg[24:40])
+	uid := endianess.Uint32(msg[64:68])
+	inode := endianess.Uint32(msg[68:72])
+
+	state, err := convertState(kernelState)
+	if err != nil {
+		return nil, fmt.Errorf("converting kernel TCP state: %w", err)
+	}
+
+	srcIP, err := convertAddr(family, rawSrcAddr)
+	if err != nil {
+		return nil, fmt.Errorf("converting source address: %w", err)
+	}
+
+	dstIP, err := convertAddr(family, rawDstAddr)
+	if err != nil {
+		return nil, fmt.Errorf("converting destination address: %w", err)
+	}
+
+	return &bpfevent.Event{
+		Event: event.Event{
+			SourceIP:   srcIP,
+			DestIP:     dstIP,
+			SourcePort: srcPort,
+			DestPort:   dstPort,
+			OldState:   state,
+			NewState:   state,
+			SocketInfo: &event.SocketInfo{
+				INode:       inode,
+				UID:         uid,
+				SocketState: snapshotSocketState(kernelState, inode),
+			},
+		},
+		Snapshot: true,
+	}, nil
+}
+
+// SnapshotSocketState infers the state of the socket from the TCP state, as
+// sock_diag does not report it. Sockets without an inode have been released
+// by their owner (or are yet to be accepted).
+func snapshotSocketState(kernelState int32, inode uint32) socketstate.State {
+	switch {
+	case inode == 0:
+		return socketstate.StateFree
+	case kernelState == TCPListen:
+		return socketstate.StateUnconnected
+	case kernelState == TCPSynSent:
+		return socketstate.StateConnecting
+	default:
+		return socketstate.StateConnected
+	}
+}
+
+// NetlinkSockDiagDumper dumps TCP sockets using a netlink sock_diag socket.
+type netlinkSockDiagDumper struct{}
+
+func (*netlinkSockDiagDumper) dump(family uint8, states uint32) ([][]byte, error) {
+	fd, err := unix.Socket(unix.AF_NETLINK, unix.SOCK_DGRAM|unix.SOCK_CLOEXEC, unix.NETLINK_SOCK_DIAG)
+	if err != nil {
+		return nil, fmt.Errorf("creating netlink socket: %w", err)
+	}
+	defer unix.Close(fd)
+
+	endianess := systemEndianess()
+	req := make([]byte, unix.NLMSG_HDRLEN+inetDiagReqV2Len)
+	endianess.PutUint32(req[0:4], uint32(len(req)))
+	endianess.PutUint16(req[4:6], sockDiagByFamily)
+	endianess.PutUint16(req[6:8], unix.NLM_F_REQUEST|unix.NLM_F_DUMP)
+	endianess.PutUint32(req[8:12], 1) // Sequence number
+	req[unix.NLMSG_HDRLEN] = family
+	req[unix.NLMSG_HDRLEN+1] = unix.IPPROTO_TCP
+	endianess.PutUint32(req[unix.NLMSG_HDRLEN+4:], states)
+
+	if err := unix.Sendto(fd, req, 0, &unix.SockaddrNetlink{Family: unix.AF_NETLINK}); err != nil {
+		return nil, fmt.Errorf("sending sock_diag request: %w", err)
+	}
+
+	var msgs [][]byte
+	buf := make([]byte, sockDiagRecvBufLen)
+	for {
+		n, _, err := unix.Recvfrom(fd, buf, 0)
+		if err != nil {
+			return nil, fmt.Errorf("receiving sock_diag response: %w", err)
+		}
+
+		netlinkMsgs, err := syscall.ParseNetlinkMessage(buf[:n])
+		if err != nil {
+			return nil, fmt.Errorf("parsing sock_diag response: %w", err)
+		}
+
+		for _, netlinkMsg := range netlinkMsgs {
+			switch netlinkMsg.Header.Type {
+			case unix.NLMSG_DONE:
+				return msgs, nil
+			case unix.NLMSG_ERROR:
+				if len(netlinkMsg.Data) < 4 {
+					return nil, errors.New("short netlink error message")
+				}
+
+				if errno := int32(endianess.Uint32(netlinkMsg.Data[0:4])); errno != 0 {
+					return nil, fmt.Errorf("sock_diag request failed: %w", syscall.Errno(-errno))
+				}
+			case sockDiagByFamily:
+				msg := make([]byte, len(netlinkMsg.Data))
+				copy(msg, netlinkMsg.Data)
+				msgs = append(msgs, msg)
+			}
+		}
+	}
+}
+
+// CurrentNetNSINode returns the inode number of the network namespace of the
+// current process.
+func currentNetNSINode() (uint32, error) {
+	info, err := os.Stat(netNSPath)
+	if err != nil {
+		return 0, err
+	}
+
+	stat, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return 0, fmt.Errorf("unexpected stat type %T", info.Sys())
+	}
+
+	return uint32(stat.Ino), nil
+}
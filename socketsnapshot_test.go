@@ -0,0 +1,176 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/jhwbarlow/tcp-audit-common/pkg/socketstate"
+	"github.com/jhwbarlow/tcp-audit-common/pkg/tcpstate"
+)
+
+type mockSockDiagDumper struct {
+	msgsToReturn  map[uint8][][]byte
+	errorToReturn error
+
+	receivedFamilies []uint8
+	receivedStates   uint32
+}
+
+func newMockSockDiagDumper(msgsToReturn map[uint8][][]byte, errorToReturn error) *mockSockDiagDumper {
+	return &mockSockDiagDumper{
+		msgsToReturn:  msgsToReturn,
+		errorToReturn: errorToReturn,
+	}
+}
+
+func (md *mockSockDiagDumper) dump(family uint8, states uint32) ([][]byte, error) {
+	md.receivedFamilies = append(md.receivedFamilies, family)
+	md.receivedStates = states
+
+	if md.errorToReturn != nil {
+		return nil, md.errorToReturn
+	}
+
+	return md.msgsToReturn[family], nil
+}
+
+func newMockInetDiagMsg(family uint8,
+	state uint8,
+	srcIP, dstIP net.IP,
+	srcPort, dstPort uint16,
+	uid, inode uint32) []byte {
+	msg := make([]byte, inetDiagMsgLen)
+	msg[0] = family
+	msg[1] = state
+	binary.BigEndian.PutUint16(msg[4:6], srcPort)
+	binary.BigEndian.PutUint16(msg[6:8], dstPort)
+	if family == afINET {
+		copy(msg[8:24], srcIP.To4())
+		copy(msg[24:40], dstIP.To4())
+	} else {
+		copy(msg[8:24], srcIP.To16())
+		copy(msg[24:40], dstIP.To16())
+	}
+	systemEndianess().PutUint32(msg[64:68], uid)
+	systemEndianess().PutUint32(msg[68:72], inode)
+
+	return msg
+}
+
+func TestSockDiagSnapshot(t *testing.T) {
+	timeNow := time.Now()
+	mockClock := newMockClock([]time.Time{timeNow}, nil, nil)
+	mockDumper := newMockSockDiagDumper(map[uint8][][]byte{
+		afINET: {
+			newMockInetDiagMsg(afINET, TCPEstablished, net.IPv4(10, 0, 0, 1), net.IPv4(10, 0, 0, 2), 5432, 55420, 999, 12345),
+		},
+		afINET6: {
+			newMockInetDiagMsg(afINET6, TCPListen, net.ParseIP("::"), net.ParseIP("::"), 443, 0, 0, 23456),
+		},
+	}, nil)
+	mockNetNSINode := func() (uint32, error) { return 4026531992, nil }
+
+	snapshotter := newSockDiagSnapshotter(mockDumper, mockClock, mockNetNSINode)
+	events, err := snapshotter.snapshot()
+	if err != nil {
+		t.Errorf("expected nil error, got %v (of type %T)", err, err)
+	}
+
+	if len(mockDumper.receivedFamilies) != 2 {
+		t.Errorf("expected sockets of 2 address families to be dumped, got %d", len(mockDumper.receivedFamilies))
+	}
+
+	if mockDumper.receivedStates&(1<<TCPTimeWait) != 0 {
+		t.Error("expected time-wait sockets not to be requested, but were")
+	}
+
+	if len(events) != 2 {
+		t.Fatalf("expected 2 events, got %d", len(events))
+	}
+
+	t.Logf("got events %q", events)
+
+	established := events[0]
+	if !established.Snapshot {
+		t.Error("expected event to be flagged as a snapshot event, but was not")
+	}
+
+	if established.Time != timeNow {
+		t.Errorf("expected time %v, got %v", timeNow, established.Time)
+	}
+
+	if established.NetNSINode != 4026531992 {
+		t.Errorf("expected network namespace inode %d, got %d", uint32(4026531992), established.NetNSINode)
+	}
+
+	if !established.SourceIP.Equal(net.IPv4(10, 0, 0, 1)) || established.SourcePort != 5432 {
+		t.Errorf("expected source 10.0.0.1:5432, got %v:%d", established.SourceIP, established.SourcePort)
+	}
+
+	if !established.DestIP.Equal(net.IPv4(10, 0, 0, 2)) || established.DestPort != 55420 {
+		t.Errorf("expected destination 10.0.0.2:55420, got %v:%d", established.DestIP, established.DestPort)
+	}
+
+	if established.OldState != tcpstate.StateEstablished || established.NewState != tcpstate.StateEstablished {
+		t.Errorf("expected states ESTABLISHED, got %v and %v", established.OldState, established.NewState)
+	}
+
+	if established.SocketInfo.UID != 999 || established.SocketInfo.INode != 12345 {
+		t.Errorf("expected UID 999 and inode 12345, got %d and %d", established.SocketInfo.UID, established.SocketInfo.INode)
+	}
+
+	if established.SocketInfo.SocketState != socketstate.StateConnected {
+		t.Errorf("expected socket state %v, got %v", socketstate.StateConnected, established.SocketInfo.SocketState)
+	}
+
+	listen := events[1]
+	if listen.NewState != tcpstate.StateListen {
+		t.Errorf("expected state %v, got %v", tcpstate.StateListen, listen.NewState)
+	}
+
+	if listen.SocketInfo.SocketState != socketstate.StateUnconnected {
+		t.Errorf("expected socket state %v, got %v", socketstate.StateUnconnected, listen.SocketInfo.SocketState)
+	}
+}
+
+func TestSockDiagSnapshotDumperError(t *testing.T) {
+	mockError := errors.New("mock sock_diag dumper error")
+	mockClock := newMockClock([]time.Time{time.Now()}, nil, nil)
+	mockDumper := newMockSockDiagDumper(nil, mockError)
+	mockNetNSINode := func() (uint32, error) { return 0, nil }
+
+	snapshotter := newSockDiagSnapshotter(mockDumper, mockClock, mockNetNSINode)
+	_, err := snapshotter.snapshot()
+	if err == nil {
+		t.Error("expected error, got nil")
+	}
+
+	t.Logf("got error %q (of type %T)", err, err)
+
+	if !errors.Is(err, mockError) {
+		t.Errorf("expected error chain to include %q, but did not", mockError)
+	}
+}
+
+func TestInetDiagMsgToEventError(t *testing.T) {
+	tests := [...]struct {
+		name string
+		msg  []byte
+	}{
+		{"short message", make([]byte, inetDiagMsgLen-1)},
+		{"illegal state", newMockInetDiagMsg(afINET, 0xFF, net.IPv4zero, net.IPv4zero, 0, 0, 0, 0)},
+		{"illegal address family", newMockInetDiagMsg(0xFF, TCPEstablished, net.IPv4zero, net.IPv4zero, 0, 0, 0, 0)},
+	}
+
+	for _, test := range tests {
+		_, err := inetDiagMsgToEvent(test.msg)
+		if err == nil {
+			t.Errorf("%s: expected error, got nil", test.name)
+		}
+
+		t.Logf("%s: got error %q (of type %T)", test.name, err, err)
+	}
+}